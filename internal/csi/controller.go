@@ -0,0 +1,515 @@
+package csi
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/jakekeeys/freenas-provisioner/internal/provisioner"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/snapshot"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/z_vol"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultVolumeSize = 1 << 30
+	// sizes are rounded up to whole MiB so they suit any zvol block size
+	volumeSizeUnit = 1 << 20
+)
+
+var controllerCapabilities = []csi.ControllerServiceCapability_RPC_Type{
+	csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+	csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+}
+
+// CreateVolume provisions a volume like a claim of a storage class with the
+// request's parameters. Per volume chap credentials and initiator groups rely
+// on kubernetes objects and are not supported.
+func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume name is required")
+	}
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+	config, err := provisioner.ParseConfig(req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if config.AuthType != "" || config.PerVolumeInitiatorGroup {
+		return nil, status.Error(codes.InvalidArgument, "chap auth and per volume initiator groups are not supported by the csi driver")
+	}
+
+	err = validateCapabilities(config.Protocol, req.VolumeCapabilities)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	size, err := requestedSize(req.CapacityRange)
+	if err != nil {
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+
+	var dataSource *v1.TypedLocalObjectReference
+	if source := req.VolumeContentSource; source != nil {
+		dataSource, size, err = d.snapshotDataSource(ctx, config, source, req.CapacityRange, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	existing, err := d.existingSize(ctx, config, req.Name)
+	if err != nil {
+		return nil, statusError(err, "error looking up volume %s", req.Name)
+	}
+	if existing >= 0 && existing != size {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with a size of %d bytes", req.Name, existing)
+	}
+
+	volume, err := d.Provisioner.Provision(controller.VolumeOptions{
+		PVName: req.Name,
+		PVC: &v1.PersistentVolumeClaim{
+			Spec: v1.PersistentVolumeClaimSpec{
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceStorage: *resource.NewQuantity(size, resource.BinarySI),
+					},
+				},
+				DataSource: dataSource,
+			},
+		},
+		Parameters:                    req.Parameters,
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+	})
+	if err != nil {
+		return nil, statusError(err, "error provisioning volume %s", req.Name)
+	}
+
+	id, err := provisioner.VolumeID(volume)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      id,
+			CapacityBytes: size,
+			VolumeContext: volumeContext(volume),
+			ContentSource: req.VolumeContentSource,
+		},
+	}, nil
+}
+
+// snapshotDataSource returns the data source of a volume restored from the
+// snapshot of source, and the volume's size, which is at least the size of
+// the snapshot. Only iscsi volumes can be restored, and the volumes they are
+// restored to are clones that keep their source volume from being deleted
+// until they are deleted themselves.
+func (d *Driver) snapshotDataSource(ctx context.Context, config *provisioner.Config, source *csi.VolumeContentSource, capacity *csi.CapacityRange, size int64) (*v1.TypedLocalObjectReference, int64, error) {
+	snapshot := source.GetSnapshot()
+	if snapshot == nil || snapshot.SnapshotId == "" {
+		return nil, 0, status.Error(codes.InvalidArgument, "only snapshots are supported as volume content sources")
+	}
+	if config.Protocol != provisioner.ISCSIProtocol {
+		return nil, 0, status.Errorf(codes.InvalidArgument, "%s volumes cannot be restored from snapshots", config.Protocol)
+	}
+	if !strings.Contains(snapshot.SnapshotId, "@") {
+		return nil, 0, status.Errorf(codes.NotFound, "snapshot %s does not exist", snapshot.SnapshotId)
+	}
+
+	snapshotSize, err := provisioner.SnapshotSize(ctx, d.Freenas, snapshot.SnapshotId)
+	if err != nil {
+		return nil, 0, statusError(err, "error looking up snapshot %s", snapshot.SnapshotId)
+	}
+	if size < snapshotSize {
+		if limit := capacity.GetLimitBytes(); limit > 0 && snapshotSize > limit {
+			return nil, 0, status.Errorf(codes.OutOfRange, "snapshot %s of %d bytes exceeds the limit of %d bytes", snapshot.SnapshotId, snapshotSize, limit)
+		}
+		size = snapshotSize
+	}
+
+	return &v1.TypedLocalObjectReference{
+		Kind: provisioner.ZFSSnapshotKind,
+		Name: snapshot.SnapshotId,
+	}, size, nil
+}
+
+// existingSize returns the size of the zvol or dataset of a volume created
+// earlier under name, -1 when there is none or its size is unknown.
+func (d *Driver) existingSize(ctx context.Context, config *provisioner.Config, name string) (int64, error) {
+	rootDs, err := d.Freenas.Storage().Dataset().Get(ctx, &dataset.Dataset{Name: &config.RootDatasetName})
+	if err != nil {
+		return -1, err
+	}
+
+	return d.volumeSize(ctx, fmt.Sprintf("%s/%s", *rootDs.Name, name), config.Protocol == provisioner.ISCSIProtocol)
+}
+
+// volumeSize returns the size of a zvol, or the quota of a dataset, by its
+// full name, -1 when there is none or its size is unknown.
+func (d *Driver) volumeSize(ctx context.Context, name string, block bool) (int64, error) {
+	if !block {
+		ds, err := d.Freenas.Storage().Dataset().Get(ctx, &dataset.Dataset{Name: &name})
+		if rest.IsNotFound(err) || (err == nil && ds.Quota == nil) {
+			return -1, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+		return int64(*ds.Quota), nil
+	}
+
+	pool := strings.SplitN(name, "/", 2)
+	zVol, err := d.Freenas.Storage().ZVol().Get(ctx, &dataset.Dataset{Pool: &pool[0]}, &z_vol.ZVol{Name: &pool[1]})
+	if rest.IsNotFound(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	size, err := zVol.Size()
+	if err != nil {
+		glog.Warningf("unknown size of zvol %s: %v", name, err)
+		return -1, nil
+	}
+
+	return size, nil
+}
+
+// DeleteVolume removes a volume. Ids that no volume can have are treated as
+// deleted volumes.
+func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+
+	volume, err := provisioner.ParseVolumeID(req.VolumeId)
+	if err != nil {
+		glog.Warningf("not deleting volume: %v", err)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	err = d.Provisioner.Delete(volume)
+	if err != nil {
+		return nil, statusError(err, "error deleting volume %s", req.VolumeId)
+	}
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "capacity range is required")
+	}
+
+	volume, err := provisioner.ParseVolumeID(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	size, err := requestedSize(req.CapacityRange)
+	if err != nil {
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+
+	ds, err := provisioner.VolumeDataset(volume)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	// volumes never shrink, a volume as large as requested is expanded already
+	current, err := d.volumeSize(ctx, ds, provisioner.IsBlockVolume(volume))
+	if err != nil {
+		return nil, statusError(err, "error getting volume %s", req.VolumeId)
+	}
+	if current >= size {
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         current,
+			NodeExpansionRequired: provisioner.IsBlockVolume(volume),
+		}, nil
+	}
+
+	err = provisioner.ExpandVolume(ctx, d.Freenas, volume, *resource.NewQuantity(size, resource.BinarySI))
+	if err != nil {
+		return nil, statusError(err, "error expanding volume %s", req.VolumeId)
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes: size,
+		// the file system on a zvol has to be grown on the node
+		NodeExpansionRequired: provisioner.IsBlockVolume(volume),
+	}, nil
+}
+
+// CreateSnapshot takes a zfs snapshot of the volume named after the request.
+// Its full name is the snapshot id.
+func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "source volume id is required")
+	}
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot name is required")
+	}
+
+	volume, err := provisioner.ParseVolumeID(req.SourceVolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	ds, err := provisioner.VolumeDataset(volume)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	// snapshot names are unique across volumes
+	snapshots, err := d.Freenas.Storage().Snapshot().List(ctx, rest.ListOptions{Filters: map[string]string{"name": req.Name}})
+	if err != nil {
+		return nil, statusError(err, "error listing zfs snapshots")
+	}
+	for _, s := range snapshots {
+		if s.Fullname != nil && *s.Fullname != fmt.Sprintf("%s@%s", ds, req.Name) {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists as %s", req.Name, *s.Fullname)
+		}
+	}
+
+	fullname, err := provisioner.SnapshotVolume(ctx, d.Freenas, volume, req.Name)
+	if err != nil {
+		return nil, statusError(err, "error creating snapshot %s of volume %s", req.Name, req.SourceVolumeId)
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: &csi.Snapshot{
+			SnapshotId:     fullname,
+			SourceVolumeId: req.SourceVolumeId,
+			CreationTime:   ptypes.TimestampNow(),
+			ReadyToUse:     true,
+		},
+	}, nil
+}
+
+func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot id is required")
+	}
+	if !strings.Contains(req.SnapshotId, "@") {
+		glog.Warningf("not deleting snapshot with invalid id %s", req.SnapshotId)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	err := d.Freenas.Storage().Snapshot().Delete(ctx, &snapshot.Snapshot{Fullname: &req.SnapshotId})
+	if err != nil && !rest.IsNotFound(err) {
+		return nil, statusError(err, "error deleting snapshot %s", req.SnapshotId)
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+
+	volume, err := provisioner.ParseVolumeID(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	ds, err := provisioner.VolumeDataset(volume)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	protocol := provisioner.NFSProtocol
+	if provisioner.IsBlockVolume(volume) {
+		protocol = provisioner.ISCSIProtocol
+		pool := strings.SplitN(ds, "/", 2)
+		_, err = d.Freenas.Storage().ZVol().Get(ctx, &dataset.Dataset{Pool: &pool[0]}, &z_vol.ZVol{Name: &pool[1]})
+	} else {
+		_, err = d.Freenas.Storage().Dataset().Get(ctx, &dataset.Dataset{Name: &ds})
+	}
+	if err != nil {
+		return nil, statusError(err, "error getting volume %s", req.VolumeId)
+	}
+
+	err = validateCapabilities(protocol, req.VolumeCapabilities)
+	if err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
+		},
+	}, nil
+}
+
+// GetCapacity returns the space available to the root dataset of the
+// parameters. Without parameters there is no capacity to report.
+func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if len(req.Parameters) == 0 {
+		return &csi.GetCapacityResponse{}, nil
+	}
+
+	config, err := provisioner.ParseConfig(req.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(req.VolumeCapabilities) > 0 && validateCapabilities(config.Protocol, req.VolumeCapabilities) != nil {
+		return &csi.GetCapacityResponse{}, nil
+	}
+
+	rootDs, err := d.Freenas.Storage().Dataset().Get(ctx, &dataset.Dataset{Name: &config.RootDatasetName})
+	if err != nil {
+		return nil, statusError(err, "error getting root dataset %s", config.RootDatasetName)
+	}
+
+	var available int64
+	if rootDs.Avail != nil {
+		available = *rootDs.Avail
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+	}, nil
+}
+
+func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	capabilities := make([]*csi.ControllerServiceCapability, 0, len(controllerCapabilities))
+	for _, c := range controllerCapabilities {
+		capabilities = append(capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: c,
+				},
+			},
+		})
+	}
+
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: capabilities,
+	}, nil
+}
+
+func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+// requestedSize returns the size of a volume for capacity, rounded up to a
+// whole MiB.
+func requestedSize(capacity *csi.CapacityRange) (int64, error) {
+	size := int64(defaultVolumeSize)
+	if capacity == nil {
+		return size, nil
+	}
+
+	required, limit := capacity.RequiredBytes, capacity.LimitBytes
+	if required < 0 || limit < 0 {
+		return 0, fmt.Errorf("capacity range must not be negative")
+	}
+	switch {
+	case required > 0:
+		size = required
+	case limit > 0 && limit < size:
+		size = limit
+	}
+
+	size = (size + volumeSizeUnit - 1) / volumeSizeUnit * volumeSizeUnit
+	if limit > 0 && size > limit {
+		return 0, fmt.Errorf("%d bytes rounded up to whole MiB exceed the limit of %d bytes", required, limit)
+	}
+
+	return size, nil
+}
+
+// validateCapabilities checks that volumes of protocol can be used as
+// capabilities ask.
+func validateCapabilities(protocol string, capabilities []*csi.VolumeCapability) error {
+	for _, c := range capabilities {
+		if c.AccessMode == nil {
+			return fmt.Errorf("volume capability access mode is required")
+		}
+		if c.GetBlock() == nil && c.GetMount() == nil {
+			return fmt.Errorf("volume capability access type is required")
+		}
+
+		switch protocol {
+		case provisioner.ISCSIProtocol:
+			switch c.AccessMode.Mode {
+			case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+				csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+			default:
+				return fmt.Errorf("access mode %s is not supported by %s volumes", c.AccessMode.Mode, protocol)
+			}
+		case provisioner.NFSProtocol:
+			if c.GetBlock() != nil {
+				return fmt.Errorf("%s volumes cannot be block devices", protocol)
+			}
+			if c.AccessMode.Mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+				return fmt.Errorf("access mode %s is not supported by %s volumes", c.AccessMode.Mode, protocol)
+			}
+		}
+	}
+
+	return nil
+}
+
+// volumeContext passes on what the node service needs to attach volume.
+func volumeContext(volume *v1.PersistentVolume) map[string]string {
+	if nfs := volume.Spec.NFS; nfs != nil {
+		return map[string]string{
+			NFSServerKey: nfs.Server,
+			NFSPathKey:   nfs.Path,
+		}
+	}
+
+	iscsi := volume.Spec.ISCSI
+	if iscsi == nil {
+		return nil
+	}
+
+	context := map[string]string{
+		TargetPortalKey:   iscsi.TargetPortal,
+		IQNKey:            iscsi.IQN,
+		LunKey:            strconv.Itoa(int(iscsi.Lun)),
+		ISCSIInterfaceKey: iscsi.ISCSIInterface,
+		FsTypeKey:         iscsi.FSType,
+	}
+	if len(iscsi.Portals) > 0 {
+		context[PortalsKey] = strings.Join(iscsi.Portals, ",")
+	}
+	if iscsi.InitiatorName != nil {
+		context[InitiatorNameKey] = *iscsi.InitiatorName
+	}
+
+	return context
+}
@@ -0,0 +1,103 @@
+package csi
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/jakekeeys/freenas-provisioner/internal/provisioner"
+	freenas_fake "github.com/jakekeeys/freenas-provisioner/pkg/freenas/fake"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"testing"
+)
+
+func TestControllerExpandVolume(t *testing.T) {
+	const (
+		zVolID      = "iscsi:1:2:tank/k8s/pvc-1"
+		datasetID   = "nfs:3:tank/k8s/pvc-2"
+		zVolPath    = "/api/v1.0/storage/volume/tank/zvols/k8s/pvc-1/"
+		datasetPath = "/api/v1.0/storage/volume/tank/datasets/k8s/pvc-2/"
+	)
+
+	tests := []struct {
+		name     string
+		volumeID string
+		size     int64
+		// want is the size of the volume afterwards
+		want         int64
+		wantUpdate   bool
+		wantNodeGrow bool
+		wantCode     codes.Code
+	}{
+		{name: "grows a zvol", volumeID: zVolID, size: 2 << 30, want: 2 << 30, wantUpdate: true, wantNodeGrow: true},
+		{name: "keeps a zvol of the requested size", volumeID: zVolID, size: 1 << 30, want: 1 << 30, wantNodeGrow: true},
+		{name: "does not shrink a zvol", volumeID: zVolID, size: 512 << 20, want: 1 << 30, wantNodeGrow: true},
+		{name: "grows a dataset quota", volumeID: datasetID, size: 2 << 30, want: 2 << 30, wantUpdate: true},
+		{name: "does not shrink a dataset quota", volumeID: datasetID, size: 512 << 20, want: 1 << 30},
+		{name: "missing volume", volumeID: "iscsi:1:2:tank/k8s/pvc-3", size: 2 << 30, wantCode: codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := freenas_fake.NewServer()
+			defer server.Close()
+			server.AddPool("tank", 0)
+			err := server.AddDataset("tank/k8s")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = server.AddZVol("tank/k8s/pvc-1", 1<<30)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool, name, quota := "tank", "k8s/pvc-2", 1<<30
+			_, err = server.Client().Storage().Dataset().Create(context.Background(), &dataset.Dataset{Pool: &pool}, &dataset.Dataset{Name: &name, Quota: &quota})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			driver := NewDriver("freenas.csi.jakekeeys.github.com", "test", &provisioner.Freenas{
+				Kubernetes: k8sfake.NewSimpleClientset(),
+				Freenas:    server.Client(),
+			})
+
+			resp, err := driver.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:      tt.volumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: tt.size},
+			})
+			if tt.wantCode != codes.OK {
+				if status.Code(err) != tt.wantCode {
+					t.Fatalf("ControllerExpandVolume() error = %v, want code %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ControllerExpandVolume() error = %v", err)
+			}
+
+			if resp.CapacityBytes != tt.want {
+				t.Errorf("ControllerExpandVolume() capacity = %d, want %d", resp.CapacityBytes, tt.want)
+			}
+			if resp.NodeExpansionRequired != tt.wantNodeGrow {
+				t.Errorf("ControllerExpandVolume() node expansion required = %v, want %v", resp.NodeExpansionRequired, tt.wantNodeGrow)
+			}
+
+			updates := server.Requests(http.MethodPut, zVolPath) + server.Requests(http.MethodPut, datasetPath)
+			if updated := updates > 0; updated != tt.wantUpdate {
+				t.Errorf("ControllerExpandVolume() made %d updates, want updated %v", updates, tt.wantUpdate)
+			}
+
+			zVol, _ := server.Dataset("tank/k8s/pvc-1")
+			ds, _ := server.Dataset("tank/k8s/pvc-2")
+			got := zVol.Volsize
+			if tt.volumeID == datasetID {
+				got = ds.Quota
+			}
+			if got != tt.want {
+				t.Errorf("volume size = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
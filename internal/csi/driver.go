@@ -0,0 +1,130 @@
+package csi
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/jakekeeys/freenas-provisioner/internal/provisioner"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/url"
+	"os"
+)
+
+const (
+	// volume context keys, read by the node service
+	TargetPortalKey   = "targetPortal"
+	PortalsKey        = "portals"
+	IQNKey            = "iqn"
+	LunKey            = "lun"
+	ISCSIInterfaceKey = "iscsiInterface"
+	InitiatorNameKey  = "initiatorName"
+	FsTypeKey         = "fsType"
+	NFSServerKey      = "nfsServer"
+	NFSPathKey        = "nfsPath"
+)
+
+// Driver serves the CSI identity and controller services on top of the
+// provisioner, so volumes are created by the same code as in the external
+// provisioner mode.
+type Driver struct {
+	Name        string
+	Version     string
+	Freenas     freenas.Interface
+	Provisioner *provisioner.Freenas
+}
+
+// NewDriver returns a driver serving the controller service through p, or
+// only the identity service when p is nil.
+func NewDriver(name, version string, p *provisioner.Freenas) *Driver {
+	d := &Driver{
+		Name:    name,
+		Version: version,
+	}
+	if p != nil {
+		d.Freenas = p.Freenas
+		d.Provisioner = p
+	}
+
+	return d
+}
+
+// Run serves the driver's services on endpoint, a unix:// or tcp:// url, until
+// the listener fails. Further services, such as the node service, are
+// registered along with them.
+func (d *Driver) Run(endpoint string, services ...func(*grpc.Server)) error {
+	listener, err := listen(endpoint)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(logCalls))
+	csi.RegisterIdentityServer(server, d)
+	if d.Provisioner != nil {
+		csi.RegisterControllerServer(server, d)
+	}
+	for _, register := range services {
+		register(server)
+	}
+
+	glog.Infof("serving csi driver %s on %s", d.Name, endpoint)
+	return server.Serve(listener)
+}
+
+func listen(endpoint string) (net.Listener, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid csi endpoint %s: %v", endpoint, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		address := u.Path
+		if address == "" {
+			address = u.Host
+		}
+		// a socket left behind by an earlier run blocks listening
+		err = os.Remove(address)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error removing stale csi socket %s: %v", address, err)
+		}
+		return net.Listen("unix", address)
+	case "tcp":
+		return net.Listen("tcp", u.Host)
+	}
+
+	return nil, fmt.Errorf("invalid csi endpoint %s, expected a unix:// or tcp:// url", endpoint)
+}
+
+func logCalls(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	glog.V(4).Infof("%s: %+v", info.FullMethod, req)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		glog.Errorf("%s failed: %v", info.FullMethod, err)
+	}
+
+	return resp, err
+}
+
+// statusError returns the grpc status for a FreeNAS error.
+func statusError(err error, format string, args ...interface{}) error {
+	message := fmt.Sprintf("%s: %v", fmt.Sprintf(format, args...), err)
+
+	switch {
+	case rest.IsNotFound(err):
+		return status.Error(codes.NotFound, message)
+	case rest.IsConflict(err):
+		return status.Error(codes.AlreadyExists, message)
+	case rest.IsValidation(err):
+		return status.Error(codes.InvalidArgument, message)
+	case rest.IsRetryable(err):
+		return status.Error(codes.Unavailable, message)
+	}
+
+	return status.Error(codes.Internal, message)
+}
@@ -0,0 +1,329 @@
+package csi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// iscsiadm exit codes
+	iscsiErrSessExists  = 15
+	iscsiErrNoObjsFound = 21
+
+	// blkid exit code for a device without a recognised file system
+	blkidNotFound = 2
+)
+
+// Host runs the commands that attach volumes to the node, so that the node
+// service can be tested without iscsi, file systems or root.
+type Host interface {
+	// Login logs in to the iscsi target iqn at portal through iface, as
+	// initiatorName unless it is empty.
+	Login(portal, iqn, iface, initiatorName string) error
+	// Logout logs out of the iscsi target, doing nothing without a session.
+	Logout(portal, iqn string) error
+	// Rescan makes the session of the iscsi target pick up new lun sizes.
+	Rescan(portal, iqn string) error
+	DeviceExists(device string) bool
+	DeviceSize(device string) (int64, error)
+	// MultipathDevice returns the multipath device holding the path device,
+	// empty while multipathd has not assembled one.
+	MultipathDevice(device string) (string, error)
+	// ResizeMultipath makes the multipath device pick up the rescanned size
+	// of its paths.
+	ResizeMultipath(device string) error
+
+	HasFilesystem(device string) (bool, error)
+	Format(device, fsType string) error
+	// ResizeFilesystem grows the file system on device, mounted at path, to
+	// the size of the device.
+	ResizeFilesystem(device, path string) error
+
+	Mount(source, target, fsType string, options []string) error
+	Unmount(target string) error
+	IsMountPoint(path string) (bool, error)
+	FilesystemStats(path string) (*FilesystemStats, error)
+}
+
+// FilesystemStats is the usage of a mounted file system.
+type FilesystemStats struct {
+	TotalBytes      int64
+	AvailableBytes  int64
+	UsedBytes       int64
+	TotalInodes     int64
+	AvailableInodes int64
+	UsedInodes      int64
+}
+
+// ExecHost implements Host with iscsiadm, multipathd, blkid, mkfs and mount.
+type ExecHost struct {
+	// Command prepares the commands, exec.Command unless replaced in tests
+	Command func(name string, args ...string) *exec.Cmd
+}
+
+func NewExecHost() Host {
+	return &ExecHost{
+		Command: exec.Command,
+	}
+}
+
+func (h *ExecHost) run(name string, args ...string) ([]byte, error) {
+	glog.V(4).Infof("running %s %s", name, strings.Join(args, " "))
+	output, err := h.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(output))
+	}
+
+	return output, nil
+}
+
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+
+	return -1
+}
+
+func (h *ExecHost) Login(portal, iqn, iface, initiatorName string) error {
+	if initiatorName != "" {
+		var err error
+		iface, err = h.initiatorIface(iface, initiatorName)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := h.run("iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", portal, "-I", iface)
+	if err != nil {
+		return err
+	}
+
+	cmd := h.Command("iscsiadm", "-m", "node", "-T", iqn, "-p", portal, "-I", iface, "--login")
+	output, err := cmd.CombinedOutput()
+	if err != nil && exitCode(err) != iscsiErrSessExists {
+		return fmt.Errorf("error logging in to iscsi target %s at %s: %v: %s", iqn, portal, err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
+
+// initiatorIface returns an iscsi interface like iface that logs in as
+// initiatorName, creating it if needed.
+func (h *ExecHost) initiatorIface(iface, initiatorName string) (string, error) {
+	sum := sha256.Sum256([]byte(iface + "/" + initiatorName))
+	name := "freenas-" + hex.EncodeToString(sum[:])[:12]
+
+	_, err := h.run("iscsiadm", "-m", "iface", "-I", name)
+	if err != nil {
+		_, err = h.run("iscsiadm", "-m", "iface", "-I", name, "-o", "new")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	_, err = h.run("iscsiadm", "-m", "iface", "-I", name, "-o", "update", "-n", "iface.initiatorname", "-v", initiatorName)
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+func (h *ExecHost) Logout(portal, iqn string) error {
+	cmd := h.Command("iscsiadm", "-m", "node", "-T", iqn, "-p", portal, "--logout")
+	output, err := cmd.CombinedOutput()
+	if err != nil && exitCode(err) != iscsiErrNoObjsFound {
+		return fmt.Errorf("error logging out of iscsi target %s at %s: %v: %s", iqn, portal, err, bytes.TrimSpace(output))
+	}
+
+	cmd = h.Command("iscsiadm", "-m", "node", "-T", iqn, "-p", portal, "-o", "delete")
+	output, err = cmd.CombinedOutput()
+	if err != nil && exitCode(err) != iscsiErrNoObjsFound {
+		return fmt.Errorf("error deleting iscsi node %s at %s: %v: %s", iqn, portal, err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
+
+func (h *ExecHost) Rescan(portal, iqn string) error {
+	_, err := h.run("iscsiadm", "-m", "node", "-T", iqn, "-p", portal, "-R")
+	return err
+}
+
+func (h *ExecHost) DeviceExists(device string) bool {
+	_, err := os.Stat(device)
+	return err == nil
+}
+
+func (h *ExecHost) DeviceSize(device string) (int64, error) {
+	output, err := h.run("blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(bytes.TrimSpace(output)), 10, 64)
+}
+
+func (h *ExecHost) MultipathDevice(device string) (string, error) {
+	path, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", err
+	}
+
+	holders, err := ioutil.ReadDir(filepath.Join("/sys/block", filepath.Base(path), "holders"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, holder := range holders {
+		if strings.HasPrefix(holder.Name(), "dm-") {
+			return filepath.Join("/dev", holder.Name()), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (h *ExecHost) ResizeMultipath(device string) error {
+	_, err := h.run("multipathd", "resize", "map", filepath.Base(device))
+	return err
+}
+
+func (h *ExecHost) HasFilesystem(device string) (bool, error) {
+	cmd := h.Command("blkid", "-p", "-s", "TYPE", "-o", "value", device)
+	output, err := cmd.CombinedOutput()
+	if exitCode(err) == blkidNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error probing %s: %v: %s", device, err, bytes.TrimSpace(output))
+	}
+
+	return len(bytes.TrimSpace(output)) > 0, nil
+}
+
+func (h *ExecHost) Format(device, fsType string) error {
+	args := []string{"-t", fsType}
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		// do not ask whether to format a whole disk
+		args = append(args, "-F")
+	case "xfs":
+		args = append(args, "-f")
+	}
+	args = append(args, device)
+
+	_, err := h.run("mkfs", args...)
+	return err
+}
+
+func (h *ExecHost) ResizeFilesystem(device, path string) error {
+	output, err := h.run("blkid", "-p", "-s", "TYPE", "-o", "value", device)
+	if err != nil {
+		return err
+	}
+
+	switch fsType := string(bytes.TrimSpace(output)); fsType {
+	case "ext2", "ext3", "ext4":
+		_, err = h.run("resize2fs", device)
+	case "xfs":
+		_, err = h.run("xfs_growfs", path)
+	default:
+		err = fmt.Errorf("cannot resize %s file system on %s", fsType, device)
+	}
+
+	return err
+}
+
+func (h *ExecHost) Mount(source, target, fsType string, options []string) error {
+	var args []string
+	if fsType != "" {
+		args = append(args, "-t", fsType)
+	}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, source, target)
+
+	_, err := h.run("mount", args...)
+	return err
+}
+
+func (h *ExecHost) Unmount(target string) error {
+	_, err := h.run("umount", target)
+	return err
+}
+
+// IsMountPoint reports whether path is listed in /proc/mounts, which also
+// catches bind mounts of the same file system.
+func (h *ExecHost) IsMountPoint(path string) (bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+
+	mounts, err := os.Open("/proc/mounts")
+	if err != nil {
+		return false, err
+	}
+	defer mounts.Close()
+
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// spaces and other special characters are octal escaped
+		if len(fields) > 1 && unescapeMountPath(fields[1]) == path {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	unquoted, err := strconv.Unquote(`"` + path + `"`)
+	if err != nil {
+		return path
+	}
+
+	return unquoted
+}
+
+func (h *ExecHost) FilesystemStats(path string) (*FilesystemStats, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := int64(stat.Bsize)
+	return &FilesystemStats{
+		TotalBytes:      int64(stat.Blocks) * blockSize,
+		AvailableBytes:  int64(stat.Bavail) * blockSize,
+		UsedBytes:       (int64(stat.Blocks) - int64(stat.Bfree)) * blockSize,
+		TotalInodes:     int64(stat.Files),
+		AvailableInodes: int64(stat.Ffree),
+		UsedInodes:      int64(stat.Files) - int64(stat.Ffree),
+	}, nil
+}
@@ -0,0 +1,146 @@
+package csi
+
+import (
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// commands stands in for the commands of an ExecHost. Each command exits
+// with the code of an exit codes key it contains, 0 for none, so keys must
+// not share commands.
+type commands struct {
+	exitCodes map[string]int
+	ran       []string
+}
+
+func (c *commands) command(name string, args ...string) *exec.Cmd {
+	line := strings.Join(append([]string{name}, args...), " ")
+	c.ran = append(c.ran, line)
+
+	code := 0
+	for key, exitCode := range c.exitCodes {
+		if strings.Contains(line, key) {
+			code = exitCode
+			break
+		}
+	}
+
+	return exec.Command("sh", "-c", fmt.Sprintf("echo %s; exit %d", name, code))
+}
+
+func TestExecHostLogin(t *testing.T) {
+	tests := []struct {
+		name      string
+		exitCodes map[string]int
+		wantErr   bool
+	}{
+		{name: "logs in"},
+		{name: "has a session already", exitCodes: map[string]int{"--login": iscsiErrSessExists}},
+		{name: "fails to log in", exitCodes: map[string]int{"--login": 8}, wantErr: true},
+		{name: "finds no objects", exitCodes: map[string]int{"--login": iscsiErrNoObjsFound}, wantErr: true},
+		{name: "fails to discover", exitCodes: map[string]int{"discovery": 4}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &commands{exitCodes: tt.exitCodes}
+			host := &ExecHost{Command: c.command}
+
+			err := host.Login("10.0.0.1:3260", "iqn.2005-10.org.freenas.ctl:pvc-1", "default", "")
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Login() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Login() error = %v", err)
+			}
+
+			want := []string{
+				"iscsiadm -m discovery -t sendtargets -p 10.0.0.1:3260 -I default",
+				"iscsiadm -m node -T iqn.2005-10.org.freenas.ctl:pvc-1 -p 10.0.0.1:3260 -I default --login",
+			}
+			if !reflect.DeepEqual(c.ran, want) {
+				t.Errorf("Login() ran %v, want %v", c.ran, want)
+			}
+		})
+	}
+}
+
+func TestExecHostLogout(t *testing.T) {
+	tests := []struct {
+		name      string
+		exitCodes map[string]int
+		wantErr   bool
+	}{
+		{name: "logs out"},
+		{name: "has no session", exitCodes: map[string]int{"--logout": iscsiErrNoObjsFound}},
+		{name: "has no session or node", exitCodes: map[string]int{"--logout": iscsiErrNoObjsFound, "-o delete": iscsiErrNoObjsFound}},
+		{name: "fails to log out", exitCodes: map[string]int{"--logout": 8}, wantErr: true},
+		{name: "fails to delete the node", exitCodes: map[string]int{"-o delete": 6}, wantErr: true},
+		{name: "has a session on logout", exitCodes: map[string]int{"--logout": iscsiErrSessExists}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &commands{exitCodes: tt.exitCodes}
+			host := &ExecHost{Command: c.command}
+
+			err := host.Logout("10.0.0.1:3260", "iqn.2005-10.org.freenas.ctl:pvc-1")
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Logout() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Logout() error = %v", err)
+			}
+
+			want := []string{
+				"iscsiadm -m node -T iqn.2005-10.org.freenas.ctl:pvc-1 -p 10.0.0.1:3260 --logout",
+				"iscsiadm -m node -T iqn.2005-10.org.freenas.ctl:pvc-1 -p 10.0.0.1:3260 -o delete",
+			}
+			if !reflect.DeepEqual(c.ran, want) {
+				t.Errorf("Logout() ran %v, want %v", c.ran, want)
+			}
+		})
+	}
+}
+
+func TestExecHostHasFilesystem(t *testing.T) {
+	tests := []struct {
+		name      string
+		exitCodes map[string]int
+		want      bool
+		wantErr   bool
+	}{
+		{name: "formatted", want: true},
+		{name: "empty", exitCodes: map[string]int{"blkid": blkidNotFound}},
+		{name: "fails", exitCodes: map[string]int{"blkid": 4}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := &ExecHost{Command: (&commands{exitCodes: tt.exitCodes}).command}
+
+			got, err := host.HasFilesystem("/dev/sdb")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("HasFilesystem() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HasFilesystem() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("HasFilesystem() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
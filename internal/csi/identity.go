@@ -0,0 +1,52 @@
+package csi
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{
+		Name:          d.Name,
+		VendorVersion: d.Version,
+	}, nil
+}
+
+func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	capabilities := []*csi.PluginCapability{{
+		Type: &csi.PluginCapability_VolumeExpansion_{
+			VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+				Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+			},
+		},
+	}}
+	if d.Provisioner != nil {
+		capabilities = append(capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		})
+	}
+
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: capabilities,
+	}, nil
+}
+
+// Probe reports the driver ready while FreeNAS answers.
+func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if d.Freenas == nil {
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+	}
+
+	_, err := d.Freenas.ISCSI().GlobalConfiguration().Get(ctx)
+	if err != nil {
+		glog.Warningf("csi probe failed: %v", err)
+	}
+
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: err == nil}}, nil
+}
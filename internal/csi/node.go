@@ -0,0 +1,625 @@
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultISCSIPort  = "3260"
+	defaultISCSIIface = "default"
+	defaultFsType     = "ext4"
+	nfsFsType         = "nfs"
+
+	devicePollInterval = time.Second
+)
+
+var nodeCapabilities = []csi.NodeServiceCapability_RPC_Type{
+	csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+	csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+}
+
+// Node serves the CSI node service. Volumes are staged by logging in to
+// their iscsi target, formatting the lun if it is empty and mounting it, or
+// by mounting their nfs share, and published by bind mounting the staged
+// volume.
+type Node struct {
+	NodeID string
+	Host   Host
+	// StateDir keeps what unstaging and expanding need to know about each
+	// staged volume
+	StateDir string
+	// DeviceTimeout is how long to wait for the lun's device after login
+	DeviceTimeout time.Duration
+
+	mu       sync.Mutex
+	inFlight sets.String
+}
+
+// stagedVolume is what is kept about a staged volume.
+type stagedVolume struct {
+	Portal    string   `json:"portal,omitempty"`
+	Portals   []string `json:"portals,omitempty"`
+	IQN       string   `json:"iqn,omitempty"`
+	Device    string   `json:"device,omitempty"`
+	Multipath bool     `json:"multipath,omitempty"`
+	Block     bool     `json:"block,omitempty"`
+}
+
+// portals returns every portal the volume was logged in through.
+func (v *stagedVolume) portals() []string {
+	return append([]string{v.Portal}, v.Portals...)
+}
+
+func NewNode(nodeID, stateDir string, host Host) *Node {
+	return &Node{
+		NodeID:        nodeID,
+		Host:          host,
+		StateDir:      stateDir,
+		DeviceTimeout: 30 * time.Second,
+		inFlight:      sets.NewString(),
+	}
+}
+
+// Register adds the node service to server, see Driver.Run.
+func (n *Node) Register(server *grpc.Server) {
+	csi.RegisterNodeServer(server, n)
+}
+
+// lock fails while another operation on volumeID is running.
+func (n *Node) lock(volumeID string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.inFlight.Has(volumeID) {
+		return status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", volumeID)
+	}
+	n.inFlight.Insert(volumeID)
+
+	return nil
+}
+
+func (n *Node) unlock(volumeID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.inFlight.Delete(volumeID)
+}
+
+func (n *Node) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+
+	err := n.lock(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer n.unlock(req.VolumeId)
+
+	mounted, err := n.Host.IsMountPoint(req.StagingTargetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// block volumes are not mounted, their state tells that they are staged
+	if req.VolumeCapability.GetBlock() != nil {
+		staged, err := n.loadVolume(req.VolumeId)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if staged != nil && staged.Block && n.Host.DeviceExists(staged.Device) {
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+	}
+
+	volumeContext := req.VolumeContext
+	var options []string
+	if mount := req.VolumeCapability.GetMount(); mount != nil {
+		options = mount.MountFlags
+	}
+
+	// nfs shares are mounted as they are
+	if server, ok := volumeContext[NFSServerKey]; ok {
+		if req.VolumeCapability.GetBlock() != nil {
+			return nil, status.Error(codes.InvalidArgument, "nfs volumes cannot be block devices")
+		}
+
+		err = os.MkdirAll(req.StagingTargetPath, 0750)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		err = n.Host.Mount(fmt.Sprintf("%s:%s", server, volumeContext[NFSPathKey]), req.StagingTargetPath, nfsFsType, options)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	volume, err := n.login(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	volume.Block = req.VolumeCapability.GetBlock() != nil
+	err = n.saveVolume(req.VolumeId, volume)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// block volumes are published straight from the device
+	if volume.Block {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	fsType := volumeContext[FsTypeKey]
+	if mount := req.VolumeCapability.GetMount(); mount != nil && mount.FsType != "" {
+		fsType = mount.FsType
+	}
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+
+	formatted, err := n.Host.HasFilesystem(volume.Device)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !formatted {
+		glog.Infof("formatting %s of volume %s with %s", volume.Device, req.VolumeId, fsType)
+		err = n.Host.Format(volume.Device, fsType)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = os.MkdirAll(req.StagingTargetPath, 0750)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	err = n.Host.Mount(volume.Device, req.StagingTargetPath, fsType, options)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// login logs in to the iscsi target of a volume through each of its portals
+// and waits for its device, the multipath device when there are several
+// portals and multipathd assembles their paths.
+func (n *Node) login(volumeContext map[string]string) (*stagedVolume, error) {
+	portal, iqn := volumeContext[TargetPortalKey], volumeContext[IQNKey]
+	if portal == "" || iqn == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "volume context keys %s and %s are required", TargetPortalKey, IQNKey)
+	}
+
+	portals := []string{portal}
+	for _, portal := range strings.Split(volumeContext[PortalsKey], ",") {
+		if portal != "" {
+			portals = append(portals, portal)
+		}
+	}
+	for i, portal := range portals {
+		if _, _, err := net.SplitHostPort(portal); err != nil {
+			portals[i] = net.JoinHostPort(portal, defaultISCSIPort)
+		}
+	}
+
+	lun, err := strconv.Atoi(volumeContext[LunKey])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume context %s: %v", LunKey, err)
+	}
+
+	iface := volumeContext[ISCSIInterfaceKey]
+	if iface == "" {
+		iface = defaultISCSIIface
+	}
+
+	// each portal is a path to the lun, so the volume is usable as long as
+	// one of them is
+	var devices []string
+	for _, portal := range portals {
+		err = n.Host.Login(portal, iqn, iface, volumeContext[InitiatorNameKey])
+		if err != nil {
+			glog.Warningf("error logging in to %s through portal %s: %v", iqn, portal, err)
+			continue
+		}
+		devices = append(devices, fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-%d", portal, iqn, lun))
+	}
+	if len(devices) == 0 {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	var device string
+	err = wait.PollImmediate(devicePollInterval, n.DeviceTimeout, func() (bool, error) {
+		for _, d := range devices {
+			if n.Host.DeviceExists(d) {
+				device = d
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.DeadlineExceeded, "no device showed up after logging in to %s", iqn)
+	}
+
+	volume := &stagedVolume{
+		Portal:  portals[0],
+		Portals: portals[1:],
+		IQN:     iqn,
+		Device:  device,
+	}
+	if len(portals) == 1 {
+		return volume, nil
+	}
+
+	err = wait.PollImmediate(devicePollInterval, n.DeviceTimeout, func() (bool, error) {
+		multipathDevice, err := n.Host.MultipathDevice(device)
+		if err != nil || multipathDevice == "" {
+			return false, err
+		}
+		volume.Device = multipathDevice
+		volume.Multipath = true
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		glog.Warningf("multipathd did not assemble the paths of %s, using %s alone", iqn, device)
+		return volume, nil
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return volume, nil
+}
+
+func (n *Node) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+
+	err := n.lock(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer n.unlock(req.VolumeId)
+
+	err = n.unmount(req.StagingTargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	volume, err := n.loadVolume(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if volume == nil {
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	for _, portal := range volume.portals() {
+		err = n.Host.Logout(portal, volume.IQN)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = os.Remove(n.statePath(req.VolumeId))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (n *Node) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is required")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+
+	err := n.lock(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer n.unlock(req.VolumeId)
+
+	mounted, err := n.Host.IsMountPoint(req.TargetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	options := []string{"bind"}
+	if req.Readonly {
+		options = append(options, "ro")
+	}
+
+	source := req.StagingTargetPath
+	if req.VolumeCapability.GetBlock() != nil {
+		volume, err := n.loadVolume(req.VolumeId)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if volume == nil || !volume.Block {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not staged as a block device", req.VolumeId)
+		}
+		source = volume.Device
+
+		// block devices are bind mounted onto a file
+		err = os.MkdirAll(filepath.Dir(req.TargetPath), 0750)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		file, err := os.OpenFile(req.TargetPath, os.O_CREATE, 0640)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		file.Close()
+	} else {
+		err = os.MkdirAll(req.TargetPath, 0750)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = n.Host.Mount(source, req.TargetPath, "", options)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (n *Node) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is required")
+	}
+
+	err := n.lock(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer n.unlock(req.VolumeId)
+
+	err = n.unmount(req.TargetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// unmount unmounts and removes path if it exists.
+func (n *Node) unmount(path string) error {
+	mounted, err := n.Host.IsMountPoint(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if mounted {
+		err = n.Host.Unmount(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (n *Node) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path is required")
+	}
+
+	info, err := os.Stat(req.VolumePath)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", req.VolumePath)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !info.IsDir() {
+		size, err := n.Host.DeviceSize(req.VolumePath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{{
+				Unit:  csi.VolumeUsage_BYTES,
+				Total: size,
+			}},
+		}, nil
+	}
+
+	stats, err := n.Host.FilesystemStats(req.VolumePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     stats.TotalBytes,
+				Available: stats.AvailableBytes,
+				Used:      stats.UsedBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     stats.TotalInodes,
+				Available: stats.AvailableInodes,
+				Used:      stats.UsedInodes,
+			},
+		},
+	}, nil
+}
+
+// NodeExpandVolume makes the node see the grown lun of a volume and grows
+// its file system.
+func (n *Node) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path is required")
+	}
+
+	err := n.lock(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer n.unlock(req.VolumeId)
+
+	volume, err := n.loadVolume(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// nfs quotas need nothing on the node
+	if volume == nil {
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+
+	for _, portal := range volume.portals() {
+		err = n.Host.Rescan(portal, volume.IQN)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if volume.Multipath {
+		err = n.Host.ResizeMultipath(volume.Device)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !volume.Block {
+		err = n.Host.ResizeFilesystem(volume.Device, req.VolumePath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	size, err := n.Host.DeviceSize(volume.Device)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: size,
+	}, nil
+}
+
+func (n *Node) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	capabilities := make([]*csi.NodeServiceCapability, 0, len(nodeCapabilities))
+	for _, c := range nodeCapabilities {
+		capabilities = append(capabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: c,
+				},
+			},
+		})
+	}
+
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: capabilities,
+	}, nil
+}
+
+func (n *Node) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{
+		NodeId: n.NodeID,
+	}, nil
+}
+
+func (n *Node) statePath(volumeID string) string {
+	return filepath.Join(n.StateDir, url.PathEscape(volumeID)+".json")
+}
+
+func (n *Node) saveVolume(volumeID string, volume *stagedVolume) error {
+	b, err := json.Marshal(volume)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(n.StateDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(n.statePath(volumeID), b, 0600)
+}
+
+// loadVolume returns what was kept about a staged iscsi volume, nil for
+// other volumes.
+func (n *Node) loadVolume(volumeID string) (*stagedVolume, error) {
+	b, err := ioutil.ReadFile(n.statePath(volumeID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	volume := &stagedVolume{}
+	err = json.Unmarshal(b, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	return volume, nil
+}
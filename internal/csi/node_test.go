@@ -0,0 +1,559 @@
+package csi
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testIQN = "iqn.2005-10.org.freenas.ctl:pvc-1"
+
+// fakeHost attaches volumes in memory. Logging in to a target through a
+// portal makes the path device of its lun 0 show up, and multipathd assembles
+// the paths into Multipath unless it is empty.
+type fakeHost struct {
+	// FailLogin are the portals that cannot be logged in through
+	FailLogin sets.String
+	Multipath string
+
+	mu          sync.Mutex
+	sessions    sets.String
+	devices     sets.String
+	filesystems map[string]string
+	// mounts are the sources mounted at each target
+	mounts map[string]string
+	calls  []string
+}
+
+func newFakeHost() *fakeHost {
+	return &fakeHost{
+		FailLogin:   sets.NewString(),
+		sessions:    sets.NewString(),
+		devices:     sets.NewString(),
+		filesystems: map[string]string{},
+		mounts:      map[string]string{},
+	}
+}
+
+func pathDevice(portal, iqn string) string {
+	return fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-0", portal, iqn)
+}
+
+func (h *fakeHost) call(format string, args ...interface{}) {
+	h.calls = append(h.calls, fmt.Sprintf(format, args...))
+}
+
+// Calls returns the calls made that start with prefix.
+func (h *fakeHost) Calls(prefix string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var calls []string
+	for _, call := range h.calls {
+		if strings.HasPrefix(call, prefix) {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+func (h *fakeHost) Mounts() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	mounts := map[string]string{}
+	for target, source := range h.mounts {
+		mounts[target] = source
+	}
+
+	return mounts
+}
+
+func (h *fakeHost) Sessions() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.sessions.List()
+}
+
+func (h *fakeHost) Login(portal, iqn, iface, initiatorName string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.call("login %s %s", portal, iqn)
+	if h.FailLogin.Has(portal) {
+		return fmt.Errorf("no route to %s", portal)
+	}
+	h.sessions.Insert(portal + " " + iqn)
+	h.devices.Insert(pathDevice(portal, iqn))
+
+	return nil
+}
+
+func (h *fakeHost) Logout(portal, iqn string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.call("logout %s %s", portal, iqn)
+	h.sessions.Delete(portal + " " + iqn)
+	h.devices.Delete(pathDevice(portal, iqn))
+
+	return nil
+}
+
+func (h *fakeHost) Rescan(portal, iqn string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.call("rescan %s %s", portal, iqn)
+	return nil
+}
+
+func (h *fakeHost) DeviceExists(device string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.devices.Has(device) || (device == h.Multipath && h.devices.Len() > 0)
+}
+
+func (h *fakeHost) DeviceSize(device string) (int64, error) {
+	return 1 << 30, nil
+}
+
+func (h *fakeHost) MultipathDevice(device string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.devices.Has(device) {
+		return "", fmt.Errorf("%s does not exist", device)
+	}
+
+	return h.Multipath, nil
+}
+
+func (h *fakeHost) ResizeMultipath(device string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.call("resize multipath %s", device)
+	return nil
+}
+
+func (h *fakeHost) HasFilesystem(device string) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, ok := h.filesystems[device]
+	return ok, nil
+}
+
+func (h *fakeHost) Format(device, fsType string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.call("format %s %s", device, fsType)
+	h.filesystems[device] = fsType
+	return nil
+}
+
+func (h *fakeHost) ResizeFilesystem(device, path string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.call("resize filesystem %s", device)
+	return nil
+}
+
+func (h *fakeHost) Mount(source, target, fsType string, options []string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.call("mount %s %s", source, target)
+	h.mounts[target] = source
+	return nil
+}
+
+func (h *fakeHost) Unmount(target string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.call("unmount %s", target)
+	if _, ok := h.mounts[target]; !ok {
+		return fmt.Errorf("%s is not mounted", target)
+	}
+	delete(h.mounts, target)
+	return nil
+}
+
+func (h *fakeHost) IsMountPoint(path string) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, ok := h.mounts[path]
+	return ok, nil
+}
+
+func (h *fakeHost) FilesystemStats(path string) (*FilesystemStats, error) {
+	return &FilesystemStats{
+		TotalBytes:      1 << 30,
+		AvailableBytes:  1 << 29,
+		UsedBytes:       1 << 29,
+		TotalInodes:     1000,
+		AvailableInodes: 900,
+		UsedInodes:      100,
+	}, nil
+}
+
+// newTestNode returns a node on a fake host keeping its state and volumes in
+// a temporary directory, which has to be removed when done.
+func newTestNode(t *testing.T) (*Node, *fakeHost, string) {
+	dir, err := ioutil.TempDir("", "csi-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := newFakeHost()
+	node := NewNode("node-1", filepath.Join(dir, "state"), host)
+	node.DeviceTimeout = 10 * time.Millisecond
+
+	return node, host, dir
+}
+
+func iscsiVolumeContext(portals string) map[string]string {
+	return map[string]string{
+		TargetPortalKey: "10.0.0.1:3260",
+		PortalsKey:      portals,
+		IQNKey:          testIQN,
+		LunKey:          "0",
+	}
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func blockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	path1, path2 := pathDevice("10.0.0.1:3260", testIQN), pathDevice("10.0.0.2:3260", testIQN)
+
+	tests := []struct {
+		name string
+		// portals are the volume's portals besides the target portal
+		portals         string
+		capability      *csi.VolumeCapability
+		failLogin       []string
+		multipathDevice string
+		formatted       bool
+		want            stagedVolume
+		wantFormat      bool
+		wantMount       bool
+		wantCode        codes.Code
+	}{
+		{
+			name:       "one portal",
+			capability: mountCapability(),
+			want:       stagedVolume{Portal: "10.0.0.1:3260", IQN: testIQN, Device: path1},
+			wantFormat: true,
+			wantMount:  true,
+		},
+		{
+			name:       "formatted lun",
+			capability: mountCapability(),
+			formatted:  true,
+			want:       stagedVolume{Portal: "10.0.0.1:3260", IQN: testIQN, Device: path1},
+			wantMount:  true,
+		},
+		{
+			name:       "block device",
+			capability: blockCapability(),
+			want:       stagedVolume{Portal: "10.0.0.1:3260", IQN: testIQN, Device: path1, Block: true},
+		},
+		{
+			name:            "multipath device",
+			portals:         "10.0.0.2",
+			capability:      mountCapability(),
+			multipathDevice: "/dev/dm-0",
+			want:            stagedVolume{Portal: "10.0.0.1:3260", Portals: []string{"10.0.0.2:3260"}, IQN: testIQN, Device: "/dev/dm-0", Multipath: true},
+			wantFormat:      true,
+			wantMount:       true,
+		},
+		{
+			name:       "paths without a multipath device",
+			portals:    "10.0.0.2",
+			capability: mountCapability(),
+			want:       stagedVolume{Portal: "10.0.0.1:3260", Portals: []string{"10.0.0.2:3260"}, IQN: testIQN, Device: path1},
+			wantFormat: true,
+			wantMount:  true,
+		},
+		{
+			name:       "unreachable target portal",
+			portals:    "10.0.0.2",
+			capability: mountCapability(),
+			failLogin:  []string{"10.0.0.1:3260"},
+			want:       stagedVolume{Portal: "10.0.0.1:3260", Portals: []string{"10.0.0.2:3260"}, IQN: testIQN, Device: path2},
+			wantFormat: true,
+			wantMount:  true,
+		},
+		{
+			name:       "unreachable portals",
+			portals:    "10.0.0.2",
+			capability: mountCapability(),
+			failLogin:  []string{"10.0.0.1:3260", "10.0.0.2:3260"},
+			wantCode:   codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, host, dir := newTestNode(t)
+			defer os.RemoveAll(dir)
+			host.FailLogin.Insert(tt.failLogin...)
+			host.Multipath = tt.multipathDevice
+			if tt.formatted {
+				host.filesystems[tt.want.Device] = "xfs"
+			}
+
+			stagingPath := filepath.Join(dir, "staging")
+			_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          "iscsi:1:1:tank/k8s/pvc-1",
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  tt.capability,
+				VolumeContext:     iscsiVolumeContext(tt.portals),
+			})
+			if tt.wantCode != codes.OK {
+				if status.Code(err) != tt.wantCode {
+					t.Fatalf("NodeStageVolume() error = %v, want code %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NodeStageVolume() error = %v", err)
+			}
+
+			volume, err := node.loadVolume("iscsi:1:1:tank/k8s/pvc-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if volume == nil || !reflect.DeepEqual(*volume, tt.want) {
+				t.Errorf("staged volume = %+v, want %+v", volume, tt.want)
+			}
+
+			formats := host.Calls("format")
+			if tt.wantFormat && !reflect.DeepEqual(formats, []string{"format " + tt.want.Device + " ext4"}) {
+				t.Errorf("formats = %v, want one of %s", formats, tt.want.Device)
+			}
+			if !tt.wantFormat && len(formats) > 0 {
+				t.Errorf("formats = %v, want none", formats)
+			}
+
+			mounts := host.Mounts()
+			if tt.wantMount && mounts[stagingPath] != tt.want.Device {
+				t.Errorf("mounts = %v, want %s at %s", mounts, tt.want.Device, stagingPath)
+			}
+			if !tt.wantMount && len(mounts) > 0 {
+				t.Errorf("mounts = %v, want none", mounts)
+			}
+		})
+	}
+}
+
+func TestNodeStageUnstageIdempotency(t *testing.T) {
+	for _, capability := range []*csi.VolumeCapability{mountCapability(), blockCapability()} {
+		block := capability.GetBlock() != nil
+		t.Run(fmt.Sprintf("block %v", block), func(t *testing.T) {
+			node, host, dir := newTestNode(t)
+			defer os.RemoveAll(dir)
+			host.Multipath = "/dev/dm-0"
+
+			ctx := context.Background()
+			volumeID := "iscsi:1:1:tank/k8s/pvc-1"
+			stagingPath := filepath.Join(dir, "staging")
+			targetPath := filepath.Join(dir, "target")
+
+			for i := 0; i < 2; i++ {
+				_, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+					VolumeId:          volumeID,
+					StagingTargetPath: stagingPath,
+					VolumeCapability:  capability,
+					VolumeContext:     iscsiVolumeContext("10.0.0.2"),
+				})
+				if err != nil {
+					t.Fatalf("NodeStageVolume() error = %v", err)
+				}
+				_, err = node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+					VolumeId:          volumeID,
+					StagingTargetPath: stagingPath,
+					TargetPath:        targetPath,
+					VolumeCapability:  capability,
+				})
+				if err != nil {
+					t.Fatalf("NodePublishVolume() error = %v", err)
+				}
+			}
+
+			// both paths are logged in once, and the device is published
+			// once, straight from the device when it is a block device
+			if logins := host.Calls("login"); len(logins) != 2 {
+				t.Errorf("logins = %v, want one per portal", logins)
+			}
+			wantMounts := map[string]string{stagingPath: "/dev/dm-0", targetPath: stagingPath}
+			if block {
+				wantMounts = map[string]string{targetPath: "/dev/dm-0"}
+			}
+			if mounts := host.Mounts(); !reflect.DeepEqual(mounts, wantMounts) {
+				t.Errorf("mounts = %v, want %v", mounts, wantMounts)
+			}
+			if mounts := host.Calls("mount"); len(mounts) != len(wantMounts) {
+				t.Errorf("mount calls = %v, want %d", mounts, len(wantMounts))
+			}
+
+			for i := 0; i < 2; i++ {
+				_, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+					VolumeId:   volumeID,
+					TargetPath: targetPath,
+				})
+				if err != nil {
+					t.Fatalf("NodeUnpublishVolume() error = %v", err)
+				}
+				_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+					VolumeId:          volumeID,
+					StagingTargetPath: stagingPath,
+				})
+				if err != nil {
+					t.Fatalf("NodeUnstageVolume() error = %v", err)
+				}
+			}
+
+			if logouts := host.Calls("logout"); len(logouts) != 2 {
+				t.Errorf("logouts = %v, want one per portal", logouts)
+			}
+			if sessions := host.Sessions(); len(sessions) > 0 {
+				t.Errorf("sessions = %v, want none", sessions)
+			}
+			if mounts := host.Mounts(); len(mounts) > 0 {
+				t.Errorf("mounts = %v, want none", mounts)
+			}
+			for _, path := range []string{stagingPath, targetPath, node.statePath(volumeID)} {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("%s was not removed: %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeRestoresState(t *testing.T) {
+	node, host, dir := newTestNode(t)
+	defer os.RemoveAll(dir)
+	host.Multipath = "/dev/dm-0"
+
+	ctx := context.Background()
+	blockIQN := "iqn.2005-10.org.freenas.ctl:pvc-2"
+	blockContext := iscsiVolumeContext("10.0.0.2")
+	blockContext[IQNKey] = blockIQN
+	for _, req := range []*csi.NodeStageVolumeRequest{
+		{
+			VolumeId:          "iscsi:1:1:tank/k8s/pvc-1",
+			StagingTargetPath: filepath.Join(dir, "staging-1"),
+			VolumeCapability:  mountCapability(),
+			VolumeContext:     iscsiVolumeContext("10.0.0.2"),
+		},
+		{
+			VolumeId:          "iscsi:2:2:tank/k8s/pvc-2",
+			StagingTargetPath: filepath.Join(dir, "staging-2"),
+			VolumeCapability:  blockCapability(),
+			VolumeContext:     blockContext,
+		},
+	} {
+		_, err := node.NodeStageVolume(ctx, req)
+		if err != nil {
+			t.Fatalf("NodeStageVolume(%s) error = %v", req.VolumeId, err)
+		}
+	}
+
+	// a restarted node knows the staged volumes from its state dir alone,
+	// even while multipathd does not report their multipath devices
+	restarted := NewNode("node-1", node.StateDir, host)
+	host.Multipath = ""
+
+	_, err := restarted.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+		VolumeId:   "iscsi:1:1:tank/k8s/pvc-1",
+		VolumePath: filepath.Join(dir, "target-1"),
+	})
+	if err != nil {
+		t.Fatalf("NodeExpandVolume() error = %v", err)
+	}
+	want := []string{"rescan 10.0.0.1:3260 " + testIQN, "rescan 10.0.0.2:3260 " + testIQN}
+	if rescans := host.Calls("rescan"); !reflect.DeepEqual(rescans, want) {
+		t.Errorf("rescans = %v, want %v", rescans, want)
+	}
+	want = []string{"resize multipath /dev/dm-0", "resize filesystem /dev/dm-0"}
+	if resizes := host.Calls("resize"); !reflect.DeepEqual(resizes, want) {
+		t.Errorf("resizes = %v, want %v", resizes, want)
+	}
+
+	targetPath := filepath.Join(dir, "target-2")
+	_, err = restarted.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "iscsi:2:2:tank/k8s/pvc-2",
+		StagingTargetPath: filepath.Join(dir, "staging-2"),
+		TargetPath:        targetPath,
+		VolumeCapability:  blockCapability(),
+	})
+	if err != nil {
+		t.Fatalf("NodePublishVolume() error = %v", err)
+	}
+	if source := host.Mounts()[targetPath]; source != "/dev/dm-0" {
+		t.Errorf("published %s, want /dev/dm-0", source)
+	}
+
+	_, err = restarted.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "iscsi:1:1:tank/k8s/pvc-1",
+		StagingTargetPath: filepath.Join(dir, "staging-1"),
+	})
+	if err != nil {
+		t.Fatalf("NodeUnstageVolume() error = %v", err)
+	}
+	want = []string{"logout 10.0.0.1:3260 " + testIQN, "logout 10.0.0.2:3260 " + testIQN}
+	if logouts := host.Calls("logout"); !reflect.DeepEqual(logouts, want) {
+		t.Errorf("logouts = %v, want %v", logouts, want)
+	}
+	if sessions := host.Sessions(); len(sessions) != 2 || !strings.HasSuffix(sessions[0], blockIQN) {
+		t.Errorf("sessions = %v, want only those of pvc-2", sessions)
+	}
+}
+
+func TestNodePublishUnstagedBlockVolume(t *testing.T) {
+	node, _, dir := newTestNode(t)
+	defer os.RemoveAll(dir)
+
+	_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "iscsi:1:1:tank/k8s/pvc-1",
+		StagingTargetPath: filepath.Join(dir, "staging"),
+		TargetPath:        filepath.Join(dir, "target"),
+		VolumeCapability:  blockCapability(),
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("NodePublishVolume() error = %v, want code %s", err, codes.FailedPrecondition)
+	}
+}
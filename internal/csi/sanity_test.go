@@ -0,0 +1,60 @@
+package csi
+
+import (
+	"github.com/jakekeeys/freenas-provisioner/internal/provisioner"
+	freenas_fake "github.com/jakekeeys/freenas-provisioner/pkg/freenas/fake"
+	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	"io/ioutil"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSanity runs csi-sanity against the driver and the node service, backed
+// by a fake appliance and a fake host.
+func TestSanity(t *testing.T) {
+	server := freenas_fake.NewServer()
+	defer server.Close()
+	server.AddPool("tank", 100<<30)
+	err := server.AddDataset("tank/k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "csi-sanity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver := NewDriver("freenas.csi.jakekeeys.github.com", "test", &provisioner.Freenas{
+		Kubernetes: k8sfake.NewSimpleClientset(),
+		Freenas:    server.Client(),
+	})
+	node := NewNode("node-1", filepath.Join(dir, "state"), newFakeHost())
+	node.DeviceTimeout = time.Second
+
+	endpoint := "unix://" + filepath.Join(dir, "csi.sock")
+	go func() {
+		// the server lives as long as the test binary
+		err := driver.Run(endpoint, node.Register)
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	}()
+
+	sanity.Test(t, &sanity.Config{
+		Address:     endpoint,
+		TargetPath:  filepath.Join(dir, "target"),
+		StagingPath: filepath.Join(dir, "staging"),
+		TestVolumeParameters: map[string]string{
+			"rootDatasetName": "tank/k8s",
+			"portalGroup":     "1",
+			"initiatorGroup":  "2",
+			"lunID":           "0",
+			"targetPortal":    "10.0.0.1:3260",
+		},
+	})
+}
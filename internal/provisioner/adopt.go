@@ -0,0 +1,237 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/auth"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/extent"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/initiator"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target_group"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target_to_extent"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/sharing/nfs"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/z_vol"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// The find functions look up objects left behind by an earlier, interrupted
+// Provision of the same volume so that a retry adopts them instead of failing
+// on a name conflict. They return nil when no matching object exists.
+
+func (p *Freenas) findZVol(ctx context.Context, rootDs *dataset.Dataset, zVolName string, size int64, cloned bool) (*z_vol.ZVol, error) {
+	zVol, err := p.Freenas.Storage().ZVol().Get(ctx, rootDs, &z_vol.ZVol{Name: &zVolName})
+	if rest.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting zvol")
+	}
+
+	existingSize, err := zVol.Size()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading size of existing zvol %s", zVolName)
+	}
+	// clones are at least as large as their source
+	if existingSize < size || (!cloned && existingSize != size) {
+		return nil, fmt.Errorf("existing zvol %s has %d bytes instead of the requested %d, not adopting it", zVolName, existingSize, size)
+	}
+
+	zVol.Name = &zVolName
+	return zVol, nil
+}
+
+func (p *Freenas) findDataset(ctx context.Context, name string, quota int) (*dataset.Dataset, error) {
+	ds, err := p.Freenas.Storage().Dataset().Get(ctx, &dataset.Dataset{Name: &name})
+	if rest.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting dataset")
+	}
+
+	if intField(ds.Quota) != quota {
+		return nil, fmt.Errorf("existing dataset %s has a quota of %d bytes instead of the requested %d, not adopting it", name, intField(ds.Quota), quota)
+	}
+
+	return ds, nil
+}
+
+func (p *Freenas) findTarget(ctx context.Context, name string) (*target.Target, error) {
+	tgt, err := p.Freenas.ISCSI().Target().Get(ctx, &target.Target{IscsiTargetName: &name})
+	if rest.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting iscsi target")
+	}
+
+	return tgt, nil
+}
+
+// findTargetGroup returns the target group of want's target. It fails if the
+// group does not grant access like want.
+func (p *Freenas) findTargetGroup(ctx context.Context, want *target_group.TargetGroup) (*target_group.TargetGroup, error) {
+	targetGroups, err := p.Freenas.ISCSI().TargetGroup().List(ctx, rest.ListOptions{
+		Filters: map[string]string{"iscsi_target": strconv.Itoa(*want.IscsiTarget)},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing iscsi target groups")
+	}
+
+	if len(targetGroups) == 0 {
+		return nil, nil
+	}
+
+	tg := targetGroups[0]
+	var mismatches []string
+	if tg.IscsiTargetPortalgroup == nil || *tg.IscsiTargetPortalgroup != *want.IscsiTargetPortalgroup {
+		mismatches = append(mismatches, fmt.Sprintf("portal group %v instead of %d", intField(tg.IscsiTargetPortalgroup), *want.IscsiTargetPortalgroup))
+	}
+	if intField(tg.IscsiTargetInitiatorgroup) != intField(want.IscsiTargetInitiatorgroup) {
+		mismatches = append(mismatches, fmt.Sprintf("initiator group %d instead of %d", intField(tg.IscsiTargetInitiatorgroup), intField(want.IscsiTargetInitiatorgroup)))
+	}
+	if intField(tg.IscsiTargetAuthgroup) != intField(want.IscsiTargetAuthgroup) {
+		mismatches = append(mismatches, fmt.Sprintf("auth group %d instead of %d", intField(tg.IscsiTargetAuthgroup), intField(want.IscsiTargetAuthgroup)))
+	}
+	if want.IscsiTargetAuthtype != nil && (tg.IscsiTargetAuthtype == nil || *tg.IscsiTargetAuthtype != *want.IscsiTargetAuthtype) {
+		mismatches = append(mismatches, fmt.Sprintf("auth type %s", *want.IscsiTargetAuthtype))
+	}
+	if len(mismatches) > 0 {
+		return nil, fmt.Errorf("existing iscsi target group %d of target %d does not match, it has %s, not adopting it", *tg.ID, *want.IscsiTarget, strings.Join(mismatches, ", "))
+	}
+
+	return tg, nil
+}
+
+// findExtent returns the extent name. It fails if the extent exports another
+// disk than disk.
+func (p *Freenas) findExtent(ctx context.Context, name, disk string) (*extent.Extent, error) {
+	ext, err := p.Freenas.ISCSI().Extent().Get(ctx, &extent.Extent{IscsiTargetExtentName: &name})
+	if rest.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting iscsi extent")
+	}
+
+	if ext.IscsiTargetExtentDisk == nil || *ext.IscsiTargetExtentDisk != disk {
+		return nil, fmt.Errorf("extent %s already exists for a different disk", name)
+	}
+
+	return ext, nil
+}
+
+// findTargetToExtent returns the mapping of the extent to the target. It fails
+// if the extent is mapped as another lun than lunID.
+func (p *Freenas) findTargetToExtent(ctx context.Context, targetID, extentID, lunID int) (*target_to_extent.TargetToExtent, error) {
+	targetToExtents, err := p.Freenas.ISCSI().TargetToExtent().List(ctx, rest.ListOptions{
+		Filters: map[string]string{
+			"iscsi_target": strconv.Itoa(targetID),
+			"iscsi_extent": strconv.Itoa(extentID),
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing iscsi target to extents")
+	}
+
+	if len(targetToExtents) == 0 {
+		return nil, nil
+	}
+
+	tte := targetToExtents[0]
+	if intField(tte.IscsiLunid) != lunID {
+		return nil, fmt.Errorf("extent %d is already mapped to target %d as lun %d instead of %d", extentID, targetID, intField(tte.IscsiLunid), lunID)
+	}
+
+	return tte, nil
+}
+
+func (p *Freenas) findAuth(ctx context.Context, user string) (*auth.Auth, error) {
+	auths, err := p.Freenas.ISCSI().Auth().List(ctx, rest.ListOptions{
+		Filters: map[string]string{"iscsi_target_auth_user": user},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing iscsi auth credentials")
+	}
+
+	if len(auths) == 0 {
+		return nil, nil
+	}
+
+	return auths[0], nil
+}
+
+// findAuthGroup returns the first credentials of the auth group tag.
+func (p *Freenas) findAuthGroup(ctx context.Context, tag int) (*auth.Auth, error) {
+	auths, err := p.Freenas.ISCSI().Auth().List(ctx, rest.ListOptions{
+		Filters: map[string]string{"iscsi_target_auth_tag": strconv.Itoa(tag)},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing iscsi auth credentials")
+	}
+
+	if len(auths) == 0 {
+		return nil, nil
+	}
+
+	return auths[0], nil
+}
+
+func (p *Freenas) findInitiatorGroup(ctx context.Context, comment string) (*initiator.Initiator, error) {
+	initiators, err := p.Freenas.ISCSI().Initiator().List(ctx, rest.ListOptions{
+		Filters: map[string]string{"iscsi_target_initiator_comment": comment},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing iscsi initiator groups")
+	}
+
+	if len(initiators) == 0 {
+		return nil, nil
+	}
+
+	return initiators[0], nil
+}
+
+// findNFSShare returns the share exporting path. Shares export lists of paths,
+// which filters cannot match.
+func (p *Freenas) findNFSShare(ctx context.Context, path string) (*nfs.Share, error) {
+	shares, err := p.Freenas.Sharing().NFS().List(ctx, rest.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing nfs shares")
+	}
+
+	for _, share := range shares {
+		for _, sharePath := range share.NfsPaths {
+			if sharePath == path {
+				return share, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// intField returns the number in a field the api versions report as ints or
+// json numbers, zero if it is unset.
+func intField(v interface{}) int {
+	switch v := v.(type) {
+	case int:
+		return v
+	case *int:
+		if v != nil {
+			return *v
+		}
+	case float64:
+		return int(v)
+	case json.Number:
+		n, _ := v.Int64()
+		return int(n)
+	}
+
+	return 0
+}
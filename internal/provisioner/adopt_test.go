@@ -0,0 +1,249 @@
+package provisioner
+
+import (
+	"context"
+	freenas_fake "github.com/jakekeeys/freenas-provisioner/pkg/freenas/fake"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/snapshot"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	v1 "k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProvisionAdoptsLeftovers(t *testing.T) {
+	// leftovers describes what an interrupted Provision of pvc-1 left behind
+	type leftovers struct {
+		zVolSize    int64
+		targetGroup freenas_fake.Object
+		extentDisk  string
+		lunID       int
+	}
+	complete := func(modify func(*leftovers)) *leftovers {
+		l := &leftovers{
+			zVolSize:    1 << 30,
+			targetGroup: freenas_fake.Object{"iscsi_target_portalgroup": 1, "iscsi_target_initiatorgroup": 2},
+			extentDisk:  "zvol/tank/k8s/pvc-1",
+		}
+		if modify != nil {
+			modify(l)
+		}
+		return l
+	}
+
+	tests := []struct {
+		name      string
+		leftovers *leftovers
+		wantErr   string
+	}{
+		{name: "nothing left behind"},
+		{name: "everything left behind", leftovers: complete(nil)},
+		{
+			name:      "zvol of another size",
+			leftovers: complete(func(l *leftovers) { l.zVolSize = 2 << 30 }),
+			wantErr:   "existing zvol k8s/pvc-1 has 2147483648 bytes instead of the requested 1073741824",
+		},
+		{
+			name:      "target group with another portal group",
+			leftovers: complete(func(l *leftovers) { l.targetGroup["iscsi_target_portalgroup"] = 3 }),
+			wantErr:   "portal group 3 instead of 1",
+		},
+		{
+			name:      "target group with another initiator group",
+			leftovers: complete(func(l *leftovers) { l.targetGroup["iscsi_target_initiatorgroup"] = 4 }),
+			wantErr:   "initiator group 4 instead of 2",
+		},
+		{
+			name: "target group with an auth group",
+			leftovers: complete(func(l *leftovers) {
+				l.targetGroup["iscsi_target_authgroup"] = 5
+				l.targetGroup["iscsi_target_authtype"] = freenasChapAuthType
+			}),
+			wantErr: "auth group 5 instead of 0",
+		},
+		{
+			name:      "extent of another disk",
+			leftovers: complete(func(l *leftovers) { l.extentDisk = "zvol/tank/k8s/pvc-2" }),
+			wantErr:   "extent pvc-1 already exists for a different disk",
+		},
+		{
+			name:      "extent mapped as another lun",
+			leftovers: complete(func(l *leftovers) { l.lunID = 7 }),
+			wantErr:   "as lun 7 instead of 0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+
+			if l := tt.leftovers; l != nil {
+				if err := server.AddZVol("tank/k8s/pvc-1", l.zVolSize); err != nil {
+					t.Fatal(err)
+				}
+				if err := server.AddZVol("tank/k8s/pvc-2", l.zVolSize); err != nil {
+					t.Fatal(err)
+				}
+				targetID := server.Add(freenas_fake.Targets, freenas_fake.Object{"iscsi_target_name": "pvc-1"})
+				l.targetGroup["iscsi_target"] = targetID
+				server.Add(freenas_fake.TargetGroups, l.targetGroup)
+				extentID := server.Add(freenas_fake.Extents, freenas_fake.Object{
+					"iscsi_target_extent_name": "pvc-1",
+					"iscsi_target_extent_type": defaultExtentType,
+					"iscsi_target_extent_disk": l.extentDisk,
+				})
+				server.Add(freenas_fake.TargetToExtents, freenas_fake.Object{"iscsi_target": targetID, "iscsi_extent": extentID, "iscsi_lunid": l.lunID})
+			}
+
+			claim := testClaim("claim-1", "pvc-1", nil)
+			pv, err := p.Provision(controller.VolumeOptions{
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:                        "pvc-1",
+				PVC:                           claim,
+				Parameters:                    iscsiParameters(nil),
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Provision() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Provision() error = %v", err)
+			}
+
+			for _, kind := range []string{freenas_fake.Targets, freenas_fake.TargetGroups, freenas_fake.Extents, freenas_fake.TargetToExtents} {
+				want := 1
+				if tt.leftovers != nil {
+					want = 0
+				}
+				if creates := server.Requests(http.MethodPost, "/api/v1.0/"+kind+"/"); creates != want {
+					t.Errorf("Provision() created %d %s, want %d", creates, kind, want)
+				}
+				if objects := server.Objects(kind); len(objects) != 1 {
+					t.Errorf("%s = %v, want exactly one", kind, objects)
+				}
+			}
+			if pv.Annotations[zVolNameAnnotation] != "k8s/pvc-1" {
+				t.Errorf("Provision() annotations = %v, want zvol k8s/pvc-1", pv.Annotations)
+			}
+		})
+	}
+}
+
+func TestProvisionAdoptsClone(t *testing.T) {
+	tests := []struct {
+		name          string
+		promoteClones bool
+	}{
+		{name: "unpromoted"},
+		{name: "promoted", promoteClones: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+
+			parameters := iscsiParameters(map[string]string{promoteClonesParam: strconv.FormatBool(tt.promoteClones)})
+			provisionTestVolume(t, p, testClaim("src", "pvc-src", nil), parameters)
+
+			// an interrupted Provision of pvc-dst cloned the zvol already
+			origin := "tank/k8s/pvc-src@clone-pvc-dst"
+			err := server.AddSnapshot(origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = server.Client().Storage().Snapshot().Clone(context.Background(), &snapshot.Snapshot{Fullname: &origin}, "tank/k8s/pvc-dst")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			provisionTestVolume(t, p, testClaim("dst", "pvc-dst", &v1.TypedLocalObjectReference{Kind: claimKind, Name: "src"}), parameters)
+
+			if clones := server.Requests(http.MethodPost, "/api/v1.0/storage/snapshot/"+origin+"/clone/"); clones != 1 {
+				t.Errorf("cloned the snapshot %d times, want the leftover clone adopted", clones)
+			}
+			pv, err := p.Kubernetes.CoreV1().PersistentVolumes().Get("pvc-dst", v12.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pv.Annotations[cloneOriginAnnotation] != origin {
+				t.Errorf("clone origin annotation = %q, want %q", pv.Annotations[cloneOriginAnnotation], origin)
+			}
+			if promoted := pv.Annotations[clonePromotedAnnotation] == "true"; promoted != tt.promoteClones {
+				t.Errorf("clone promoted annotation = %v, want %v", promoted, tt.promoteClones)
+			}
+
+			// the annotations let Delete untangle the adopted clone
+			deleteTestVolume(t, p, "pvc-src")
+			deleteTestVolume(t, p, "pvc-dst")
+			if _, ok := server.Dataset("tank/k8s/pvc-dst"); ok {
+				t.Error("zvol tank/k8s/pvc-dst was not deleted")
+			}
+			if snapshots := server.Snapshots(); len(snapshots) != 0 {
+				t.Errorf("snapshots = %v, want none", snapshots)
+			}
+		})
+	}
+}
+
+func TestProvisionNFSAdoptsDataset(t *testing.T) {
+	tests := []struct {
+		name string
+		// quota is the quota of the dataset left behind, none if zero
+		quota   int
+		wantErr string
+	}{
+		{name: "nothing left behind"},
+		{name: "dataset left behind", quota: 1 << 30},
+		{
+			name:    "dataset with another quota",
+			quota:   2 << 30,
+			wantErr: "existing dataset tank/k8s/pvc-1 has a quota of 2147483648 bytes instead of the requested 1073741824",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+
+			if tt.quota != 0 {
+				pool, name := "tank", "k8s/pvc-1"
+				_, err := server.Client().Storage().Dataset().Create(context.Background(), &dataset.Dataset{Pool: &pool}, &dataset.Dataset{Name: &name, Quota: &tt.quota})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := p.Provision(controller.VolumeOptions{
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:                        "pvc-1",
+				PVC:                           testClaim("claim-1", "pvc-1", nil),
+				Parameters:                    nfsParameters(),
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Provision() error = %v, want %q", err, tt.wantErr)
+				}
+				if ds, ok := server.Dataset("tank/k8s/pvc-1"); !ok || ds.Quota != int64(tt.quota) {
+					t.Errorf("dataset tank/k8s/pvc-1 = %+v, want it left alone", ds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Provision() error = %v", err)
+			}
+
+			ds, ok := server.Dataset("tank/k8s/pvc-1")
+			if !ok || ds.Quota != 1<<30 {
+				t.Errorf("dataset tank/k8s/pvc-1 = %+v, want a quota of 1Gi", ds)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/auth"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	// freenas target auth types
+	freenasChapAuthType       = "CHAP"
+	freenasMutualChapAuthType = "CHAP Mutual"
+
+	// annotation keys
+	authIDAnnotation              = "authID"
+	chapSecretNameAnnotation      = "chapSecretName"
+	chapSecretNamespaceAnnotation = "chapSecretNamespace"
+
+	// iscsi chap secret keys
+	chapSecretType           = "kubernetes.io/iscsi-chap"
+	chapSessionUsernameKey   = "node.session.auth.username"
+	chapSessionPasswordKey   = "node.session.auth.password"
+	chapSessionUsernameInKey = "node.session.auth.username_in"
+	chapSessionPasswordInKey = "node.session.auth.password_in"
+
+	// freenas requires chap secrets of 12 to 16 characters
+	chapSecretLength  = 16
+	chapSecretCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// chapAuth is the freenas auth group and kubernetes secret a target is
+// protected with.
+type chapAuth struct {
+	authType  string
+	tag       int
+	secretRef *v1.SecretReference
+	// auth is only set for per volume credentials, which are owned by the volume
+	auth *auth.Auth
+}
+
+// createChapAuth creates or looks up the chap credentials for a new volume.
+// It returns nil when the storage class does not require authentication.
+func (p *Freenas) createChapAuth(ctx context.Context, tx *transaction, options controller.VolumeOptions, config *Config) (*chapAuth, error) {
+	if config.AuthType == "" {
+		return nil, nil
+	}
+
+	if config.SharedChap {
+		return p.sharedChapAuth(ctx, config)
+	}
+
+	return p.perVolumeChapAuth(ctx, tx, options, config)
+}
+
+func (p *Freenas) perVolumeChapAuth(ctx context.Context, tx *transaction, options controller.VolumeOptions, config *Config) (*chapAuth, error) {
+	// serialise tag allocation so concurrent provisions do not pick the same tag
+	p.authTagMu.Lock()
+	defer p.authTagMu.Unlock()
+
+	a, err := p.findAuth(ctx, options.PVName)
+	if err != nil {
+		return nil, err
+	}
+
+	if a == nil {
+		a, err = p.createPerVolumeAuth(ctx, options.PVName, config.AuthType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	credentials := a
+	tx.add(fmt.Sprintf("iscsi auth credentials %d", *a.ID), func() error {
+		return p.Freenas.ISCSI().Auth().Delete(ctx, a)
+	})
+
+	namespace := config.ChapSecretNamespace
+	if namespace == "" {
+		namespace = options.PVC.GetNamespace()
+	}
+	secretRef := &v1.SecretReference{
+		Name:      fmt.Sprintf("%s-chap", options.PVName),
+		Namespace: namespace,
+	}
+
+	err = p.writeChapSecret(secretRef, credentials)
+	if err != nil {
+		return nil, err
+	}
+	tx.add(fmt.Sprintf("chap secret %s/%s", secretRef.Namespace, secretRef.Name), func() error {
+		return p.Kubernetes.CoreV1().Secrets(secretRef.Namespace).Delete(secretRef.Name, nil)
+	})
+
+	return &chapAuth{
+		authType:  config.AuthType,
+		tag:       *a.IscsiTargetAuthTag,
+		secretRef: secretRef,
+		auth:      a,
+	}, nil
+}
+
+func (p *Freenas) createPerVolumeAuth(ctx context.Context, user, authType string) (*auth.Auth, error) {
+	credentials, err := newChapCredentials(user, authType)
+	if err != nil {
+		return nil, err
+	}
+
+	auths, err := p.Freenas.ISCSI().Auth().List(ctx, rest.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing iscsi auth credentials")
+	}
+
+	tag := 1
+	for _, a := range auths {
+		if a.IscsiTargetAuthTag != nil && *a.IscsiTargetAuthTag >= tag {
+			tag = *a.IscsiTargetAuthTag + 1
+		}
+	}
+	credentials.IscsiTargetAuthTag = &tag
+
+	a, err := p.Freenas.ISCSI().Auth().Create(ctx, credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating iscsi auth credentials")
+	}
+
+	// fill in the secrets in case the response omits them
+	a.IscsiTargetAuthUser = credentials.IscsiTargetAuthUser
+	a.IscsiTargetAuthSecret = credentials.IscsiTargetAuthSecret
+	a.IscsiTargetAuthPeeruser = credentials.IscsiTargetAuthPeeruser
+	a.IscsiTargetAuthPeersecret = credentials.IscsiTargetAuthPeersecret
+
+	return a, nil
+}
+
+func (p *Freenas) sharedChapAuth(ctx context.Context, config *Config) (*chapAuth, error) {
+	secretRef := &v1.SecretReference{
+		Name:      config.ChapSecretName,
+		Namespace: config.ChapSecretNamespace,
+	}
+	sharedAuth := &chapAuth{
+		authType:  config.AuthType,
+		tag:       config.AuthGroup,
+		secretRef: secretRef,
+	}
+
+	secret, err := p.Kubernetes.CoreV1().Secrets(secretRef.Namespace).Get(secretRef.Name, v12.GetOptions{})
+	secretExists := err == nil
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, errors.Wrap(err, "error getting shared chap secret")
+	}
+
+	p.authTagMu.Lock()
+	defer p.authTagMu.Unlock()
+
+	credentials, err := p.findAuthGroup(ctx, config.AuthGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	if secretExists {
+		if credentials != nil {
+			return sharedAuth, nil
+		}
+
+		// the auth group was deleted on FreeNAS, recreate it with the
+		// credentials the nodes already log in with
+		credentials, err = secretChapCredentials(secret)
+		if err != nil {
+			return nil, err
+		}
+		credentials.IscsiTargetAuthTag = &config.AuthGroup
+
+		_, err = p.Freenas.ISCSI().Auth().Create(ctx, credentials)
+		if err != nil {
+			return nil, errors.Wrap(err, "error recreating iscsi auth credentials")
+		}
+
+		return sharedAuth, nil
+	}
+
+	// the secret is missing, reuse the credentials of an existing auth group or create it
+	if credentials == nil {
+		credentials, err = newChapCredentials(config.ChapSecretName, config.AuthType)
+		if err != nil {
+			return nil, err
+		}
+		credentials.IscsiTargetAuthTag = &config.AuthGroup
+
+		_, err = p.Freenas.ISCSI().Auth().Create(ctx, credentials)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating iscsi auth credentials")
+		}
+	}
+
+	err = p.writeChapSecret(secretRef, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return sharedAuth, nil
+}
+
+// secretChapCredentials reads the credentials of a chap secret.
+func secretChapCredentials(secret *v1.Secret) (*auth.Auth, error) {
+	user, ok := secret.Data[chapSessionUsernameKey]
+	if !ok {
+		return nil, fmt.Errorf("chap secret %s/%s is missing key %s", secret.Namespace, secret.Name, chapSessionUsernameKey)
+	}
+
+	password, ok := secret.Data[chapSessionPasswordKey]
+	if !ok {
+		return nil, fmt.Errorf("chap secret %s/%s is missing key %s", secret.Namespace, secret.Name, chapSessionPasswordKey)
+	}
+
+	userString, passwordString := string(user), string(password)
+	credentials := &auth.Auth{
+		IscsiTargetAuthUser:   &userString,
+		IscsiTargetAuthSecret: &passwordString,
+	}
+
+	peerUser, okUser := secret.Data[chapSessionUsernameInKey]
+	peerPassword, okPassword := secret.Data[chapSessionPasswordInKey]
+	if okUser && okPassword {
+		peerUserString, peerPasswordString := string(peerUser), string(peerPassword)
+		credentials.IscsiTargetAuthPeeruser = &peerUserString
+		credentials.IscsiTargetAuthPeersecret = &peerPasswordString
+	}
+
+	return credentials, nil
+}
+
+func (p *Freenas) writeChapSecret(secretRef *v1.SecretReference, credentials *auth.Auth) error {
+	data := map[string][]byte{
+		chapSessionUsernameKey: []byte(*credentials.IscsiTargetAuthUser),
+		chapSessionPasswordKey: []byte(*credentials.IscsiTargetAuthSecret),
+	}
+	if credentials.IscsiTargetAuthPeeruser != nil && credentials.IscsiTargetAuthPeersecret != nil {
+		data[chapSessionUsernameInKey] = []byte(*credentials.IscsiTargetAuthPeeruser)
+		data[chapSessionPasswordInKey] = []byte(*credentials.IscsiTargetAuthPeersecret)
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: v12.ObjectMeta{
+			Name:      secretRef.Name,
+			Namespace: secretRef.Namespace,
+		},
+		Type: chapSecretType,
+		Data: data,
+	}
+
+	_, err := p.Kubernetes.CoreV1().Secrets(secretRef.Namespace).Create(secret)
+	if apierrors.IsAlreadyExists(err) {
+		// left behind by an earlier attempt, overwrite it with the current credentials
+		_, err = p.Kubernetes.CoreV1().Secrets(secretRef.Namespace).Update(secret)
+	}
+	if err != nil {
+		return errors.Wrap(err, "error writing chap secret")
+	}
+
+	return nil
+}
+
+// deleteChapAuth removes the per volume credentials recorded in the volume
+// annotations, if any.
+func (p *Freenas) deleteChapAuth(ctx context.Context, volume *v1.PersistentVolume) error {
+	authIDString, ok := volume.Annotations[authIDAnnotation]
+	if !ok {
+		return nil
+	}
+
+	authID, err := strconv.Atoi(authIDString)
+	if err != nil {
+		return errors.Wrapf(err, "error converting parameter %s", authIDAnnotation)
+	}
+
+	err = p.Freenas.ISCSI().Auth().Delete(ctx, &auth.Auth{
+		ID: &authID,
+	})
+	if err != nil && !rest.IsNotFound(err) {
+		return errors.Wrap(err, "error deleting iscsi auth credentials")
+	}
+
+	secretName, ok := volume.Annotations[chapSecretNameAnnotation]
+	if !ok {
+		return fmt.Errorf("missing required volume annotation %s", chapSecretNameAnnotation)
+	}
+
+	secretNamespace, ok := volume.Annotations[chapSecretNamespaceAnnotation]
+	if !ok {
+		return fmt.Errorf("missing required volume annotation %s", chapSecretNamespaceAnnotation)
+	}
+
+	err = p.Kubernetes.CoreV1().Secrets(secretNamespace).Delete(secretName, nil)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "error deleting chap secret")
+	}
+
+	return nil
+}
+
+func (c *chapAuth) annotate(annotations map[string]string) {
+	if c == nil || c.auth == nil {
+		return
+	}
+
+	annotations[authIDAnnotation] = strconv.Itoa(*c.auth.ID)
+	annotations[chapSecretNameAnnotation] = c.secretRef.Name
+	annotations[chapSecretNamespaceAnnotation] = c.secretRef.Namespace
+}
+
+func newChapCredentials(user, authType string) (*auth.Auth, error) {
+	secret, err := randomString(chapSecretLength)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating chap secret")
+	}
+
+	credentials := &auth.Auth{
+		IscsiTargetAuthUser:   &user,
+		IscsiTargetAuthSecret: &secret,
+	}
+
+	if authType == freenasMutualChapAuthType {
+		peerUser := fmt.Sprintf("%s-peer", user)
+		peerSecret, err := randomString(chapSecretLength)
+		if err != nil {
+			return nil, errors.Wrap(err, "error generating chap peer secret")
+		}
+		credentials.IscsiTargetAuthPeeruser = &peerUser
+		credentials.IscsiTargetAuthPeersecret = &peerSecret
+	}
+
+	return credentials, nil
+}
+
+func randomString(length int) (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(chapSecretCharset)))
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(chapSecretCharset[n.Int64()])
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,97 @@
+package provisioner
+
+import (
+	"context"
+	freenas_fake "github.com/jakekeeys/freenas-provisioner/pkg/freenas/fake"
+	v1 "k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"testing"
+)
+
+func TestSharedChapAuth(t *testing.T) {
+	config := iscsiConfig(func(c *Config) {
+		c.AuthType = freenasMutualChapAuthType
+		c.SharedChap = true
+		c.AuthGroup = 5
+		c.ChapSecretName = "freenas-chap"
+		c.ChapSecretNamespace = "kube-system"
+	})
+	secret := &v1.Secret{
+		ObjectMeta: v12.ObjectMeta{Name: "freenas-chap", Namespace: "kube-system"},
+		Type:       chapSecretType,
+		Data: map[string][]byte{
+			chapSessionUsernameKey:   []byte("secret-user"),
+			chapSessionPasswordKey:   []byte("secret-password"),
+			chapSessionUsernameInKey: []byte("secret-peer"),
+			chapSessionPasswordInKey: []byte("secret-peer-password"),
+		},
+	}
+	group := freenas_fake.Object{
+		"iscsi_target_auth_tag":        float64(5),
+		"iscsi_target_auth_user":       "group-user",
+		"iscsi_target_auth_secret":     "group-password",
+		"iscsi_target_auth_peeruser":   "group-peer",
+		"iscsi_target_auth_peersecret": "group-peer-password",
+	}
+
+	tests := []struct {
+		name     string
+		secret   bool
+		group    bool
+		wantUser string
+		// wantUsers are the users of the credentials on FreeNAS
+		wantUsers []string
+	}{
+		{name: "creates the auth group and the secret", wantUsers: []string{"freenas-chap"}, wantUser: "freenas-chap"},
+		{name: "writes the secret of an existing auth group", group: true, wantUsers: []string{"group-user"}, wantUser: "group-user"},
+		{name: "uses the existing auth group and secret", secret: true, group: true, wantUsers: []string{"group-user"}, wantUser: "secret-user"},
+		{name: "recreates a missing auth group from the secret", secret: true, wantUsers: []string{"secret-user"}, wantUser: "secret-user"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tt.secret {
+				objects = append(objects, secret.DeepCopy())
+			}
+			p, server := newTestFreenas(t, objects...)
+			defer server.Close()
+			if tt.group {
+				server.Add(freenas_fake.AuthCredentials, group)
+			}
+
+			chap, err := p.sharedChapAuth(context.Background(), config)
+			if err != nil {
+				t.Fatalf("sharedChapAuth() error = %v", err)
+			}
+			if chap.tag != 5 || chap.secretRef.Name != "freenas-chap" || chap.secretRef.Namespace != "kube-system" || chap.auth != nil {
+				t.Errorf("sharedChapAuth() = %+v, want auth group 5 and secret kube-system/freenas-chap", chap)
+			}
+
+			auths := server.Objects(freenas_fake.AuthCredentials)
+			if len(auths) != len(tt.wantUsers) {
+				t.Fatalf("auth credentials = %v, want users %v", auths, tt.wantUsers)
+			}
+			for i, a := range auths {
+				if a["iscsi_target_auth_user"] != tt.wantUsers[i] || a["iscsi_target_auth_tag"] != float64(5) {
+					t.Errorf("auth credentials %d = %v, want user %s in auth group 5", i, a, tt.wantUsers[i])
+				}
+				if a["iscsi_target_auth_peeruser"] == nil {
+					t.Errorf("auth credentials %d = %v, want mutual chap", i, a)
+				}
+			}
+
+			written, err := p.Kubernetes.CoreV1().Secrets("kube-system").Get("freenas-chap", v12.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user := string(written.Data[chapSessionUsernameKey]); user != tt.wantUser {
+				t.Errorf("secret user = %s, want %s", user, tt.wantUser)
+			}
+			if _, ok := written.Data[chapSessionUsernameInKey]; !ok {
+				t.Errorf("secret = %v, want mutual chap credentials", written.Data)
+			}
+		})
+	}
+}
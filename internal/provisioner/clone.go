@@ -0,0 +1,364 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/snapshot"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/z_vol"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sort"
+	"strings"
+)
+
+const (
+	volumeSnapshotKind = "VolumeSnapshot"
+	claimKind          = "PersistentVolumeClaim"
+	// ZFSSnapshotKind is the data source kind of claims cloned straight from
+	// the zfs snapshot the data source is named after, as the csi driver
+	// restores its snapshots
+	ZFSSnapshotKind = "ZFSSnapshot"
+
+	// annotation keys
+	cloneOriginAnnotation   = "cloneOrigin"
+	clonePromotedAnnotation = "clonePromoted"
+
+	// event reasons
+	clonePromotedReason = "ClonePromoted"
+)
+
+// cloneSource is the zfs snapshot a new zvol is cloned from.
+type cloneSource struct {
+	fullname string
+	size     resource.Quantity
+	// temporary is set when the snapshot was taken just for this clone
+	temporary bool
+	// promoted is set once the clone has been promoted, which makes the
+	// source zvol depend on the clone instead
+	promoted bool
+}
+
+// annotate records where a zvol was cloned from, Delete needs it to untangle
+// the zvol from its source.
+func (s *cloneSource) annotate(annotations map[string]string) {
+	if s == nil {
+		return
+	}
+
+	annotations[cloneOriginAnnotation] = s.fullname
+	if s.promoted {
+		annotations[clonePromotedAnnotation] = "true"
+	}
+}
+
+// cloneSnapshotName returns the name of the snapshot taken to clone the
+// volume pvName from a claim.
+func cloneSnapshotName(pvName string) string {
+	return fmt.Sprintf("clone-%s", pvName)
+}
+
+// cloneZVol creates the zvol for a claim with a data source as a clone of the
+// source snapshot, growing it when the claim asks for more than the source.
+// Promoting the clone is left to promoteClone.
+func (p *Freenas) cloneZVol(ctx context.Context, tx *transaction, options controller.VolumeOptions, rootDs *dataset.Dataset, zVolName string) (*z_vol.ZVol, *cloneSource, error) {
+	source, err := p.getCloneSource(ctx, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.undoCloneSnapshot(ctx, tx, source)
+
+	if !strings.HasPrefix(source.fullname, *rootDs.Pool+"/") {
+		return nil, nil, fmt.Errorf("clone source %s is not in pool %s", source.fullname, *rootDs.Pool)
+	}
+
+	fullZVolName := fmt.Sprintf("%s/%s", *rootDs.Pool, zVolName)
+	err = p.Freenas.Storage().Snapshot().Clone(ctx, &snapshot.Snapshot{Fullname: &source.fullname}, fullZVolName)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error cloning snapshot")
+	}
+
+	p.event(options.PVC, v1.EventTypeNormal, zVolCreatedReason, "Cloned zvol %s from snapshot %s", fullZVolName, source.fullname)
+
+	zVol := &z_vol.ZVol{Name: &zVolName}
+	tx.add(fmt.Sprintf("zvol %s", fullZVolName), func() error {
+		return p.Freenas.Storage().ZVol().Delete(ctx, rootDs, zVol)
+	})
+
+	volSize := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	if volSize.Cmp(source.size) > 0 {
+		zVolSize := fmt.Sprintf("%d KiB", volSize.Value()/1024)
+		_, err = p.Freenas.Storage().ZVol().Update(ctx, rootDs, &z_vol.ZVol{
+			Name:    &zVolName,
+			Volsize: &zVolSize,
+		})
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error resizing cloned zvol")
+		}
+	}
+
+	return zVol, source, nil
+}
+
+// adoptClone returns the source of zVol, a zvol left behind by an earlier
+// attempt to clone the volume pvName, or nil if the zvol is not a clone.
+func (p *Freenas) adoptClone(ctx context.Context, tx *transaction, zVol *z_vol.ZVol, pvName string) *cloneSource {
+	if zVol.Origin == nil || *zVol.Origin == "" {
+		return nil
+	}
+
+	source := &cloneSource{
+		fullname:  *zVol.Origin,
+		temporary: strings.HasSuffix(*zVol.Origin, "@"+cloneSnapshotName(pvName)),
+	}
+	p.undoCloneSnapshot(ctx, tx, source)
+
+	return source
+}
+
+// undoCloneSnapshot makes the rollback delete the snapshot of source if it
+// was taken just for the clone.
+func (p *Freenas) undoCloneSnapshot(ctx context.Context, tx *transaction, source *cloneSource) {
+	if !source.temporary {
+		return
+	}
+
+	tx.add(fmt.Sprintf("data source snapshot %s", source.fullname), func() error {
+		return p.Freenas.Storage().Snapshot().Delete(ctx, &snapshot.Snapshot{Fullname: &source.fullname})
+	})
+}
+
+// promoteClone promotes the cloned zvol fullZVolName when config asks for
+// it. It has to be the last step of provisioning: once promoted, the clone
+// owns the source snapshot and the rollback could no longer delete it.
+func (p *Freenas) promoteClone(ctx context.Context, config *Config, source *cloneSource, fullZVolName string) error {
+	if source == nil || !config.PromoteClones {
+		return nil
+	}
+
+	err := p.Freenas.Storage().Dataset().Promote(ctx, &dataset.Dataset{Name: &fullZVolName})
+	if err != nil {
+		return errors.Wrap(err, "error promoting cloned zvol")
+	}
+	source.promoted = true
+
+	return nil
+}
+
+func (p *Freenas) getCloneSource(ctx context.Context, options controller.VolumeOptions) (*cloneSource, error) {
+	dataSource := options.PVC.Spec.DataSource
+	namespace := options.PVC.GetNamespace()
+
+	switch dataSource.Kind {
+	case volumeSnapshotKind:
+		return p.volumeSnapshotCloneSource(namespace, dataSource.Name)
+	case claimKind:
+		return p.claimCloneSource(ctx, namespace, dataSource.Name, options.PVName)
+	case ZFSSnapshotKind:
+		return p.zfsSnapshotCloneSource(ctx, dataSource.Name)
+	default:
+		return nil, fmt.Errorf("unsupported data source kind %s", dataSource.Kind)
+	}
+}
+
+func (p *Freenas) volumeSnapshotCloneSource(namespace, name string) (*cloneSource, error) {
+	if p.Dynamic == nil {
+		return nil, fmt.Errorf("cloning from volume snapshots is not enabled")
+	}
+
+	volumeSnapshot, err := p.Dynamic.Resource(volumeSnapshotResource).Namespace(namespace).Get(name, v12.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting data source volume snapshot")
+	}
+
+	fullname, ok := volumeSnapshot.GetAnnotations()[zfsSnapshotAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("volume snapshot %s has no zfs snapshot", name)
+	}
+
+	ready, _, _ := unstructured.NestedBool(volumeSnapshot.Object, "status", "ready")
+	if !ready {
+		return nil, fmt.Errorf("volume snapshot %s is not ready", name)
+	}
+
+	source := &cloneSource{fullname: fullname}
+	if restoreSize, ok, _ := unstructured.NestedString(volumeSnapshot.Object, "status", "restoreSize"); ok {
+		source.size, err = resource.ParseQuantity(restoreSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing volume snapshot restore size")
+		}
+	}
+
+	return source, nil
+}
+
+func (p *Freenas) zfsSnapshotCloneSource(ctx context.Context, fullname string) (*cloneSource, error) {
+	size, err := SnapshotSize(ctx, p.Freenas, fullname)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cloneSource{
+		fullname: fullname,
+		size:     *resource.NewQuantity(size, resource.BinarySI),
+	}, nil
+}
+
+func (p *Freenas) claimCloneSource(ctx context.Context, namespace, name, pvName string) (*cloneSource, error) {
+	claim, err := p.Kubernetes.CoreV1().PersistentVolumeClaims(namespace).Get(name, v12.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting data source claim")
+	}
+
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("data source claim %s is not bound", name)
+	}
+
+	volume, err := p.Kubernetes.CoreV1().PersistentVolumes().Get(claim.Spec.VolumeName, v12.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting data source volume")
+	}
+
+	if !IsBlockVolume(volume) {
+		return nil, fmt.Errorf("data source volume %s is missing annotation %s", volume.Name, zVolNameAnnotation)
+	}
+
+	// a snapshot left behind by an earlier attempt is reused
+	fullname, err := SnapshotVolume(ctx, p.Freenas, volume, cloneSnapshotName(pvName))
+	if err != nil {
+		return nil, errors.Wrap(err, "error snapshotting data source volume")
+	}
+
+	return &cloneSource{
+		fullname:  fullname,
+		size:      volume.Spec.Capacity[v1.ResourceStorage],
+		temporary: true,
+	}, nil
+}
+
+// releaseClones untangles the zvol of volume from the zvols zfs ties it to so
+// that it can be destroyed. A promoted clone hands the source's snapshots
+// back and the unpromoted clones of the zvol are promoted to take its
+// snapshots over. It returns the volumes cloned from the zvol.
+func (p *Freenas) releaseClones(ctx context.Context, volume *v1.PersistentVolume, fullZVolName string) ([]*v1.PersistentVolume, error) {
+	if origin, ok := volume.Annotations[cloneOriginAnnotation]; ok && volume.Annotations[clonePromotedAnnotation] == "true" {
+		source := strings.SplitN(origin, "@", 2)[0]
+		err := p.promote(ctx, source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error promoting clone source %s", source)
+		}
+	}
+
+	volumes, err := p.Kubernetes.CoreV1().PersistentVolumes().List(v12.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing volumes")
+	}
+
+	var clones []*v1.PersistentVolume
+	for i := range volumes.Items {
+		clone := &volumes.Items[i]
+		if clone.Name == volume.Name || !strings.HasPrefix(clone.Annotations[cloneOriginAnnotation], fullZVolName+"@") {
+			continue
+		}
+
+		if clone.Annotations[clonePromotedAnnotation] != "true" {
+			cloneZVol, err := VolumeDataset(clone)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error promoting clone %s", clone.Name)
+			}
+
+			err = p.promote(ctx, cloneZVol)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error promoting clone %s", cloneZVol)
+			}
+			p.event(volume, v1.EventTypeNormal, clonePromotedReason, "Promoted clone %s so that zvol %s can be deleted", cloneZVol, fullZVolName)
+		}
+
+		clones = append(clones, clone)
+	}
+
+	return clones, nil
+}
+
+// forgetClones cleans up after the zvol of volume was destroyed: the snapshot
+// taken to clone it and the snapshots its clones took over are no longer
+// needed, and the clones no longer depend on anything.
+func (p *Freenas) forgetClones(ctx context.Context, volume *v1.PersistentVolume, clones []*v1.PersistentVolume) error {
+	if origin, ok := volume.Annotations[cloneOriginAnnotation]; ok && strings.HasSuffix(origin, "@"+cloneSnapshotName(volume.Name)) {
+		err := p.deleteSnapshot(ctx, origin)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, clone := range clones {
+		cloneZVol, err := VolumeDataset(clone)
+		if err != nil {
+			return err
+		}
+
+		snapshotName := strings.SplitN(clone.Annotations[cloneOriginAnnotation], "@", 2)[1]
+		err = p.deleteSnapshot(ctx, fmt.Sprintf("%s@%s", cloneZVol, snapshotName))
+		if err != nil {
+			return err
+		}
+
+		clone, err = p.Kubernetes.CoreV1().PersistentVolumes().Get(clone.Name, v12.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "error getting clone volume")
+		}
+		delete(clone.Annotations, cloneOriginAnnotation)
+		delete(clone.Annotations, clonePromotedAnnotation)
+		_, err = p.Kubernetes.CoreV1().PersistentVolumes().Update(clone)
+		if err != nil {
+			return errors.Wrap(err, "error updating clone volume")
+		}
+	}
+
+	return nil
+}
+
+// promote promotes the clone name. Clones that are gone or no longer clones,
+// e.g. because an earlier attempt promoted them, are left alone.
+func (p *Freenas) promote(ctx context.Context, name string) error {
+	err := p.Freenas.Storage().Dataset().Promote(ctx, &dataset.Dataset{Name: &name})
+	if rest.IsNotFound(err) || rest.IsValidation(err) {
+		glog.V(4).Infof("not promoting %s: %v", name, err)
+		return nil
+	}
+
+	return err
+}
+
+func (p *Freenas) deleteSnapshot(ctx context.Context, fullname string) error {
+	err := p.Freenas.Storage().Snapshot().Delete(ctx, &snapshot.Snapshot{Fullname: &fullname})
+	if err != nil && !rest.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting zfs snapshot %s", fullname)
+	}
+
+	return nil
+}
+
+// dependentClones returns the names of the volumes whose zvols are still
+// clones of the snapshot fullname.
+func dependentClones(volumes []*v1.PersistentVolume, fullname string) []string {
+	var clones []string
+	for _, volume := range volumes {
+		if volume.Annotations[cloneOriginAnnotation] == fullname && volume.Annotations[clonePromotedAnnotation] != "true" {
+			clones = append(clones, volume.Name)
+		}
+	}
+	sort.Strings(clones)
+
+	return clones
+}
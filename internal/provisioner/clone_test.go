@@ -0,0 +1,263 @@
+package provisioner
+
+import (
+	"fmt"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testClaim returns a bound claim for pvName of size 1Gi.
+func testClaim(name, pvName string, dataSource *v1.TypedLocalObjectReference) *v1.PersistentVolumeClaim {
+	class := "iscsi"
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: v12.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: v1.PersistentVolumeClaimSpec{
+			StorageClassName: &class,
+			AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			},
+			DataSource: dataSource,
+			VolumeName: pvName,
+		},
+		Status: v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+	}
+}
+
+// provisionTestVolume provisions pvName for claim and stores the volume and
+// the claim like the provisioning controller and the binder would.
+func provisionTestVolume(t *testing.T, p *Freenas, claim *v1.PersistentVolumeClaim, parameters map[string]string) {
+	_, err := p.Kubernetes.CoreV1().PersistentVolumeClaims(claim.Namespace).Create(claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pv, err := p.Provision(controller.VolumeOptions{
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:                        claim.Spec.VolumeName,
+		PVC:                           claim,
+		Parameters:                    parameters,
+	})
+	if err != nil {
+		t.Fatalf("Provision(%s) error = %v", claim.Spec.VolumeName, err)
+	}
+
+	// volumes are not namespaced
+	pv.Namespace = ""
+	_, err = p.Kubernetes.CoreV1().PersistentVolumes().Create(pv)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deleteTestVolume deletes pvName like the provisioning controller would.
+func deleteTestVolume(t *testing.T, p *Freenas, pvName string) {
+	pv, err := p.Kubernetes.CoreV1().PersistentVolumes().Get(pvName, v12.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Delete(pv)
+	if err != nil {
+		t.Fatalf("Delete(%s) error = %v", pvName, err)
+	}
+
+	err = p.Kubernetes.CoreV1().PersistentVolumes().Delete(pvName, &v12.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteClonedVolumes(t *testing.T) {
+	tests := []struct {
+		name          string
+		promoteClones bool
+		// deleteFirst is the volume deleted while the other one still exists
+		deleteFirst string
+		deleteLast  string
+	}{
+		{name: "source first", deleteFirst: "pvc-src", deleteLast: "pvc-dst"},
+		{name: "clone first", deleteFirst: "pvc-dst", deleteLast: "pvc-src"},
+		{name: "source first with promoted clones", promoteClones: true, deleteFirst: "pvc-src", deleteLast: "pvc-dst"},
+		{name: "clone first with promoted clones", promoteClones: true, deleteFirst: "pvc-dst", deleteLast: "pvc-src"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+
+			parameters := iscsiParameters(map[string]string{promoteClonesParam: strconv.FormatBool(tt.promoteClones)})
+			provisionTestVolume(t, p, testClaim("src", "pvc-src", nil), parameters)
+			provisionTestVolume(t, p, testClaim("dst", "pvc-dst", &v1.TypedLocalObjectReference{Kind: claimKind, Name: "src"}), parameters)
+
+			clone, ok := server.Dataset("tank/k8s/pvc-dst")
+			if !ok {
+				t.Fatal("clone zvol tank/k8s/pvc-dst was not created")
+			}
+			if want := "tank/k8s/pvc-src@clone-pvc-dst"; !tt.promoteClones && clone.Origin != want {
+				t.Fatalf("clone origin = %q, want %q", clone.Origin, want)
+			}
+
+			deleteTestVolume(t, p, tt.deleteFirst)
+
+			if _, ok := server.Dataset(fmt.Sprintf("tank/k8s/%s", tt.deleteFirst)); ok {
+				t.Errorf("zvol tank/k8s/%s was not deleted", tt.deleteFirst)
+			}
+			remaining, ok := server.Dataset(fmt.Sprintf("tank/k8s/%s", tt.deleteLast))
+			if !ok {
+				t.Fatalf("zvol tank/k8s/%s was deleted", tt.deleteLast)
+			}
+			if remaining.Origin != "" {
+				t.Errorf("zvol tank/k8s/%s is still a clone of %s", tt.deleteLast, remaining.Origin)
+			}
+			if snapshots := server.Snapshots(); len(snapshots) != 0 {
+				t.Errorf("snapshots = %v, want the clone snapshot deleted", snapshots)
+			}
+
+			pv, err := p.Kubernetes.CoreV1().PersistentVolumes().Get(tt.deleteLast, v12.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if origin, ok := pv.Annotations[cloneOriginAnnotation]; ok {
+				t.Errorf("volume %s still records clone origin %s", tt.deleteLast, origin)
+			}
+
+			deleteTestVolume(t, p, tt.deleteLast)
+
+			if _, ok := server.Dataset(fmt.Sprintf("tank/k8s/%s", tt.deleteLast)); ok {
+				t.Errorf("zvol tank/k8s/%s was not deleted", tt.deleteLast)
+			}
+			if snapshots := server.Snapshots(); len(snapshots) != 0 {
+				t.Errorf("snapshots = %v, want none", snapshots)
+			}
+		})
+	}
+}
+
+func TestProvisionClonedVolumeRollback(t *testing.T) {
+	tests := []struct {
+		name string
+		// failPath is the request that fails after the zvol was cloned
+		failPath string
+	}{
+		{name: "extent mapping fails", failPath: "/api/v1.0/services/iscsi/targettoextent/"},
+		{name: "promotion fails", failPath: "/api/v1.0/storage/dataset/tank/k8s/pvc-dst/promote/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+
+			parameters := iscsiParameters(map[string]string{promoteClonesParam: "true"})
+			provisionTestVolume(t, p, testClaim("src", "pvc-src", nil), parameters)
+
+			claim := testClaim("dst", "pvc-dst", &v1.TypedLocalObjectReference{Kind: claimKind, Name: "src"})
+			_, err := p.Kubernetes.CoreV1().PersistentVolumeClaims(claim.Namespace).Create(claim)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server.Fail(http.MethodPost, tt.failPath, http.StatusInternalServerError)
+			_, err = p.Provision(controller.VolumeOptions{
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:                        "pvc-dst",
+				PVC:                           claim,
+				Parameters:                    parameters,
+			})
+			if err == nil || !strings.Contains(err.Error(), "injected failure") {
+				t.Fatalf("Provision() error = %v, want the injected failure", err)
+			}
+			if strings.Contains(err.Error(), "error rolling back") {
+				t.Fatalf("Provision() rollback failed: %v", err)
+			}
+
+			source, ok := server.Dataset("tank/k8s/pvc-src")
+			if !ok {
+				t.Fatal("source zvol tank/k8s/pvc-src was deleted")
+			}
+			if source.Origin != "" {
+				t.Errorf("source zvol is a clone of %s, want it left intact", source.Origin)
+			}
+			if _, ok := server.Dataset("tank/k8s/pvc-dst"); ok {
+				t.Error("clone zvol tank/k8s/pvc-dst was not rolled back")
+			}
+			if snapshots := server.Snapshots(); len(snapshots) != 0 {
+				t.Errorf("snapshots = %v, want the clone snapshot rolled back", snapshots)
+			}
+		})
+	}
+}
+
+func TestProvisionReusesCloneSnapshot(t *testing.T) {
+	p, server := newTestFreenas(t)
+	defer server.Close()
+
+	parameters := iscsiParameters(nil)
+	provisionTestVolume(t, p, testClaim("src", "pvc-src", nil), parameters)
+
+	// an earlier attempt took the snapshot before it failed
+	err := server.AddSnapshot("tank/k8s/pvc-src@clone-pvc-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provisionTestVolume(t, p, testClaim("dst", "pvc-dst", &v1.TypedLocalObjectReference{Kind: claimKind, Name: "src"}), parameters)
+
+	clone, ok := server.Dataset("tank/k8s/pvc-dst")
+	if !ok {
+		t.Fatal("clone zvol tank/k8s/pvc-dst was not created")
+	}
+	if want := "tank/k8s/pvc-src@clone-pvc-dst"; clone.Origin != want {
+		t.Errorf("clone origin = %q, want %q", clone.Origin, want)
+	}
+	if creates := server.Requests(http.MethodPost, "/api/v1.0/storage/snapshot/"); creates != 0 {
+		t.Errorf("Provision() created %d snapshots, want the leftover reused", creates)
+	}
+}
+
+func TestDependentClones(t *testing.T) {
+	volume := func(name, origin, promoted string) *v1.PersistentVolume {
+		annotations := map[string]string{}
+		if origin != "" {
+			annotations[cloneOriginAnnotation] = origin
+		}
+		if promoted != "" {
+			annotations[clonePromotedAnnotation] = promoted
+		}
+		return &v1.PersistentVolume{ObjectMeta: v12.ObjectMeta{Name: name, Annotations: annotations}}
+	}
+
+	volumes := []*v1.PersistentVolume{
+		volume("pvc-src", "", ""),
+		volume("pvc-3", "tank/k8s/pvc-src@snapshot-1", ""),
+		volume("pvc-1", "tank/k8s/pvc-src@snapshot-1", ""),
+		volume("pvc-2", "tank/k8s/pvc-src@snapshot-1", "true"),
+		volume("pvc-4", "tank/k8s/pvc-src@snapshot-2", ""),
+	}
+
+	tests := []struct {
+		fullname string
+		want     []string
+	}{
+		{fullname: "tank/k8s/pvc-src@snapshot-1", want: []string{"pvc-1", "pvc-3"}},
+		{fullname: "tank/k8s/pvc-src@snapshot-2", want: []string{"pvc-4"}},
+		{fullname: "tank/k8s/pvc-src@snapshot-3", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fullname, func(t *testing.T) {
+			if got := dependentClones(volumes, tt.fullname); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dependentClones() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
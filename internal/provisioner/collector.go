@@ -0,0 +1,365 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/extent"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/z_vol"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// orphan kinds, in the order orphans are deleted
+	orphanExtent = "extent"
+	orphanTarget = "target"
+	orphanZVol   = "zvol"
+
+	// event reasons
+	orphanFoundReason        = "OrphanFound"
+	orphanDeletedReason      = "OrphanDeleted"
+	orphanDeleteFailedReason = "OrphanDeleteFailed"
+)
+
+var (
+	orphanKinds = []string{orphanExtent, orphanTarget, orphanZVol}
+
+	orphansGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "freenas_provisioner",
+			Name:      "orphans",
+			Help:      "Number of FreeNAS objects under a managed root dataset that no persistent volume references. Broken down by kind.",
+		},
+		[]string{"kind"},
+	)
+	orphansDeletedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "freenas_provisioner",
+			Name:      "orphans_deleted_total",
+			Help:      "Total number of orphaned FreeNAS objects deleted. Broken down by kind.",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(orphansGauge, orphansDeletedTotal)
+}
+
+// orphan is a FreeNAS object that looks like ours but is not referenced by
+// any persistent volume.
+type orphan struct {
+	kind   string
+	name   string
+	class  *storagev1.StorageClass
+	delete func() error
+}
+
+func (o *orphan) key() string {
+	return fmt.Sprintf("%s/%s", o.kind, o.name)
+}
+
+// Collector periodically looks for zvols, iscsi targets and extents under the
+// root datasets of our iscsi storage classes that no persistent volume
+// references, as left behind by interrupted provisions, manually deleted
+// volumes or the Retain reclaim policy. Orphans are reported as metrics and
+// events on their storage class and, when DeleteOrphans is set, deleted once
+// they have been orphaned for longer than GracePeriod.
+type Collector struct {
+	Kubernetes      kubernetes.Interface
+	Freenas         freenas.Interface
+	ProvisionerName string
+	Recorder        record.EventRecorder
+	Interval        time.Duration
+	DeleteOrphans   bool
+	GracePeriod     time.Duration
+	// CSIDriverName is the name of the csi driver, whose volumes live under
+	// the same root datasets and carry their references in their volume ids
+	CSIDriverName string
+
+	informers informers.SharedInformerFactory
+	volumes   corelisters.PersistentVolumeLister
+	classes   storagelisters.StorageClassLister
+	synced    []cache.InformerSynced
+	// firstSeen is when each current orphan was first found
+	firstSeen map[string]time.Time
+}
+
+func NewCollector(client kubernetes.Interface, freenas freenas.Interface, provisionerName string, recorder record.EventRecorder, factory informers.SharedInformerFactory) *Collector {
+	volumeInformer := factory.Core().V1().PersistentVolumes()
+	classInformer := factory.Storage().V1().StorageClasses()
+
+	return &Collector{
+		Kubernetes:      client,
+		Freenas:         freenas,
+		ProvisionerName: provisionerName,
+		Recorder:        recorder,
+		informers:       factory,
+		volumes:         volumeInformer.Lister(),
+		classes:         classInformer.Lister(),
+		synced: []cache.InformerSynced{
+			volumeInformer.Informer().HasSynced,
+			classInformer.Informer().HasSynced,
+		},
+		firstSeen: map[string]time.Time{},
+	}
+}
+
+func (c *Collector) Run(stopCh <-chan struct{}) {
+	c.informers.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.synced...) {
+		utilruntime.HandleError(fmt.Errorf("timed out waiting for orphan collector caches to sync"))
+		return
+	}
+
+	wait.Until(c.runOnce, c.Interval, stopCh)
+}
+
+func (c *Collector) runOnce() {
+	err := c.collect()
+	if err != nil {
+		glog.Errorf("error collecting orphans: %v", err)
+	}
+}
+
+func (c *Collector) collect() error {
+	ctx := context.Background()
+
+	orphans, err := c.findOrphans(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seen := map[string]time.Time{}
+	counts := map[string]int{}
+	for _, o := range orphans {
+		counts[o.kind]++
+
+		firstSeen, ok := c.firstSeen[o.key()]
+		if !ok {
+			firstSeen = now
+			glog.Warningf("found orphaned %s %s", o.kind, o.name)
+			c.event(o.class, v1.EventTypeWarning, orphanFoundReason, "%s %s is not referenced by any persistent volume", o.kind, o.name)
+		}
+		seen[o.key()] = firstSeen
+	}
+	c.firstSeen = seen
+
+	for _, kind := range orphanKinds {
+		orphansGauge.WithLabelValues(kind).Set(float64(counts[kind]))
+	}
+
+	if !c.DeleteOrphans {
+		return nil
+	}
+
+	// orphans are sorted so that extents and targets go before the zvols they use
+	for _, o := range orphans {
+		if now.Sub(c.firstSeen[o.key()]) < c.GracePeriod {
+			continue
+		}
+
+		err := o.delete()
+		if err != nil && !rest.IsNotFound(err) {
+			glog.Errorf("error deleting orphaned %s %s: %v", o.kind, o.name, err)
+			c.event(o.class, v1.EventTypeWarning, orphanDeleteFailedReason, "Error deleting orphaned %s %s: %v", o.kind, o.name, err)
+			continue
+		}
+
+		glog.Infof("deleted orphaned %s %s", o.kind, o.name)
+		c.event(o.class, v1.EventTypeNormal, orphanDeletedReason, "Deleted orphaned %s %s", o.kind, o.name)
+		orphansDeletedTotal.WithLabelValues(o.kind).Inc()
+		delete(c.firstSeen, o.key())
+	}
+
+	return nil
+}
+
+// findOrphans returns the orphaned extents, targets and zvols, in that order.
+func (c *Collector) findOrphans(ctx context.Context) ([]*orphan, error) {
+	classes, err := c.classes.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	volumes, err := c.volumes.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	// everything our volumes reference
+	extentIDs := sets.NewString()
+	targetIDs := sets.NewString()
+	zVols := sets.NewString()
+	for _, volume := range volumes {
+		annotations := volume.Annotations
+		if source := volume.Spec.CSI; source != nil && c.CSIDriverName != "" && source.Driver == c.CSIDriverName {
+			// its zvol would look orphaned, so nothing can be collected safely
+			csiVolume, err := ParseVolumeID(source.VolumeHandle)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading the references of volume %s", volume.Name)
+			}
+			annotations = csiVolume.Annotations
+		} else if annotations[provisionedByAnnotation] != c.ProvisionerName {
+			continue
+		}
+
+		if id, ok := annotations[extentIDAnnotation]; ok {
+			extentIDs.Insert(id)
+		}
+		if id, ok := annotations[targetIDAnnotation]; ok {
+			targetIDs.Insert(id)
+		}
+		if zVolName, ok := annotations[zVolNameAnnotation]; ok {
+			zVols.Insert(fmt.Sprintf("%s/%s", annotations[datasetPoolAnnotation], zVolName))
+		}
+	}
+
+	var extents []*extent.Extent
+	var targets []*target.Target
+	var extentOrphans, targetOrphans, zVolOrphans []*orphan
+	roots := sets.NewString()
+	for _, class := range classes {
+		if class.Provisioner != c.ProvisionerName {
+			continue
+		}
+
+		config, err := ParseConfig(class.Parameters)
+		if err != nil {
+			glog.Warningf("skipping storage class %s when collecting orphans: %v", class.Name, err)
+			continue
+		}
+		if config.Protocol != ISCSIProtocol || roots.Has(config.RootDatasetName) {
+			continue
+		}
+		roots.Insert(config.RootDatasetName)
+
+		rootDs, err := c.Freenas.Storage().Dataset().Get(ctx, &dataset.Dataset{Name: &config.RootDatasetName})
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting root dataset")
+		}
+
+		// the volumes of a class are the direct children of its root dataset
+		volumeNames := sets.NewString()
+		zVolPrefix := strings.TrimPrefix(*rootDs.Name+"/", *rootDs.Pool+"/")
+		zVolList, err := c.Freenas.Storage().ZVol().List(ctx, rootDs, rest.ListOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error listing zvols")
+		}
+		for _, zVol := range zVolList {
+			if zVol.Name == nil {
+				continue
+			}
+
+			zVolName := strings.TrimPrefix(*zVol.Name, *rootDs.Pool+"/")
+			pvName := strings.TrimPrefix(zVolName, zVolPrefix)
+			if !strings.HasPrefix(zVolName, zVolPrefix) || pvName == "" || strings.Contains(pvName, "/") {
+				continue
+			}
+			volumeNames.Insert(pvName)
+
+			fullZVolName := fmt.Sprintf("%s/%s", *rootDs.Pool, zVolName)
+			if zVols.Has(fullZVolName) {
+				continue
+			}
+			zVolOrphans = append(zVolOrphans, &orphan{
+				kind:  orphanZVol,
+				name:  fullZVolName,
+				class: class,
+				delete: func() error {
+					return c.Freenas.Storage().ZVol().Delete(ctx, rootDs, &z_vol.ZVol{Name: &zVolName})
+				},
+			})
+		}
+
+		if extents == nil {
+			extents, err = c.Freenas.ISCSI().Extent().List(ctx, rest.ListOptions{})
+			if err != nil {
+				return nil, errors.Wrap(err, "error listing iscsi extents")
+			}
+		}
+		diskPrefix := fmt.Sprintf("zvol/%s/", *rootDs.Name)
+		for _, ext := range extents {
+			if ext.ID == nil || ext.IscsiTargetExtentName == nil || ext.IscsiTargetExtentDisk == nil {
+				continue
+			}
+			pvName := strings.TrimPrefix(*ext.IscsiTargetExtentDisk, diskPrefix)
+			if !strings.HasPrefix(*ext.IscsiTargetExtentDisk, diskPrefix) || pvName == "" || strings.Contains(pvName, "/") {
+				continue
+			}
+			volumeNames.Insert(*ext.IscsiTargetExtentName)
+
+			if extentIDs.Has(strconv.Itoa(*ext.ID)) {
+				continue
+			}
+			ext := ext
+			extentOrphans = append(extentOrphans, &orphan{
+				kind:  orphanExtent,
+				name:  *ext.IscsiTargetExtentName,
+				class: class,
+				delete: func() error {
+					return c.Freenas.ISCSI().Extent().Delete(ctx, ext)
+				},
+			})
+		}
+
+		// targets carry nothing that ties them to a root dataset, only their
+		// name matching one of the class's zvols or extents marks them as ours
+		if targets == nil {
+			targets, err = c.Freenas.ISCSI().Target().List(ctx, rest.ListOptions{})
+			if err != nil {
+				return nil, errors.Wrap(err, "error listing iscsi targets")
+			}
+		}
+		for _, tgt := range targets {
+			if tgt.ID == nil || tgt.IscsiTargetName == nil || !volumeNames.Has(*tgt.IscsiTargetName) {
+				continue
+			}
+
+			if targetIDs.Has(strconv.Itoa(*tgt.ID)) {
+				continue
+			}
+			tgt := tgt
+			targetOrphans = append(targetOrphans, &orphan{
+				kind:  orphanTarget,
+				name:  *tgt.IscsiTargetName,
+				class: class,
+				delete: func() error {
+					return c.Freenas.ISCSI().Target().Delete(ctx, tgt)
+				},
+			})
+		}
+	}
+
+	orphans := append(extentOrphans, targetOrphans...)
+	return append(orphans, zVolOrphans...), nil
+}
+
+func (c *Collector) event(class *storagev1.StorageClass, eventType, reason, messageFmt string, args ...interface{}) {
+	if c.Recorder == nil {
+		return
+	}
+
+	c.Recorder.Eventf(class, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,155 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	freenas_fake "github.com/jakekeeys/freenas-provisioner/pkg/freenas/fake"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCollectorFindOrphans(t *testing.T) {
+	const (
+		provisionerName = "freenas.org/iscsi"
+		csiDriverName   = "freenas.csi.jakekeeys.github.com"
+	)
+
+	class := &storagev1.StorageClass{
+		ObjectMeta:  v12.ObjectMeta{Name: "iscsi"},
+		Provisioner: provisionerName,
+		Parameters:  iscsiParameters(nil),
+	}
+	// pvc-1 is provisioned by the provisioner, pvc-2 by the csi driver and
+	// pvc-3 by neither
+	provisioned := &v1.PersistentVolume{
+		ObjectMeta: v12.ObjectMeta{
+			Name: "pvc-1",
+			Annotations: map[string]string{
+				provisionedByAnnotation: provisionerName,
+				targetIDAnnotation:      "1",
+				extentIDAnnotation:      "1",
+				datasetPoolAnnotation:   "tank",
+				zVolNameAnnotation:      "k8s/pvc-1",
+			},
+		},
+	}
+	csiVolume := &v1.PersistentVolume{
+		ObjectMeta: v12.ObjectMeta{
+			Name:        "pvc-2",
+			Annotations: map[string]string{provisionedByAnnotation: csiDriverName},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       csiDriverName,
+					VolumeHandle: "iscsi:2:2:tank/k8s/pvc-2",
+				},
+			},
+		},
+	}
+	otherCSIVolume := csiVolume.DeepCopy()
+	otherCSIVolume.Spec.CSI.Driver = "other.csi.example.com"
+	malformedCSIVolume := csiVolume.DeepCopy()
+	malformedCSIVolume.Spec.CSI.VolumeHandle = "pvc-2"
+
+	tests := []struct {
+		name          string
+		volumes       []*v1.PersistentVolume
+		csiDriverName string
+		want          []string
+		wantErr       bool
+	}{
+		{
+			name:          "provisioner and csi volumes",
+			volumes:       []*v1.PersistentVolume{provisioned, csiVolume},
+			csiDriverName: csiDriverName,
+			want:          []string{"extent/pvc-3", "target/pvc-3", "zvol/tank/k8s/pvc-3"},
+		},
+		{
+			name:          "csi volumes of another driver",
+			volumes:       []*v1.PersistentVolume{provisioned, otherCSIVolume},
+			csiDriverName: csiDriverName,
+			want:          []string{"extent/pvc-2", "extent/pvc-3", "target/pvc-2", "target/pvc-3", "zvol/tank/k8s/pvc-2", "zvol/tank/k8s/pvc-3"},
+		},
+		{
+			name:    "csi volumes without a csi driver name",
+			volumes: []*v1.PersistentVolume{provisioned, csiVolume},
+			want:    []string{"extent/pvc-2", "extent/pvc-3", "target/pvc-2", "target/pvc-3", "zvol/tank/k8s/pvc-2", "zvol/tank/k8s/pvc-3"},
+		},
+		{
+			name:          "csi volume with a malformed handle",
+			volumes:       []*v1.PersistentVolume{provisioned, malformedCSIVolume},
+			csiDriverName: csiDriverName,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t, class)
+			defer server.Close()
+			for i := 1; i <= 3; i++ {
+				name := fmt.Sprintf("pvc-%d", i)
+				if err := server.AddZVol("tank/k8s/"+name, 1<<30); err != nil {
+					t.Fatal(err)
+				}
+				server.Add(freenas_fake.Targets, freenas_fake.Object{"iscsi_target_name": name})
+				server.Add(freenas_fake.Extents, freenas_fake.Object{
+					"iscsi_target_extent_name": name,
+					"iscsi_target_extent_type": defaultExtentType,
+					"iscsi_target_extent_disk": "zvol/tank/k8s/" + name,
+				})
+			}
+			for _, volume := range tt.volumes {
+				if _, err := p.Kubernetes.CoreV1().PersistentVolumes().Create(volume); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			factory := informers.NewSharedInformerFactory(p.Kubernetes, 0)
+			collector := NewCollector(p.Kubernetes, p.Freenas, provisionerName, nil, factory)
+			collector.CSIDriverName = tt.csiDriverName
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			factory.Start(stopCh)
+			if !cache.WaitForCacheSync(stopCh, collector.synced...) {
+				t.Fatal("caches did not sync")
+			}
+
+			orphans, err := collector.findOrphans(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("findOrphans() = %v, want an error", orphans)
+				}
+
+				collector.DeleteOrphans = true
+				if err := collector.collect(); err == nil {
+					t.Error("collect() succeeded, want an error")
+				}
+				for i := 1; i <= 3; i++ {
+					if _, ok := server.Dataset(fmt.Sprintf("tank/k8s/pvc-%d", i)); !ok {
+						t.Errorf("collect() deleted zvol tank/k8s/pvc-%d", i)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("findOrphans() error = %v", err)
+			}
+			got := make([]string, 0, len(orphans))
+			for _, o := range orphans {
+				got = append(got, o.key())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findOrphans() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package provisioner
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Config struct {
+	Protocol         string
+	RootDatasetName  string
+	PortalGroup      int
+	InitiatorGroup   int
+	ThinProvisioning bool
+	ExtentType       string
+	LunID            int
+	TargetPortal     string
+	TargetPortals    []string
+	InitiatorName    string
+	ISCSIInterface   string
+	FsType           string
+	NFSServer        string
+	NFSMaprootUser   string
+	NFSMaprootGroup  string
+	PromoteClones    bool
+	// PerVolumeInitiatorGroup restricts each volume to the nodes using it
+	// instead of the shared InitiatorGroup
+	PerVolumeInitiatorGroup bool
+	// AuthType is the freenas target auth type, empty when auth is disabled
+	AuthType            string
+	SharedChap          bool
+	AuthGroup           int
+	ChapSecretName      string
+	ChapSecretNamespace string
+}
+
+const (
+	// protocols
+	ISCSIProtocol = "iscsi"
+	NFSProtocol   = "nfs"
+
+	// auth types
+	noAuthType         = "none"
+	chapAuthType       = "chap"
+	mutualChapAuthType = "mutualChap"
+
+	// chap credential modes
+	perVolumeChapCredentials = "perVolume"
+	sharedChapCredentials    = "shared"
+
+	// parameter keys
+	protocolParam                = "protocol"
+	rootDatasetNameParam         = "rootDatasetName"
+	portalGroupParam             = "portalGroup"
+	initiatorGroupParam          = "initiatorGroup"
+	lunIDParam                   = "lunID"
+	thinProvisioningParam        = "thinProvisioning"
+	targetPortalParam            = "targetPortal"
+	targetPortalsParam           = "targetPortals"
+	initiatorNameParam           = "initiatorName"
+	nfsServerParam               = "nfsServer"
+	nfsMaprootUserParam          = "nfsMaprootUser"
+	nfsMaprootGroupParam         = "nfsMaprootGroup"
+	promoteClonesParam           = "promoteClones"
+	authTypeParam                = "authType"
+	chapCredentialsParam         = "chapCredentials"
+	authGroupParam               = "authGroup"
+	chapSecretNameParam          = "chapSecretName"
+	chapSecretNSParam            = "chapSecretNamespace"
+	perVolumeInitiatorGroupParam = "perVolumeInitiatorGroup"
+
+	// parameter defaults
+	defaultProtocol         = ISCSIProtocol
+	defaultExtentType       = "Disk"
+	defaultISCSIInterface   = "default"
+	defaultFsType           = "ext4"
+	defaultThinProvisioning = true
+	defaultInitiatorName    = "iqn.2001-04.com.kubernetes:storage"
+)
+
+// ParseConfig builds and validates a Config from storage class parameters.
+func ParseConfig(parameters map[string]string) (*Config, error) {
+	config := &Config{
+		Protocol:         defaultProtocol,
+		ExtentType:       defaultExtentType,
+		ISCSIInterface:   defaultISCSIInterface,
+		FsType:           defaultFsType,
+		ThinProvisioning: defaultThinProvisioning,
+		InitiatorName:    defaultInitiatorName,
+	}
+
+	// required params
+	rootDatasetName, ok := parameters[rootDatasetNameParam]
+	if !ok {
+		return nil, fmt.Errorf("missing required storage class parameter %s", rootDatasetNameParam)
+	}
+	config.RootDatasetName = rootDatasetName
+
+	if protocol, ok := parameters[protocolParam]; ok {
+		config.Protocol = protocol
+	}
+
+	var err error
+	switch config.Protocol {
+	case ISCSIProtocol:
+		err = parseISCSIConfig(config, parameters)
+	case NFSProtocol:
+		err = parseNFSConfig(config, parameters)
+	default:
+		err = fmt.Errorf("unsupported storage class parameter %s value %s", protocolParam, config.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func parseISCSIConfig(config *Config, parameters map[string]string) error {
+	portalGroup, err := intParam(parameters, portalGroupParam)
+	if err != nil {
+		return err
+	}
+	config.PortalGroup = portalGroup
+
+	if perVolumeInitiatorGroupString, ok := parameters[perVolumeInitiatorGroupParam]; ok {
+		perVolumeInitiatorGroup, err := strconv.ParseBool(perVolumeInitiatorGroupString)
+		if err != nil {
+			return errors.Wrapf(err, "error converting parameter %s", perVolumeInitiatorGroupParam)
+		}
+		config.PerVolumeInitiatorGroup = perVolumeInitiatorGroup
+	}
+
+	if !config.PerVolumeInitiatorGroup {
+		initiatorGroup, err := intParam(parameters, initiatorGroupParam)
+		if err != nil {
+			return err
+		}
+		config.InitiatorGroup = initiatorGroup
+	}
+
+	lunID, err := intParam(parameters, lunIDParam)
+	if err != nil {
+		return err
+	}
+	config.LunID = lunID
+
+	var targetPortals []string
+	if targetPortalsString, ok := parameters[targetPortalsParam]; ok {
+		for _, portal := range strings.Split(targetPortalsString, ",") {
+			if portal = strings.TrimSpace(portal); portal != "" {
+				targetPortals = append(targetPortals, portal)
+			}
+		}
+	}
+
+	// targetPortal may be left out when targetPortals lists the portals
+	targetPortal, ok := parameters[targetPortalParam]
+	if !ok {
+		if len(targetPortals) == 0 {
+			return fmt.Errorf("missing required storage class parameter %s or %s", targetPortalParam, targetPortalsParam)
+		}
+		targetPortal, targetPortals = targetPortals[0], targetPortals[1:]
+	}
+	config.TargetPortal = targetPortal
+
+	for _, portal := range targetPortals {
+		if portal != config.TargetPortal {
+			config.TargetPortals = append(config.TargetPortals, portal)
+		}
+	}
+
+	// optional params
+	if thinProvisioningString, ok := parameters[thinProvisioningParam]; ok {
+		thinProvisioning, err := strconv.ParseBool(thinProvisioningString)
+		if err != nil {
+			return errors.Wrapf(err, "error converting parameter %s", thinProvisioningParam)
+		}
+		config.ThinProvisioning = thinProvisioning
+	}
+
+	if initiatorName, ok := parameters[initiatorNameParam]; ok {
+		config.InitiatorName = initiatorName
+	}
+
+	if promoteClonesString, ok := parameters[promoteClonesParam]; ok {
+		promoteClones, err := strconv.ParseBool(promoteClonesString)
+		if err != nil {
+			return errors.Wrapf(err, "error converting parameter %s", promoteClonesParam)
+		}
+		config.PromoteClones = promoteClones
+	}
+
+	return parseAuthConfig(config, parameters)
+}
+
+func parseAuthConfig(config *Config, parameters map[string]string) error {
+	authType, ok := parameters[authTypeParam]
+	if !ok {
+		authType = noAuthType
+	}
+
+	switch authType {
+	case noAuthType:
+		return nil
+	case chapAuthType:
+		config.AuthType = freenasChapAuthType
+	case mutualChapAuthType:
+		config.AuthType = freenasMutualChapAuthType
+	default:
+		return fmt.Errorf("unsupported storage class parameter %s value %s", authTypeParam, authType)
+	}
+
+	if chapSecretNamespace, ok := parameters[chapSecretNSParam]; ok {
+		config.ChapSecretNamespace = chapSecretNamespace
+	}
+
+	chapCredentials, ok := parameters[chapCredentialsParam]
+	if !ok {
+		chapCredentials = perVolumeChapCredentials
+	}
+
+	switch chapCredentials {
+	case perVolumeChapCredentials:
+		return nil
+	case sharedChapCredentials:
+		config.SharedChap = true
+	default:
+		return fmt.Errorf("unsupported storage class parameter %s value %s", chapCredentialsParam, chapCredentials)
+	}
+
+	authGroup, err := intParam(parameters, authGroupParam)
+	if err != nil {
+		return err
+	}
+	config.AuthGroup = authGroup
+
+	chapSecretName, ok := parameters[chapSecretNameParam]
+	if !ok {
+		return fmt.Errorf("missing required storage class parameter %s", chapSecretNameParam)
+	}
+	config.ChapSecretName = chapSecretName
+
+	if config.ChapSecretNamespace == "" {
+		return fmt.Errorf("missing required storage class parameter %s", chapSecretNSParam)
+	}
+
+	return nil
+}
+
+func parseNFSConfig(config *Config, parameters map[string]string) error {
+	nfsServer, ok := parameters[nfsServerParam]
+	if !ok {
+		return fmt.Errorf("missing required storage class parameter %s", nfsServerParam)
+	}
+	config.NFSServer = nfsServer
+
+	// optional params
+	if nfsMaprootUser, ok := parameters[nfsMaprootUserParam]; ok {
+		config.NFSMaprootUser = nfsMaprootUser
+	}
+
+	if nfsMaprootGroup, ok := parameters[nfsMaprootGroupParam]; ok {
+		config.NFSMaprootGroup = nfsMaprootGroup
+	}
+
+	return nil
+}
+
+func intParam(parameters map[string]string, key string) (int, error) {
+	s, ok := parameters[key]
+	if !ok {
+		return 0, fmt.Errorf("missing required storage class parameter %s", key)
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error converting parameter %s", key)
+	}
+
+	return i, nil
+}
+
+// configCache holds the parsed config of every storage class seen so far,
+// keyed by class name. An entry is reparsed when the class parameters change.
+type configCache struct {
+	mu      sync.Mutex
+	entries map[string]*configCacheEntry
+}
+
+type configCacheEntry struct {
+	parameters map[string]string
+	config     *Config
+}
+
+func (c *configCache) get(className string, parameters map[string]string) (*Config, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[className]; ok && reflect.DeepEqual(entry.parameters, parameters) {
+		return entry.config, nil
+	}
+
+	config, err := ParseConfig(parameters)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid storage class %s", className)
+	}
+
+	if c.entries == nil {
+		c.entries = map[string]*configCacheEntry{}
+	}
+
+	copied := make(map[string]string, len(parameters))
+	for k, v := range parameters {
+		copied[k] = v
+	}
+	c.entries[className] = &configCacheEntry{
+		parameters: copied,
+		config:     config,
+	}
+
+	return config, nil
+}
@@ -0,0 +1,304 @@
+package provisioner
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func iscsiParameters(overrides map[string]string) map[string]string {
+	parameters := map[string]string{
+		rootDatasetNameParam: "tank/k8s",
+		portalGroupParam:     "1",
+		initiatorGroupParam:  "2",
+		lunIDParam:           "0",
+		targetPortalParam:    "10.0.0.1:3260",
+	}
+	for k, v := range overrides {
+		if v == "" {
+			delete(parameters, k)
+			continue
+		}
+		parameters[k] = v
+	}
+
+	return parameters
+}
+
+func nfsParameters() map[string]string {
+	return map[string]string{
+		protocolParam:        NFSProtocol,
+		rootDatasetNameParam: "tank/k8s",
+		nfsServerParam:       "10.0.0.1",
+	}
+}
+
+func iscsiConfig(modify func(*Config)) *Config {
+	config := &Config{
+		Protocol:         ISCSIProtocol,
+		RootDatasetName:  "tank/k8s",
+		PortalGroup:      1,
+		InitiatorGroup:   2,
+		ThinProvisioning: true,
+		ExtentType:       defaultExtentType,
+		TargetPortal:     "10.0.0.1:3260",
+		InitiatorName:    defaultInitiatorName,
+		ISCSIInterface:   defaultISCSIInterface,
+		FsType:           defaultFsType,
+	}
+	if modify != nil {
+		modify(config)
+	}
+
+	return config
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       *Config
+		wantErr    string
+	}{
+		{
+			name:       "iscsi defaults",
+			parameters: iscsiParameters(nil),
+			want:       iscsiConfig(nil),
+		},
+		{
+			name: "iscsi options",
+			parameters: iscsiParameters(map[string]string{
+				thinProvisioningParam: "false",
+				initiatorNameParam:    "iqn.2019-01.com.example:node",
+				promoteClonesParam:    "true",
+				lunIDParam:            "3",
+			}),
+			want: iscsiConfig(func(c *Config) {
+				c.ThinProvisioning = false
+				c.InitiatorName = "iqn.2019-01.com.example:node"
+				c.PromoteClones = true
+				c.LunID = 3
+			}),
+		},
+		{
+			name:       "missing root dataset",
+			parameters: iscsiParameters(map[string]string{rootDatasetNameParam: ""}),
+			wantErr:    "missing required storage class parameter rootDatasetName",
+		},
+		{
+			name:       "unsupported protocol",
+			parameters: iscsiParameters(map[string]string{protocolParam: "smb"}),
+			wantErr:    "unsupported storage class parameter protocol value smb",
+		},
+		{
+			name:       "missing portal group",
+			parameters: iscsiParameters(map[string]string{portalGroupParam: ""}),
+			wantErr:    "missing required storage class parameter portalGroup",
+		},
+		{
+			name:       "invalid lun id",
+			parameters: iscsiParameters(map[string]string{lunIDParam: "zero"}),
+			wantErr:    "error converting parameter lunID",
+		},
+		{
+			name:       "invalid thin provisioning",
+			parameters: iscsiParameters(map[string]string{thinProvisioningParam: "maybe"}),
+			wantErr:    "error converting parameter thinProvisioning",
+		},
+		{
+			name:       "missing target portal",
+			parameters: iscsiParameters(map[string]string{targetPortalParam: ""}),
+			wantErr:    "missing required storage class parameter targetPortal or targetPortals",
+		},
+		{
+			name: "target portals without target portal",
+			parameters: iscsiParameters(map[string]string{
+				targetPortalParam:  "",
+				targetPortalsParam: " 10.0.0.1:3260, 10.0.1.1:3260,,",
+			}),
+			want: iscsiConfig(func(c *Config) {
+				c.TargetPortals = []string{"10.0.1.1:3260"}
+			}),
+		},
+		{
+			name: "target portals repeating the target portal",
+			parameters: iscsiParameters(map[string]string{
+				targetPortalsParam: "10.0.1.1:3260,10.0.0.1:3260",
+			}),
+			want: iscsiConfig(func(c *Config) {
+				c.TargetPortals = []string{"10.0.1.1:3260"}
+			}),
+		},
+		{
+			name: "per volume initiator group needs no initiator group",
+			parameters: iscsiParameters(map[string]string{
+				perVolumeInitiatorGroupParam: "true",
+				initiatorGroupParam:          "",
+			}),
+			want: iscsiConfig(func(c *Config) {
+				c.PerVolumeInitiatorGroup = true
+				c.InitiatorGroup = 0
+			}),
+		},
+		{
+			name:       "missing initiator group",
+			parameters: iscsiParameters(map[string]string{initiatorGroupParam: ""}),
+			wantErr:    "missing required storage class parameter initiatorGroup",
+		},
+		{
+			name:       "per volume chap",
+			parameters: iscsiParameters(map[string]string{authTypeParam: chapAuthType}),
+			want: iscsiConfig(func(c *Config) {
+				c.AuthType = freenasChapAuthType
+			}),
+		},
+		{
+			name: "shared mutual chap",
+			parameters: iscsiParameters(map[string]string{
+				authTypeParam:        mutualChapAuthType,
+				chapCredentialsParam: sharedChapCredentials,
+				authGroupParam:       "4",
+				chapSecretNameParam:  "chap",
+				chapSecretNSParam:    "kube-system",
+			}),
+			want: iscsiConfig(func(c *Config) {
+				c.AuthType = freenasMutualChapAuthType
+				c.SharedChap = true
+				c.AuthGroup = 4
+				c.ChapSecretName = "chap"
+				c.ChapSecretNamespace = "kube-system"
+			}),
+		},
+		{
+			name: "shared chap without secret namespace",
+			parameters: iscsiParameters(map[string]string{
+				authTypeParam:        chapAuthType,
+				chapCredentialsParam: sharedChapCredentials,
+				authGroupParam:       "4",
+				chapSecretNameParam:  "chap",
+			}),
+			wantErr: "missing required storage class parameter chapSecretNamespace",
+		},
+		{
+			name: "shared chap without auth group",
+			parameters: iscsiParameters(map[string]string{
+				authTypeParam:        chapAuthType,
+				chapCredentialsParam: sharedChapCredentials,
+			}),
+			wantErr: "missing required storage class parameter authGroup",
+		},
+		{
+			name:       "unsupported auth type",
+			parameters: iscsiParameters(map[string]string{authTypeParam: "kerberos"}),
+			wantErr:    "unsupported storage class parameter authType value kerberos",
+		},
+		{
+			name: "unsupported chap credentials",
+			parameters: iscsiParameters(map[string]string{
+				authTypeParam:        chapAuthType,
+				chapCredentialsParam: "perNode",
+			}),
+			wantErr: "unsupported storage class parameter chapCredentials value perNode",
+		},
+		{
+			name: "nfs",
+			parameters: map[string]string{
+				protocolParam:        NFSProtocol,
+				rootDatasetNameParam: "tank/nfs",
+				nfsServerParam:       "10.0.0.1",
+				nfsMaprootUserParam:  "root",
+				nfsMaprootGroupParam: "wheel",
+			},
+			want: &Config{
+				Protocol:         NFSProtocol,
+				RootDatasetName:  "tank/nfs",
+				ThinProvisioning: true,
+				ExtentType:       defaultExtentType,
+				InitiatorName:    defaultInitiatorName,
+				ISCSIInterface:   defaultISCSIInterface,
+				FsType:           defaultFsType,
+				NFSServer:        "10.0.0.1",
+				NFSMaprootUser:   "root",
+				NFSMaprootGroup:  "wheel",
+			},
+		},
+		{
+			name: "nfs without server",
+			parameters: map[string]string{
+				protocolParam:        NFSProtocol,
+				rootDatasetNameParam: "tank/nfs",
+			},
+			wantErr: "missing required storage class parameter nfsServer",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseConfig(tt.parameters)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(config, tt.want) {
+				t.Errorf("ParseConfig() = %+v, want %+v", config, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigCache(t *testing.T) {
+	var cache configCache
+
+	parameters := iscsiParameters(nil)
+	first, err := cache.get("fast", parameters)
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+
+	second, err := cache.get("fast", iscsiParameters(nil))
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if first != second {
+		t.Errorf("get() reparsed unchanged parameters")
+	}
+
+	// the cache keeps its own copy of the parameters
+	parameters[lunIDParam] = "7"
+	third, err := cache.get("fast", iscsiParameters(nil))
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if third != first {
+		t.Errorf("get() was affected by changes to the caller's parameters")
+	}
+
+	changed, err := cache.get("fast", iscsiParameters(map[string]string{lunIDParam: "7"}))
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if changed == first || changed.LunID != 7 {
+		t.Errorf("get() = %+v, want the changed parameters parsed", changed)
+	}
+
+	other, err := cache.get("slow", iscsiParameters(nil))
+	if err != nil {
+		t.Fatalf("get() error = %v", err)
+	}
+	if other == changed {
+		t.Errorf("get() shared a config between classes")
+	}
+
+	_, err = cache.get("broken", iscsiParameters(map[string]string{portalGroupParam: ""}))
+	if err == nil || !strings.Contains(err.Error(), "invalid storage class broken") {
+		t.Errorf("get() error = %v, want the class name", err)
+	}
+	if _, ok := cache.entries["broken"]; ok {
+		t.Errorf("get() cached an invalid config")
+	}
+}
@@ -1,41 +1,39 @@
 package provisioner
 
 import (
+	"context"
 	"fmt"
-	"github.com/golang/glog"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/extent"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target_group"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target_to_extent"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/z_vol"
 	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
 	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Freenas struct {
 	Kubernetes kubernetes.Interface
+	Dynamic    dynamic.Interface
 	Freenas    freenas.Interface
-	Config     *Config
-}
+	Recorder   record.EventRecorder
 
-type Config struct {
-	RootDatasetName  string
-	PortalGroup      int
-	InitiatorGroup   int
-	ThinProvisioning bool
-	ExtentType       string
-	LunID            int
-	TargetPortal     string
-	InitiatorName    string
-	ISCSIInterface   string
-	FsType           string
+	configs   configCache
+	authTagMu sync.Mutex
 }
 
 const (
@@ -44,18 +42,118 @@ const (
 	targetIDAnnotation    = "targetID"
 	datasetPoolAnnotation = "datasetPool"
 	zVolNameAnnotation    = "zVolName"
+	datasetNameAnnotation = "datasetName"
+	nfsShareIDAnnotation  = "nfsShareID"
+
+	betaStorageClassAnnotation = "volume.beta.kubernetes.io/storage-class"
+
+	// event reasons
+	rolledBackReason         = "ProvisioningRolledBack"
+	rollbackFailedReason     = "ProvisioningRollbackFailed"
+	chapAuthReason           = "ISCSIAuthConfigured"
+	initiatorGroupReason     = "ISCSIInitiatorGroupConfigured"
+	zVolCreatedReason        = "ZVolCreated"
+	targetCreatedReason      = "ISCSITargetCreated"
+	targetGroupCreatedReason = "ISCSITargetGroupCreated"
+	extentCreatedReason      = "ISCSIExtentCreated"
+	extentMappedReason       = "ISCSIExtentMapped"
+	datasetCreatedReason     = "DatasetCreated"
+	nfsShareCreatedReason    = "NFSShareCreated"
+	extentDeletedReason      = "ISCSIExtentDeleted"
+	targetDeletedReason      = "ISCSITargetDeleted"
+	zVolDeletedReason        = "ZVolDeleted"
+	nfsShareDeletedReason    = "NFSShareDeleted"
+	datasetDeletedReason     = "DatasetDeleted"
 )
 
-func (p *Freenas) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
+func storageClassName(claim *v1.PersistentVolumeClaim) string {
+	if class, ok := claim.Annotations[betaStorageClassAnnotation]; ok {
+		return class
+	}
+
+	if claim.Spec.StorageClassName != nil {
+		return *claim.Spec.StorageClassName
+	}
+
+	return ""
+}
+
+func (p *Freenas) Provision(options controller.VolumeOptions) (pv *v1.PersistentVolume, err error) {
+	ctx := context.Background()
+	class := storageClassName(options.PVC)
+	defer func(start time.Time) { observeOperation(provisionOperation, class, start, err) }(time.Now())
+
+	config, err := p.configs.get(class, options.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &transaction{}
+	if config.Protocol == NFSProtocol {
+		pv, err = p.provisionNFS(ctx, tx, options, config)
+	} else {
+		pv, err = p.provisionISCSI(ctx, tx, options, config)
+	}
+	if err != nil {
+		return nil, p.rollback(tx, options.PVC, err)
+	}
+
+	return pv, nil
+}
+
+// rollback unwinds a failed Provision and reports the outcome as an event on
+// the claim. The returned error includes any rollback failures.
+func (p *Freenas) rollback(tx *transaction, claim *v1.PersistentVolumeClaim, err error) error {
+	undone := tx.descriptions()
+	if len(undone) == 0 {
+		return err
+	}
+
+	rollbackErr := tx.rollback()
+	rollbacksTotal.WithLabelValues(storageClassName(claim), outcome(rollbackErr)).Inc()
+	if rollbackErr != nil {
+		p.event(claim, v1.EventTypeWarning, rollbackFailedReason, "Rollback after failed provisioning left objects behind on FreeNAS: %v", rollbackErr)
+		return utilerrors.NewAggregate([]error{err, rollbackErr})
+	}
+
+	p.event(claim, v1.EventTypeNormal, rolledBackReason, "Rolled back %s after failed provisioning", strings.Join(undone, ", "))
+	return err
+}
+
+func (p *Freenas) event(object runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if p.Recorder == nil {
+		return
+	}
+
+	p.Recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+func (p *Freenas) provisionISCSI(ctx context.Context, tx *transaction, options controller.VolumeOptions, config *Config) (*v1.PersistentVolume, error) {
 	pvName := options.PVName
 	pvNamespace := options.PVC.GetObjectMeta().GetNamespace()
 
-	globalConfig, err := p.Freenas.ISCSI().GlobalConfiguration().Get()
+	chap, err := p.createChapAuth(ctx, tx, options, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating chap auth")
+	}
+	if chap != nil {
+		p.event(options.PVC, v1.EventTypeNormal, chapAuthReason, "Using iscsi %s auth group %d", chap.authType, chap.tag)
+	}
+
+	ig, err := p.createInitiatorGroup(ctx, tx, pvName, config)
+	if err != nil {
+		return nil, err
+	}
+	if ig != nil {
+		p.event(options.PVC, v1.EventTypeNormal, initiatorGroupReason, "Using iscsi initiator group %d", *ig.ID)
+	}
+
+	globalConfig, err := p.Freenas.ISCSI().GlobalConfiguration().Get(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "error getting global iscsi config")
 	}
 
-	rootDs, err := p.Freenas.Storage().Dataset().Get(&dataset.Dataset{Name: &p.Config.RootDatasetName})
+	rootDs, err := p.Freenas.Storage().Dataset().Get(ctx, &dataset.Dataset{Name: &config.RootDatasetName})
 	if err != nil {
 		return nil, errors.Wrap(err, "error getting root dataset")
 	}
@@ -64,113 +162,199 @@ func (p *Freenas) Provision(options controller.VolumeOptions) (*v1.PersistentVol
 	volSize := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
 	zVolSize := fmt.Sprintf("%d KiB", int(volSize.Value())/1024)
 	zVolName := strings.TrimPrefix(fmt.Sprintf("%s/%s", *rootDs.Name, pvName), *rootDs.Pool+"/")
-	zVol, err := p.Freenas.Storage().ZVol().Create(rootDs, &z_vol.ZVol{
-		Name:    &zVolName,
-		Volsize: &zVolSize,
-		Sparse:  &p.Config.ThinProvisioning,
-	})
+	zVol, err := p.findZVol(ctx, rootDs, zVolName, volSize.Value()/1024*1024, options.PVC.Spec.DataSource != nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating zvol")
+		return nil, err
+	}
+	var clone *cloneSource
+	if zVol == nil && options.PVC.Spec.DataSource != nil {
+		zVol, clone, err = p.cloneZVol(ctx, tx, options, rootDs, zVolName)
+		if err != nil {
+			return nil, errors.Wrap(err, "error cloning zvol")
+		}
+	} else {
+		if zVol == nil {
+			zVol, err = p.Freenas.Storage().ZVol().Create(ctx, rootDs, &z_vol.ZVol{
+				Name:    &zVolName,
+				Volsize: &zVolSize,
+				Sparse:  &config.ThinProvisioning,
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "error creating zvol")
+			}
+			p.event(options.PVC, v1.EventTypeNormal, zVolCreatedReason, "Created zvol %s/%s of %s", *rootDs.Pool, zVolName, zVolSize)
+		} else {
+			// Delete needs to know where an adopted clone came from
+			if options.PVC.Spec.DataSource != nil {
+				clone = p.adoptClone(ctx, tx, zVol, pvName)
+			}
+			p.event(options.PVC, v1.EventTypeNormal, zVolCreatedReason, "Adopted existing zvol %s/%s", *rootDs.Pool, zVolName)
+		}
+		tx.add(fmt.Sprintf("zvol %s", zVolName), func() error {
+			return p.Freenas.Storage().ZVol().Delete(ctx, rootDs, &z_vol.ZVol{Name: &zVolName})
+		})
 	}
 
 	// create target
-	tgt, err := p.Freenas.ISCSI().Target().Create(&target.Target{
-		IscsiTargetName: &pvName,
-	})
+	tgt, err := p.findTarget(ctx, pvName)
 	if err != nil {
-		if rollbackErr := p.Freenas.Storage().ZVol().Delete(rootDs, zVol); rollbackErr != nil {
-			glog.Warning("error rolling back zvol creation", rollbackErr)
+		return nil, err
+	}
+	if tgt == nil {
+		tgt, err = p.Freenas.ISCSI().Target().Create(ctx, &target.Target{
+			IscsiTargetName: &pvName,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating iscsi target")
 		}
-		return nil, errors.Wrap(err, "error creating iscsi target")
+		p.event(options.PVC, v1.EventTypeNormal, targetCreatedReason, "Created iscsi target %d %s", *tgt.ID, pvName)
+	} else {
+		p.event(options.PVC, v1.EventTypeNormal, targetCreatedReason, "Adopted existing iscsi target %d %s", *tgt.ID, pvName)
 	}
+	tx.add(fmt.Sprintf("iscsi target %d", *tgt.ID), func() error {
+		return p.Freenas.ISCSI().Target().Delete(ctx, tgt)
+	})
 
 	// create target group
-	_, err = p.Freenas.ISCSI().TargetGroup().Create(&target_group.TargetGroup{
+	wantTargetGroup := &target_group.TargetGroup{
 		IscsiTarget:               tgt.ID,
-		IscsiTargetPortalgroup:    &p.Config.PortalGroup,
-		IscsiTargetInitiatorgroup: p.Config.InitiatorGroup,
-	})
+		IscsiTargetPortalgroup:    &config.PortalGroup,
+		IscsiTargetInitiatorgroup: config.InitiatorGroup,
+	}
+	if ig != nil {
+		wantTargetGroup.IscsiTargetInitiatorgroup = *ig.ID
+	}
+	if chap != nil {
+		wantTargetGroup.IscsiTargetAuthgroup = chap.tag
+		wantTargetGroup.IscsiTargetAuthtype = &chap.authType
+	}
+	targetGroup, err := p.findTargetGroup(ctx, wantTargetGroup)
 	if err != nil {
-		if rollbackErr := p.Freenas.ISCSI().Target().Delete(tgt); rollbackErr != nil {
-			glog.Warning("error rolling back iscsi target creation", rollbackErr)
-		}
-		if rollbackErr := p.Freenas.Storage().ZVol().Delete(rootDs, zVol); rollbackErr != nil {
-			glog.Warning("error rolling back zvol creation", rollbackErr)
+		return nil, err
+	}
+	if targetGroup == nil {
+		targetGroup, err = p.Freenas.ISCSI().TargetGroup().Create(ctx, wantTargetGroup)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating iscsi target group")
 		}
-		return nil, errors.Wrap(err, "error creating iscsi target group")
+		p.event(options.PVC, v1.EventTypeNormal, targetGroupCreatedReason, "Created iscsi target group %d for target %d with portal group %d", *targetGroup.ID, *tgt.ID, config.PortalGroup)
 	}
+	tx.add(fmt.Sprintf("iscsi target group %d", *targetGroup.ID), func() error {
+		return p.Freenas.ISCSI().TargetGroup().Delete(ctx, targetGroup)
+	})
 
 	// create extent
 	extentDisk := fmt.Sprintf("zvol/%s/%s", *rootDs.Pool, *zVol.Name)
-	ext, err := p.Freenas.ISCSI().Extent().Create(&extent.Extent{
-		IscsiTargetExtentType: &p.Config.ExtentType,
-		IscsiTargetExtentName: &pvName,
-		IscsiTargetExtentDisk: &extentDisk,
-	})
+	ext, err := p.findExtent(ctx, pvName, extentDisk)
 	if err != nil {
-		if rollbackErr := p.Freenas.ISCSI().Target().Delete(tgt); rollbackErr != nil {
-			glog.Warning("error rolling back iscsi target creation", rollbackErr)
-		}
-		if rollbackErr := p.Freenas.Storage().ZVol().Delete(rootDs, zVol); rollbackErr != nil {
-			glog.Warning("error rolling back zvol creation", rollbackErr)
+		return nil, err
+	}
+	if ext == nil {
+		ext, err = p.Freenas.ISCSI().Extent().Create(ctx, &extent.Extent{
+			IscsiTargetExtentType: &config.ExtentType,
+			IscsiTargetExtentName: &pvName,
+			IscsiTargetExtentDisk: &extentDisk,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating iscsi extent")
 		}
-		return nil, errors.Wrap(err, "error creating iscsi extent")
+		p.event(options.PVC, v1.EventTypeNormal, extentCreatedReason, "Created iscsi extent %d %s for %s", *ext.ID, pvName, extentDisk)
+	} else {
+		p.event(options.PVC, v1.EventTypeNormal, extentCreatedReason, "Adopted existing iscsi extent %d %s for %s", *ext.ID, pvName, extentDisk)
 	}
+	tx.add(fmt.Sprintf("iscsi extent %d", *ext.ID), func() error {
+		return p.Freenas.ISCSI().Extent().Delete(ctx, ext)
+	})
 
 	// create target to extent
-	_, err = p.Freenas.ISCSI().TargetToExtent().Create(&target_to_extent.TargetToExtent{
-		IscsiTarget: tgt.ID,
-		IscsiExtent: ext.ID,
-		IscsiLunid:  p.Config.LunID,
-	})
+	tte, err := p.findTargetToExtent(ctx, *tgt.ID, *ext.ID, config.LunID)
 	if err != nil {
-		if rollbackErr := p.Freenas.ISCSI().Extent().Delete(ext); rollbackErr != nil {
-			glog.Warning("error rolling back iscsi extent creation", rollbackErr)
-		}
-		if rollbackErr := p.Freenas.ISCSI().Target().Delete(tgt); rollbackErr != nil {
-			glog.Warning("error rolling back iscsi target creation", rollbackErr)
-		}
-		if rollbackErr := p.Freenas.Storage().ZVol().Delete(rootDs, zVol); rollbackErr != nil {
-			glog.Warning("error rolling back zvol creation", rollbackErr)
+		return nil, err
+	}
+	if tte == nil {
+		tte, err = p.Freenas.ISCSI().TargetToExtent().Create(ctx, &target_to_extent.TargetToExtent{
+			IscsiTarget: tgt.ID,
+			IscsiExtent: ext.ID,
+			IscsiLunid:  config.LunID,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating iscsi target to extent")
 		}
-		return nil, errors.Wrap(err, "error creating iscsi target to extent")
+	}
+	p.event(options.PVC, v1.EventTypeNormal, extentMappedReason, "Mapped iscsi extent %d to target %d as lun %d (target to extent %d)", *ext.ID, *tgt.ID, config.LunID, *tte.ID)
+
+	// promote the clone last, the rollback cannot delete a promoted clone
+	err = p.promoteClone(ctx, config, clone, fmt.Sprintf("%s/%s", *rootDs.Pool, zVolName))
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{
+		extentIDAnnotation:    strconv.Itoa(*ext.ID),
+		targetIDAnnotation:    strconv.Itoa(*tgt.ID),
+		datasetPoolAnnotation: *rootDs.Pool,
+		zVolNameAnnotation:    *zVol.Name,
+	}
+	chap.annotate(annotations)
+	clone.annotate(annotations)
+	if ig != nil {
+		annotations[initiatorGroupIDAnnotation] = strconv.Itoa(*ig.ID)
+	}
+
+	iscsiSource := &v1.ISCSIPersistentVolumeSource{
+		TargetPortal:   config.TargetPortal,
+		Portals:        config.TargetPortals,
+		IQN:            fmt.Sprintf("%s:%s", *globalConfig.IscsiBasename, pvName),
+		Lun:            int32(config.LunID),
+		ISCSIInterface: config.ISCSIInterface,
+		FSType:         config.FsType,
+		InitiatorName:  &config.InitiatorName,
+	}
+	// nodes log in with their own iqn so the per volume initiator group can tell them apart
+	if ig != nil {
+		iscsiSource.InitiatorName = nil
+	}
+	if chap != nil {
+		iscsiSource.SessionCHAPAuth = true
+		iscsiSource.SecretRef = chap.secretRef
 	}
 
 	return &v1.PersistentVolume{
 		ObjectMeta: v12.ObjectMeta{
-			Name:      pvName,
-			Namespace: pvNamespace,
-			Annotations: map[string]string{
-				extentIDAnnotation:    strconv.Itoa(*ext.ID),
-				targetIDAnnotation:    strconv.Itoa(*tgt.ID),
-				datasetPoolAnnotation: *rootDs.Pool,
-				zVolNameAnnotation:    *zVol.Name,
-			},
+			Name:        pvName,
+			Namespace:   pvNamespace,
+			Annotations: annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
 			Capacity: v1.ResourceList{
 				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
-				ISCSI: &v1.ISCSIPersistentVolumeSource{
-					TargetPortal:   p.Config.TargetPortal,
-					IQN:            fmt.Sprintf("%s:%s", *globalConfig.IscsiBasename, pvName),
-					Lun:            int32(p.Config.LunID),
-					ISCSIInterface: p.Config.ISCSIInterface,
-					FSType:         p.Config.FsType,
-					InitiatorName:  &p.Config.InitiatorName,
-				},
+				ISCSI: iscsiSource,
 			},
 			AccessModes:                   options.PVC.Spec.AccessModes,
 			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
-			StorageClassName:              *options.PVC.Spec.StorageClassName,
+			StorageClassName:              storageClassName(options.PVC),
 			MountOptions:                  options.MountOptions,
 			VolumeMode:                    options.PVC.Spec.VolumeMode,
 		},
 	}, nil
 }
 
-func (p *Freenas) Delete(volume *v1.PersistentVolume) error {
+func (p *Freenas) Delete(volume *v1.PersistentVolume) (err error) {
+	ctx := context.Background()
+	defer func(start time.Time) {
+		observeOperation(deleteOperation, volume.Spec.StorageClassName, start, err)
+	}(time.Now())
+
+	if _, ok := volume.Annotations[nfsShareIDAnnotation]; ok {
+		return p.deleteNFS(ctx, volume)
+	}
+
+	return p.deleteISCSI(ctx, volume)
+}
+
+func (p *Freenas) deleteISCSI(ctx context.Context, volume *v1.PersistentVolume) error {
 	// delete extent
 	extentIDString, ok := volume.Annotations[extentIDAnnotation]
 	if !ok {
@@ -182,12 +366,15 @@ func (p *Freenas) Delete(volume *v1.PersistentVolume) error {
 		return errors.Wrapf(err, "error converting parameter %s", extentIDAnnotation)
 	}
 
-	err = p.Freenas.ISCSI().Extent().Delete(&extent.Extent{
+	err = p.Freenas.ISCSI().Extent().Delete(ctx, &extent.Extent{
 		ID: &extentID,
 	})
-	if err != nil {
+	if err != nil && !rest.IsNotFound(err) {
 		return errors.Wrap(err, "error deleting extent")
 	}
+	if err == nil {
+		p.event(volume, v1.EventTypeNormal, extentDeletedReason, "Deleted iscsi extent %d", extentID)
+	}
 
 	// delete target which also removes associated target groups and target to extents
 	targetIDString, ok := volume.Annotations[targetIDAnnotation]
@@ -200,12 +387,27 @@ func (p *Freenas) Delete(volume *v1.PersistentVolume) error {
 		return errors.Wrapf(err, "error converting parameter %s", targetIDAnnotation)
 	}
 
-	err = p.Freenas.ISCSI().Target().Delete(&target.Target{
+	err = p.Freenas.ISCSI().Target().Delete(ctx, &target.Target{
 		ID: &targetID,
 	})
-	if err != nil {
+	if err != nil && !rest.IsNotFound(err) {
 		return errors.Wrap(err, "error deleting target")
 	}
+	if err == nil {
+		p.event(volume, v1.EventTypeNormal, targetDeletedReason, "Deleted iscsi target %d with its target groups and extent mappings", targetID)
+	}
+
+	// delete per volume chap credentials
+	err = p.deleteChapAuth(ctx, volume)
+	if err != nil {
+		return err
+	}
+
+	// delete per volume initiator group
+	err = p.deleteInitiatorGroup(ctx, volume)
+	if err != nil {
+		return err
+	}
 
 	datasetPool, ok := volume.Annotations[datasetPoolAnnotation]
 	if !ok {
@@ -217,8 +419,14 @@ func (p *Freenas) Delete(volume *v1.PersistentVolume) error {
 		return fmt.Errorf("missing required volume annotation %s", zVolNameAnnotation)
 	}
 
+	// untangle clones so that zfs lets the zvol go
+	clones, err := p.releaseClones(ctx, volume, fmt.Sprintf("%s/%s", datasetPool, zVolName))
+	if err != nil {
+		return err
+	}
+
 	// delete zvol
-	err = p.Freenas.Storage().ZVol().Delete(
+	err = p.Freenas.Storage().ZVol().Delete(ctx,
 		&dataset.Dataset{
 			Pool: &datasetPool,
 		},
@@ -226,9 +434,12 @@ func (p *Freenas) Delete(volume *v1.PersistentVolume) error {
 			Name: &zVolName,
 		},
 	)
-	if err != nil {
+	if err != nil && !rest.IsNotFound(err) {
 		return errors.Wrap(err, "error deleting zvol")
 	}
+	if err == nil {
+		p.event(volume, v1.EventTypeNormal, zVolDeletedReason, "Deleted zvol %s/%s", datasetPool, zVolName)
+	}
 
-	return nil
+	return p.forgetClones(ctx, volume, clones)
 }
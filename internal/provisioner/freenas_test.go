@@ -0,0 +1,100 @@
+package provisioner
+
+import (
+	"fmt"
+	freenas_fake "github.com/jakekeeys/freenas-provisioner/pkg/freenas/fake"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+)
+
+// newTestFreenas returns a provisioner backed by a fake appliance with the
+// pool tank and the root dataset tank/k8s, and by a fake kubernetes api
+// holding objects. The appliance has to be closed when done.
+func newTestFreenas(t *testing.T, objects ...runtime.Object) (*Freenas, *freenas_fake.Server) {
+	server := freenas_fake.NewServer()
+	server.AddPool("tank", 0)
+	err := server.AddDataset("tank/k8s")
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return &Freenas{
+		Kubernetes: k8sfake.NewSimpleClientset(objects...),
+		Freenas:    server.Client(),
+		Recorder:   record.NewFakeRecorder(1000),
+	}, server
+}
+
+// deletedEvents drains the events recorded by p and returns the reasons of
+// those reporting a deletion.
+func deletedEvents(p *Freenas) []string {
+	recorder := p.Recorder.(*record.FakeRecorder)
+
+	var reasons []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			// events are recorded as "<type> <reason> <message>"
+			fields := strings.SplitN(event, " ", 3)
+			if len(fields) == 3 && strings.HasSuffix(fields[1], "Deleted") {
+				reasons = append(reasons, fields[1])
+			}
+		default:
+			return reasons
+		}
+	}
+}
+
+func TestDeleteEvents(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		want       []string
+	}{
+		{
+			name:       "iscsi",
+			parameters: iscsiParameters(nil),
+			want:       []string{extentDeletedReason, targetDeletedReason, zVolDeletedReason},
+		},
+		{
+			name:       "nfs",
+			parameters: nfsParameters(),
+			want:       []string{nfsShareDeletedReason, datasetDeletedReason},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+			provisionTestVolume(t, p, testClaim("claim-1", "pvc-1", nil), tt.parameters)
+			pv, err := p.Kubernetes.CoreV1().PersistentVolumes().Get("pvc-1", v12.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			deletedEvents(p)
+
+			err = p.Delete(pv)
+			if err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if got := deletedEvents(p); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Delete() recorded %v, want %v", got, tt.want)
+			}
+
+			// everything is gone already
+			err = p.Delete(pv)
+			if err != nil {
+				t.Fatalf("second Delete() error = %v", err)
+			}
+			if got := deletedEvents(p); len(got) != 0 {
+				t.Errorf("second Delete() recorded %v, want no deletions", got)
+			}
+		})
+	}
+}
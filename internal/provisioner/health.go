@@ -0,0 +1,168 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthChecker probes FreeNAS every Interval and serves the cached result
+// as readiness, so probes neither wait for nor load the appliance.
+//
+// A probe reads the iscsi global configuration, which checks reachability and
+// auth, and the root dataset of every storage class of the provisioner.
+// Readiness is lost after FailureThreshold consecutive failed probes and
+// regained after SuccessThreshold consecutive successful ones.
+type HealthChecker struct {
+	Freenas          freenas.Interface
+	ProvisionerName  string
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+	SuccessThreshold int
+
+	informers informers.SharedInformerFactory
+	classes   storagelisters.StorageClassLister
+	synced    []cache.InformerSynced
+
+	mu        sync.Mutex
+	ready     bool
+	lastErr   error
+	lastProbe time.Time
+	failures  int
+	successes int
+}
+
+func NewHealthChecker(freenas freenas.Interface, provisionerName string, factory informers.SharedInformerFactory) *HealthChecker {
+	classInformer := factory.Storage().V1().StorageClasses()
+
+	return &HealthChecker{
+		Freenas:          freenas,
+		ProvisionerName:  provisionerName,
+		Interval:         10 * time.Second,
+		Timeout:          5 * time.Second,
+		FailureThreshold: 3,
+		SuccessThreshold: 1,
+		informers:        factory,
+		classes:          classInformer.Lister(),
+		synced: []cache.InformerSynced{
+			classInformer.Informer().HasSynced,
+		},
+		lastErr: errors.New("freenas has not been probed yet"),
+	}
+}
+
+func (h *HealthChecker) Run(stopCh <-chan struct{}) {
+	h.informers.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, h.synced...) {
+		utilruntime.HandleError(fmt.Errorf("timed out waiting for health checker caches to sync"))
+		return
+	}
+
+	wait.Until(h.runOnce, h.Interval, stopCh)
+}
+
+func (h *HealthChecker) runOnce() {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	h.record(h.probe(ctx))
+}
+
+func (h *HealthChecker) probe(ctx context.Context) error {
+	_, err := h.Freenas.ISCSI().GlobalConfiguration().Get(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error getting iscsi global configuration")
+	}
+
+	classes, err := h.classes.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	roots := sets.NewString()
+	for _, class := range classes {
+		if class.Provisioner != h.ProvisionerName {
+			continue
+		}
+
+		config, err := ParseConfig(class.Parameters)
+		if err != nil || roots.Has(config.RootDatasetName) {
+			continue
+		}
+		roots.Insert(config.RootDatasetName)
+
+		_, err = h.Freenas.Storage().Dataset().Get(ctx, &dataset.Dataset{Name: &config.RootDatasetName})
+		if err != nil {
+			return errors.Wrapf(err, "error getting root dataset %s of storage class %s", config.RootDatasetName, class.Name)
+		}
+	}
+
+	return nil
+}
+
+func (h *HealthChecker) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastProbe = time.Now()
+	h.lastErr = err
+	if err != nil {
+		h.successes = 0
+		h.failures++
+		if h.ready && h.failures >= h.FailureThreshold {
+			glog.Warningf("%d consecutive freenas probes failed, reporting not ready: %v", h.failures, err)
+			h.ready = false
+		}
+		return
+	}
+
+	h.failures = 0
+	h.successes++
+	if !h.ready && h.successes >= h.SuccessThreshold {
+		glog.Infof("freenas probe succeeded, reporting ready")
+		h.ready = true
+	}
+}
+
+// Healthz reports whether the probe loop is still running.
+func (h *HealthChecker) Healthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	lastProbe := h.lastProbe
+	h.mu.Unlock()
+
+	// the loop may not have started before the caches synced
+	if !lastProbe.IsZero() && time.Since(lastProbe) > 3*h.Interval+h.Timeout {
+		http.Error(w, fmt.Sprintf("last freenas probe ran %s ago", time.Since(lastProbe).Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz reports the cached readiness.
+func (h *HealthChecker) Readyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	ready, lastErr := h.ready, h.lastErr
+	h.mu.Unlock()
+
+	if !ready {
+		http.Error(w, fmt.Sprintf("not ready: %v", lastErr), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
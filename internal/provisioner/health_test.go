@@ -0,0 +1,128 @@
+package provisioner
+
+import (
+	"errors"
+	"k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHealthChecker(failureThreshold, successThreshold int) *HealthChecker {
+	factory := informers.NewSharedInformerFactory(k8sfake.NewSimpleClientset(), 0)
+	h := NewHealthChecker(nil, "freenas.org/iscsi", factory)
+	h.FailureThreshold = failureThreshold
+	h.SuccessThreshold = successThreshold
+
+	return h
+}
+
+// serveHealth returns the status code and body of handler.
+func serveHealth(handler http.HandlerFunc) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestHealthCheckerRecord(t *testing.T) {
+	failed := errors.New("connection refused")
+
+	tests := []struct {
+		name             string
+		failureThreshold int
+		successThreshold int
+		// probes are the results recorded in turn
+		probes []error
+		// want is the readiness after each probe
+		want []bool
+	}{
+		{name: "not probed yet", failureThreshold: 3, successThreshold: 1},
+		{name: "first success", failureThreshold: 3, successThreshold: 1, probes: []error{nil}, want: []bool{true}},
+		{name: "first failure", failureThreshold: 3, successThreshold: 1, probes: []error{failed}, want: []bool{false}},
+		{
+			name:             "failures below the threshold",
+			failureThreshold: 3,
+			successThreshold: 1,
+			probes:           []error{nil, failed, failed, nil, failed, failed},
+			want:             []bool{true, true, true, true, true, true},
+		},
+		{
+			name:             "failures reaching the threshold",
+			failureThreshold: 3,
+			successThreshold: 1,
+			probes:           []error{nil, failed, failed, failed, failed},
+			want:             []bool{true, true, true, false, false},
+		},
+		{
+			name:             "successes reaching the threshold",
+			failureThreshold: 1,
+			successThreshold: 2,
+			probes:           []error{nil, nil, failed, nil, failed, nil, nil},
+			want:             []bool{false, true, false, false, false, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHealthChecker(tt.failureThreshold, tt.successThreshold)
+
+			for i, err := range tt.probes {
+				h.record(err)
+
+				code, body := serveHealth(h.Readyz)
+				if ready := code == http.StatusOK; ready != tt.want[i] {
+					t.Errorf("Readyz() after probe %d = %d %q, want ready %v", i, code, body, tt.want[i])
+				}
+				if code != http.StatusOK && err != nil && !strings.Contains(body, err.Error()) {
+					t.Errorf("Readyz() after probe %d = %q, want the probe error", i, body)
+				}
+			}
+
+			if len(tt.probes) == 0 {
+				code, body := serveHealth(h.Readyz)
+				if code != http.StatusServiceUnavailable || !strings.Contains(body, "has not been probed yet") {
+					t.Errorf("Readyz() = %d %q, want not ready before the first probe", code, body)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthCheckerHealthz(t *testing.T) {
+	tests := []struct {
+		name string
+		// sinceProbe is how long ago the last probe ran, never if zero
+		sinceProbe time.Duration
+		want       int
+	}{
+		{name: "not probed yet", want: http.StatusOK},
+		{name: "recent probe", sinceProbe: time.Second, want: http.StatusOK},
+		{name: "probe a few intervals ago", sinceProbe: 30 * time.Second, want: http.StatusOK},
+		{name: "stale probe", sinceProbe: time.Minute, want: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// probes are stale after 3 intervals and a timeout, 35s
+			h := newTestHealthChecker(3, 1)
+			h.Interval = 10 * time.Second
+			h.Timeout = 5 * time.Second
+			if tt.sinceProbe != 0 {
+				h.record(nil)
+				h.lastProbe = time.Now().Add(-tt.sinceProbe)
+			}
+
+			code, body := serveHealth(h.Healthz)
+			if code != tt.want {
+				t.Errorf("Healthz() = %d %q, want %d", code, body, tt.want)
+			}
+			if code != http.StatusOK && !strings.Contains(body, "last freenas probe ran 1m0s ago") {
+				t.Errorf("Healthz() = %q, want the age of the last probe", body)
+			}
+		})
+	}
+}
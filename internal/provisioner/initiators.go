@@ -0,0 +1,377 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/initiator"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// annotation keys
+	initiatorGroupIDAnnotation = "initiatorGroupID"
+
+	// NodeInitiatorNameAnnotation is the node annotation holding the iqn the
+	// node's iscsi initiator logs in with.
+	NodeInitiatorNameAnnotation = "freenas-provisioner/initiator-name"
+
+	// noInitiators never matches a real initiator, freenas treats an empty
+	// initiator list as allowing every initiator
+	noInitiators         = "iqn.1994-05.invalid:none"
+	allNetworks          = "ALL"
+	initiatorThreadiness = 2
+)
+
+// createInitiatorGroup creates the initiator group of a volume using a per
+// volume initiator group. It starts out empty and is populated by the
+// InitiatorSyncer once pods use the volume.
+func (p *Freenas) createInitiatorGroup(ctx context.Context, tx *transaction, pvName string, config *Config) (*initiator.Initiator, error) {
+	if !config.PerVolumeInitiatorGroup {
+		return nil, nil
+	}
+
+	ig, err := p.findInitiatorGroup(ctx, pvName)
+	if err != nil {
+		return nil, err
+	}
+
+	if ig == nil {
+		// without iqns the group never admits anyone and the volume cannot be attached
+		err = p.checkNodeInitiatorNames()
+		if err != nil {
+			return nil, err
+		}
+
+		initiators := noInitiators
+		authNetwork := allNetworks
+		ig, err = p.Freenas.ISCSI().Initiator().Create(ctx, &initiator.Initiator{
+			IscsiTargetInitiatorInitiators:  &initiators,
+			IscsiTargetInitiatorAuthNetwork: &authNetwork,
+			IscsiTargetInitiatorComment:     &pvName,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating iscsi initiator group")
+		}
+	}
+	tx.add(fmt.Sprintf("iscsi initiator group %d", *ig.ID), func() error {
+		return p.Freenas.ISCSI().Initiator().Delete(ctx, ig)
+	})
+
+	return ig, nil
+}
+
+// checkNodeInitiatorNames fails unless at least one node publishes its iqn.
+func (p *Freenas) checkNodeInitiatorNames() error {
+	nodes, err := p.Kubernetes.CoreV1().Nodes().List(v12.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error listing nodes")
+	}
+
+	for _, node := range nodes.Items {
+		if node.Annotations[NodeInitiatorNameAnnotation] != "" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s requires nodes annotated with their iqn but no node has annotation %s, run the node annotator (--annotate-node) on every node", perVolumeInitiatorGroupParam, NodeInitiatorNameAnnotation)
+}
+
+// deleteInitiatorGroup removes the per volume initiator group recorded in the
+// volume annotations, if any.
+func (p *Freenas) deleteInitiatorGroup(ctx context.Context, volume *v1.PersistentVolume) error {
+	initiatorGroupIDString, ok := volume.Annotations[initiatorGroupIDAnnotation]
+	if !ok {
+		return nil
+	}
+
+	initiatorGroupID, err := strconv.Atoi(initiatorGroupIDString)
+	if err != nil {
+		return errors.Wrapf(err, "error converting parameter %s", initiatorGroupIDAnnotation)
+	}
+
+	err = p.Freenas.ISCSI().Initiator().Delete(ctx, &initiator.Initiator{
+		ID: &initiatorGroupID,
+	})
+	if err != nil && !rest.IsNotFound(err) {
+		return errors.Wrap(err, "error deleting iscsi initiator group")
+	}
+
+	return nil
+}
+
+// InitiatorSyncer keeps the members of every per volume initiator group in
+// line with the iqns of the nodes running pods that use the volume.
+type InitiatorSyncer struct {
+	Kubernetes      kubernetes.Interface
+	Freenas         freenas.Interface
+	ProvisionerName string
+
+	informers informers.SharedInformerFactory
+	pods      corelisters.PodLister
+	claims    corelisters.PersistentVolumeClaimLister
+	volumes   corelisters.PersistentVolumeLister
+	nodes     corelisters.NodeLister
+	synced    []cache.InformerSynced
+	queue     workqueue.RateLimitingInterface
+}
+
+func NewInitiatorSyncer(client kubernetes.Interface, freenas freenas.Interface, provisionerName string, factory informers.SharedInformerFactory) *InitiatorSyncer {
+	podInformer := factory.Core().V1().Pods()
+	claimInformer := factory.Core().V1().PersistentVolumeClaims()
+	volumeInformer := factory.Core().V1().PersistentVolumes()
+	nodeInformer := factory.Core().V1().Nodes()
+
+	s := &InitiatorSyncer{
+		Kubernetes:      client,
+		Freenas:         freenas,
+		ProvisionerName: provisionerName,
+		informers:       factory,
+		pods:            podInformer.Lister(),
+		claims:          claimInformer.Lister(),
+		volumes:         volumeInformer.Lister(),
+		nodes:           nodeInformer.Lister(),
+		synced: []cache.InformerSynced{
+			podInformer.Informer().HasSynced,
+			claimInformer.Informer().HasSynced,
+			volumeInformer.Informer().HasSynced,
+			nodeInformer.Informer().HasSynced,
+		},
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "initiators"),
+	}
+
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.enqueuePodVolumes,
+		UpdateFunc: func(oldObj, newObj interface{}) { s.enqueuePodVolumes(newObj) },
+		DeleteFunc: s.enqueuePodVolumes,
+	})
+	volumeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: s.enqueueVolume,
+	})
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: s.enqueueNodeVolumes,
+	})
+
+	return s
+}
+
+func (s *InitiatorSyncer) enqueueVolume(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	s.queue.Add(key)
+}
+
+func (s *InitiatorSyncer) enqueuePodVolumes(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+
+		claim, err := s.claims.PersistentVolumeClaims(pod.Namespace).Get(volume.PersistentVolumeClaim.ClaimName)
+		if err != nil || claim.Spec.VolumeName == "" {
+			continue
+		}
+
+		s.queue.Add(claim.Spec.VolumeName)
+	}
+}
+
+// enqueueNodeVolumes enqueues the volumes of the pods on a node whose iqn
+// annotation changed.
+func (s *InitiatorSyncer) enqueueNodeVolumes(oldObj, newObj interface{}) {
+	oldNode, ok := oldObj.(*v1.Node)
+	if !ok {
+		return
+	}
+	node, ok := newObj.(*v1.Node)
+	if !ok || node.Annotations[NodeInitiatorNameAnnotation] == oldNode.Annotations[NodeInitiatorNameAnnotation] {
+		return
+	}
+
+	pods, err := s.pods.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, pod := range pods {
+		if pod.Spec.NodeName == node.Name {
+			s.enqueuePodVolumes(pod)
+		}
+	}
+}
+
+func (s *InitiatorSyncer) Run(stopCh <-chan struct{}) {
+	defer s.queue.ShutDown()
+
+	s.informers.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, s.synced...) {
+		utilruntime.HandleError(fmt.Errorf("timed out waiting for initiator syncer caches to sync"))
+		return
+	}
+
+	for i := 0; i < initiatorThreadiness; i++ {
+		go wait.Until(s.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+}
+
+func (s *InitiatorSyncer) runWorker() {
+	for s.processNextItem() {
+	}
+}
+
+func (s *InitiatorSyncer) processNextItem() bool {
+	key, quit := s.queue.Get()
+	if quit {
+		return false
+	}
+	defer s.queue.Done(key)
+
+	err := s.sync(key.(string))
+	if err != nil {
+		glog.Errorf("error syncing initiator group of volume %s: %v", key, err)
+		s.queue.AddRateLimited(key)
+		return true
+	}
+
+	s.queue.Forget(key)
+	return true
+}
+
+func (s *InitiatorSyncer) sync(volumeName string) error {
+	ctx := context.Background()
+
+	volume, err := s.volumes.Get(volumeName)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if volume.Annotations[provisionedByAnnotation] != s.ProvisionerName {
+		return nil
+	}
+
+	initiatorGroupIDString, ok := volume.Annotations[initiatorGroupIDAnnotation]
+	if !ok {
+		return nil
+	}
+
+	initiatorGroupID, err := strconv.Atoi(initiatorGroupIDString)
+	if err != nil {
+		return errors.Wrapf(err, "error converting parameter %s", initiatorGroupIDAnnotation)
+	}
+
+	iqns, err := s.volumeInitiators(volume)
+	if err != nil {
+		return err
+	}
+
+	initiators := noInitiators
+	if len(iqns) > 0 {
+		initiators = strings.Join(iqns, "\n")
+	}
+
+	ig, err := s.Freenas.ISCSI().Initiator().Get(ctx, &initiator.Initiator{ID: &initiatorGroupID})
+	if err != nil {
+		return errors.Wrap(err, "error getting iscsi initiator group")
+	}
+
+	if ig.IscsiTargetInitiatorInitiators != nil && *ig.IscsiTargetInitiatorInitiators == initiators {
+		return nil
+	}
+
+	_, err = s.Freenas.ISCSI().Initiator().Update(ctx, &initiator.Initiator{
+		ID:                             &initiatorGroupID,
+		IscsiTargetInitiatorInitiators: &initiators,
+	})
+	if err != nil {
+		return errors.Wrap(err, "error updating iscsi initiator group")
+	}
+
+	glog.Infof("updated initiator group of volume %s to %v", volume.Name, iqns)
+	return nil
+}
+
+// volumeInitiators returns the sorted iqns of the nodes running pods that use
+// the volume.
+func (s *InitiatorSyncer) volumeInitiators(volume *v1.PersistentVolume) ([]string, error) {
+	claimRef := volume.Spec.ClaimRef
+	if claimRef == nil {
+		return nil, nil
+	}
+
+	pods, err := s.pods.Pods(claimRef.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	iqns := sets.NewString()
+	for _, pod := range pods {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+
+		if !podUsesClaim(pod, claimRef.Name) {
+			continue
+		}
+
+		node, err := s.nodes.Get(pod.Spec.NodeName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting node %s", pod.Spec.NodeName)
+		}
+
+		iqn, ok := node.Annotations[NodeInitiatorNameAnnotation]
+		if !ok {
+			glog.Warningf("node %s is missing annotation %s, volume %s will not be accessible from it", node.Name, NodeInitiatorNameAnnotation, volume.Name)
+			continue
+		}
+
+		iqns.Insert(iqn)
+	}
+
+	return iqns.List(), nil
+}
+
+func podUsesClaim(pod *v1.Pod, claimName string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claimName {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,95 @@
+package provisioner
+
+import (
+	v1 "k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestInitiatorSyncerEnqueuesNodeVolumes(t *testing.T) {
+	node := func(iqn string, labels map[string]string) *v1.Node {
+		return &v1.Node{ObjectMeta: v12.ObjectMeta{
+			Name:        "node-1",
+			Labels:      labels,
+			Annotations: map[string]string{NodeInitiatorNameAnnotation: iqn},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		oldNode *v1.Node
+		newNode *v1.Node
+		podNode string
+		want    []string
+	}{
+		{
+			name:    "changed iqn",
+			oldNode: node("iqn.1993-08.org.debian:01:abc", nil),
+			newNode: node("iqn.1993-08.org.debian:01:def", nil),
+			podNode: "node-1",
+			want:    []string{"pvc-1"},
+		},
+		{
+			name:    "new iqn",
+			oldNode: &v1.Node{ObjectMeta: v12.ObjectMeta{Name: "node-1"}},
+			newNode: node("iqn.1993-08.org.debian:01:abc", nil),
+			podNode: "node-1",
+			want:    []string{"pvc-1"},
+		},
+		{
+			name:    "unchanged iqn",
+			oldNode: node("iqn.1993-08.org.debian:01:abc", nil),
+			newNode: node("iqn.1993-08.org.debian:01:abc", map[string]string{"role": "storage"}),
+			podNode: "node-1",
+		},
+		{
+			name:    "pods on other nodes",
+			oldNode: node("iqn.1993-08.org.debian:01:abc", nil),
+			newNode: node("iqn.1993-08.org.debian:01:def", nil),
+			podNode: "node-2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the informers are not started, the handler only sees the indexers
+			client := k8sfake.NewSimpleClientset()
+			factory := informers.NewSharedInformerFactory(client, 0)
+			s := NewInitiatorSyncer(client, nil, "freenas.org/iscsi", factory)
+			defer s.queue.ShutDown()
+
+			pod := &v1.Pod{
+				ObjectMeta: v12.ObjectMeta{Name: "pod-1", Namespace: "default"},
+				Spec: v1.PodSpec{
+					NodeName: tt.podNode,
+					Volumes: []v1.Volume{{
+						Name:         "data",
+						VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "claim-1"}},
+					}},
+				},
+			}
+			err := factory.Core().V1().Pods().Informer().GetIndexer().Add(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = factory.Core().V1().PersistentVolumeClaims().Informer().GetIndexer().Add(testClaim("claim-1", "pvc-1", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.enqueueNodeVolumes(tt.oldNode, tt.newNode)
+
+			var got []string
+			for s.queue.Len() > 0 {
+				key, _ := s.queue.Get()
+				got = append(got, key.(string))
+				s.queue.Done(key)
+			}
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("enqueueNodeVolumes() queued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package provisioner
+
+import (
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"time"
+)
+
+const (
+	// volume operations
+	provisionOperation = "provision"
+	deleteOperation    = "delete"
+
+	// outcomes
+	successOutcome = "success"
+	failureOutcome = "failure"
+)
+
+var (
+	volumeOperationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "freenas_provisioner",
+			Name:      "volume_operations_total",
+			Help:      "Total number of volume provision and delete operations. Broken down by operation, storage class and outcome.",
+		},
+		[]string{"operation", "class", "outcome"},
+	)
+	volumeOperationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "freenas_provisioner",
+			Name:      "volume_operation_duration_seconds",
+			Help:      "Latency of volume provision and delete operations in seconds. Broken down by operation, storage class and outcome.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		},
+		[]string{"operation", "class", "outcome"},
+	)
+	rollbacksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "freenas_provisioner",
+			Name:      "rollbacks_total",
+			Help:      "Total number of rollbacks of failed provisioning. Broken down by storage class and outcome.",
+		},
+		[]string{"class", "outcome"},
+	)
+
+	managedVolumesDesc = prometheus.NewDesc(
+		"freenas_provisioner_managed_volumes",
+		"Number of persistent volumes provisioned by this provisioner. Broken down by storage class and protocol.",
+		[]string{"class", "protocol"},
+		nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(volumeOperationsTotal, volumeOperationDuration, rollbacksTotal)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return failureOutcome
+	}
+
+	return successOutcome
+}
+
+// observeOperation records a volume operation that started at start.
+func observeOperation(operation, class string, start time.Time, err error) {
+	volumeOperationsTotal.WithLabelValues(operation, class, outcome(err)).Inc()
+	volumeOperationDuration.WithLabelValues(operation, class, outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+// VolumeCollector is a prometheus.Collector that counts the persistent
+// volumes of a provisioner when scraped.
+type VolumeCollector struct {
+	ProvisionerName string
+
+	volumes       corelisters.PersistentVolumeLister
+	volumesSynced cache.InformerSynced
+}
+
+func NewVolumeCollector(provisionerName string, factory informers.SharedInformerFactory) *VolumeCollector {
+	volumeInformer := factory.Core().V1().PersistentVolumes()
+
+	return &VolumeCollector{
+		ProvisionerName: provisionerName,
+		volumes:         volumeInformer.Lister(),
+		volumesSynced:   volumeInformer.Informer().HasSynced,
+	}
+}
+
+func (c *VolumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- managedVolumesDesc
+}
+
+func (c *VolumeCollector) Collect(ch chan<- prometheus.Metric) {
+	// an unsynced cache would report too few volumes
+	if !c.volumesSynced() {
+		return
+	}
+
+	volumes, err := c.volumes.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("error listing persistent volumes: %v", err)
+		return
+	}
+
+	type key struct{ class, protocol string }
+	counts := map[key]int{}
+	for _, volume := range volumes {
+		if volume.Annotations[provisionedByAnnotation] != c.ProvisionerName {
+			continue
+		}
+
+		protocol := ISCSIProtocol
+		if _, ok := volume.Annotations[nfsShareIDAnnotation]; ok {
+			protocol = NFSProtocol
+		}
+		counts[key{volume.Spec.StorageClassName, protocol}]++
+	}
+
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(managedVolumesDesc, prometheus.GaugeValue, float64(count), k.class, k.protocol)
+	}
+}
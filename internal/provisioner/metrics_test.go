@@ -0,0 +1,103 @@
+package provisioner
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"testing"
+)
+
+func TestVolumeCollector(t *testing.T) {
+	volume := func(name, class, provisioner string, nfs bool) *v1.PersistentVolume {
+		annotations := map[string]string{provisionedByAnnotation: provisioner}
+		if nfs {
+			annotations[nfsShareIDAnnotation] = "1"
+		}
+		return &v1.PersistentVolume{
+			ObjectMeta: v12.ObjectMeta{Name: name, Annotations: annotations},
+			Spec:       v1.PersistentVolumeSpec{StorageClassName: class},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		volumes []runtime.Object
+		// unsynced leaves the informers stopped
+		unsynced bool
+		// want is the gauge value by class and protocol
+		want map[string]float64
+	}{
+		{name: "no volumes", want: map[string]float64{}},
+		{
+			name: "volumes by class and protocol",
+			volumes: []runtime.Object{
+				volume("pvc-1", "fast", "freenas.org/iscsi", false),
+				volume("pvc-2", "fast", "freenas.org/iscsi", false),
+				volume("pvc-3", "shared", "freenas.org/iscsi", true),
+				volume("pvc-4", "fast", "freenas.org/iscsi", true),
+			},
+			want: map[string]float64{"fast/iscsi": 2, "fast/nfs": 1, "shared/nfs": 1},
+		},
+		{
+			name: "volumes of other provisioners",
+			volumes: []runtime.Object{
+				volume("pvc-1", "fast", "freenas.org/iscsi", false),
+				volume("pvc-2", "fast", "kubernetes.io/aws-ebs", false),
+				volume("pvc-3", "fast", "", false),
+			},
+			want: map[string]float64{"fast/iscsi": 1},
+		},
+		{
+			name:     "unsynced cache",
+			volumes:  []runtime.Object{volume("pvc-1", "fast", "freenas.org/iscsi", false)},
+			unsynced: true,
+			want:     map[string]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			factory := informers.NewSharedInformerFactory(k8sfake.NewSimpleClientset(tt.volumes...), 0)
+			collector := NewVolumeCollector("freenas.org/iscsi", factory)
+			if !tt.unsynced {
+				stopCh := make(chan struct{})
+				defer close(stopCh)
+				factory.Start(stopCh)
+				if !cache.WaitForCacheSync(stopCh, collector.volumesSynced) {
+					t.Fatal("caches did not sync")
+				}
+			}
+
+			// a registry of its own keeps the test apart from the default one
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(collector)
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatalf("Gather() error = %v", err)
+			}
+
+			got := map[string]float64{}
+			for _, family := range families {
+				if family.GetName() != "freenas_provisioner_managed_volumes" {
+					t.Errorf("unexpected metric %s", family.GetName())
+					continue
+				}
+				for _, metric := range family.GetMetric() {
+					labels := map[string]string{}
+					for _, label := range metric.GetLabel() {
+						labels[label.GetName()] = label.GetValue()
+					}
+					got[labels["class"]+"/"+labels["protocol"]] = metric.GetGauge().GetValue()
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("managed volumes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
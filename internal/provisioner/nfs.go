@@ -0,0 +1,162 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/sharing/nfs"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+	"strings"
+)
+
+func (p *Freenas) provisionNFS(ctx context.Context, tx *transaction, options controller.VolumeOptions, config *Config) (*v1.PersistentVolume, error) {
+	pvName := options.PVName
+	pvNamespace := options.PVC.GetObjectMeta().GetNamespace()
+
+	if options.PVC.Spec.DataSource != nil {
+		return nil, fmt.Errorf("data sources are not supported for %s volumes", NFSProtocol)
+	}
+
+	rootDs, err := p.Freenas.Storage().Dataset().Get(ctx, &dataset.Dataset{Name: &config.RootDatasetName})
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting root dataset")
+	}
+
+	// create dataset
+	volSize := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	quota := int(volSize.Value())
+	datasetName := strings.TrimPrefix(fmt.Sprintf("%s/%s", *rootDs.Name, pvName), *rootDs.Pool+"/")
+	ds, err := p.findDataset(ctx, fmt.Sprintf("%s/%s", *rootDs.Pool, datasetName), quota)
+	created := err == nil && ds == nil
+	if created {
+		_, err = p.Freenas.Storage().Dataset().Create(ctx, rootDs, &dataset.Dataset{
+			Name:  &datasetName,
+			Quota: &quota,
+		})
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating dataset")
+	}
+	if created {
+		p.event(options.PVC, v1.EventTypeNormal, datasetCreatedReason, "Created dataset %s/%s with a quota of %d bytes", *rootDs.Pool, datasetName, quota)
+	} else {
+		p.event(options.PVC, v1.EventTypeNormal, datasetCreatedReason, "Adopted existing dataset %s/%s", *rootDs.Pool, datasetName)
+	}
+	tx.add(fmt.Sprintf("dataset %s", datasetName), func() error {
+		return p.Freenas.Storage().Dataset().Delete(ctx, rootDs, &dataset.Dataset{Name: &datasetName})
+	})
+
+	// create nfs share
+	sharePath := fmt.Sprintf("/mnt/%s/%s", *rootDs.Pool, datasetName)
+	share := &nfs.Share{
+		NfsComment: &pvName,
+		NfsPaths:   []string{sharePath},
+	}
+	if config.NFSMaprootUser != "" {
+		share.NfsMaprootUser = &config.NFSMaprootUser
+	}
+	if config.NFSMaprootGroup != "" {
+		share.NfsMaprootGroup = &config.NFSMaprootGroup
+	}
+
+	existing, err := p.findNFSShare(ctx, sharePath)
+	if err == nil && existing != nil {
+		share = existing
+	} else if err == nil {
+		share, err = p.Freenas.Sharing().NFS().Create(ctx, share)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating nfs share")
+	}
+	if existing != nil {
+		p.event(options.PVC, v1.EventTypeNormal, nfsShareCreatedReason, "Adopted existing nfs share %d of %s", *share.ID, sharePath)
+	} else {
+		p.event(options.PVC, v1.EventTypeNormal, nfsShareCreatedReason, "Created nfs share %d of %s", *share.ID, sharePath)
+	}
+	tx.add(fmt.Sprintf("nfs share %d", *share.ID), func() error {
+		return p.Freenas.Sharing().NFS().Delete(ctx, share)
+	})
+
+	return &v1.PersistentVolume{
+		ObjectMeta: v12.ObjectMeta{
+			Name:      pvName,
+			Namespace: pvNamespace,
+			Annotations: map[string]string{
+				nfsShareIDAnnotation:  strconv.Itoa(*share.ID),
+				datasetPoolAnnotation: *rootDs.Pool,
+				datasetNameAnnotation: datasetName,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): volSize,
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				NFS: &v1.NFSVolumeSource{
+					Server: config.NFSServer,
+					Path:   sharePath,
+				},
+			},
+			AccessModes:                   options.PVC.Spec.AccessModes,
+			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
+			StorageClassName:              storageClassName(options.PVC),
+			MountOptions:                  options.MountOptions,
+		},
+	}, nil
+}
+
+func (p *Freenas) deleteNFS(ctx context.Context, volume *v1.PersistentVolume) error {
+	// delete nfs share
+	shareIDString, ok := volume.Annotations[nfsShareIDAnnotation]
+	if !ok {
+		return fmt.Errorf("missing required volume annotation %s", nfsShareIDAnnotation)
+	}
+
+	shareID, err := strconv.Atoi(shareIDString)
+	if err != nil {
+		return errors.Wrapf(err, "error converting parameter %s", nfsShareIDAnnotation)
+	}
+
+	err = p.Freenas.Sharing().NFS().Delete(ctx, &nfs.Share{
+		ID: &shareID,
+	})
+	if err != nil && !rest.IsNotFound(err) {
+		return errors.Wrap(err, "error deleting nfs share")
+	}
+	if err == nil {
+		p.event(volume, v1.EventTypeNormal, nfsShareDeletedReason, "Deleted nfs share %d", shareID)
+	}
+
+	datasetPool, ok := volume.Annotations[datasetPoolAnnotation]
+	if !ok {
+		return fmt.Errorf("missing required volume annotation %s", datasetPoolAnnotation)
+	}
+
+	datasetName, ok := volume.Annotations[datasetNameAnnotation]
+	if !ok {
+		return fmt.Errorf("missing required volume annotation %s", datasetNameAnnotation)
+	}
+
+	// delete dataset
+	err = p.Freenas.Storage().Dataset().Delete(ctx,
+		&dataset.Dataset{
+			Pool: &datasetPool,
+		},
+		&dataset.Dataset{
+			Name: &datasetName,
+		},
+	)
+	if err != nil && !rest.IsNotFound(err) {
+		return errors.Wrap(err, "error deleting dataset")
+	}
+	if err == nil {
+		p.event(volume, v1.EventTypeNormal, datasetDeletedReason, "Deleted dataset %s/%s", datasetPool, datasetName)
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package provisioner
+
+import (
+	"context"
+	freenas_fake "github.com/jakekeeys/freenas-provisioner/pkg/freenas/fake"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
+	v1 "k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProvisionNFS(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		dataSource *v1.TypedLocalObjectReference
+		// share is an nfs share of the dataset left behind, if any
+		share     freenas_fake.Object
+		failShare bool
+		wantErr   string
+	}{
+		{name: "share"},
+		{
+			name: "share with maproot",
+			parameters: map[string]string{
+				nfsMaprootUserParam:  "root",
+				nfsMaprootGroupParam: "wheel",
+			},
+		},
+		{
+			name:  "share left behind",
+			share: freenas_fake.Object{"nfs_paths": []interface{}{"/mnt/tank/k8s/pvc-1"}, "nfs_comment": "pvc-1"},
+		},
+		{
+			name:       "data source",
+			dataSource: &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "claim-0"},
+			wantErr:    "data sources are not supported for nfs volumes",
+		},
+		{name: "failed share", failShare: true, wantErr: "error creating nfs share"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+
+			parameters := nfsParameters()
+			for k, v := range tt.parameters {
+				parameters[k] = v
+			}
+			shareID := 0
+			if tt.share != nil {
+				shareID = server.Add(freenas_fake.NFSShares, tt.share)
+			}
+			if tt.failShare {
+				server.Fail(http.MethodPost, "/api/v1.0/sharing/nfs/", http.StatusInternalServerError)
+			}
+
+			pv, err := p.Provision(controller.VolumeOptions{
+				PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+				PVName:                        "pvc-1",
+				PVC:                           testClaim("claim-1", "pvc-1", tt.dataSource),
+				Parameters:                    parameters,
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Provision() error = %v, want %q", err, tt.wantErr)
+				}
+				if _, ok := server.Dataset("tank/k8s/pvc-1"); ok {
+					t.Error("dataset tank/k8s/pvc-1 was left behind")
+				}
+				if shares := server.Objects(freenas_fake.NFSShares); len(shares) != 0 {
+					t.Errorf("nfs shares %v were left behind", shares)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Provision() error = %v", err)
+			}
+
+			ds, ok := server.Dataset("tank/k8s/pvc-1")
+			if !ok || ds.ZVol || ds.Quota != 1<<30 {
+				t.Errorf("dataset tank/k8s/pvc-1 = %+v, want a dataset with a quota of 1Gi", ds)
+			}
+
+			shares := server.Objects(freenas_fake.NFSShares)
+			if len(shares) != 1 {
+				t.Fatalf("nfs shares = %v, want one", shares)
+			}
+			share := shares[0]
+			if shareID != 0 && share.ID() != shareID {
+				t.Errorf("nfs share id = %d, want the share left behind %d", share.ID(), shareID)
+			}
+			if paths, _ := share["nfs_paths"].([]interface{}); len(paths) != 1 || paths[0] != "/mnt/tank/k8s/pvc-1" {
+				t.Errorf("nfs share paths = %v, want [/mnt/tank/k8s/pvc-1]", share["nfs_paths"])
+			}
+			for field, param := range map[string]string{"nfs_maproot_user": nfsMaprootUserParam, "nfs_maproot_group": nfsMaprootGroupParam} {
+				if got, _ := share[field].(string); got != tt.parameters[param] {
+					t.Errorf("nfs share %s = %q, want %q", field, got, tt.parameters[param])
+				}
+			}
+
+			source := pv.Spec.NFS
+			if source == nil || source.Server != "10.0.0.1" || source.Path != "/mnt/tank/k8s/pvc-1" {
+				t.Errorf("Provision() nfs source = %+v, want 10.0.0.1:/mnt/tank/k8s/pvc-1", source)
+			}
+			wantAnnotations := map[string]string{
+				nfsShareIDAnnotation:  strconv.Itoa(share.ID()),
+				datasetPoolAnnotation: "tank",
+				datasetNameAnnotation: "k8s/pvc-1",
+			}
+			for k, v := range wantAnnotations {
+				if pv.Annotations[k] != v {
+					t.Errorf("Provision() annotation %s = %q, want %q", k, pv.Annotations[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteNFS(t *testing.T) {
+	tests := []struct {
+		name string
+		// removed is run after provisioning to take things away behind the
+		// provisioner's back
+		removed func(t *testing.T, server *freenas_fake.Server)
+	}{
+		{name: "share and dataset"},
+		{
+			name: "share already deleted",
+			removed: func(t *testing.T, server *freenas_fake.Server) {
+				for _, share := range server.Objects(freenas_fake.NFSShares) {
+					server.Remove(freenas_fake.NFSShares, share.ID())
+				}
+			},
+		},
+		{
+			name: "share and dataset already deleted",
+			removed: func(t *testing.T, server *freenas_fake.Server) {
+				for _, share := range server.Objects(freenas_fake.NFSShares) {
+					server.Remove(freenas_fake.NFSShares, share.ID())
+				}
+				pool, name := "tank", "k8s/pvc-1"
+				err := server.Client().Storage().Dataset().Delete(context.Background(), &dataset.Dataset{Pool: &pool}, &dataset.Dataset{Name: &name})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+			provisionTestVolume(t, p, testClaim("claim-1", "pvc-1", nil), nfsParameters())
+			if tt.removed != nil {
+				tt.removed(t, server)
+			}
+
+			pv, err := p.Kubernetes.CoreV1().PersistentVolumes().Get("pvc-1", v12.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.Delete(pv)
+			if err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+
+			if shares := server.Objects(freenas_fake.NFSShares); len(shares) != 0 {
+				t.Errorf("nfs shares = %v, want none", shares)
+			}
+			if _, ok := server.Dataset("tank/k8s/pvc-1"); ok {
+				t.Error("dataset tank/k8s/pvc-1 still exists")
+			}
+			if _, ok := server.Dataset("tank/k8s"); !ok {
+				t.Error("root dataset tank/k8s was deleted")
+			}
+		})
+	}
+}
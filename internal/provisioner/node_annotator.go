@@ -0,0 +1,114 @@
+package provisioner
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultInitiatorNameFile is where open-iscsi keeps the iqn of a node.
+	DefaultInitiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+
+	defaultNodeAnnotatorInterval = time.Minute
+)
+
+// NodeAnnotator publishes the iqn of the node it runs on in the node's
+// NodeInitiatorNameAnnotation, which per volume initiator groups are built
+// from. It runs on every node, e.g. in a DaemonSet.
+type NodeAnnotator struct {
+	Kubernetes        kubernetes.Interface
+	NodeName          string
+	InitiatorNameFile string
+	// Interval is how often the iqn is read again, it changes when the node
+	// is reinstalled without being renamed
+	Interval time.Duration
+}
+
+func NewNodeAnnotator(client kubernetes.Interface, nodeName string) *NodeAnnotator {
+	return &NodeAnnotator{
+		Kubernetes:        client,
+		NodeName:          nodeName,
+		InitiatorNameFile: DefaultInitiatorNameFile,
+		Interval:          defaultNodeAnnotatorInterval,
+	}
+}
+
+func (a *NodeAnnotator) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		err := a.Annotate()
+		if err != nil {
+			glog.Errorf("error annotating node %s: %v", a.NodeName, err)
+		}
+	}, a.Interval, stopCh)
+}
+
+// Annotate sets the annotation to the node's current iqn.
+func (a *NodeAnnotator) Annotate() error {
+	iqn, err := ReadInitiatorName(a.InitiatorNameFile)
+	if err != nil {
+		return err
+	}
+
+	node, err := a.Kubernetes.CoreV1().Nodes().Get(a.NodeName, v12.GetOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error getting node")
+	}
+
+	if node.Annotations[NodeInitiatorNameAnnotation] == iqn {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{NodeInitiatorNameAnnotation: iqn},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = a.Kubernetes.CoreV1().Nodes().Patch(a.NodeName, types.StrategicMergePatchType, patch)
+	if err != nil {
+		return errors.Wrap(err, "error patching node")
+	}
+
+	glog.Infof("annotated node %s with initiator name %s", a.NodeName, iqn)
+	return nil
+}
+
+// ReadInitiatorName returns the iqn in an open-iscsi initiatorname.iscsi file.
+func ReadInitiatorName(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading initiator name")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "InitiatorName" && strings.TrimSpace(parts[1]) != "" {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "error reading initiator name")
+	}
+
+	return "", fmt.Errorf("no InitiatorName in %s", path)
+}
@@ -0,0 +1,160 @@
+package provisioner
+
+import (
+	"context"
+	freenas_fake "github.com/jakekeeys/freenas-provisioner/pkg/freenas/fake"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeInitiatorNameFile(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "initiatorname.iscsi")
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestReadInitiatorName(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", content: "InitiatorName=iqn.1993-08.org.debian:01:abc\n", want: "iqn.1993-08.org.debian:01:abc"},
+		{name: "comments and spaces", content: "## DO NOT EDIT\n# InitiatorName=iqn.invalid\n  InitiatorName = iqn.1994-05.com.redhat:abc  \n", want: "iqn.1994-05.com.redhat:abc"},
+		{name: "empty name", content: "InitiatorName=\n", wantErr: true},
+		{name: "no name", content: "# InitiatorName=iqn.invalid\n", wantErr: true},
+	}
+
+	dir, err := ioutil.TempDir("", "initiator-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadInitiatorName(writeInitiatorNameFile(t, dir, tt.content))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ReadInitiatorName() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadInitiatorName() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ReadInitiatorName() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ReadInitiatorName(filepath.Join(dir, "missing")); err == nil {
+		t.Error("ReadInitiatorName() of a missing file succeeded")
+	}
+}
+
+func TestNodeAnnotator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "initiator-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := k8sfake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: v12.ObjectMeta{Name: "node-1", Annotations: map[string]string{"other": "kept"}},
+	})
+	annotator := NewNodeAnnotator(client, "node-1")
+
+	for _, iqn := range []string{"iqn.1993-08.org.debian:01:abc", "iqn.1993-08.org.debian:01:abc", "iqn.1993-08.org.debian:01:def"} {
+		annotator.InitiatorNameFile = writeInitiatorNameFile(t, dir, "InitiatorName="+iqn+"\n")
+		err = annotator.Annotate()
+		if err != nil {
+			t.Fatalf("Annotate() error = %v", err)
+		}
+
+		node, err := client.CoreV1().Nodes().Get("node-1", v12.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := node.Annotations[NodeInitiatorNameAnnotation]; got != iqn {
+			t.Errorf("annotation %s = %s, want %s", NodeInitiatorNameAnnotation, got, iqn)
+		}
+		if node.Annotations["other"] != "kept" {
+			t.Errorf("Annotate() dropped the other annotations: %v", node.Annotations)
+		}
+	}
+
+	patches := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "patch" {
+			patches++
+		}
+	}
+	if patches != 2 {
+		t.Errorf("Annotate() patched the node %d times, want 2", patches)
+	}
+}
+
+func TestCreateInitiatorGroup(t *testing.T) {
+	config := iscsiConfig(func(c *Config) { c.PerVolumeInitiatorGroup = true })
+
+	tests := []struct {
+		name    string
+		nodes   []*v1.Node
+		wantErr bool
+	}{
+		{name: "no nodes", wantErr: true},
+		{
+			name:    "no annotated nodes",
+			nodes:   []*v1.Node{{ObjectMeta: v12.ObjectMeta{Name: "node-1"}}},
+			wantErr: true,
+		},
+		{
+			name: "annotated nodes",
+			nodes: []*v1.Node{
+				{ObjectMeta: v12.ObjectMeta{Name: "node-1"}},
+				{ObjectMeta: v12.ObjectMeta{Name: "node-2", Annotations: map[string]string{NodeInitiatorNameAnnotation: "iqn.1993-08.org.debian:01:abc"}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+			for _, node := range tt.nodes {
+				if _, err := p.Kubernetes.CoreV1().Nodes().Create(node); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ig, err := p.createInitiatorGroup(context.Background(), &transaction{}, "pvc-1", config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("createInitiatorGroup() = %v, want an error", ig)
+				}
+			} else if err != nil {
+				t.Fatalf("createInitiatorGroup() error = %v", err)
+			}
+
+			want := 1
+			if tt.wantErr {
+				want = 0
+			}
+			if groups := server.Objects(freenas_fake.AuthorizedInitiators); len(groups) != want {
+				t.Errorf("initiator groups = %v, want %d", groups, want)
+			}
+		})
+	}
+}
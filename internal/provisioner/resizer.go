@@ -0,0 +1,229 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"time"
+)
+
+const (
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+
+	resizerThreadiness = 2
+)
+
+// Resizer grows the zvol or the dataset quota backing a bound claim whenever
+// the claim requests more storage than its volume currently provides.
+type Resizer struct {
+	Kubernetes      kubernetes.Interface
+	Freenas         freenas.Interface
+	ProvisionerName string
+
+	informers informers.SharedInformerFactory
+	claims    corelisters.PersistentVolumeClaimLister
+	volumes   corelisters.PersistentVolumeLister
+	classes   storagelisters.StorageClassLister
+	synced    []cache.InformerSynced
+	queue     workqueue.RateLimitingInterface
+}
+
+func NewResizer(client kubernetes.Interface, freenas freenas.Interface, provisionerName string, factory informers.SharedInformerFactory) *Resizer {
+	claimInformer := factory.Core().V1().PersistentVolumeClaims()
+	volumeInformer := factory.Core().V1().PersistentVolumes()
+	classInformer := factory.Storage().V1().StorageClasses()
+
+	r := &Resizer{
+		Kubernetes:      client,
+		Freenas:         freenas,
+		ProvisionerName: provisionerName,
+		informers:       factory,
+		claims:          claimInformer.Lister(),
+		volumes:         volumeInformer.Lister(),
+		classes:         classInformer.Lister(),
+		synced: []cache.InformerSynced{
+			claimInformer.Informer().HasSynced,
+			volumeInformer.Informer().HasSynced,
+			classInformer.Informer().HasSynced,
+		},
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "resize"),
+	}
+
+	claimInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    r.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) { r.enqueue(newObj) },
+	})
+
+	return r
+}
+
+func (r *Resizer) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	r.queue.Add(key)
+}
+
+func (r *Resizer) Run(stopCh <-chan struct{}) {
+	defer r.queue.ShutDown()
+
+	r.informers.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, r.synced...) {
+		utilruntime.HandleError(fmt.Errorf("timed out waiting for resizer caches to sync"))
+		return
+	}
+
+	for i := 0; i < resizerThreadiness; i++ {
+		go wait.Until(r.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+}
+
+func (r *Resizer) runWorker() {
+	for r.processNextItem() {
+	}
+}
+
+func (r *Resizer) processNextItem() bool {
+	key, quit := r.queue.Get()
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	err := r.sync(key.(string))
+	if err != nil {
+		glog.Errorf("error resizing claim %s: %v", key, err)
+		r.queue.AddRateLimited(key)
+		return true
+	}
+
+	r.queue.Forget(key)
+	return true
+}
+
+func (r *Resizer) sync(key string) error {
+	ctx := context.Background()
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	claim, err := r.claims.PersistentVolumeClaims(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.VolumeName == "" {
+		return nil
+	}
+
+	volume, err := r.volumes.Get(claim.Spec.VolumeName)
+	if err != nil {
+		return err
+	}
+
+	if volume.Annotations[provisionedByAnnotation] != r.ProvisionerName {
+		return nil
+	}
+
+	requested := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	capacity := volume.Spec.Capacity[v1.ResourceStorage]
+	if requested.Cmp(capacity) <= 0 {
+		return nil
+	}
+
+	class, err := r.classes.Get(storageClassName(claim))
+	if err != nil {
+		return err
+	}
+	if class.AllowVolumeExpansion == nil || !*class.AllowVolumeExpansion {
+		return nil
+	}
+
+	claim, err = r.setClaimCondition(claim, v1.PersistentVolumeClaimResizing)
+	if err != nil {
+		return errors.Wrap(err, "error marking claim as resizing")
+	}
+
+	// grow zvol or dataset quota
+	err = ExpandVolume(ctx, r.Freenas, volume, requested)
+	if err != nil {
+		return err
+	}
+
+	// update volume capacity
+	volume = volume.DeepCopy()
+	volume.Spec.Capacity[v1.ResourceStorage] = requested
+	_, err = r.Kubernetes.CoreV1().PersistentVolumes().Update(volume)
+	if err != nil {
+		return errors.Wrap(err, "error updating volume capacity")
+	}
+
+	// datasets and block volumes need no file system resize on the node
+	if !IsBlockVolume(volume) || (volume.Spec.VolumeMode != nil && *volume.Spec.VolumeMode == v1.PersistentVolumeBlock) {
+		return r.completeClaimResize(claim, requested)
+	}
+
+	_, err = r.setClaimCondition(claim, v1.PersistentVolumeClaimFileSystemResizePending)
+	if err != nil {
+		return errors.Wrap(err, "error marking claim as pending file system resize")
+	}
+
+	return nil
+}
+
+func (r *Resizer) setClaimCondition(claim *v1.PersistentVolumeClaim, conditionType v1.PersistentVolumeClaimConditionType) (*v1.PersistentVolumeClaim, error) {
+	for _, condition := range claim.Status.Conditions {
+		if condition.Type == conditionType {
+			return claim, nil
+		}
+	}
+
+	claim = claim.DeepCopy()
+	claim.Status.Conditions = []v1.PersistentVolumeClaimCondition{{
+		Type:               conditionType,
+		Status:             v1.ConditionTrue,
+		LastTransitionTime: v12.Now(),
+	}}
+
+	return r.Kubernetes.CoreV1().PersistentVolumeClaims(claim.Namespace).UpdateStatus(claim)
+}
+
+func (r *Resizer) completeClaimResize(claim *v1.PersistentVolumeClaim, capacity resource.Quantity) error {
+	claim = claim.DeepCopy()
+	claim.Status.Conditions = nil
+	if claim.Status.Capacity == nil {
+		claim.Status.Capacity = v1.ResourceList{}
+	}
+	claim.Status.Capacity[v1.ResourceStorage] = capacity
+
+	_, err := r.Kubernetes.CoreV1().PersistentVolumeClaims(claim.Namespace).UpdateStatus(claim)
+	if err != nil {
+		return errors.Wrap(err, "error updating claim capacity")
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package provisioner
+
+import (
+	"context"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"testing"
+)
+
+const (
+	resizerProvisionerName = "freenas.org/iscsi"
+
+	resizeZVolPath    = "/api/v1.0/storage/volume/tank/zvols/k8s/pvc-1/"
+	resizeDatasetPath = "/api/v1.0/storage/volume/tank/datasets/k8s/pvc-1/"
+)
+
+// resizeTestObjects returns a class allowing expansion, a volume of 1Gi and a
+// claim bound to it requesting requested.
+func resizeTestObjects(requested string, nfs bool, volumeMode v1.PersistentVolumeMode) (*storagev1.StorageClass, *v1.PersistentVolume, *v1.PersistentVolumeClaim) {
+	allowExpansion := true
+	class := &storagev1.StorageClass{
+		ObjectMeta:           v12.ObjectMeta{Name: "iscsi"},
+		Provisioner:          resizerProvisionerName,
+		AllowVolumeExpansion: &allowExpansion,
+	}
+
+	annotations := map[string]string{
+		provisionedByAnnotation: resizerProvisionerName,
+		datasetPoolAnnotation:   "tank",
+	}
+	if nfs {
+		annotations[nfsShareIDAnnotation] = "1"
+		annotations[datasetNameAnnotation] = "k8s/pvc-1"
+	} else {
+		annotations[targetIDAnnotation] = "1"
+		annotations[extentIDAnnotation] = "1"
+		annotations[zVolNameAnnotation] = "k8s/pvc-1"
+	}
+	volume := &v1.PersistentVolume{
+		ObjectMeta: v12.ObjectMeta{Name: "pvc-1", Annotations: annotations},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:   v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			VolumeMode: &volumeMode,
+		},
+	}
+
+	claim := testClaim("claim-1", "pvc-1", nil)
+	claim.Spec.Resources.Requests[v1.ResourceStorage] = resource.MustParse(requested)
+
+	return class, volume, claim
+}
+
+// newTestResizer returns a resizer on p with synced caches, they stop when
+// stopCh is closed.
+func newTestResizer(t *testing.T, p *Freenas, stopCh <-chan struct{}) *Resizer {
+	factory := informers.NewSharedInformerFactory(p.Kubernetes, 0)
+	r := NewResizer(p.Kubernetes, p.Freenas, resizerProvisionerName, factory)
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, r.synced...) {
+		t.Fatal("caches did not sync")
+	}
+
+	return r
+}
+
+func TestResizerSync(t *testing.T) {
+	tests := []struct {
+		name           string
+		requested      string
+		nfs            bool
+		volumeMode     v1.PersistentVolumeMode
+		allowExpansion bool
+		// wantSize is the size of the zvol or the dataset quota afterwards
+		wantSize      int64
+		wantCondition v1.PersistentVolumeClaimConditionType
+		// wantCapacity is the capacity of the claim afterwards, if any
+		wantCapacity string
+	}{
+		{
+			name:           "grown claim",
+			requested:      "2Gi",
+			volumeMode:     v1.PersistentVolumeFilesystem,
+			allowExpansion: true,
+			wantSize:       2 << 30,
+			wantCondition:  v1.PersistentVolumeClaimFileSystemResizePending,
+		},
+		{
+			name:           "grown block claim",
+			requested:      "2Gi",
+			volumeMode:     v1.PersistentVolumeBlock,
+			allowExpansion: true,
+			wantSize:       2 << 30,
+			wantCapacity:   "2Gi",
+		},
+		{
+			name:           "grown nfs claim",
+			requested:      "2Gi",
+			nfs:            true,
+			volumeMode:     v1.PersistentVolumeFilesystem,
+			allowExpansion: true,
+			wantSize:       2 << 30,
+			wantCapacity:   "2Gi",
+		},
+		{name: "unchanged claim", requested: "1Gi", volumeMode: v1.PersistentVolumeFilesystem, allowExpansion: true, wantSize: 1 << 30},
+		{name: "shrunk claim", requested: "512Mi", volumeMode: v1.PersistentVolumeFilesystem, allowExpansion: true, wantSize: 1 << 30},
+		{name: "shrunk nfs claim", requested: "512Mi", nfs: true, volumeMode: v1.PersistentVolumeFilesystem, allowExpansion: true, wantSize: 1 << 30},
+		{name: "class without expansion", requested: "2Gi", volumeMode: v1.PersistentVolumeFilesystem, wantSize: 1 << 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, volume, claim := resizeTestObjects(tt.requested, tt.nfs, tt.volumeMode)
+			class.AllowVolumeExpansion = &tt.allowExpansion
+			p, server := newTestFreenas(t, class, volume, claim)
+			defer server.Close()
+
+			path := resizeZVolPath
+			if tt.nfs {
+				path = resizeDatasetPath
+				pool, name, quota := "tank", "k8s/pvc-1", 1<<30
+				_, err := p.Freenas.Storage().Dataset().Create(context.Background(), &dataset.Dataset{Pool: &pool}, &dataset.Dataset{Name: &name, Quota: &quota})
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err := server.AddZVol("tank/k8s/pvc-1", 1<<30); err != nil {
+				t.Fatal(err)
+			}
+
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			r := newTestResizer(t, p, stopCh)
+
+			err := r.sync("default/claim-1")
+			if err != nil {
+				t.Fatalf("sync() error = %v", err)
+			}
+
+			ds, _ := server.Dataset("tank/k8s/pvc-1")
+			size := ds.Volsize
+			if tt.nfs {
+				size = ds.Quota
+			}
+			if size != tt.wantSize {
+				t.Errorf("size = %d, want %d", size, tt.wantSize)
+			}
+			if updates := server.Requests(http.MethodPut, path); (updates > 0) != (tt.wantSize != 1<<30) {
+				t.Errorf("sync() made %d updates", updates)
+			}
+
+			gotVolume, err := p.Kubernetes.CoreV1().PersistentVolumes().Get("pvc-1", v12.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if capacity := gotVolume.Spec.Capacity[v1.ResourceStorage]; capacity.Value() != tt.wantSize {
+				t.Errorf("volume capacity = %s, want %d bytes", capacity.String(), tt.wantSize)
+			}
+
+			gotClaim, err := p.Kubernetes.CoreV1().PersistentVolumeClaims("default").Get("claim-1", v12.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var conditions []v1.PersistentVolumeClaimConditionType
+			for _, condition := range gotClaim.Status.Conditions {
+				conditions = append(conditions, condition.Type)
+			}
+			if (tt.wantCondition == "" && len(conditions) != 0) || (tt.wantCondition != "" && (len(conditions) != 1 || conditions[0] != tt.wantCondition)) {
+				t.Errorf("claim conditions = %v, want %q", conditions, tt.wantCondition)
+			}
+			if tt.wantCapacity != "" {
+				want := resource.MustParse(tt.wantCapacity)
+				if capacity := gotClaim.Status.Capacity[v1.ResourceStorage]; capacity.Cmp(want) != 0 {
+					t.Errorf("claim capacity = %s, want %s", capacity.String(), tt.wantCapacity)
+				}
+			}
+		})
+	}
+}
+
+func TestResizerRequeuesFailedUpdates(t *testing.T) {
+	class, volume, claim := resizeTestObjects("2Gi", false, v1.PersistentVolumeFilesystem)
+	p, server := newTestFreenas(t, class, volume, claim)
+	defer server.Close()
+	err := server.AddZVol("tank/k8s/pvc-1", 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	r := newTestResizer(t, p, stopCh)
+	defer r.queue.ShutDown()
+
+	server.Fail(http.MethodPut, resizeZVolPath, http.StatusInternalServerError)
+	r.queue.Add("default/claim-1")
+	if !r.processNextItem() {
+		t.Fatal("processNextItem() = false, want the queue to keep running")
+	}
+
+	if requeues := r.queue.NumRequeues("default/claim-1"); requeues != 1 {
+		t.Errorf("claim was requeued %d times, want once", requeues)
+	}
+	if ds, _ := server.Dataset("tank/k8s/pvc-1"); ds.Volsize != 1<<30 {
+		t.Errorf("zvol size = %d, want it unchanged", ds.Volsize)
+	}
+}
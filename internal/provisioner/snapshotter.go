@@ -0,0 +1,326 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/snapshot"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"strings"
+	"time"
+)
+
+const (
+	// annotation keys
+	zfsSnapshotAnnotation = "zfsSnapshot"
+
+	// event reasons
+	snapshotInUseReason = "SnapshotInUse"
+
+	snapshotFinalizer      = "freenas-provisioner/snapshot"
+	snapshotterThreadiness = 2
+)
+
+var (
+	volumeSnapshotResource = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1alpha1",
+		Resource: "volumesnapshots",
+	}
+	volumeSnapshotClassResource = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1alpha1",
+		Resource: "volumesnapshotclasses",
+	}
+)
+
+// Snapshotter takes a zfs snapshot of the zvol behind every VolumeSnapshot
+// whose source claim is bound to one of our volumes. The zfs snapshot name is
+// recorded on the VolumeSnapshot and a finalizer removes it again once the
+// VolumeSnapshot is deleted, as soon as no clone depends on it anymore.
+type Snapshotter struct {
+	Kubernetes      kubernetes.Interface
+	Dynamic         dynamic.Interface
+	Freenas         freenas.Interface
+	ProvisionerName string
+	Recorder        record.EventRecorder
+
+	informers        informers.SharedInformerFactory
+	dynamicInformers dynamicinformer.DynamicSharedInformerFactory
+	claims           corelisters.PersistentVolumeClaimLister
+	volumes          corelisters.PersistentVolumeLister
+	snapshots        cache.GenericLister
+	synced           []cache.InformerSynced
+	queue            workqueue.RateLimitingInterface
+}
+
+func NewSnapshotter(client kubernetes.Interface, dynamicClient dynamic.Interface, freenas freenas.Interface, provisionerName string, recorder record.EventRecorder, factory informers.SharedInformerFactory, dynamicFactory dynamicinformer.DynamicSharedInformerFactory) *Snapshotter {
+	claimInformer := factory.Core().V1().PersistentVolumeClaims()
+	volumeInformer := factory.Core().V1().PersistentVolumes()
+	snapshotInformer := dynamicFactory.ForResource(volumeSnapshotResource)
+
+	s := &Snapshotter{
+		Kubernetes:       client,
+		Dynamic:          dynamicClient,
+		Freenas:          freenas,
+		ProvisionerName:  provisionerName,
+		Recorder:         recorder,
+		informers:        factory,
+		dynamicInformers: dynamicFactory,
+		claims:           claimInformer.Lister(),
+		volumes:          volumeInformer.Lister(),
+		snapshots:        snapshotInformer.Lister(),
+		synced: []cache.InformerSynced{
+			claimInformer.Informer().HasSynced,
+			volumeInformer.Informer().HasSynced,
+			snapshotInformer.Informer().HasSynced,
+		},
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "snapshot"),
+	}
+
+	snapshotInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) { s.enqueue(newObj) },
+	})
+
+	return s
+}
+
+func (s *Snapshotter) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	s.queue.Add(key)
+}
+
+func (s *Snapshotter) Run(stopCh <-chan struct{}) {
+	defer s.queue.ShutDown()
+
+	s.informers.Start(stopCh)
+	s.dynamicInformers.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, s.synced...) {
+		utilruntime.HandleError(fmt.Errorf("timed out waiting for snapshotter caches to sync"))
+		return
+	}
+
+	for i := 0; i < snapshotterThreadiness; i++ {
+		go wait.Until(s.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+}
+
+func (s *Snapshotter) runWorker() {
+	for s.processNextItem() {
+	}
+}
+
+func (s *Snapshotter) processNextItem() bool {
+	key, quit := s.queue.Get()
+	if quit {
+		return false
+	}
+	defer s.queue.Done(key)
+
+	err := s.sync(key.(string))
+	if err != nil {
+		glog.Errorf("error syncing volume snapshot %s: %v", key, err)
+		s.queue.AddRateLimited(key)
+		return true
+	}
+
+	s.queue.Forget(key)
+	return true
+}
+
+func (s *Snapshotter) sync(key string) error {
+	ctx := context.Background()
+
+	obj, err := s.snapshots.Get(key)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	volumeSnapshot := obj.(*unstructured.Unstructured).DeepCopy()
+	if volumeSnapshot.GetDeletionTimestamp() != nil {
+		return s.deleteSnapshot(ctx, volumeSnapshot)
+	}
+
+	if _, ok := volumeSnapshot.GetAnnotations()[zfsSnapshotAnnotation]; ok {
+		return nil
+	}
+
+	return s.createSnapshot(ctx, volumeSnapshot)
+}
+
+func (s *Snapshotter) createSnapshot(ctx context.Context, volumeSnapshot *unstructured.Unstructured) error {
+	volume, err := s.sourceVolume(volumeSnapshot)
+	if err != nil || volume == nil {
+		return err
+	}
+
+	ours, err := s.snapshotClassIsOurs(volumeSnapshot)
+	if err != nil || !ours {
+		return err
+	}
+
+	// create zfs snapshot, reusing one left behind by an earlier attempt
+	fullname, err := SnapshotVolume(ctx, s.Freenas, volume, fmt.Sprintf("snapshot-%s", volumeSnapshot.GetUID()))
+	if err != nil {
+		return err
+	}
+
+	annotations := volumeSnapshot.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[zfsSnapshotAnnotation] = fullname
+	volumeSnapshot.SetAnnotations(annotations)
+	volumeSnapshot.SetFinalizers(append(volumeSnapshot.GetFinalizers(), snapshotFinalizer))
+
+	status := map[string]interface{}{
+		"creationTime": time.Now().UTC().Format(time.RFC3339),
+		"ready":        true,
+	}
+	if capacity, ok := volume.Spec.Capacity[v1.ResourceStorage]; ok {
+		status["restoreSize"] = capacity.String()
+	}
+	err = unstructured.SetNestedMap(volumeSnapshot.Object, status, "status")
+	if err != nil {
+		return err
+	}
+
+	client := s.Dynamic.Resource(volumeSnapshotResource).Namespace(volumeSnapshot.GetNamespace())
+	updated, err := client.Update(volumeSnapshot, v12.UpdateOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error updating volume snapshot")
+	}
+
+	// the status is written by the update above unless the crd has a status subresource
+	err = unstructured.SetNestedMap(updated.Object, status, "status")
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateStatus(updated, v12.UpdateOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "error updating volume snapshot status")
+	}
+
+	return nil
+}
+
+func (s *Snapshotter) deleteSnapshot(ctx context.Context, volumeSnapshot *unstructured.Unstructured) error {
+	finalizers := volumeSnapshot.GetFinalizers()
+	var remaining []string
+	for _, finalizer := range finalizers {
+		if finalizer != snapshotFinalizer {
+			remaining = append(remaining, finalizer)
+		}
+	}
+	if len(remaining) == len(finalizers) {
+		return nil
+	}
+
+	if fullname, ok := volumeSnapshot.GetAnnotations()[zfsSnapshotAnnotation]; ok {
+		// zfs refuses to destroy a snapshot with clones, wait for them to go
+		volumes, err := s.volumes.List(labels.Everything())
+		if err != nil {
+			return err
+		}
+		if clones := dependentClones(volumes, fullname); len(clones) > 0 {
+			if s.Recorder != nil {
+				s.Recorder.Eventf(volumeSnapshot, v1.EventTypeWarning, snapshotInUseReason, "Not deleting zfs snapshot %s while volumes %s are cloned from it", fullname, strings.Join(clones, ", "))
+			}
+			return fmt.Errorf("zfs snapshot %s is in use by clones %v", fullname, clones)
+		}
+
+		err = s.Freenas.Storage().Snapshot().Delete(ctx, &snapshot.Snapshot{Fullname: &fullname})
+		if err != nil && !rest.IsNotFound(err) {
+			return errors.Wrap(err, "error deleting zfs snapshot")
+		}
+	}
+
+	volumeSnapshot.SetFinalizers(remaining)
+	_, err := s.Dynamic.Resource(volumeSnapshotResource).Namespace(volumeSnapshot.GetNamespace()).Update(volumeSnapshot, v12.UpdateOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error removing volume snapshot finalizer")
+	}
+
+	return nil
+}
+
+// sourceVolume returns the zvol backed volume bound to the snapshot's source
+// claim, or nil if the snapshot is not for one of our volumes.
+func (s *Snapshotter) sourceVolume(volumeSnapshot *unstructured.Unstructured) (*v1.PersistentVolume, error) {
+	kind, _, _ := unstructured.NestedString(volumeSnapshot.Object, "spec", "source", "kind")
+	claimName, _, _ := unstructured.NestedString(volumeSnapshot.Object, "spec", "source", "name")
+	if kind != "PersistentVolumeClaim" || claimName == "" {
+		return nil, nil
+	}
+
+	claim, err := s.claims.PersistentVolumeClaims(volumeSnapshot.GetNamespace()).Get(claimName)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting snapshot source claim")
+	}
+
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("snapshot source claim %s is not bound", claimName)
+	}
+
+	volume, err := s.volumes.Get(claim.Spec.VolumeName)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting snapshot source volume")
+	}
+
+	if volume.Annotations[provisionedByAnnotation] != s.ProvisionerName {
+		return nil, nil
+	}
+
+	if _, ok := volume.Annotations[zVolNameAnnotation]; !ok {
+		return nil, nil
+	}
+	if _, ok := volume.Annotations[datasetPoolAnnotation]; !ok {
+		return nil, nil
+	}
+
+	return volume, nil
+}
+
+func (s *Snapshotter) snapshotClassIsOurs(volumeSnapshot *unstructured.Unstructured) (bool, error) {
+	className, _, _ := unstructured.NestedString(volumeSnapshot.Object, "spec", "snapshotClassName")
+	if className == "" {
+		return true, nil
+	}
+
+	class, err := s.Dynamic.Resource(volumeSnapshotClassResource).Get(className, v12.GetOptions{})
+	if err != nil {
+		return false, errors.Wrap(err, "error getting volume snapshot class")
+	}
+
+	snapshotter, _, _ := unstructured.NestedString(class.Object, "snapshotter")
+	return snapshotter == s.ProvisionerName, nil
+}
@@ -0,0 +1,73 @@
+package provisioner
+
+import (
+	"github.com/golang/glog"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/pkg/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"time"
+)
+
+// rollbackBackoff is how often and how patiently each undo is retried.
+var rollbackBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    4,
+}
+
+// transaction records every object created while provisioning a volume so
+// that a failed Provision can remove them again, newest first.
+type transaction struct {
+	undos []undo
+}
+
+type undo struct {
+	description string
+	fn          func() error
+}
+
+// add records how to remove an object that has just been created or adopted.
+func (t *transaction) add(description string, fn func() error) {
+	t.undos = append(t.undos, undo{description: description, fn: fn})
+}
+
+// rollback unwinds the recorded undos in reverse order, retrying each one, and
+// returns the aggregate of the undos that still failed.
+func (t *transaction) rollback() error {
+	var errs []error
+	for i := len(t.undos) - 1; i >= 0; i-- {
+		u := t.undos[i]
+
+		var lastErr error
+		err := wait.ExponentialBackoff(rollbackBackoff, func() (bool, error) {
+			lastErr = u.fn()
+			// the object is gone already
+			if rest.IsNotFound(lastErr) {
+				lastErr = nil
+			}
+			if lastErr != nil {
+				glog.Warningf("error rolling back %s, retrying: %v", u.description, lastErr)
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			errs = append(errs, errors.Wrapf(lastErr, "error rolling back %s", u.description))
+		}
+	}
+	t.undos = nil
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// descriptions lists the recorded undos, oldest first.
+func (t *transaction) descriptions() []string {
+	descriptions := make([]string, 0, len(t.undos))
+	for _, u := range t.undos {
+		descriptions = append(descriptions, u.description)
+	}
+
+	return descriptions
+}
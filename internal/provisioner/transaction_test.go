@@ -0,0 +1,108 @@
+package provisioner
+
+import (
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// keep failing undos from slowing the tests down
+	rollbackBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 4}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	errFailed := fmt.Errorf("appliance unavailable")
+
+	tests := []struct {
+		name string
+		// results of the successive calls of each undo, the last one repeats
+		results   map[string][]error
+		wantCalls map[string]int
+		wantErr   []string
+	}{
+		{
+			name:      "all undone",
+			results:   map[string][]error{"zvol": {nil}, "target": {nil}, "extent": {nil}},
+			wantCalls: map[string]int{"zvol": 1, "target": 1, "extent": 1},
+		},
+		{
+			name:      "not found counts as undone",
+			results:   map[string][]error{"zvol": {nil}, "target": {rest.NewNotFoundError("/target/1/", "gone")}, "extent": {nil}},
+			wantCalls: map[string]int{"zvol": 1, "target": 1, "extent": 1},
+		},
+		{
+			name:      "retried until undone",
+			results:   map[string][]error{"zvol": {nil}, "target": {errFailed, errFailed, nil}, "extent": {nil}},
+			wantCalls: map[string]int{"zvol": 1, "target": 3, "extent": 1},
+		},
+		{
+			name:      "failures are aggregated and do not stop the rollback",
+			results:   map[string][]error{"zvol": {errFailed}, "target": {nil}, "extent": {errFailed}},
+			wantCalls: map[string]int{"zvol": 4, "target": 1, "extent": 4},
+			wantErr:   []string{"error rolling back extent: appliance unavailable", "error rolling back zvol: appliance unavailable"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &transaction{}
+			calls := map[string]int{}
+			var order []string
+			for _, description := range []string{"zvol", "target", "extent"} {
+				description := description
+				tx.add(description, func() error {
+					results := tt.results[description]
+					call := calls[description]
+					calls[description]++
+					if call == 0 {
+						order = append(order, description)
+					}
+					if call >= len(results) {
+						call = len(results) - 1
+					}
+					return results[call]
+				})
+			}
+
+			err := tx.rollback()
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatalf("rollback() error = %v", err)
+			}
+			for _, want := range tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("rollback() error = %v, want it to contain %q", err, want)
+				}
+			}
+
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("undo calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if want := []string{"extent", "target", "zvol"}; !reflect.DeepEqual(order, want) {
+				t.Errorf("undo order = %v, want newest first %v", order, want)
+			}
+			if len(tx.descriptions()) != 0 {
+				t.Errorf("rollback() left undos %v behind", tx.descriptions())
+			}
+		})
+	}
+}
+
+func TestTransactionDescriptions(t *testing.T) {
+	tx := &transaction{}
+	if got := tx.descriptions(); len(got) != 0 {
+		t.Errorf("descriptions() = %v, want none", got)
+	}
+
+	tx.add("zvol tank/k8s/pvc-1", func() error { return nil })
+	tx.add("iscsi target 1", func() error { return nil })
+
+	want := []string{"zvol tank/k8s/pvc-1", "iscsi target 1"}
+	if got := tx.descriptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("descriptions() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,210 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/snapshot"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/z_vol"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The volume functions work on the annotations Provision records on a
+// persistent volume, so they serve volumes whether kubernetes or a CSI
+// client keeps track of them.
+
+// VolumeID returns an id from which ParseVolumeID restores what Delete needs
+// to remove the volume, for clients that only keep an id.
+//
+// Volumes with per volume chap credentials or initiator groups cannot be
+// identified this way.
+func VolumeID(volume *v1.PersistentVolume) (string, error) {
+	if _, ok := volume.Annotations[authIDAnnotation]; ok {
+		return "", fmt.Errorf("volume %s has per volume chap credentials", volume.Name)
+	}
+	if _, ok := volume.Annotations[initiatorGroupIDAnnotation]; ok {
+		return "", fmt.Errorf("volume %s has a per volume initiator group", volume.Name)
+	}
+
+	if shareID, ok := volume.Annotations[nfsShareIDAnnotation]; ok {
+		// nfs:<share id>:<pool>/<dataset>
+		return fmt.Sprintf("%s:%s:%s/%s", NFSProtocol, shareID, volume.Annotations[datasetPoolAnnotation], volume.Annotations[datasetNameAnnotation]), nil
+	}
+
+	// iscsi:<target id>:<extent id>:<pool>/<zvol>
+	return fmt.Sprintf("%s:%s:%s:%s/%s", ISCSIProtocol, volume.Annotations[targetIDAnnotation], volume.Annotations[extentIDAnnotation], volume.Annotations[datasetPoolAnnotation], volume.Annotations[zVolNameAnnotation]), nil
+}
+
+// ParseVolumeID returns a persistent volume carrying the annotations of the
+// volume with id.
+func ParseVolumeID(id string) (*v1.PersistentVolume, error) {
+	fields := strings.Split(id, ":")
+	annotations := map[string]string{}
+
+	var name string
+	switch {
+	case len(fields) == 3 && fields[0] == NFSProtocol:
+		annotations[nfsShareIDAnnotation] = fields[1]
+		name = fields[2]
+	case len(fields) == 4 && fields[0] == ISCSIProtocol:
+		annotations[targetIDAnnotation] = fields[1]
+		annotations[extentIDAnnotation] = fields[2]
+		name = fields[3]
+	default:
+		return nil, fmt.Errorf("invalid volume id %s", id)
+	}
+
+	for _, idAnnotation := range []string{nfsShareIDAnnotation, targetIDAnnotation, extentIDAnnotation} {
+		if value, ok := annotations[idAnnotation]; ok {
+			if _, err := strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("invalid volume id %s", id)
+			}
+		}
+	}
+
+	pool := strings.SplitN(name, "/", 2)
+	if len(pool) != 2 || pool[0] == "" || pool[1] == "" {
+		return nil, fmt.Errorf("invalid volume id %s", id)
+	}
+	annotations[datasetPoolAnnotation] = pool[0]
+	if fields[0] == NFSProtocol {
+		annotations[datasetNameAnnotation] = pool[1]
+	} else {
+		annotations[zVolNameAnnotation] = pool[1]
+	}
+
+	return &v1.PersistentVolume{
+		ObjectMeta: v12.ObjectMeta{
+			Name:        path.Base(name),
+			Annotations: annotations,
+		},
+	}, nil
+}
+
+// VolumeDataset returns the full name of the zvol or dataset backing volume.
+func VolumeDataset(volume *v1.PersistentVolume) (string, error) {
+	datasetPool, ok := volume.Annotations[datasetPoolAnnotation]
+	if !ok {
+		return "", fmt.Errorf("missing required volume annotation %s", datasetPoolAnnotation)
+	}
+
+	if zVolName, ok := volume.Annotations[zVolNameAnnotation]; ok {
+		return fmt.Sprintf("%s/%s", datasetPool, zVolName), nil
+	}
+	if datasetName, ok := volume.Annotations[datasetNameAnnotation]; ok {
+		return fmt.Sprintf("%s/%s", datasetPool, datasetName), nil
+	}
+
+	return "", fmt.Errorf("missing required volume annotation %s or %s", zVolNameAnnotation, datasetNameAnnotation)
+}
+
+// IsBlockVolume reports whether volume is backed by a zvol.
+func IsBlockVolume(volume *v1.PersistentVolume) bool {
+	_, ok := volume.Annotations[zVolNameAnnotation]
+	return ok
+}
+
+// ExpandVolume grows the zvol of volume, or the quota of its dataset, to
+// size.
+func ExpandVolume(ctx context.Context, fn freenas.Interface, volume *v1.PersistentVolume, size resource.Quantity) error {
+	datasetPool, ok := volume.Annotations[datasetPoolAnnotation]
+	if !ok {
+		return fmt.Errorf("missing required volume annotation %s", datasetPoolAnnotation)
+	}
+
+	if zVolName, ok := volume.Annotations[zVolNameAnnotation]; ok {
+		zVolSize := fmt.Sprintf("%d KiB", size.Value()/1024)
+		_, err := fn.Storage().ZVol().Update(ctx,
+			&dataset.Dataset{
+				Pool: &datasetPool,
+			},
+			&z_vol.ZVol{
+				Name:    &zVolName,
+				Volsize: &zVolSize,
+			},
+		)
+		if err != nil {
+			return errors.Wrap(err, "error resizing zvol")
+		}
+
+		return nil
+	}
+
+	datasetName, ok := volume.Annotations[datasetNameAnnotation]
+	if !ok {
+		return fmt.Errorf("missing required volume annotation %s", datasetNameAnnotation)
+	}
+
+	quota := int(size.Value())
+	_, err := fn.Storage().Dataset().Update(ctx,
+		&dataset.Dataset{
+			Pool: &datasetPool,
+		},
+		&dataset.Dataset{
+			Name:  &datasetName,
+			Quota: &quota,
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "error resizing dataset")
+	}
+
+	return nil
+}
+
+// SnapshotSize returns the size of the zvol the zfs snapshot fullname was
+// taken of. Zvols only grow, so volumes cloned from the snapshot fit in it.
+func SnapshotSize(ctx context.Context, fn freenas.Interface, fullname string) (int64, error) {
+	_, err := fn.Storage().Snapshot().Get(ctx, &snapshot.Snapshot{Fullname: &fullname})
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting zfs snapshot")
+	}
+
+	pool := strings.SplitN(strings.SplitN(fullname, "@", 2)[0], "/", 2)
+	if len(pool) != 2 {
+		return 0, fmt.Errorf("zfs snapshot %s is not of a zvol", fullname)
+	}
+	zVol, err := fn.Storage().ZVol().Get(ctx, &dataset.Dataset{Pool: &pool[0]}, &z_vol.ZVol{Name: &pool[1]})
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting snapshotted zvol")
+	}
+
+	return zVol.Size()
+}
+
+// SnapshotVolume takes the zfs snapshot name of the zvol or dataset backing
+// volume, reusing one left behind by an earlier attempt, and returns its full
+// name.
+func SnapshotVolume(ctx context.Context, fn freenas.Interface, volume *v1.PersistentVolume, name string) (string, error) {
+	ds, err := VolumeDataset(volume)
+	if err != nil {
+		return "", err
+	}
+
+	fullname := fmt.Sprintf("%s@%s", ds, name)
+	_, err = fn.Storage().Snapshot().Get(ctx, &snapshot.Snapshot{Fullname: &fullname})
+	if err == nil {
+		return fullname, nil
+	}
+	if !rest.IsNotFound(err) {
+		return "", errors.Wrap(err, "error getting zfs snapshot")
+	}
+
+	_, err = fn.Storage().Snapshot().Create(ctx, &snapshot.Snapshot{
+		Dataset: &ds,
+		Name:    &name,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "error creating zfs snapshot")
+	}
+
+	return fullname, nil
+}
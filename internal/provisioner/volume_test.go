@@ -0,0 +1,226 @@
+package provisioner
+
+import (
+	"context"
+	freenas_fake "github.com/jakekeeys/freenas-provisioner/pkg/freenas/fake"
+	v1 "k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestVolumeID(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name: "iscsi",
+			annotations: map[string]string{
+				targetIDAnnotation:    "1",
+				extentIDAnnotation:    "2",
+				datasetPoolAnnotation: "tank",
+				zVolNameAnnotation:    "k8s/pvc-1",
+			},
+			want: "iscsi:1:2:tank/k8s/pvc-1",
+		},
+		{
+			name: "nfs",
+			annotations: map[string]string{
+				nfsShareIDAnnotation:  "3",
+				datasetPoolAnnotation: "tank",
+				datasetNameAnnotation: "k8s/pvc-1",
+			},
+			want: "nfs:3:tank/k8s/pvc-1",
+		},
+		{
+			name: "per volume chap credentials",
+			annotations: map[string]string{
+				targetIDAnnotation:    "1",
+				extentIDAnnotation:    "2",
+				datasetPoolAnnotation: "tank",
+				zVolNameAnnotation:    "k8s/pvc-1",
+				authIDAnnotation:      "4",
+			},
+			wantErr: true,
+		},
+		{
+			name: "per volume initiator group",
+			annotations: map[string]string{
+				targetIDAnnotation:         "1",
+				extentIDAnnotation:         "2",
+				datasetPoolAnnotation:      "tank",
+				zVolNameAnnotation:         "k8s/pvc-1",
+				initiatorGroupIDAnnotation: "5",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume := &v1.PersistentVolume{ObjectMeta: v12.ObjectMeta{Name: "pvc-1", Annotations: tt.annotations}}
+			got, err := VolumeID(volume)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("VolumeID() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VolumeID() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("VolumeID() = %s, want %s", got, tt.want)
+			}
+
+			// the id restores the annotations it was made of
+			parsed, err := ParseVolumeID(got)
+			if err != nil {
+				t.Fatalf("ParseVolumeID(%s) error = %v", got, err)
+			}
+			if !reflect.DeepEqual(parsed.Annotations, tt.annotations) {
+				t.Errorf("ParseVolumeID(%s) annotations = %v, want %v", got, parsed.Annotations, tt.annotations)
+			}
+		})
+	}
+}
+
+func TestParseVolumeID(t *testing.T) {
+	tests := []struct {
+		id       string
+		wantName string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{
+			id:       "iscsi:1:2:tank/k8s/pvc-1",
+			wantName: "pvc-1",
+			want: map[string]string{
+				targetIDAnnotation:    "1",
+				extentIDAnnotation:    "2",
+				datasetPoolAnnotation: "tank",
+				zVolNameAnnotation:    "k8s/pvc-1",
+			},
+		},
+		{
+			id:       "nfs:3:tank/pvc-1",
+			wantName: "pvc-1",
+			want: map[string]string{
+				nfsShareIDAnnotation:  "3",
+				datasetPoolAnnotation: "tank",
+				datasetNameAnnotation: "pvc-1",
+			},
+		},
+		{id: "", wantErr: true},
+		{id: "pvc-1", wantErr: true},
+		{id: "iscsi:1:tank/k8s/pvc-1", wantErr: true},
+		{id: "nfs:3:2:tank/k8s/pvc-1", wantErr: true},
+		{id: "smb:3:tank/k8s/pvc-1", wantErr: true},
+		{id: "iscsi:a:2:tank/k8s/pvc-1", wantErr: true},
+		{id: "iscsi:1:b:tank/k8s/pvc-1", wantErr: true},
+		{id: "nfs::tank/k8s/pvc-1", wantErr: true},
+		{id: "iscsi:1:2:pvc-1", wantErr: true},
+		{id: "iscsi:1:2:/k8s/pvc-1", wantErr: true},
+		{id: "nfs:3:tank/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			got, err := ParseVolumeID(tt.id)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseVolumeID() = %v, want an error", got.Annotations)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVolumeID() error = %v", err)
+			}
+			if got.Name != tt.wantName {
+				t.Errorf("ParseVolumeID() name = %s, want %s", got.Name, tt.wantName)
+			}
+			if !reflect.DeepEqual(got.Annotations, tt.want) {
+				t.Errorf("ParseVolumeID() annotations = %v, want %v", got.Annotations, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotVolume(t *testing.T) {
+	const snapshotPath = "/api/v1.0/storage/snapshot/tank/k8s/pvc-1@snap-1/"
+
+	tests := []struct {
+		name string
+		// prepare sets up the appliance before the snapshot is taken
+		prepare       func(t *testing.T, server *freenas_fake.Server)
+		wantErr       bool
+		wantCreates   int
+		wantSnapshots []string
+	}{
+		{
+			name:          "creates a missing snapshot",
+			wantCreates:   1,
+			wantSnapshots: []string{"tank/k8s/pvc-1@snap-1"},
+		},
+		{
+			name: "reuses an existing snapshot",
+			prepare: func(t *testing.T, server *freenas_fake.Server) {
+				if err := server.AddSnapshot("tank/k8s/pvc-1@snap-1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantSnapshots: []string{"tank/k8s/pvc-1@snap-1"},
+		},
+		{
+			name: "fails when the lookup fails",
+			prepare: func(t *testing.T, server *freenas_fake.Server) {
+				server.Fail(http.MethodGet, snapshotPath, http.StatusInternalServerError)
+			},
+			wantErr:       true,
+			wantSnapshots: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, server := newTestFreenas(t)
+			defer server.Close()
+			if err := server.AddZVol("tank/k8s/pvc-1", 1<<30); err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, server)
+			}
+
+			volume, err := ParseVolumeID("iscsi:1:1:tank/k8s/pvc-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fullname, err := SnapshotVolume(context.Background(), p.Freenas, volume, "snap-1")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("SnapshotVolume() = %s, want an error", fullname)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("SnapshotVolume() error = %v", err)
+				}
+				if fullname != "tank/k8s/pvc-1@snap-1" {
+					t.Errorf("SnapshotVolume() = %s, want tank/k8s/pvc-1@snap-1", fullname)
+				}
+			}
+
+			if creates := server.Requests(http.MethodPost, "/api/v1.0/storage/snapshot/"); creates != tt.wantCreates {
+				t.Errorf("SnapshotVolume() created %d snapshots, want %d", creates, tt.wantCreates)
+			}
+			if snapshots := server.Snapshots(); !reflect.DeepEqual(snapshots, tt.wantSnapshots) {
+				t.Errorf("snapshots = %v, want %v", snapshots, tt.wantSnapshots)
+			}
+		})
+	}
+}
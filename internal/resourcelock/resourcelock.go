@@ -0,0 +1,140 @@
+// Package resourcelock adds a leader election lock on coordination.k8s.io
+// leases to the endpoints and configmaps locks of client-go, whose release in
+// use predates its own lease lock.
+package resourcelock
+
+import (
+	"errors"
+	"fmt"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	EndpointsResourceLock  = resourcelock.EndpointsResourceLock
+	ConfigMapsResourceLock = resourcelock.ConfigMapsResourceLock
+	LeasesResourceLock     = "leases"
+)
+
+// ResourceLockConfig is the configuration shared by all lock types.
+type ResourceLockConfig = resourcelock.ResourceLockConfig
+
+// New returns a lock of lockType on the object name in namespace ns.
+func New(lockType, ns, name string, coreClient corev1client.CoreV1Interface, coordinationClient coordinationclient.CoordinationV1beta1Interface, rlc ResourceLockConfig) (resourcelock.Interface, error) {
+	if lockType != LeasesResourceLock {
+		return resourcelock.New(lockType, ns, name, coreClient, rlc)
+	}
+
+	return &LeaseLock{
+		LeaseMeta: v12.ObjectMeta{
+			Namespace: ns,
+			Name:      name,
+		},
+		Client:     coordinationClient,
+		LockConfig: rlc,
+	}, nil
+}
+
+// LeaseLock keeps the leader election record in the spec of a lease.
+type LeaseLock struct {
+	LeaseMeta  v12.ObjectMeta
+	Client     coordinationclient.LeasesGetter
+	LockConfig ResourceLockConfig
+	lease      *coordinationv1beta1.Lease
+}
+
+// Get returns the election record of the lease.
+func (l *LeaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	var err error
+	l.lease, err = l.Client.Leases(l.LeaseMeta.Namespace).Get(l.LeaseMeta.Name, v12.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return leaseSpecToRecord(&l.lease.Spec), nil
+}
+
+// Create creates the lease holding ler.
+func (l *LeaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	var err error
+	l.lease, err = l.Client.Leases(l.LeaseMeta.Namespace).Create(&coordinationv1beta1.Lease{
+		ObjectMeta: v12.ObjectMeta{
+			Namespace: l.LeaseMeta.Namespace,
+			Name:      l.LeaseMeta.Name,
+		},
+		Spec: recordToLeaseSpec(&ler),
+	})
+
+	return err
+}
+
+// Update replaces the election record of the lease read by Get or Create.
+func (l *LeaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return errors.New("lease not initialized, call get or create first")
+	}
+
+	l.lease.Spec = recordToLeaseSpec(&ler)
+	var err error
+	l.lease, err = l.Client.Leases(l.LeaseMeta.Namespace).Update(l.lease)
+
+	return err
+}
+
+// RecordEvent records s on the lease.
+func (l *LeaseLock) RecordEvent(s string) {
+	if l.LockConfig.EventRecorder == nil || l.lease == nil {
+		return
+	}
+
+	events := fmt.Sprintf("%v %v", l.LockConfig.Identity, s)
+	l.LockConfig.EventRecorder.Eventf(&coordinationv1beta1.Lease{ObjectMeta: l.lease.ObjectMeta}, v1.EventTypeNormal, "LeaderElection", events)
+}
+
+// Describe returns the namespace and name of the lease.
+func (l *LeaseLock) Describe() string {
+	return fmt.Sprintf("%v/%v", l.LeaseMeta.Namespace, l.LeaseMeta.Name)
+}
+
+// Identity returns the identity of this candidate.
+func (l *LeaseLock) Identity() string {
+	return l.LockConfig.Identity
+}
+
+func leaseSpecToRecord(spec *coordinationv1beta1.LeaseSpec) *resourcelock.LeaderElectionRecord {
+	record := &resourcelock.LeaderElectionRecord{}
+	if spec.HolderIdentity != nil {
+		record.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		record.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.LeaseTransitions != nil {
+		record.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	if spec.AcquireTime != nil {
+		record.AcquireTime = v12.Time{Time: spec.AcquireTime.Time}
+	}
+	if spec.RenewTime != nil {
+		record.RenewTime = v12.Time{Time: spec.RenewTime.Time}
+	}
+
+	return record
+}
+
+func recordToLeaseSpec(ler *resourcelock.LeaderElectionRecord) coordinationv1beta1.LeaseSpec {
+	leaseDurationSeconds := int32(ler.LeaseDurationSeconds)
+	leaseTransitions := int32(ler.LeaderTransitions)
+
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &ler.HolderIdentity,
+		LeaseDurationSeconds: &leaseDurationSeconds,
+		AcquireTime:          &v12.MicroTime{Time: ler.AcquireTime.Time},
+		RenewTime:            &v12.MicroTime{Time: ler.RenewTime.Time},
+		LeaseTransitions:     &leaseTransitions,
+	}
+}
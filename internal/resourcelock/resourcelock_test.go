@@ -0,0 +1,153 @@
+package resourcelock
+
+import (
+	"context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		lockType string
+		wantErr  bool
+	}{
+		{lockType: LeasesResourceLock},
+		{lockType: EndpointsResourceLock},
+		{lockType: ConfigMapsResourceLock},
+		{lockType: "secrets", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lockType, func(t *testing.T) {
+			client := k8sfake.NewSimpleClientset()
+			lock, err := New(tt.lockType, "storage", "freenas-provisioner", client.CoreV1(), client.CoordinationV1beta1(), ResourceLockConfig{Identity: "replica-1"})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("New() = %T, want an error", lock)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			if _, ok := lock.(*LeaseLock); ok != (tt.lockType == LeasesResourceLock) {
+				t.Errorf("New() = %T", lock)
+			}
+			if lock.Identity() != "replica-1" || lock.Describe() != "storage/freenas-provisioner" {
+				t.Errorf("New() = %s of %s, want replica-1 of storage/freenas-provisioner", lock.Identity(), lock.Describe())
+			}
+		})
+	}
+}
+
+func TestLeaseLock(t *testing.T) {
+	client := k8sfake.NewSimpleClientset()
+	lock, err := New(LeasesResourceLock, "storage", "freenas-provisioner", client.CoreV1(), client.CoordinationV1beta1(), ResourceLockConfig{
+		Identity:      "replica-1",
+		EventRecorder: record.NewFakeRecorder(10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = lock.Get()
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("Get() error = %v, want not found", err)
+	}
+	if err := lock.Update(resourcelock.LeaderElectionRecord{}); err == nil {
+		t.Error("Update() before Create() error = nil, want an error")
+	}
+
+	// leases store times in microseconds
+	now := v12.Time{Time: time.Now().Truncate(time.Second)}
+	created := resourcelock.LeaderElectionRecord{
+		HolderIdentity:       "replica-1",
+		LeaseDurationSeconds: 15,
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+	err = lock.Create(created)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	lock.RecordEvent("became leader")
+
+	got, err := lock.Get()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !recordsEqual(*got, created) {
+		t.Errorf("Get() = %+v, want %+v", *got, created)
+	}
+
+	renewed := created
+	renewed.HolderIdentity = "replica-2"
+	renewed.RenewTime = v12.Time{Time: now.Add(10 * time.Second)}
+	renewed.LeaderTransitions = 1
+	err = lock.Update(renewed)
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	lease, err := client.CoordinationV1beta1().Leases("storage").Get("freenas-provisioner", v12.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *lease.Spec.HolderIdentity != "replica-2" || *lease.Spec.LeaseTransitions != 1 || *lease.Spec.LeaseDurationSeconds != 15 {
+		t.Errorf("lease spec = %+v, want replica-2 holding it after 1 transition", lease.Spec)
+	}
+}
+
+func TestLeaseLockElection(t *testing.T) {
+	client := k8sfake.NewSimpleClientset()
+	lock, err := New(LeasesResourceLock, "storage", "freenas-provisioner", client.CoreV1(), client.CoordinationV1beta1(), ResourceLockConfig{
+		Identity:      "replica-1",
+		EventRecorder: record.NewFakeRecorder(10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) { cancel() },
+			OnStoppedLeading: func() {},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elector.Run(ctx)
+
+	if ctx.Err() != context.Canceled {
+		t.Fatal("replica-1 did not become leader")
+	}
+	lease, err := client.CoordinationV1beta1().Leases("storage").Get("freenas-provisioner", v12.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *lease.Spec.HolderIdentity != "replica-1" {
+		t.Errorf("lease holder = %s, want replica-1", *lease.Spec.HolderIdentity)
+	}
+}
+
+func recordsEqual(a, b resourcelock.LeaderElectionRecord) bool {
+	return a.HolderIdentity == b.HolderIdentity &&
+		a.LeaseDurationSeconds == b.LeaseDurationSeconds &&
+		a.AcquireTime.Equal(&b.AcquireTime) &&
+		a.RenewTime.Equal(&b.RenewTime) &&
+		a.LeaderTransitions == b.LeaderTransitions
+}
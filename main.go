@@ -1,49 +1,53 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/golang/glog"
+	"github.com/jakekeeys/freenas-provisioner/internal/csi"
 	"github.com/jakekeeys/freenas-provisioner/internal/provisioner"
+	"github.com/jakekeeys/freenas-provisioner/internal/resourcelock"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/middleware"
 	freenas_rest "github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
 	"github.com/jawher/mow.cli"
 	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"github.com/kubernetes-sigs/sig-storage-lib-external-provisioner/controller/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/record"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	appName = "freenas-provisioner"
 	appDesc = "Kubernetes FreeNAS Provisioner"
+
+	transportREST      = "rest"
+	transportWebsocket = "websocket"
 )
 
 var (
 	appVersion string
 )
 
-const (
-	// parameter keys
-	rootDatasetNameParam  = "rootDatasetName"
-	portalGroupParam      = "portalGroup"
-	initiatorGroupParam   = "initiatorGroup"
-	lunIDParam            = "lunID"
-	thinProvisioningParam = "thinProvisioning"
-	targetPortalParam     = "targetPortal"
-	initiatorNameParam    = "initiatorName"
-
-	// parameter defaults
-	extentType       = "Disk"
-	iSCSIInterface   = "default"
-	fsType           = "ext4"
-	thinProvisioning = true
-	initiatorName    = "iqn.2001-04.com.kubernetes:storage"
-)
-
 func main() {
 	flag.Parse()
 	err := flag.Set("logtostderr", "true")
@@ -65,12 +69,6 @@ func main() {
 		Desc:   "Provisioner Name (e.g. 'provisioner' attribute of storage-class)",
 		EnvVar: "PROVISIONER_NAME",
 	})
-	storageClassName := app.String(cli.StringOpt{
-		Name:   "storage-class-name",
-		Value:  "freenas-iscsi",
-		Desc:   "Storage class name",
-		EnvVar: "STORAGE_CLASS_NAME",
-	})
 
 	freenasAPIUser := app.String(cli.StringOpt{
 		Name:   "freenas-api-user",
@@ -83,19 +81,280 @@ func main() {
 		Desc:   "Freenas API password",
 		EnvVar: "FREENAS_API_PASSWORD",
 	})
+	freenasAPIKey := app.String(cli.StringOpt{
+		Name:   "freenas-api-key",
+		Desc:   "Freenas API key, used instead of the username and password when set",
+		EnvVar: "FREENAS_API_KEY",
+	})
 	freenasAPIHost := app.String(cli.StringOpt{
 		Name:   "freenas-api-host",
 		Desc:   "Freenas API host",
 		EnvVar: "FREENAS_API_HOST",
 	})
+	freenasAPIVersion := app.String(cli.StringOpt{
+		Name:   "freenas-api-version",
+		Value:  freenas.APIVersionAuto,
+		Desc:   "Freenas API version (auto, v1.0 or v2.0)",
+		EnvVar: "FREENAS_API_VERSION",
+	})
+	freenasAPITransport := app.String(cli.StringOpt{
+		Name:   "freenas-api-transport",
+		Value:  transportREST,
+		Desc:   "Freenas API transport (rest or websocket, websocket requires the v2.0 middleware)",
+		EnvVar: "FREENAS_API_TRANSPORT",
+	})
 	freenasAPISkipTLSVerification := app.Bool(cli.BoolOpt{
 		Name:   "freenas-api-skip-tls-verification",
 		Desc:   "Skip tls certificate verification",
 		EnvVar: "FREENAS_API_SKIP_TLS_VERIFICATION",
 		Value:  false,
 	})
+	freenasAPICAFile := app.String(cli.StringOpt{
+		Name:   "freenas-api-ca-file",
+		Desc:   "PEM bundle of the CAs that sign the Freenas API certificate",
+		EnvVar: "FREENAS_API_CA_FILE",
+	})
+	freenasAPITLSFingerprint := app.String(cli.StringOpt{
+		Name:   "freenas-api-tls-fingerprint",
+		Desc:   "SHA-256 fingerprint the Freenas API certificate has to match, trusted without verifying its chain unless a CA file is given",
+		EnvVar: "FREENAS_API_TLS_FINGERPRINT",
+	})
+	freenasAPIClientCert := app.String(cli.StringOpt{
+		Name:   "freenas-api-client-cert",
+		Desc:   "PEM client certificate for mutual tls with the Freenas API",
+		EnvVar: "FREENAS_API_CLIENT_CERT",
+	})
+	freenasAPIClientKey := app.String(cli.StringOpt{
+		Name:   "freenas-api-client-key",
+		Desc:   "PEM key of the client certificate",
+		EnvVar: "FREENAS_API_CLIENT_KEY",
+	})
+	freenasAPITLSMinVersion := app.String(cli.StringOpt{
+		Name:   "freenas-api-tls-min-version",
+		Value:  "1.2",
+		Desc:   "Lowest tls version accepted from the Freenas API (1.0, 1.1, 1.2 or 1.3)",
+		EnvVar: "FREENAS_API_TLS_MIN_VERSION",
+	})
+	freenasAPITimeout := app.String(cli.StringOpt{
+		Name:   "freenas-api-timeout",
+		Value:  freenas_rest.DefaultTimeouts.Default.String(),
+		Desc:   "How long a Freenas API request may take before it is abandoned (0 disables the timeout)",
+		EnvVar: "FREENAS_API_TIMEOUT",
+	})
+	freenasAPIOperationTimeouts := app.String(cli.StringOpt{
+		Name:   "freenas-api-operation-timeouts",
+		Desc:   "Timeouts overriding --freenas-api-timeout per operation (e.g. create=5m,delete=2m)",
+		EnvVar: "FREENAS_API_OPERATION_TIMEOUTS",
+	})
+	freenasAPIMaxRetries := app.Int(cli.IntOpt{
+		Name:   "freenas-api-max-retries",
+		Value:  freenas_rest.DefaultRetryConfig.MaxRetries,
+		Desc:   "How often failed Freenas API requests are retried (0 disables retries)",
+		EnvVar: "FREENAS_API_MAX_RETRIES",
+	})
+	freenasAPIRetryBackoff := app.String(cli.StringOpt{
+		Name:   "freenas-api-retry-backoff",
+		Value:  freenas_rest.DefaultRetryConfig.InitialBackoff.String(),
+		Desc:   "Wait before the first retry, doubled for every further retry",
+		EnvVar: "FREENAS_API_RETRY_BACKOFF",
+	})
+	freenasAPIRetryMaxBackoff := app.String(cli.StringOpt{
+		Name:   "freenas-api-retry-max-backoff",
+		Value:  freenas_rest.DefaultRetryConfig.MaxBackoff.String(),
+		Desc:   "Longest wait between retries",
+		EnvVar: "FREENAS_API_RETRY_MAX_BACKOFF",
+	})
+	freenasAPIRetryJitter := app.String(cli.StringOpt{
+		Name:   "freenas-api-retry-jitter",
+		Value:  strconv.FormatFloat(freenas_rest.DefaultRetryConfig.Jitter, 'f', -1, 64),
+		Desc:   "Fraction by which waits between retries are randomly extended",
+		EnvVar: "FREENAS_API_RETRY_JITTER",
+	})
+	freenasAPIBreakerThreshold := app.Int(cli.IntOpt{
+		Name:   "freenas-api-breaker-threshold",
+		Value:  freenas_rest.DefaultRetryConfig.BreakerThreshold,
+		Desc:   "Consecutive failed Freenas API requests after which requests fail fast (0 disables the circuit breaker)",
+		EnvVar: "FREENAS_API_BREAKER_THRESHOLD",
+	})
+	freenasAPIBreakerCooldown := app.String(cli.StringOpt{
+		Name:   "freenas-api-breaker-cooldown",
+		Value:  freenas_rest.DefaultRetryConfig.BreakerCooldown.String(),
+		Desc:   "How long requests fail fast before the Freenas API is tried again",
+		EnvVar: "FREENAS_API_BREAKER_COOLDOWN",
+	})
+
+	enableSnapshots := app.Bool(cli.BoolOpt{
+		Name:   "enable-snapshots",
+		Desc:   "Take zfs snapshots for VolumeSnapshot objects (requires the snapshot.storage.k8s.io CRDs)",
+		EnvVar: "ENABLE_SNAPSHOTS",
+		Value:  false,
+	})
+
+	orphanCollectionInterval := app.String(cli.StringOpt{
+		Name:   "orphan-collection-interval",
+		Value:  "10m",
+		Desc:   "How often to look for FreeNAS objects no persistent volume references (0 disables)",
+		EnvVar: "ORPHAN_COLLECTION_INTERVAL",
+	})
+	deleteOrphans := app.Bool(cli.BoolOpt{
+		Name:   "delete-orphans",
+		Desc:   "Delete FreeNAS objects no persistent volume references once the grace period has passed",
+		EnvVar: "DELETE_ORPHANS",
+		Value:  false,
+	})
+	orphanGracePeriod := app.String(cli.StringOpt{
+		Name:   "orphan-grace-period",
+		Value:  "24h",
+		Desc:   "How long an object has to be orphaned before it is deleted",
+		EnvVar: "ORPHAN_GRACE_PERIOD",
+	})
+	metricsPort := app.Int(cli.IntOpt{
+		Name:   "metrics-port",
+		Desc:   "Port to serve prometheus metrics on (0 disables)",
+		EnvVar: "METRICS_PORT",
+		Value:  8080,
+	})
+	healthPort := app.Int(cli.IntOpt{
+		Name:   "health-port",
+		Desc:   "Port to serve /healthz and /readyz on (0 disables)",
+		EnvVar: "HEALTH_PORT",
+		Value:  8081,
+	})
+	readinessProbeInterval := app.String(cli.StringOpt{
+		Name:   "readiness-probe-interval",
+		Value:  "10s",
+		Desc:   "How often to probe FreeNAS for readiness, /readyz serves the latest result",
+		EnvVar: "READINESS_PROBE_INTERVAL",
+	})
+	readinessProbeTimeout := app.String(cli.StringOpt{
+		Name:   "readiness-probe-timeout",
+		Value:  "5s",
+		Desc:   "Timeout of a readiness probe of FreeNAS",
+		EnvVar: "READINESS_PROBE_TIMEOUT",
+	})
+	readinessFailureThreshold := app.Int(cli.IntOpt{
+		Name:   "readiness-failure-threshold",
+		Value:  3,
+		Desc:   "Consecutive failed FreeNAS probes after which the provisioner is not ready",
+		EnvVar: "READINESS_FAILURE_THRESHOLD",
+	})
+	readinessSuccessThreshold := app.Int(cli.IntOpt{
+		Name:   "readiness-success-threshold",
+		Value:  1,
+		Desc:   "Consecutive successful FreeNAS probes after which the provisioner is ready again",
+		EnvVar: "READINESS_SUCCESS_THRESHOLD",
+	})
+
+	leaderElection := app.Bool(cli.BoolOpt{
+		Name:   "leader-election",
+		Desc:   "Elect a leader among the replicas, only the leader provisions volumes",
+		EnvVar: "LEADER_ELECTION",
+		Value:  true,
+	})
+	leaderElectionLockType := app.String(cli.StringOpt{
+		Name:   "leader-election-lock-type",
+		Value:  resourcelock.LeasesResourceLock,
+		Desc:   "Kind of object holding the leader election lock (leases, endpoints or configmaps)",
+		EnvVar: "LEADER_ELECTION_LOCK_TYPE",
+	})
+	leaderElectionNamespace := app.String(cli.StringOpt{
+		Name:   "leader-election-namespace",
+		Desc:   "Namespace of the leader election lock (defaults to the provisioner's namespace)",
+		EnvVar: "LEADER_ELECTION_NAMESPACE",
+	})
+	leaderElectionIdentity := app.String(cli.StringOpt{
+		Name:   "leader-election-identity",
+		Desc:   "Identity of this replica in the leader election (defaults to the hostname)",
+		EnvVar: "LEADER_ELECTION_IDENTITY",
+	})
+	leaderElectionLeaseDuration := app.String(cli.StringOpt{
+		Name:   "leader-election-lease-duration",
+		Value:  "15s",
+		Desc:   "How long standby replicas wait before taking over the lock of a leader that stopped renewing it",
+		EnvVar: "LEADER_ELECTION_LEASE_DURATION",
+	})
+	leaderElectionRenewDeadline := app.String(cli.StringOpt{
+		Name:   "leader-election-renew-deadline",
+		Value:  "10s",
+		Desc:   "How long the leader retries renewing its lock before giving up leadership",
+		EnvVar: "LEADER_ELECTION_RENEW_DEADLINE",
+	})
+	leaderElectionRetryPeriod := app.String(cli.StringOpt{
+		Name:   "leader-election-retry-period",
+		Value:  "2s",
+		Desc:   "How often replicas try to acquire or renew the lock",
+		EnvVar: "LEADER_ELECTION_RETRY_PERIOD",
+	})
+
+	csiEndpoint := app.String(cli.StringOpt{
+		Name:   "csi-endpoint",
+		Desc:   "unix:// or tcp:// url to serve the CSI identity and controller services on, alongside the provisioner (empty disables)",
+		EnvVar: "CSI_ENDPOINT",
+	})
+	csiDriverName := app.String(cli.StringOpt{
+		Name:   "csi-driver-name",
+		Value:  "freenas.csi.jakekeeys.github.com",
+		Desc:   "Name of the CSI driver",
+		EnvVar: "CSI_DRIVER_NAME",
+	})
+	csiNode := app.Bool(cli.BoolOpt{
+		Name:   "csi-node",
+		Value:  false,
+		Desc:   "Only serve the CSI identity and node services on --csi-endpoint, attaching volumes to this node",
+		EnvVar: "CSI_NODE",
+	})
+	csiNodeID := app.String(cli.StringOpt{
+		Name:   "csi-node-id",
+		Desc:   "Id of this node in the CSI node service (defaults to the hostname)",
+		EnvVar: "CSI_NODE_ID",
+	})
+	csiStateDir := app.String(cli.StringOpt{
+		Name:   "csi-state-dir",
+		Value:  "/var/lib/freenas-csi",
+		Desc:   "Directory the CSI node service keeps staged volumes in, must survive restarts",
+		EnvVar: "CSI_STATE_DIR",
+	})
+
+	annotateNode := app.Bool(cli.BoolOpt{
+		Name:   "annotate-node",
+		Value:  false,
+		Desc:   "Only publish the iscsi initiator name of --node-name in its " + provisioner.NodeInitiatorNameAnnotation + " annotation, which per volume initiator groups require",
+		EnvVar: "ANNOTATE_NODE",
+	})
+	nodeName := app.String(cli.StringOpt{
+		Name:   "node-name",
+		Desc:   "Name of the node to annotate",
+		EnvVar: "NODE_NAME",
+	})
+	initiatorNameFile := app.String(cli.StringOpt{
+		Name:   "initiator-name-file",
+		Value:  provisioner.DefaultInitiatorNameFile,
+		Desc:   "open-iscsi file holding the node's initiator name",
+		EnvVar: "INITIATOR_NAME_FILE",
+	})
 
 	app.Action = func() {
+		// the node service runs on every node and needs neither kubernetes
+		// nor freenas
+		if *csiNode {
+			if *csiEndpoint == "" {
+				glog.Fatal("--csi-node requires --csi-endpoint")
+			}
+
+			nodeID := *csiNodeID
+			if nodeID == "" {
+				hostname, err := os.Hostname()
+				if err != nil {
+					glog.Fatal(err)
+				}
+				nodeID = hostname
+			}
+
+			node := csi.NewNode(nodeID, *csiStateDir, csi.NewExecHost())
+			driver := csi.NewDriver(*csiDriverName, appVersion, nil)
+			glog.Fatal(driver.Run(*csiEndpoint, node.Register))
+		}
+
 		var config *rest.Config
 		var err error
 		if *kubenetesConfig != "" {
@@ -115,89 +374,263 @@ func main() {
 			glog.Fatal(err)
 		}
 
-		serverVersion, err := k8sClient.Discovery().ServerVersion()
+		// the node annotator runs on every node and does not need freenas
+		if *annotateNode {
+			if *nodeName == "" {
+				glog.Fatal("--annotate-node requires --node-name")
+			}
+
+			annotator := provisioner.NewNodeAnnotator(k8sClient, *nodeName)
+			annotator.InitiatorNameFile = *initiatorNameFile
+			annotator.Run(wait.NeverStop)
+			return
+		}
+
+		dynamicClient, err := dynamic.NewForConfig(config)
 		if err != nil {
 			glog.Fatal(err)
 		}
 
-		class, err := k8sClient.StorageV1().StorageClasses().Get(*storageClassName, v1.GetOptions{})
+		serverVersion, err := k8sClient.Discovery().ServerVersion()
 		if err != nil {
 			glog.Fatal(err)
 		}
 
-		freenasProvisionerConfig := provisioner.Config{
-			ExtentType:       extentType,
-			ISCSIInterface:   iSCSIInterface,
-			FsType:           fsType,
-			ThinProvisioning: thinProvisioning,
-			InitiatorName:    initiatorName,
-		}
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartLogging(glog.Infof)
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8sClient.CoreV1().Events("")})
+		recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: *provisionerName})
 
-		// required params
-		rootDatasetName, ok := class.Parameters[rootDatasetNameParam]
-		if !ok {
-			glog.Fatal("missing required storage class parameter", rootDatasetNameParam)
+		tlsConfig, err := freenas_rest.TLSOptions{
+			InsecureSkipVerify: *freenasAPISkipTLSVerification,
+			CAFile:             *freenasAPICAFile,
+			Fingerprint:        *freenasAPITLSFingerprint,
+			CertFile:           *freenasAPIClientCert,
+			KeyFile:            *freenasAPIClientKey,
+			MinVersion:         *freenasAPITLSMinVersion,
+		}.Config()
+		if err != nil {
+			glog.Fatal(err)
 		}
-		freenasProvisionerConfig.RootDatasetName = rootDatasetName
 
-		portalGroupString, ok := class.Parameters[portalGroupParam]
-		if !ok {
-			glog.Fatal("missing required storage class parameter", portalGroupParam)
+		timeouts := freenas_rest.Timeouts{}
+		timeouts.Default, err = time.ParseDuration(*freenasAPITimeout)
+		if err != nil {
+			glog.Fatal(err)
 		}
-		portalGroup, err := strconv.Atoi(portalGroupString)
+		timeouts.Operations, err = freenas_rest.ParseOperationTimeouts(*freenasAPIOperationTimeouts)
 		if err != nil {
 			glog.Fatal(err)
 		}
-		freenasProvisionerConfig.PortalGroup = portalGroup
 
-		initiatorGroupString, ok := class.Parameters[initiatorGroupParam]
-		if !ok {
-			glog.Fatal("missing required storage class parameter", initiatorGroupParam)
+		retryConfig := freenas_rest.RetryConfig{
+			MaxRetries:       *freenasAPIMaxRetries,
+			BreakerThreshold: *freenasAPIBreakerThreshold,
 		}
-		initiatorGroup, err := strconv.Atoi(initiatorGroupString)
+		retryConfig.InitialBackoff, err = time.ParseDuration(*freenasAPIRetryBackoff)
 		if err != nil {
 			glog.Fatal(err)
 		}
-		freenasProvisionerConfig.InitiatorGroup = initiatorGroup
-
-		lunIDString, ok := class.Parameters[lunIDParam]
-		if !ok {
-			glog.Fatal("missing required storage class parameter", lunIDParam)
+		retryConfig.MaxBackoff, err = time.ParseDuration(*freenasAPIRetryMaxBackoff)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		retryConfig.Jitter, err = strconv.ParseFloat(*freenasAPIRetryJitter, 64)
+		if err != nil {
+			glog.Fatal(err)
 		}
-		lunID, err := strconv.Atoi(lunIDString)
+		retryConfig.BreakerCooldown, err = time.ParseDuration(*freenasAPIBreakerCooldown)
 		if err != nil {
 			glog.Fatal(err)
 		}
-		freenasProvisionerConfig.LunID = lunID
 
-		targetPortal, ok := class.Parameters[targetPortalParam]
-		if !ok {
-			glog.Fatal("missing required storage class parameter", targetPortalParam)
+		var fnClient freenas.Interface
+		switch *freenasAPITransport {
+		case transportREST:
+			restClient := freenas_rest.New(*freenasAPIUser, *freenasAPIPassword, *freenasAPIHost, tlsConfig)
+			apiVersion := *freenasAPIVersion
+			if *freenasAPIKey != "" {
+				// api keys are only accepted by the v2.0 api
+				if apiVersion == freenas.APIVersion1 {
+					glog.Fatalf("api keys require api version %s", freenas.APIVersion2)
+				}
+				restClient = freenas_rest.NewWithAPIKey(*freenasAPIKey, *freenasAPIHost, tlsConfig)
+				apiVersion = freenas.APIVersion2
+			}
+			fnClient, err = freenas.NewForVersion(context.Background(), freenas_rest.NewRetryClient(freenas_rest.NewTimeoutClient(freenas_rest.NewInstrumentedClient(restClient), timeouts), retryConfig), apiVersion)
+			if err != nil {
+				glog.Fatal(err)
+			}
+		case transportWebsocket:
+			middlewareClient := middleware.New(*freenasAPIUser, *freenasAPIPassword, *freenasAPIHost, tlsConfig)
+			if *freenasAPIKey != "" {
+				middlewareClient = middleware.NewWithAPIKey(*freenasAPIKey, *freenasAPIHost, tlsConfig)
+			}
+			fnClient = freenas.NewV2(freenas_rest.NewRetryClient(freenas_rest.NewTimeoutClient(freenas_rest.NewInstrumentedClient(middlewareClient), timeouts), retryConfig))
+		default:
+			glog.Fatalf("unsupported freenas api transport %s", *freenasAPITransport)
+		}
+		freenasProvisioner := &provisioner.Freenas{
+			Kubernetes: k8sClient,
+			Freenas:    fnClient,
+			Recorder:   recorder,
+		}
+		if *enableSnapshots {
+			freenasProvisioner.Dynamic = dynamicClient
+		}
+
+		informerFactory := informers.NewSharedInformerFactory(k8sClient, controller.DefaultResyncPeriod)
+
+		// metrics are served by every replica, not only by the leader, so the
+		// provisioner's own metrics are registered here instead of by the
+		// provision controller
+		if *metricsPort > 0 {
+			prometheus.MustRegister(
+				provisioner.NewVolumeCollector(*provisionerName, informerFactory),
+				metrics.PersistentVolumeClaimProvisionTotal,
+				metrics.PersistentVolumeClaimProvisionFailedTotal,
+				metrics.PersistentVolumeClaimProvisionDurationSeconds,
+				metrics.PersistentVolumeDeleteTotal,
+				metrics.PersistentVolumeDeleteFailedTotal,
+				metrics.PersistentVolumeDeleteDurationSeconds,
+			)
+			informerFactory.Start(wait.NeverStop)
+
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			go func() {
+				glog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), mux))
+			}()
 		}
-		freenasProvisionerConfig.TargetPortal = targetPortal
 
-		// optional params
-		if thinProvisioning, ok := class.Parameters[thinProvisioningParam]; ok {
-			thinProvisioning, err := strconv.ParseBool(thinProvisioning)
+		if *healthPort > 0 {
+			healthChecker := provisioner.NewHealthChecker(fnClient, *provisionerName, informerFactory)
+			healthChecker.Interval, err = time.ParseDuration(*readinessProbeInterval)
 			if err != nil {
 				glog.Fatal(err)
 			}
-			freenasProvisionerConfig.ThinProvisioning = thinProvisioning
+			healthChecker.Timeout, err = time.ParseDuration(*readinessProbeTimeout)
+			if err != nil {
+				glog.Fatal(err)
+			}
+			healthChecker.FailureThreshold = *readinessFailureThreshold
+			healthChecker.SuccessThreshold = *readinessSuccessThreshold
+			go healthChecker.Run(wait.NeverStop)
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/healthz", healthChecker.Healthz)
+			mux.HandleFunc("/readyz", healthChecker.Readyz)
+			go func() {
+				glog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *healthPort), mux))
+			}()
 		}
 
-		if initiatorName, ok := class.Parameters[initiatorNameParam]; ok {
-			freenasProvisionerConfig.InitiatorName = initiatorName
+		// csi clients elect their own leader, and their volumes have no
+		// kubernetes objects to record events on
+		if *csiEndpoint != "" {
+			driver := csi.NewDriver(*csiDriverName, appVersion, &provisioner.Freenas{
+				Kubernetes: k8sClient,
+				Freenas:    fnClient,
+			})
+			go func() {
+				glog.Fatal(driver.Run(*csiEndpoint))
+			}()
 		}
 
-		fnClient := freenas.New(freenas_rest.New(*freenasAPIUser, *freenasAPIPassword, *freenasAPIHost, *freenasAPISkipTLSVerification))
-		freenasProvisioner := &provisioner.Freenas{
-			Kubernetes: k8sClient,
-			Freenas:    fnClient,
-			Config:     &freenasProvisionerConfig,
+		collectionInterval, err := time.ParseDuration(*orphanCollectionInterval)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		gracePeriod, err := time.ParseDuration(*orphanGracePeriod)
+		if err != nil {
+			glog.Fatal(err)
 		}
 
-		pc := controller.NewProvisionController(k8sClient, *provisionerName, freenasProvisioner, serverVersion.GitVersion)
-		pc.Run(wait.NeverStop)
+		// everything that writes to FreeNAS or kubernetes only runs on the
+		// leader
+		run := func(ctx context.Context) {
+			resizer := provisioner.NewResizer(k8sClient, fnClient, *provisionerName, informerFactory)
+			go resizer.Run(ctx.Done())
+
+			initiatorSyncer := provisioner.NewInitiatorSyncer(k8sClient, fnClient, *provisionerName, informerFactory)
+			go initiatorSyncer.Run(ctx.Done())
+
+			if *enableSnapshots {
+				dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, controller.DefaultResyncPeriod)
+				snapshotter := provisioner.NewSnapshotter(k8sClient, dynamicClient, fnClient, *provisionerName, recorder, informerFactory, dynamicInformerFactory)
+				go snapshotter.Run(ctx.Done())
+			}
+
+			if collectionInterval > 0 {
+				collector := provisioner.NewCollector(k8sClient, fnClient, *provisionerName, recorder, informerFactory)
+				collector.CSIDriverName = *csiDriverName
+				collector.Interval = collectionInterval
+				collector.DeleteOrphans = *deleteOrphans
+				collector.GracePeriod = gracePeriod
+				go collector.Run(ctx.Done())
+			}
+
+			pc := controller.NewProvisionController(k8sClient, *provisionerName, freenasProvisioner, serverVersion.GitVersion,
+				controller.LeaderElection(false),
+			)
+			pc.Run(ctx.Done())
+		}
+
+		if !*leaderElection {
+			run(context.Background())
+			return
+		}
+
+		namespace := *leaderElectionNamespace
+		if namespace == "" {
+			namespace = inClusterNamespace()
+		}
+		identity := *leaderElectionIdentity
+		if identity == "" {
+			identity, err = os.Hostname()
+			if err != nil {
+				glog.Fatal(err)
+			}
+		}
+		leaseDuration, err := time.ParseDuration(*leaderElectionLeaseDuration)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		renewDeadline, err := time.ParseDuration(*leaderElectionRenewDeadline)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		retryPeriod, err := time.ParseDuration(*leaderElectionRetryPeriod)
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		lock, err := resourcelock.New(*leaderElectionLockType, namespace, strings.Replace(*provisionerName, "/", "-", -1), k8sClient.CoreV1(), k8sClient.CoordinationV1beta1(), resourcelock.ResourceLockConfig{
+			Identity:      identity,
+			EventRecorder: recorder,
+		})
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		glog.Infof("%s waiting to become leader of %s/%s", identity, namespace, lock.Describe())
+		leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+			Lock:          lock,
+			LeaseDuration: leaseDuration,
+			RenewDeadline: renewDeadline,
+			RetryPeriod:   retryPeriod,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: run,
+				OnStoppedLeading: func() {
+					glog.Fatalf("%s lost leadership", identity)
+				},
+				OnNewLeader: func(leader string) {
+					if leader != identity {
+						glog.Infof("%s is the leader", leader)
+					}
+				},
+			},
+		})
 	}
 
 	err = app.Run(os.Args)
@@ -205,3 +638,14 @@ func main() {
 		glog.Fatal(err)
 	}
 }
+
+// inClusterNamespace returns the namespace of the provisioner's pod.
+func inClusterNamespace() string {
+	namespace, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		glog.Warningf("error reading the provisioner's namespace, using default: %v", err)
+		return v1.NamespaceDefault
+	}
+
+	return strings.TrimSpace(string(namespace))
+}
@@ -0,0 +1,385 @@
+// Package fake serves an in-memory imitation of the FreeNAS v1.0 api for
+// tests, so that clients can be exercised end to end without an appliance.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	apiPath = "/api/v1.0/"
+
+	// Basename is the iqn base name of the fake appliance
+	Basename = "iqn.2005-10.org.freenas.ctl"
+)
+
+// object kinds, named after their api paths
+const (
+	Targets              = "services/iscsi/target"
+	TargetGroups         = "services/iscsi/targetgroup"
+	Extents              = "services/iscsi/extent"
+	TargetToExtents      = "services/iscsi/targettoextent"
+	AuthCredentials      = "services/iscsi/authcredential"
+	AuthorizedInitiators = "services/iscsi/authorizedinitiator"
+	NFSShares            = "sharing/nfs"
+)
+
+// uniqueFields are the fields that the appliance rejects duplicate values
+// of, by kind.
+var uniqueFields = map[string]string{
+	Targets: "iscsi_target_name",
+	Extents: "iscsi_target_extent_name",
+}
+
+// Object is an iscsi or nfs object as represented by the v1.0 api.
+type Object map[string]interface{}
+
+// ID returns the id of o.
+func (o Object) ID() int {
+	id, _ := o["id"].(int)
+	return id
+}
+
+type collection struct {
+	nextID  int
+	objects map[int]Object
+}
+
+type failure struct {
+	method     string
+	path       string
+	statusCode int
+}
+
+// Server is the fake appliance. It is safe for concurrent use.
+type Server struct {
+	URL string
+
+	server *httptest.Server
+
+	mu           sync.Mutex
+	datasets     map[string]*zfsDataset
+	snapshots    map[string]*zfsSnapshot
+	created      int
+	collections  map[string]*collection
+	globalConfig Object
+	failures     []*failure
+	requests     map[string]int
+}
+
+// NewServer starts a fake appliance without any pools. It has to be closed
+// when done.
+func NewServer() *Server {
+	s := &Server{
+		datasets:  map[string]*zfsDataset{},
+		snapshots: map[string]*zfsSnapshot{},
+		collections: map[string]*collection{
+			Targets:              {nextID: 1, objects: map[int]Object{}},
+			TargetGroups:         {nextID: 1, objects: map[int]Object{}},
+			Extents:              {nextID: 1, objects: map[int]Object{}},
+			TargetToExtents:      {nextID: 1, objects: map[int]Object{}},
+			AuthCredentials:      {nextID: 1, objects: map[int]Object{}},
+			AuthorizedInitiators: {nextID: 1, objects: map[int]Object{}},
+			NFSShares:            {nextID: 1, objects: map[int]Object{}},
+		},
+		globalConfig: Object{"id": 1, "iscsi_basename": Basename},
+		requests:     map[string]int{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+
+	return s
+}
+
+// Close shuts the appliance down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Client returns a v1.0 client of the appliance.
+func (s *Server) Client() freenas.Interface {
+	return freenas.New(rest.New("root", "", s.URL, nil))
+}
+
+// Fail makes the next request with method to path fail with statusCode.
+func (s *Server) Fail(method, path string, statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, &failure{method: method, path: path, statusCode: statusCode})
+}
+
+// Requests returns how many requests with method to path were served.
+func (s *Server) Requests(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[method+" "+path]
+}
+
+// Add stores object as one of kind and returns its id.
+func (s *Server) Add(kind string, object Object) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.collections[kind].add(object)
+}
+
+// Objects returns the objects of kind ordered by id.
+func (s *Server) Objects(kind string) []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.collections[kind].list()
+}
+
+// Remove deletes the object of kind with id as if it was deleted on the
+// appliance.
+func (s *Server) Remove(kind string, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.collections[kind].objects, id)
+}
+
+func (c *collection) add(object Object) int {
+	id := c.nextID
+	c.nextID++
+
+	stored := Object{}
+	for field, value := range object {
+		stored[field] = value
+	}
+	stored["id"] = id
+	c.objects[id] = stored
+
+	return id
+}
+
+func (c *collection) list() []Object {
+	ids := make([]int, 0, len(c.objects))
+	for id := range c.objects {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	objects := make([]Object, 0, len(ids))
+	for _, id := range ids {
+		objects = append(objects, c.objects[id])
+	}
+
+	return objects
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[r.Method+" "+r.URL.Path]++
+	for i, f := range s.failures {
+		if f.method == r.Method && f.path == r.URL.Path {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			writeError(w, f.statusCode, "__all__", "injected failure")
+			return
+		}
+	}
+
+	if !strings.HasPrefix(r.URL.Path, apiPath) || !strings.HasSuffix(r.URL.Path, "/") {
+		writeError(w, http.StatusNotFound, "error_message", "not found")
+		return
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiPath), "/")
+
+	switch {
+	case path == "system/version":
+		writeJSON(w, http.StatusOK, Object{"fullversion": "FreeNAS-11.2-U8", "name": "FreeNAS", "version": ""})
+	case path == "services/iscsi/globalconfiguration":
+		s.serveGlobalConfiguration(w, r)
+	case strings.HasPrefix(path, "storage/volume/"):
+		s.serveVolume(w, r, strings.TrimPrefix(path, "storage/volume/"))
+	case path == "storage/dataset" || strings.HasPrefix(path, "storage/dataset/"):
+		s.serveDataset(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "storage/dataset"), "/"))
+	case path == "storage/snapshot" || strings.HasPrefix(path, "storage/snapshot/"):
+		s.serveSnapshot(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "storage/snapshot"), "/"))
+	default:
+		s.serveCollection(w, r, path)
+	}
+}
+
+func (s *Server) serveGlobalConfiguration(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.globalConfig)
+	case http.MethodPut:
+		var update Object
+		if !readJSON(w, r, &update) {
+			return
+		}
+		for field, value := range update {
+			s.globalConfig[field] = value
+		}
+		writeJSON(w, http.StatusOK, s.globalConfig)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "error_message", "method not allowed")
+	}
+}
+
+// serveCollection serves the iscsi and nfs objects, which are all handled
+// alike.
+func (s *Server) serveCollection(w http.ResponseWriter, r *http.Request, path string) {
+	kind, idString := path, ""
+	if _, ok := s.collections[kind]; !ok {
+		i := strings.LastIndex(path, "/")
+		if i < 0 {
+			writeError(w, http.StatusNotFound, "error_message", "not found")
+			return
+		}
+		kind, idString = path[:i], path[i+1:]
+	}
+	c, ok := s.collections[kind]
+	if !ok {
+		writeError(w, http.StatusNotFound, "error_message", "not found")
+		return
+	}
+
+	if idString == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, paginate(r, c.list()))
+		case http.MethodPost:
+			var object Object
+			if !readJSON(w, r, &object) || !s.validate(w, kind, 0, object) {
+				return
+			}
+			id := c.add(object)
+			writeJSON(w, http.StatusCreated, c.objects[id])
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "error_message", "method not allowed")
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(idString)
+	object, ok := c.objects[id]
+	if err != nil || !ok {
+		writeError(w, http.StatusNotFound, "error_message", fmt.Sprintf("%s %s does not exist", kind, idString))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, object)
+	case http.MethodPut:
+		var update Object
+		if !readJSON(w, r, &update) || !s.validate(w, kind, id, update) {
+			return
+		}
+		for field, value := range update {
+			if field != "id" {
+				object[field] = value
+			}
+		}
+		writeJSON(w, http.StatusOK, object)
+	case http.MethodDelete:
+		s.deleteObject(kind, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "error_message", "method not allowed")
+	}
+}
+
+// validate rejects duplicate names and extents of missing zvols like the
+// appliance does.
+func (s *Server) validate(w http.ResponseWriter, kind string, id int, object Object) bool {
+	if field, ok := uniqueFields[kind]; ok {
+		for _, other := range s.collections[kind].objects {
+			if other.ID() != id && object[field] != nil && other[field] == object[field] {
+				writeError(w, http.StatusBadRequest, field, fmt.Sprintf("%v already exists", object[field]))
+				return false
+			}
+		}
+	}
+
+	if disk, ok := object["iscsi_target_extent_disk"].(string); ok && kind == Extents {
+		if _, ok := s.datasets[strings.TrimPrefix(disk, "zvol/")]; !ok {
+			writeError(w, http.StatusBadRequest, "iscsi_target_extent_disk", fmt.Sprintf("zvol %s does not exist", disk))
+			return false
+		}
+	}
+
+	return true
+}
+
+// deleteObject removes an object along with the target groups and extent
+// mappings that reference it.
+func (s *Server) deleteObject(kind string, id int) {
+	delete(s.collections[kind].objects, id)
+
+	var references []string
+	switch kind {
+	case Targets:
+		references = []string{TargetGroups, TargetToExtents}
+	case Extents:
+		references = []string{TargetToExtents}
+	}
+	field := map[string]string{Targets: "iscsi_target", Extents: "iscsi_extent"}[kind]
+	for _, referencing := range references {
+		for objectID, object := range s.collections[referencing].objects {
+			if fmt.Sprint(object[field]) == strconv.Itoa(id) {
+				delete(s.collections[referencing].objects, objectID)
+			}
+		}
+	}
+}
+
+// paginate applies the limit and offset of a list request.
+func paginate(r *http.Request, objects []Object) []Object {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	if offset > len(objects) {
+		offset = len(objects)
+	}
+	objects = objects[offset:]
+	if limit > 0 && limit < len(objects) {
+		objects = objects[:limit]
+	}
+
+	return objects
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "__all__", fmt.Sprintf("invalid json: %v", err))
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with a v1.0 error, {"error_message": "..."} or
+// {"field": ["..."]}.
+func writeError(w http.ResponseWriter, statusCode int, field, message string) {
+	if field == "error_message" {
+		writeJSON(w, statusCode, Object{field: message})
+		return
+	}
+
+	writeJSON(w, statusCode, Object{field: []string{message}})
+}
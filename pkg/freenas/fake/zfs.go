@@ -0,0 +1,626 @@
+package fake
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultAvail is the free space of pools added without one.
+const defaultAvail = 1 << 40
+
+// zfsDataset is a pool, file system or zvol.
+type zfsDataset struct {
+	name    string
+	pool    string
+	zvol    bool
+	volsize int64
+	quota   int64
+	avail   int64
+	// origin is the snapshot a clone was created from
+	origin string
+}
+
+type zfsSnapshot struct {
+	dataset string
+	name    string
+	// created orders the snapshots of a dataset, promote moves the older
+	// ones
+	created int
+}
+
+func (z *zfsSnapshot) fullname() string {
+	return fmt.Sprintf("%s@%s", z.dataset, z.name)
+}
+
+// Dataset is the state of a dataset or zvol on the appliance.
+type Dataset struct {
+	Name    string
+	ZVol    bool
+	Volsize int64
+	Quota   int64
+	// Origin is the snapshot a clone was created from, empty for other
+	// datasets
+	Origin string
+}
+
+// AddPool adds a pool with avail bytes of free space, or a default amount
+// when avail is zero.
+func (s *Server) AddPool(name string, avail int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if avail == 0 {
+		avail = defaultAvail
+	}
+	s.datasets[name] = &zfsDataset{name: name, pool: name, avail: avail}
+}
+
+// AddDataset adds a file system, its parent has to exist.
+func (s *Server) AddDataset(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.createDataset(name, false, 0)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddZVol adds a zvol of size bytes, its parent has to exist.
+func (s *Server) AddZVol(name string, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.createDataset(name, true, size)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddSnapshot adds the snapshot with fullname, its dataset has to exist.
+func (s *Server) AddSnapshot(fullname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.SplitN(fullname, "@", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid snapshot name %s", fullname)
+	}
+
+	_, err := s.createSnapshot(parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Dataset returns the dataset or zvol with the full name name.
+func (s *Server) Dataset(name string) (Dataset, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ds, ok := s.datasets[name]
+	if !ok {
+		return Dataset{}, false
+	}
+
+	return Dataset{Name: ds.name, ZVol: ds.zvol, Volsize: ds.volsize, Quota: ds.quota, Origin: ds.origin}, true
+}
+
+// Snapshots returns the full names of all snapshots, sorted.
+func (s *Server) Snapshots() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.snapshots))
+	for fullname := range s.snapshots {
+		names = append(names, fullname)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// apiError is an error response of the appliance.
+type apiError struct {
+	statusCode int
+	field      string
+	message    string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func notFound(format string, args ...interface{}) *apiError {
+	return &apiError{statusCode: http.StatusNotFound, field: "error_message", message: fmt.Sprintf(format, args...)}
+}
+
+func invalid(field, format string, args ...interface{}) *apiError {
+	return &apiError{statusCode: http.StatusBadRequest, field: field, message: fmt.Sprintf(format, args...)}
+}
+
+func writeAPIError(w http.ResponseWriter, err *apiError) {
+	writeError(w, err.statusCode, err.field, err.message)
+}
+
+func (s *Server) createDataset(name string, zvol bool, volsize int64) (*zfsDataset, *apiError) {
+	if _, ok := s.datasets[name]; ok {
+		return nil, invalid("name", "dataset %s already exists", name)
+	}
+	parent, ok := s.datasets[path.Dir(name)]
+	if !ok || parent.zvol {
+		return nil, invalid("name", "parent of %s does not exist", name)
+	}
+
+	ds := &zfsDataset{name: name, pool: parent.pool, zvol: zvol, volsize: volsize}
+	s.datasets[name] = ds
+
+	return ds, nil
+}
+
+// destroyDataset destroys a dataset along with its snapshots, unless clones
+// depend on them.
+func (s *Server) destroyDataset(name string) *apiError {
+	if _, ok := s.datasets[name]; !ok {
+		return notFound("dataset %s does not exist", name)
+	}
+
+	for other := range s.datasets {
+		if strings.HasPrefix(other, name+"/") {
+			return invalid("__all__", "cannot destroy %s: filesystem has children", name)
+		}
+	}
+	for fullname, snap := range s.snapshots {
+		if snap.dataset == name && len(s.clones(fullname)) > 0 {
+			return invalid("__all__", "cannot destroy %s: filesystem has dependent clones %s", name, strings.Join(s.clones(fullname), ", "))
+		}
+	}
+
+	for fullname, snap := range s.snapshots {
+		if snap.dataset == name {
+			delete(s.snapshots, fullname)
+		}
+	}
+	delete(s.datasets, name)
+
+	return nil
+}
+
+// clones returns the datasets cloned from the snapshot fullname.
+func (s *Server) clones(fullname string) []string {
+	var clones []string
+	for name, ds := range s.datasets {
+		if ds.origin == fullname {
+			clones = append(clones, name)
+		}
+	}
+	sort.Strings(clones)
+
+	return clones
+}
+
+func (s *Server) createSnapshot(dataset, name string) (*zfsSnapshot, *apiError) {
+	if _, ok := s.datasets[dataset]; !ok {
+		return nil, invalid("dataset", "dataset %s does not exist", dataset)
+	}
+
+	snap := &zfsSnapshot{dataset: dataset, name: name}
+	if _, ok := s.snapshots[snap.fullname()]; ok {
+		return nil, invalid("__all__", "snapshot %s already exists", snap.fullname())
+	}
+	s.created++
+	snap.created = s.created
+	s.snapshots[snap.fullname()] = snap
+
+	return snap, nil
+}
+
+func (s *Server) destroySnapshot(fullname string) *apiError {
+	if _, ok := s.snapshots[fullname]; !ok {
+		return notFound("snapshot %s does not exist", fullname)
+	}
+	if clones := s.clones(fullname); len(clones) > 0 {
+		return invalid("__all__", "cannot destroy snapshot %s: snapshot has dependent clones %s", fullname, strings.Join(clones, ", "))
+	}
+
+	delete(s.snapshots, fullname)
+	return nil
+}
+
+func (s *Server) clone(fullname, name string) *apiError {
+	snap, ok := s.snapshots[fullname]
+	if !ok {
+		return notFound("snapshot %s does not exist", fullname)
+	}
+	source := s.datasets[snap.dataset]
+
+	ds, err := s.createDataset(name, source.zvol, source.volsize)
+	if err != nil {
+		return err
+	}
+	ds.quota = source.quota
+	ds.origin = fullname
+
+	return nil
+}
+
+// promote swaps the roles of a clone and its origin like zfs promote: the
+// snapshots of the origin's dataset up to the clone's origin move to the
+// clone, and that dataset becomes a clone of the moved snapshot.
+func (s *Server) promote(name string) *apiError {
+	ds, ok := s.datasets[name]
+	if !ok {
+		return notFound("dataset %s does not exist", name)
+	}
+	if ds.origin == "" {
+		return invalid("__all__", "cannot promote %s: not a cloned filesystem", name)
+	}
+
+	origin := s.snapshots[ds.origin]
+	source := s.datasets[origin.dataset]
+	for fullname, snap := range s.snapshots {
+		if snap.dataset != source.name || snap.created > origin.created {
+			continue
+		}
+
+		moved := &zfsSnapshot{dataset: name, name: snap.name, created: snap.created}
+		if _, ok := s.snapshots[moved.fullname()]; ok {
+			return invalid("__all__", "cannot promote %s: snapshot %s already exists", name, moved.fullname())
+		}
+		delete(s.snapshots, fullname)
+		s.snapshots[moved.fullname()] = moved
+		for _, other := range s.datasets {
+			if other.origin == fullname && other != ds {
+				other.origin = moved.fullname()
+			}
+		}
+	}
+
+	ds.origin, source.origin = source.origin, fmt.Sprintf("%s@%s", name, origin.name)
+	return nil
+}
+
+func (s *Server) datasetObject(ds *zfsDataset) Object {
+	pool := s.datasets[ds.pool]
+	return Object{
+		"name":       ds.name,
+		"pool":       ds.pool,
+		"avail":      pool.avail,
+		"used":       0,
+		"quota":      ds.quota,
+		"mountpoint": "/mnt/" + ds.name,
+	}
+}
+
+func (s *Server) zVolObject(ds *zfsDataset) Object {
+	return Object{
+		"name":    strings.TrimPrefix(ds.name, ds.pool+"/"),
+		"volsize": ds.volsize,
+		"avail":   s.datasets[ds.pool].avail,
+		"origin":  ds.origin,
+	}
+}
+
+func (s *Server) snapshotObject(snap *zfsSnapshot) Object {
+	return Object{
+		"filesystem":  snap.dataset,
+		"fullname":    snap.fullname(),
+		"id":          snap.fullname(),
+		"name":        snap.name,
+		"parent_type": map[bool]string{true: "volume", false: "filesystem"}[s.datasets[snap.dataset].zvol],
+	}
+}
+
+// serveVolume serves the zvols and datasets of a pool under
+// /storage/volume/<pool>/.
+func (s *Server) serveVolume(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) < 2 {
+		writeError(w, http.StatusNotFound, "error_message", "not found")
+		return
+	}
+	pool, ok := s.datasets[parts[0]]
+	if !ok || pool.pool != pool.name {
+		writeError(w, http.StatusNotFound, "error_message", fmt.Sprintf("pool %s does not exist", parts[0]))
+		return
+	}
+	zvols := parts[1] == "zvols"
+	if !zvols && parts[1] != "datasets" {
+		writeError(w, http.StatusNotFound, "error_message", "not found")
+		return
+	}
+
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			var objects []Object
+			for _, name := range s.datasetNames() {
+				ds := s.datasets[name]
+				if ds.pool != pool.name || ds.name == pool.name || ds.zvol != zvols {
+					continue
+				}
+				if zvols {
+					objects = append(objects, s.zVolObject(ds))
+				} else {
+					objects = append(objects, s.datasetObject(ds))
+				}
+			}
+			writeJSON(w, http.StatusOK, paginate(r, objects))
+		case http.MethodPost:
+			s.createVolumeDataset(w, r, pool.name, zvols)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "error_message", "method not allowed")
+		}
+		return
+	}
+
+	ds, ok := s.datasets[pool.name+"/"+parts[2]]
+	if !ok || ds.zvol != zvols {
+		writeError(w, http.StatusNotFound, "error_message", fmt.Sprintf("%s/%s does not exist", pool.name, parts[2]))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if zvols {
+			writeJSON(w, http.StatusOK, s.zVolObject(ds))
+		} else {
+			writeJSON(w, http.StatusOK, s.datasetObject(ds))
+		}
+	case http.MethodPut:
+		var update struct {
+			Volsize interface{} `json:"volsize"`
+			Quota   *int64      `json:"quota"`
+		}
+		if !readJSON(w, r, &update) {
+			return
+		}
+		if update.Volsize != nil {
+			size, err := parseSize(update.Volsize)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "volsize", err.Error())
+				return
+			}
+			if size < ds.volsize {
+				writeError(w, http.StatusBadRequest, "volsize", "zvols cannot shrink")
+				return
+			}
+			ds.volsize = size
+		}
+		if update.Quota != nil {
+			ds.quota = *update.Quota
+		}
+		if zvols {
+			writeJSON(w, http.StatusOK, s.zVolObject(ds))
+		} else {
+			writeJSON(w, http.StatusOK, s.datasetObject(ds))
+		}
+	case http.MethodDelete:
+		err := s.destroyDataset(ds.name)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "error_message", "method not allowed")
+	}
+}
+
+func (s *Server) createVolumeDataset(w http.ResponseWriter, r *http.Request, pool string, zvol bool) {
+	var create struct {
+		Name    string      `json:"name"`
+		Volsize interface{} `json:"volsize"`
+		Quota   int64       `json:"quota"`
+	}
+	if !readJSON(w, r, &create) {
+		return
+	}
+	if create.Name == "" {
+		writeError(w, http.StatusBadRequest, "name", "this field is required")
+		return
+	}
+
+	var size int64
+	if zvol {
+		var err error
+		size, err = parseSize(create.Volsize)
+		if err != nil || size <= 0 {
+			writeError(w, http.StatusBadRequest, "volsize", fmt.Sprintf("invalid volsize %v", create.Volsize))
+			return
+		}
+	}
+
+	ds, apiErr := s.createDataset(pool+"/"+create.Name, zvol, size)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	if zvol {
+		// zvols are created asynchronously
+		writeJSON(w, http.StatusAccepted, s.zVolObject(ds))
+		return
+	}
+	ds.quota = create.Quota
+	writeJSON(w, http.StatusCreated, s.datasetObject(ds))
+}
+
+// serveDataset serves /storage/dataset/, which lists file systems and
+// promotes clones.
+func (s *Server) serveDataset(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "error_message", "method not allowed")
+			return
+		}
+
+		var objects []Object
+		for _, name := range s.datasetNames() {
+			if !s.datasets[name].zvol {
+				objects = append(objects, s.datasetObject(s.datasets[name]))
+			}
+		}
+		writeJSON(w, http.StatusOK, paginate(r, objects))
+		return
+	}
+
+	if strings.HasSuffix(name, "/promote") {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "error_message", "method not allowed")
+			return
+		}
+
+		err := s.promote(strings.TrimSuffix(name, "/promote"))
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	ds, ok := s.datasets[name]
+	if !ok || r.Method != http.MethodGet {
+		writeError(w, http.StatusNotFound, "error_message", fmt.Sprintf("dataset %s does not exist", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.datasetObject(ds))
+}
+
+// serveSnapshot serves /storage/snapshot/ including rollbacks and clones.
+func (s *Server) serveSnapshot(w http.ResponseWriter, r *http.Request, fullname string) {
+	if fullname == "" {
+		switch r.Method {
+		case http.MethodGet:
+			names := make([]string, 0, len(s.snapshots))
+			for name := range s.snapshots {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			objects := make([]Object, 0, len(names))
+			for _, name := range names {
+				objects = append(objects, s.snapshotObject(s.snapshots[name]))
+			}
+			writeJSON(w, http.StatusOK, paginate(r, objects))
+		case http.MethodPost:
+			var create struct {
+				Dataset string `json:"dataset"`
+				Name    string `json:"name"`
+			}
+			if !readJSON(w, r, &create) {
+				return
+			}
+			snap, err := s.createSnapshot(create.Dataset, create.Name)
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, s.snapshotObject(snap))
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "error_message", "method not allowed")
+		}
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(fullname, "/clone") && r.Method == http.MethodPost:
+		var clone struct {
+			Name string `json:"name"`
+		}
+		if !readJSON(w, r, &clone) {
+			return
+		}
+		err := s.clone(strings.TrimSuffix(fullname, "/clone"), clone.Name)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasSuffix(fullname, "/rollback") && r.Method == http.MethodPost:
+		if _, ok := s.snapshots[strings.TrimSuffix(fullname, "/rollback")]; !ok {
+			writeError(w, http.StatusNotFound, "error_message", fmt.Sprintf("snapshot %s does not exist", fullname))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodGet:
+		snap, ok := s.snapshots[fullname]
+		if !ok {
+			writeError(w, http.StatusNotFound, "error_message", fmt.Sprintf("snapshot %s does not exist", fullname))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.snapshotObject(snap))
+	case r.Method == http.MethodDelete:
+		err := s.destroySnapshot(fullname)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "error_message", "method not allowed")
+	}
+}
+
+func (s *Server) datasetNames() []string {
+	names := make([]string, 0, len(s.datasets))
+	for name := range s.datasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KiB": 1 << 10,
+	"M":   1 << 20,
+	"MiB": 1 << 20,
+	"G":   1 << 30,
+	"GiB": 1 << 30,
+	"T":   1 << 40,
+	"TiB": 1 << 40,
+}
+
+// parseSize parses a size in bytes or in the "<n> <unit>" form the
+// provisioner sends.
+func parseSize(size interface{}) (int64, error) {
+	switch size := size.(type) {
+	case float64:
+		return int64(size), nil
+	case string:
+		fields := strings.Fields(size)
+		if len(fields) == 0 || len(fields) > 2 {
+			return 0, fmt.Errorf("invalid size %s", size)
+		}
+		unit := ""
+		if len(fields) == 2 {
+			unit = fields[1]
+		}
+		multiplier, ok := sizeUnits[unit]
+		if !ok {
+			return 0, fmt.Errorf("invalid size unit %s", unit)
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size %s", size)
+		}
+		return n * multiplier, nil
+	}
+
+	return 0, fmt.Errorf("invalid size %v", size)
+}
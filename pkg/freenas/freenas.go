@@ -1,20 +1,37 @@
 package freenas
 
 import (
+	"context"
+	"fmt"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/sharing"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// api versions
+	APIVersionAuto = "auto"
+	APIVersion1    = "v1.0"
+	APIVersion2    = "v2.0"
+
+	v1VersionPath = "/api/v1.0/system/version/"
+	v2VersionPath = "/api/v2.0/system/version"
 )
 
 type Client struct {
 	client  rest.Interface
 	iscsi   iscsi.Interface
 	storage storage.Interface
+	sharing sharing.Interface
 }
 
 type Interface interface {
 	ISCSI() iscsi.Interface
 	Storage() storage.Interface
+	Sharing() sharing.Interface
 }
 
 func New(client rest.Interface) Interface {
@@ -22,6 +39,88 @@ func New(client rest.Interface) Interface {
 		client:  client,
 		iscsi:   iscsi.New(client),
 		storage: storage.New(client),
+		sharing: sharing.New(client),
+	}
+}
+
+// NewV2 returns a Client for the v2.0 api of TrueNAS and newer FreeNAS
+// releases.
+func NewV2(client rest.Interface) Interface {
+	return &Client{
+		client:  client,
+		iscsi:   iscsi.NewV2(client),
+		storage: storage.NewV2(client),
+		sharing: sharing.NewV2(client),
+	}
+}
+
+// NewForVersion returns a Client for the given api version, detecting the
+// version to use for APIVersionAuto.
+func NewForVersion(ctx context.Context, client rest.Interface, version string) (Interface, error) {
+	if version == APIVersionAuto {
+		var err error
+		version, err = DetectAPIVersion(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch version {
+	case APIVersion1:
+		return New(client), nil
+	case APIVersion2:
+		return NewV2(client), nil
+	default:
+		return nil, fmt.Errorf("unsupported api version %s", version)
+	}
+}
+
+// DetectAPIVersion returns the api version to use with the appliance. v1.0 is
+// preferred while the appliance still serves it.
+func DetectAPIVersion(ctx context.Context, client rest.Interface) (string, error) {
+	ok, err := serves(ctx, client, v1VersionPath)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return APIVersion1, nil
+	}
+
+	ok, err = serves(ctx, client, v2VersionPath)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return APIVersion2, nil
+	}
+
+	return "", fmt.Errorf("neither api %s nor %s is available", APIVersion1, APIVersion2)
+}
+
+func serves(ctx context.Context, client rest.Interface, path string) (bool, error) {
+	request, err := client.NewRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return false, err
+	}
+
+	response, err := client.DoRequest(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, rest.NewAPIError(response, body)
+	default:
+		return false, nil
 	}
 }
 
@@ -32,3 +131,7 @@ func (f Client) ISCSI() iscsi.Interface {
 func (f Client) Storage() storage.Interface {
 	return f.storage
 }
+
+func (f Client) Sharing() sharing.Interface {
+	return f.sharing
+}
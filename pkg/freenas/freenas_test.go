@@ -0,0 +1,296 @@
+package freenas
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/extent"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/z_vol"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectAPIVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		// statuses are the responses of the version paths, 404 if missing
+		statuses map[string]int
+		want     string
+		wantErr  string
+	}{
+		{name: "v1", statuses: map[string]int{v1VersionPath: http.StatusOK, v2VersionPath: http.StatusOK}, want: APIVersion1},
+		{name: "v2 only", statuses: map[string]int{v2VersionPath: http.StatusOK}, want: APIVersion2},
+		{name: "neither", wantErr: "neither api v1.0 nor v2.0 is available"},
+		{name: "unauthorized", statuses: map[string]int{v1VersionPath: http.StatusUnauthorized}, wantErr: "401"},
+		{name: "forbidden v2", statuses: map[string]int{v2VersionPath: http.StatusForbidden}, wantErr: "403"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status, ok := tt.statuses[r.URL.Path]
+				if !ok {
+					status = http.StatusNotFound
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			got, err := DetectAPIVersion(context.Background(), rest.New("root", "secret", server.URL, nil))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("DetectAPIVersion() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DetectAPIVersion() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("DetectAPIVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestV2Requests(t *testing.T) {
+	pool := &dataset.Dataset{Pool: stringPtr("tank")}
+
+	tests := []struct {
+		name string
+		// call makes the request through c and returns what it got back
+		call func(ctx context.Context, c Interface) (interface{}, error)
+		// response is the status and body the appliance answers with
+		status   int
+		response string
+		// wantMethod, wantURI and wantBody describe the request, no body if empty
+		wantMethod string
+		wantURI    string
+		wantBody   string
+		want       interface{}
+		wantErr    func(error) bool
+	}{
+		{
+			name: "create zvol",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return c.Storage().ZVol().Create(ctx, pool, &z_vol.ZVol{
+					Name:        stringPtr("k8s/pvc-1"),
+					Volsize:     int64(1 << 30),
+					Compression: stringPtr("lz4"),
+					Blocksize:   stringPtr("16K"),
+				})
+			},
+			status:     http.StatusOK,
+			response:   `{"id": "tank/k8s/pvc-1", "name": "tank/k8s/pvc-1", "pool": "tank", "volsize": {"value": "1G", "rawvalue": "1073741824"}, "compression": {"value": "LZ4"}}`,
+			wantMethod: http.MethodPost,
+			wantURI:    "/api/v2.0/pool/dataset",
+			wantBody:   `{"name": "tank/k8s/pvc-1", "type": "VOLUME", "volsize": 1073741824, "volblocksize": "16K", "compression": "LZ4"}`,
+			want:       &z_vol.ZVol{Name: stringPtr("k8s/pvc-1"), Volsize: int64(1 << 30), Compression: stringPtr("LZ4")},
+		},
+		{
+			name: "get zvol",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return c.Storage().ZVol().Get(ctx, pool, &z_vol.ZVol{Name: stringPtr("k8s/pvc-2")})
+			},
+			status:     http.StatusOK,
+			response:   `{"name": "tank/k8s/pvc-2", "pool": "tank", "volsize": {"rawvalue": "2147483648"}, "origin": {"value": "tank/k8s/pvc-1@clone-pvc-2"}}`,
+			wantMethod: http.MethodGet,
+			wantURI:    "/api/v2.0/pool/dataset/id/tank%2Fk8s%2Fpvc-2",
+			want:       &z_vol.ZVol{Name: stringPtr("k8s/pvc-2"), Volsize: int64(2 << 30), Origin: stringPtr("tank/k8s/pvc-1@clone-pvc-2")},
+		},
+		{
+			name: "missing zvol",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return c.Storage().ZVol().Get(ctx, pool, &z_vol.ZVol{Name: stringPtr("k8s/pvc-3")})
+			},
+			status:     http.StatusNotFound,
+			response:   `{"message": "not found"}`,
+			wantMethod: http.MethodGet,
+			wantURI:    "/api/v2.0/pool/dataset/id/tank%2Fk8s%2Fpvc-3",
+			wantErr:    rest.IsNotFound,
+		},
+		{
+			name: "grow zvol",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return c.Storage().ZVol().Update(ctx, pool, &z_vol.ZVol{Name: stringPtr("k8s/pvc-1"), Volsize: int64(2 << 30)})
+			},
+			status:     http.StatusOK,
+			response:   `{"name": "tank/k8s/pvc-1", "pool": "tank", "volsize": {"rawvalue": "2147483648"}}`,
+			wantMethod: http.MethodPut,
+			wantURI:    "/api/v2.0/pool/dataset/id/tank%2Fk8s%2Fpvc-1",
+			wantBody:   `{"volsize": 2147483648}`,
+			want:       &z_vol.ZVol{Name: stringPtr("k8s/pvc-1"), Volsize: int64(2 << 30)},
+		},
+		{
+			name: "delete zvol",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return nil, c.Storage().ZVol().Delete(ctx, pool, &z_vol.ZVol{Name: stringPtr("k8s/pvc-1")})
+			},
+			status:     http.StatusOK,
+			response:   `true`,
+			wantMethod: http.MethodDelete,
+			wantURI:    "/api/v2.0/pool/dataset/id/tank%2Fk8s%2Fpvc-1",
+		},
+		{
+			name: "create extent",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return c.ISCSI().Extent().Create(ctx, &extent.Extent{
+					IscsiTargetExtentName: stringPtr("pvc-1"),
+					IscsiTargetExtentType: stringPtr("Disk"),
+					IscsiTargetExtentDisk: stringPtr("zvol/tank/k8s/pvc-1"),
+				})
+			},
+			status:     http.StatusOK,
+			response:   `{"id": 3, "name": "pvc-1", "type": "DISK", "disk": "zvol/tank/k8s/pvc-1"}`,
+			wantMethod: http.MethodPost,
+			wantURI:    "/api/v2.0/iscsi/extent",
+			wantBody:   `{"name": "pvc-1", "type": "DISK", "disk": "zvol/tank/k8s/pvc-1"}`,
+			want: &extent.Extent{
+				ID:                    intPtr(3),
+				IscsiTargetExtentName: stringPtr("pvc-1"),
+				IscsiTargetExtentType: stringPtr("Disk"),
+				IscsiTargetExtentDisk: stringPtr("zvol/tank/k8s/pvc-1"),
+			},
+		},
+		{
+			name: "get extent",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return c.ISCSI().Extent().Get(ctx, &extent.Extent{ID: intPtr(3)})
+			},
+			status:     http.StatusOK,
+			response:   `{"id": 3, "name": "pvc-1", "type": "FILE", "path": "/mnt/tank/k8s/pvc-1"}`,
+			wantMethod: http.MethodGet,
+			wantURI:    "/api/v2.0/iscsi/extent/id/3",
+			want: &extent.Extent{
+				ID:                    intPtr(3),
+				IscsiTargetExtentName: stringPtr("pvc-1"),
+				IscsiTargetExtentType: stringPtr("File"),
+				IscsiTargetExtentPath: stringPtr("/mnt/tank/k8s/pvc-1"),
+			},
+		},
+		{
+			name: "delete extent",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return nil, c.ISCSI().Extent().Delete(ctx, &extent.Extent{ID: intPtr(3)})
+			},
+			status:     http.StatusOK,
+			response:   `true`,
+			wantMethod: http.MethodDelete,
+			wantURI:    "/api/v2.0/iscsi/extent/id/3",
+		},
+		{
+			name: "create target",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return c.ISCSI().Target().Create(ctx, &target.Target{IscsiTargetName: stringPtr("pvc-1")})
+			},
+			status:     http.StatusOK,
+			response:   `{"id": 1, "name": "pvc-1", "alias": null}`,
+			wantMethod: http.MethodPost,
+			wantURI:    "/api/v2.0/iscsi/target",
+			wantBody:   `{"name": "pvc-1"}`,
+			want:       &target.Target{ID: intPtr(1), IscsiTargetName: stringPtr("pvc-1")},
+		},
+		{
+			name: "get target by name",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return c.ISCSI().Target().Get(ctx, &target.Target{IscsiTargetName: stringPtr("pvc-2")})
+			},
+			status:     http.StatusOK,
+			response:   `[{"id": 1, "name": "pvc-1"}, {"id": 2, "name": "pvc-2"}]`,
+			wantMethod: http.MethodGet,
+			wantURI:    "/api/v2.0/iscsi/target?limit=0",
+			want:       &target.Target{ID: intPtr(2), IscsiTargetName: stringPtr("pvc-2")},
+		},
+		{
+			name: "rejected target",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return c.ISCSI().Target().Create(ctx, &target.Target{IscsiTargetName: stringPtr("pvc-1")})
+			},
+			status:     http.StatusUnprocessableEntity,
+			response:   `{"iscsi_target_create.name": [{"message": "Target name already exists", "errno": 22}]}`,
+			wantMethod: http.MethodPost,
+			wantURI:    "/api/v2.0/iscsi/target",
+			wantBody:   `{"name": "pvc-1"}`,
+			wantErr:    rest.IsValidation,
+		},
+		{
+			name: "delete target",
+			call: func(ctx context.Context, c Interface) (interface{}, error) {
+				return nil, c.ISCSI().Target().Delete(ctx, &target.Target{ID: intPtr(1)})
+			},
+			status:     http.StatusOK,
+			response:   `true`,
+			wantMethod: http.MethodDelete,
+			wantURI:    "/api/v2.0/iscsi/target/id/1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, uri, body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				method, uri, body = r.Method, r.RequestURI, string(b)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			got, err := tt.call(context.Background(), NewV2(rest.New("root", "secret", server.URL, nil)))
+
+			if method != tt.wantMethod || uri != tt.wantURI {
+				t.Errorf("request = %s %s, want %s %s", method, uri, tt.wantMethod, tt.wantURI)
+			}
+			if !jsonEqual(t, body, tt.wantBody) {
+				t.Errorf("request body = %s, want %s", body, tt.wantBody)
+			}
+
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Errorf("error = %v, want another error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tt.want)
+				t.Errorf("got %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+// jsonEqual reports whether two json documents hold the same values, two
+// empty documents are equal.
+func jsonEqual(t *testing.T, a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+
+	var av, bv interface{}
+	if err := json.Unmarshal([]byte(a), &av); err != nil {
+		t.Fatalf("invalid json %s: %v", a, err)
+	}
+	if err := json.Unmarshal([]byte(b), &bv); err != nil {
+		t.Fatalf("invalid json %s: %v", b, err)
+	}
+
+	return reflect.DeepEqual(av, bv)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+)
+
+const basePath = "/api/v1.0/services/iscsi/authcredential"
+
+type Client struct {
+	client rest.Interface
+}
+
+type Interface interface {
+	Create(ctx context.Context, auth *Auth) (*Auth, error)
+	Delete(ctx context.Context, auth *Auth) error
+	List(ctx context.Context, opts rest.ListOptions) ([]*Auth, error)
+	Get(ctx context.Context, auth *Auth) (*Auth, error)
+	Update(ctx context.Context, auth *Auth) (*Auth, error)
+}
+
+func New(client rest.Interface) Interface {
+	return &Client{
+		client: client,
+	}
+}
+
+type Auth struct {
+	ID                        *int    `json:"id,omitempty"`
+	IscsiTargetAuthTag        *int    `json:"iscsi_target_auth_tag,omitempty"`
+	IscsiTargetAuthUser       *string `json:"iscsi_target_auth_user,omitempty"`
+	IscsiTargetAuthSecret     *string `json:"iscsi_target_auth_secret,omitempty"`
+	IscsiTargetAuthPeeruser   *string `json:"iscsi_target_auth_peeruser,omitempty"`
+	IscsiTargetAuthPeersecret *string `json:"iscsi_target_auth_peersecret,omitempty"`
+}
+
+func (c Client) Delete(ctx context.Context, auth *Auth) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%d/", basePath, *auth.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusNoContent {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c Client) Create(ctx context.Context, auth *Auth) (*Auth, error) {
+	authBytes, err := json.Marshal(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(authBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusCreated {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var a Auth
+	err = json.Unmarshal(body, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func (c Client) List(ctx context.Context, opts rest.ListOptions) ([]*Auth, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/?%s", basePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var a []*Auth
+	err = json.Unmarshal(body, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&a)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (c Client) Get(ctx context.Context, auth *Auth) (*Auth, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%d/", basePath, *auth.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var a Auth
+	err = json.Unmarshal(body, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func (c Client) Update(ctx context.Context, auth *Auth) (*Auth, error) {
+	authBytes, err := json.Marshal(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%d/", basePath, *auth.ID), bytes.NewReader(authBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var a Auth
+	err = json.Unmarshal(body, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
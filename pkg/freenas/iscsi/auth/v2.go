@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+)
+
+const v2BasePath = "/api/v2.0/iscsi/auth"
+
+// V2Client implements Interface against the v2.0 api.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2Auth struct {
+	ID         *int    `json:"id,omitempty"`
+	Tag        *int    `json:"tag,omitempty"`
+	User       *string `json:"user,omitempty"`
+	Secret     *string `json:"secret,omitempty"`
+	Peeruser   *string `json:"peeruser,omitempty"`
+	Peersecret *string `json:"peersecret,omitempty"`
+}
+
+func newV2Auth(auth *Auth) *v2Auth {
+	return &v2Auth{
+		Tag:        auth.IscsiTargetAuthTag,
+		User:       auth.IscsiTargetAuthUser,
+		Secret:     auth.IscsiTargetAuthSecret,
+		Peeruser:   auth.IscsiTargetAuthPeeruser,
+		Peersecret: auth.IscsiTargetAuthPeersecret,
+	}
+}
+
+func (a *v2Auth) toAuth() *Auth {
+	return &Auth{
+		ID:                        a.ID,
+		IscsiTargetAuthTag:        a.Tag,
+		IscsiTargetAuthUser:       a.User,
+		IscsiTargetAuthSecret:     a.Secret,
+		IscsiTargetAuthPeeruser:   a.Peeruser,
+		IscsiTargetAuthPeersecret: a.Peersecret,
+	}
+}
+
+func (c V2Client) Delete(ctx context.Context, auth *Auth) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/id/%d", v2BasePath, *auth.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c V2Client) Create(ctx context.Context, auth *Auth) (*Auth, error) {
+	authBytes, err := json.Marshal(newV2Auth(auth))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, v2BasePath, bytes.NewReader(authBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var a v2Auth
+	err = json.Unmarshal(body, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.toAuth(), nil
+}
+
+func (c V2Client) List(ctx context.Context, opts rest.ListOptions) ([]*Auth, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?%s", v2BasePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var a []*v2Auth
+	err = json.Unmarshal(body, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	auths := make([]*Auth, 0, len(a))
+	for _, auth := range a {
+		auths = append(auths, auth.toAuth())
+	}
+
+	err = opts.Apply(&auths)
+	if err != nil {
+		return nil, err
+	}
+
+	return auths, nil
+}
+
+func (c V2Client) Get(ctx context.Context, auth *Auth) (*Auth, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/id/%d", v2BasePath, *auth.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var a v2Auth
+	err = json.Unmarshal(body, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.toAuth(), nil
+}
+
+func (c V2Client) Update(ctx context.Context, auth *Auth) (*Auth, error) {
+	authBytes, err := json.Marshal(newV2Auth(auth))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/id/%d", v2BasePath, *auth.ID), bytes.NewReader(authBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var a v2Auth
+	err = json.Unmarshal(body, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.toAuth(), nil
+}
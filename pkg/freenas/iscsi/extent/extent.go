@@ -2,6 +2,7 @@ package extent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
@@ -16,8 +17,11 @@ type Client struct {
 }
 
 type Interface interface {
-	Create(target *Extent) (*Extent, error)
-	Delete(extent *Extent) error
+	Create(ctx context.Context, extent *Extent) (*Extent, error)
+	Delete(ctx context.Context, extent *Extent) error
+	Get(ctx context.Context, extent *Extent) (*Extent, error)
+	List(ctx context.Context, opts rest.ListOptions) ([]*Extent, error)
+	Update(ctx context.Context, extent *Extent) (*Extent, error)
 }
 
 func New(client rest.Interface) Interface {
@@ -45,8 +49,8 @@ type Extent struct {
 	IscsiTargetExtentSerial         *string     `json:"iscsi_target_extent_serial,omitempty"`
 }
 
-func (c Client) Delete(extent *Extent) error {
-	request, err := c.client.NewRequest(http.MethodDelete, fmt.Sprintf("%s/%d/", basePath, *extent.ID), nil)
+func (c Client) Delete(ctx context.Context, extent *Extent) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%d/", basePath, *extent.ID), nil)
 	if err != nil {
 		return err
 	}
@@ -63,19 +67,19 @@ func (c Client) Delete(extent *Extent) error {
 	}
 
 	if response.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return rest.NewAPIError(response, body)
 	}
 
 	return nil
 }
 
-func (c Client) Create(extent *Extent) (*Extent, error) {
+func (c Client) Create(ctx context.Context, extent *Extent) (*Extent, error) {
 	extentBytes, err := json.Marshal(extent)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := c.client.NewRequest(http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(extentBytes))
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(extentBytes))
 	if err != nil {
 		return nil, err
 	}
@@ -92,7 +96,7 @@ func (c Client) Create(extent *Extent) (*Extent, error) {
 	}
 
 	if response.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return nil, rest.NewAPIError(response, body)
 	}
 
 	var e Extent
@@ -103,3 +107,125 @@ func (c Client) Create(extent *Extent) (*Extent, error) {
 
 	return &e, nil
 }
+
+func (c Client) Get(ctx context.Context, extent *Extent) (*Extent, error) {
+	if extent.ID == nil {
+		return getByName(ctx, c, extent)
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%d/", basePath, *extent.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var e Extent
+	err = json.Unmarshal(body, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (c Client) List(ctx context.Context, opts rest.ListOptions) ([]*Extent, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/?%s", basePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var e []*Extent
+	err = json.Unmarshal(body, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (c Client) Update(ctx context.Context, extent *Extent) (*Extent, error) {
+	extentBytes, err := json.Marshal(extent)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%d/", basePath, *extent.ID), bytes.NewReader(extentBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var e Extent
+	err = json.Unmarshal(body, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// getByName looks up a extent without an ID by its name.
+func getByName(ctx context.Context, c Interface, extent *Extent) (*Extent, error) {
+	if extent.IscsiTargetExtentName == nil {
+		return nil, fmt.Errorf("extent has neither an id nor a name")
+	}
+
+	extents, err := c.List(ctx, rest.ListOptions{Filters: map[string]string{"iscsi_target_extent_name": *extent.IscsiTargetExtentName}})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(extents) == 0 {
+		return nil, rest.NewNotFoundError(basePath, fmt.Sprintf("no extent named %s", *extent.IscsiTargetExtentName))
+	}
+
+	return extents[0], nil
+}
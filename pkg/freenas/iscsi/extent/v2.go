@@ -0,0 +1,269 @@
+package extent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const v2BasePath = "/api/v2.0/iscsi/extent"
+
+// V2Client implements Interface against the v2.0 api.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2Extent struct {
+	ID             *int        `json:"id,omitempty"`
+	Name           *string     `json:"name,omitempty"`
+	Type           *string     `json:"type,omitempty"`
+	Disk           *string     `json:"disk,omitempty"`
+	Path           *string     `json:"path,omitempty"`
+	Filesize       interface{} `json:"filesize,omitempty"`
+	Comment        *string     `json:"comment,omitempty"`
+	Serial         *string     `json:"serial,omitempty"`
+	Naa            *string     `json:"naa,omitempty"`
+	InsecureTpc    *bool       `json:"insecure_tpc,omitempty"`
+	Xen            *bool       `json:"xen,omitempty"`
+	Rpm            *string     `json:"rpm,omitempty"`
+	Ro             *bool       `json:"ro,omitempty"`
+	Blocksize      *int        `json:"blocksize,omitempty"`
+	Pblocksize     *bool       `json:"pblocksize,omitempty"`
+	AvailThreshold interface{} `json:"avail_threshold,omitempty"`
+}
+
+func newV2Extent(extent *Extent) *v2Extent {
+	e := &v2Extent{
+		Name:           extent.IscsiTargetExtentName,
+		Disk:           extent.IscsiTargetExtentDisk,
+		Path:           extent.IscsiTargetExtentPath,
+		Comment:        extent.IscsiTargetExtentComment,
+		Serial:         extent.IscsiTargetExtentSerial,
+		Naa:            extent.IscsiTargetExtentNaa,
+		InsecureTpc:    extent.IscsiTargetExtentInsecureTpc,
+		Xen:            extent.IscsiTargetExtentXen,
+		Rpm:            extent.IscsiTargetExtentRpm,
+		Ro:             extent.IscsiTargetExtentRo,
+		Blocksize:      extent.IscsiTargetExtentBlocksize,
+		Pblocksize:     extent.IscsiTargetExtentPblocksize,
+		AvailThreshold: extent.IscsiTargetExtentAvailThreshold,
+	}
+	if extent.IscsiTargetExtentFilesize != nil {
+		e.Filesize = *extent.IscsiTargetExtentFilesize
+	}
+	// v1.0 uses Disk and File, v2.0 DISK and FILE
+	if extent.IscsiTargetExtentType != nil {
+		extentType := strings.ToUpper(*extent.IscsiTargetExtentType)
+		e.Type = &extentType
+	}
+
+	return e
+}
+
+func (e *v2Extent) toExtent() *Extent {
+	extent := &Extent{
+		ID:                              e.ID,
+		IscsiTargetExtentName:           e.Name,
+		IscsiTargetExtentDisk:           e.Disk,
+		IscsiTargetExtentPath:           e.Path,
+		IscsiTargetExtentComment:        e.Comment,
+		IscsiTargetExtentSerial:         e.Serial,
+		IscsiTargetExtentNaa:            e.Naa,
+		IscsiTargetExtentInsecureTpc:    e.InsecureTpc,
+		IscsiTargetExtentXen:            e.Xen,
+		IscsiTargetExtentRpm:            e.Rpm,
+		IscsiTargetExtentRo:             e.Ro,
+		IscsiTargetExtentBlocksize:      e.Blocksize,
+		IscsiTargetExtentPblocksize:     e.Pblocksize,
+		IscsiTargetExtentAvailThreshold: e.AvailThreshold,
+	}
+	if e.Filesize != nil {
+		filesize := fmt.Sprint(e.Filesize)
+		extent.IscsiTargetExtentFilesize = &filesize
+	}
+	if e.Type != nil {
+		extentType := strings.Title(strings.ToLower(*e.Type))
+		extent.IscsiTargetExtentType = &extentType
+	}
+
+	return extent
+}
+
+func (c V2Client) Delete(ctx context.Context, extent *Extent) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/id/%d", v2BasePath, *extent.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c V2Client) Create(ctx context.Context, extent *Extent) (*Extent, error) {
+	extentBytes, err := json.Marshal(newV2Extent(extent))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, v2BasePath, bytes.NewReader(extentBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var e v2Extent
+	err = json.Unmarshal(body, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.toExtent(), nil
+}
+
+func (c V2Client) Get(ctx context.Context, extent *Extent) (*Extent, error) {
+	if extent.ID == nil {
+		return getByName(ctx, c, extent)
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/id/%d", v2BasePath, *extent.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var e v2Extent
+	err = json.Unmarshal(body, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.toExtent(), nil
+}
+
+func (c V2Client) List(ctx context.Context, opts rest.ListOptions) ([]*Extent, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?%s", v2BasePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var e []*v2Extent
+	err = json.Unmarshal(body, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	extents := make([]*Extent, 0, len(e))
+	for _, extent := range e {
+		extents = append(extents, extent.toExtent())
+	}
+
+	err = opts.Apply(&extents)
+	if err != nil {
+		return nil, err
+	}
+
+	return extents, nil
+}
+
+func (c V2Client) Update(ctx context.Context, extent *Extent) (*Extent, error) {
+	extentBytes, err := json.Marshal(newV2Extent(extent))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/id/%d", v2BasePath, *extent.ID), bytes.NewReader(extentBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var e v2Extent
+	err = json.Unmarshal(body, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.toExtent(), nil
+}
@@ -1,6 +1,8 @@
 package global_configuration
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
@@ -15,7 +17,8 @@ type Client struct {
 }
 
 type Interface interface {
-	Get() (*GlobalConfiguration, error)
+	Get(ctx context.Context) (*GlobalConfiguration, error)
+	Update(ctx context.Context, globalConfiguration *GlobalConfiguration) (*GlobalConfiguration, error)
 }
 
 func New(client rest.Interface) Interface {
@@ -31,8 +34,8 @@ type GlobalConfiguration struct {
 	ID                      *int        `json:"id,omitempty"`
 }
 
-func (c Client) Get() (*GlobalConfiguration, error) {
-	request, err := c.client.NewRequest(http.MethodGet, fmt.Sprintf("%s/", basePath), nil)
+func (c Client) Get(ctx context.Context) (*GlobalConfiguration, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/", basePath), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -49,7 +52,42 @@ func (c Client) Get() (*GlobalConfiguration, error) {
 	}
 
 	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var gc GlobalConfiguration
+	err = json.Unmarshal(body, &gc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gc, nil
+}
+
+func (c Client) Update(ctx context.Context, globalConfiguration *GlobalConfiguration) (*GlobalConfiguration, error) {
+	globalConfigurationBytes, err := json.Marshal(globalConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/", basePath), bytes.NewReader(globalConfigurationBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
 	}
 
 	var gc GlobalConfiguration
@@ -0,0 +1,119 @@
+package global_configuration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const v2BasePath = "/api/v2.0/iscsi/global"
+
+// V2Client implements Interface against the v2.0 api.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2GlobalConfiguration struct {
+	ID                 *int        `json:"id,omitempty"`
+	Basename           *string     `json:"basename,omitempty"`
+	IsnsServers        []string    `json:"isns_servers,omitempty"`
+	PoolAvailThreshold interface{} `json:"pool_avail_threshold,omitempty"`
+}
+
+func newV2GlobalConfiguration(globalConfiguration *GlobalConfiguration) *v2GlobalConfiguration {
+	gc := &v2GlobalConfiguration{
+		Basename:           globalConfiguration.IscsiBasename,
+		PoolAvailThreshold: globalConfiguration.IscsiPoolAvailThreshold,
+	}
+	// v1.0 separates isns servers by whitespace, v2.0 lists them
+	if globalConfiguration.IscsiIsnsServers != nil {
+		gc.IsnsServers = strings.Fields(*globalConfiguration.IscsiIsnsServers)
+	}
+
+	return gc
+}
+
+func (gc *v2GlobalConfiguration) toGlobalConfiguration() *GlobalConfiguration {
+	isnsServers := strings.Join(gc.IsnsServers, " ")
+	return &GlobalConfiguration{
+		ID:                      gc.ID,
+		IscsiBasename:           gc.Basename,
+		IscsiIsnsServers:        &isnsServers,
+		IscsiPoolAvailThreshold: gc.PoolAvailThreshold,
+	}
+}
+
+func (c V2Client) Get(ctx context.Context) (*GlobalConfiguration, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, v2BasePath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var gc v2GlobalConfiguration
+	err = json.Unmarshal(body, &gc)
+	if err != nil {
+		return nil, err
+	}
+
+	return gc.toGlobalConfiguration(), nil
+}
+
+func (c V2Client) Update(ctx context.Context, globalConfiguration *GlobalConfiguration) (*GlobalConfiguration, error) {
+	globalConfigurationBytes, err := json.Marshal(newV2GlobalConfiguration(globalConfiguration))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, v2BasePath, bytes.NewReader(globalConfigurationBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var gc v2GlobalConfiguration
+	err = json.Unmarshal(body, &gc)
+	if err != nil {
+		return nil, err
+	}
+
+	return gc.toGlobalConfiguration(), nil
+}
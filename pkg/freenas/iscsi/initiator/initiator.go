@@ -0,0 +1,198 @@
+package initiator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+)
+
+const basePath = "/api/v1.0/services/iscsi/authorizedinitiator"
+
+type Client struct {
+	client rest.Interface
+}
+
+type Interface interface {
+	Create(ctx context.Context, initiator *Initiator) (*Initiator, error)
+	Get(ctx context.Context, initiator *Initiator) (*Initiator, error)
+	List(ctx context.Context, opts rest.ListOptions) ([]*Initiator, error)
+	Update(ctx context.Context, initiator *Initiator) (*Initiator, error)
+	Delete(ctx context.Context, initiator *Initiator) error
+}
+
+func New(client rest.Interface) Interface {
+	return &Client{
+		client: client,
+	}
+}
+
+type Initiator struct {
+	ID                              *int    `json:"id,omitempty"`
+	IscsiTargetInitiatorTag         *int    `json:"iscsi_target_initiator_tag,omitempty"`
+	IscsiTargetInitiatorInitiators  *string `json:"iscsi_target_initiator_initiators,omitempty"`
+	IscsiTargetInitiatorAuthNetwork *string `json:"iscsi_target_initiator_auth_network,omitempty"`
+	IscsiTargetInitiatorComment     *string `json:"iscsi_target_initiator_comment,omitempty"`
+}
+
+func (c Client) Create(ctx context.Context, initiator *Initiator) (*Initiator, error) {
+	initiatorBytes, err := json.Marshal(initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(initiatorBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusCreated {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var i Initiator
+	err = json.Unmarshal(body, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (c Client) Get(ctx context.Context, initiator *Initiator) (*Initiator, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%d/", basePath, *initiator.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var i Initiator
+	err = json.Unmarshal(body, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (c Client) List(ctx context.Context, opts rest.ListOptions) ([]*Initiator, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/?%s", basePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var i []*Initiator
+	err = json.Unmarshal(body, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&i)
+	if err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+func (c Client) Update(ctx context.Context, initiator *Initiator) (*Initiator, error) {
+	initiatorBytes, err := json.Marshal(initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%d/", basePath, *initiator.ID), bytes.NewReader(initiatorBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var i Initiator
+	err = json.Unmarshal(body, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (c Client) Delete(ctx context.Context, initiator *Initiator) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%d/", basePath, *initiator.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusNoContent {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
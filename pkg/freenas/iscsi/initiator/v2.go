@@ -0,0 +1,248 @@
+package initiator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	v2BasePath = "/api/v2.0/iscsi/initiator"
+
+	// v1.0 allows every initiator or network with ALL, v2.0 with an empty list
+	v1All = "ALL"
+)
+
+// V2Client implements Interface against the v2.0 api.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2Initiator struct {
+	ID          *int      `json:"id,omitempty"`
+	Initiators  *[]string `json:"initiators,omitempty"`
+	AuthNetwork *[]string `json:"auth_network,omitempty"`
+	Comment     *string   `json:"comment,omitempty"`
+}
+
+func newV2Initiator(initiator *Initiator) *v2Initiator {
+	return &v2Initiator{
+		Initiators:  toList(initiator.IscsiTargetInitiatorInitiators),
+		AuthNetwork: toList(initiator.IscsiTargetInitiatorAuthNetwork),
+		Comment:     initiator.IscsiTargetInitiatorComment,
+	}
+}
+
+func (i *v2Initiator) toInitiator() *Initiator {
+	return &Initiator{
+		ID: i.ID,
+		// initiator groups are referenced by id in v2.0
+		IscsiTargetInitiatorTag:         i.ID,
+		IscsiTargetInitiatorInitiators:  fromList(i.Initiators),
+		IscsiTargetInitiatorAuthNetwork: fromList(i.AuthNetwork),
+		IscsiTargetInitiatorComment:     i.Comment,
+	}
+}
+
+// toList converts a v1.0 whitespace separated list to a v2.0 list.
+func toList(s *string) *[]string {
+	if s == nil {
+		return nil
+	}
+
+	list := strings.Fields(*s)
+	if len(list) == 1 && list[0] == v1All {
+		list = []string{}
+	}
+
+	return &list
+}
+
+// fromList converts a v2.0 list to a v1.0 newline separated list.
+func fromList(list *[]string) *string {
+	if list == nil {
+		return nil
+	}
+
+	s := strings.Join(*list, "\n")
+	if s == "" {
+		s = v1All
+	}
+
+	return &s
+}
+
+func (c V2Client) Create(ctx context.Context, initiator *Initiator) (*Initiator, error) {
+	initiatorBytes, err := json.Marshal(newV2Initiator(initiator))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, v2BasePath, bytes.NewReader(initiatorBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var i v2Initiator
+	err = json.Unmarshal(body, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.toInitiator(), nil
+}
+
+func (c V2Client) Get(ctx context.Context, initiator *Initiator) (*Initiator, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/id/%d", v2BasePath, *initiator.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var i v2Initiator
+	err = json.Unmarshal(body, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.toInitiator(), nil
+}
+
+func (c V2Client) List(ctx context.Context, opts rest.ListOptions) ([]*Initiator, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?%s", v2BasePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var i []*v2Initiator
+	err = json.Unmarshal(body, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	initiators := make([]*Initiator, 0, len(i))
+	for _, initiator := range i {
+		initiators = append(initiators, initiator.toInitiator())
+	}
+
+	err = opts.Apply(&initiators)
+	if err != nil {
+		return nil, err
+	}
+
+	return initiators, nil
+}
+
+func (c V2Client) Update(ctx context.Context, initiator *Initiator) (*Initiator, error) {
+	initiatorBytes, err := json.Marshal(newV2Initiator(initiator))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/id/%d", v2BasePath, *initiator.ID), bytes.NewReader(initiatorBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var i v2Initiator
+	err = json.Unmarshal(body, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.toInitiator(), nil
+}
+
+func (c V2Client) Delete(ctx context.Context, initiator *Initiator) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/id/%d", v2BasePath, *initiator.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
@@ -1,8 +1,10 @@
 package iscsi
 
 import (
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/auth"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/extent"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/global_configuration"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/initiator"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target_group"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/iscsi/target_to_extent"
@@ -16,6 +18,8 @@ type Client struct {
 	extent              extent.Interface
 	targetToExtent      target_to_extent.Interface
 	targetGroup         target_group.Interface
+	auth                auth.Interface
+	initiator           initiator.Interface
 }
 
 type Interface interface {
@@ -24,6 +28,8 @@ type Interface interface {
 	Extent() extent.Interface
 	TargetToExtent() target_to_extent.Interface
 	TargetGroup() target_group.Interface
+	Auth() auth.Interface
+	Initiator() initiator.Interface
 }
 
 func New(client rest.Interface) Interface {
@@ -34,6 +40,22 @@ func New(client rest.Interface) Interface {
 		extent:              extent.New(client),
 		targetToExtent:      target_to_extent.New(client),
 		targetGroup:         target_group.New(client),
+		auth:                auth.New(client),
+		initiator:           initiator.New(client),
+	}
+}
+
+// NewV2 returns a Client for the v2.0 api.
+func NewV2(client rest.Interface) Interface {
+	return &Client{
+		client:              client,
+		globalConfiguration: global_configuration.NewV2(client),
+		target:              target.NewV2(client),
+		extent:              extent.NewV2(client),
+		targetToExtent:      target_to_extent.NewV2(client),
+		targetGroup:         target_group.NewV2(client),
+		auth:                auth.NewV2(client),
+		initiator:           initiator.NewV2(client),
 	}
 }
 
@@ -56,3 +78,11 @@ func (c Client) TargetToExtent() target_to_extent.Interface {
 func (c Client) TargetGroup() target_group.Interface {
 	return c.targetGroup
 }
+
+func (c Client) Auth() auth.Interface {
+	return c.auth
+}
+
+func (c Client) Initiator() initiator.Interface {
+	return c.initiator
+}
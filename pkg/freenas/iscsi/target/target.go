@@ -2,6 +2,7 @@ package target
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
@@ -16,8 +17,11 @@ type Client struct {
 }
 
 type Interface interface {
-	Create(target *Target) (*Target, error)
-	Delete(target *Target) error
+	Create(ctx context.Context, target *Target) (*Target, error)
+	Delete(ctx context.Context, target *Target) error
+	Get(ctx context.Context, target *Target) (*Target, error)
+	List(ctx context.Context, opts rest.ListOptions) ([]*Target, error)
+	Update(ctx context.Context, target *Target) (*Target, error)
 }
 
 func New(client rest.Interface) Interface {
@@ -32,8 +36,8 @@ type Target struct {
 	ID               *int        `json:"id,omitempty"`
 }
 
-func (c Client) Delete(target *Target) error {
-	request, err := c.client.NewRequest(http.MethodDelete, fmt.Sprintf("%s/%d/", basePath, *target.ID), nil)
+func (c Client) Delete(ctx context.Context, target *Target) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%d/", basePath, *target.ID), nil)
 	if err != nil {
 		return err
 	}
@@ -50,19 +54,19 @@ func (c Client) Delete(target *Target) error {
 	}
 
 	if response.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return rest.NewAPIError(response, body)
 	}
 
 	return nil
 }
 
-func (c Client) Create(target *Target) (*Target, error) {
+func (c Client) Create(ctx context.Context, target *Target) (*Target, error) {
 	targetBytes, err := json.Marshal(target)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := c.client.NewRequest(http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(targetBytes))
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(targetBytes))
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +83,7 @@ func (c Client) Create(target *Target) (*Target, error) {
 	}
 
 	if response.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return nil, rest.NewAPIError(response, body)
 	}
 
 	var t Target
@@ -90,3 +94,125 @@ func (c Client) Create(target *Target) (*Target, error) {
 
 	return &t, nil
 }
+
+func (c Client) Get(ctx context.Context, target *Target) (*Target, error) {
+	if target.ID == nil {
+		return getByName(ctx, c, target)
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%d/", basePath, *target.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (c Client) List(ctx context.Context, opts rest.ListOptions) ([]*Target, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/?%s", basePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t []*Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&t)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (c Client) Update(ctx context.Context, target *Target) (*Target, error) {
+	targetBytes, err := json.Marshal(target)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%d/", basePath, *target.ID), bytes.NewReader(targetBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// getByName looks up a target without an ID by its name.
+func getByName(ctx context.Context, c Interface, target *Target) (*Target, error) {
+	if target.IscsiTargetName == nil {
+		return nil, fmt.Errorf("target has neither an id nor a name")
+	}
+
+	targets, err := c.List(ctx, rest.ListOptions{Filters: map[string]string{"iscsi_target_name": *target.IscsiTargetName}})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(targets) == 0 {
+		return nil, rest.NewNotFoundError(basePath, fmt.Sprintf("no target named %s", *target.IscsiTargetName))
+	}
+
+	return targets[0], nil
+}
@@ -0,0 +1,213 @@
+package target
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+)
+
+const v2BasePath = "/api/v2.0/iscsi/target"
+
+// V2Client implements Interface against the v2.0 api.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2Target struct {
+	ID    *int        `json:"id,omitempty"`
+	Name  *string     `json:"name,omitempty"`
+	Alias interface{} `json:"alias,omitempty"`
+}
+
+func newV2Target(target *Target) *v2Target {
+	return &v2Target{
+		Name:  target.IscsiTargetName,
+		Alias: target.IscsiTargetAlias,
+	}
+}
+
+func (t *v2Target) toTarget() *Target {
+	return &Target{
+		ID:               t.ID,
+		IscsiTargetName:  t.Name,
+		IscsiTargetAlias: t.Alias,
+	}
+}
+
+func (c V2Client) Delete(ctx context.Context, target *Target) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/id/%d", v2BasePath, *target.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c V2Client) Create(ctx context.Context, target *Target) (*Target, error) {
+	targetBytes, err := json.Marshal(newV2Target(target))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, v2BasePath, bytes.NewReader(targetBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t v2Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.toTarget(), nil
+}
+
+func (c V2Client) Get(ctx context.Context, target *Target) (*Target, error) {
+	if target.ID == nil {
+		return getByName(ctx, c, target)
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/id/%d", v2BasePath, *target.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t v2Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.toTarget(), nil
+}
+
+func (c V2Client) List(ctx context.Context, opts rest.ListOptions) ([]*Target, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?%s", v2BasePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t []*v2Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]*Target, 0, len(t))
+	for _, target := range t {
+		targets = append(targets, target.toTarget())
+	}
+
+	err = opts.Apply(&targets)
+	if err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+func (c V2Client) Update(ctx context.Context, target *Target) (*Target, error) {
+	targetBytes, err := json.Marshal(newV2Target(target))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/id/%d", v2BasePath, *target.ID), bytes.NewReader(targetBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t v2Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.toTarget(), nil
+}
@@ -2,6 +2,7 @@ package target_group
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
@@ -16,7 +17,11 @@ type Client struct {
 }
 
 type Interface interface {
-	Create(targetGroup *TargetGroup) (*TargetGroup, error)
+	Create(ctx context.Context, targetGroup *TargetGroup) (*TargetGroup, error)
+	Delete(ctx context.Context, targetGroup *TargetGroup) error
+	Get(ctx context.Context, targetGroup *TargetGroup) (*TargetGroup, error)
+	List(ctx context.Context, opts rest.ListOptions) ([]*TargetGroup, error)
+	Update(ctx context.Context, targetGroup *TargetGroup) (*TargetGroup, error)
 }
 
 func New(client rest.Interface) Interface {
@@ -26,6 +31,7 @@ func New(client rest.Interface) Interface {
 }
 
 type TargetGroup struct {
+	ID                        *int        `json:"id,omitempty"`
 	IscsiTarget               *int        `json:"iscsi_target,omitempty"`
 	IscsiTargetAuthgroup      interface{} `json:"iscsi_target_authgroup,omitempty"`
 	IscsiTargetAuthtype       *string     `json:"iscsi_target_authtype,omitempty"`
@@ -34,13 +40,13 @@ type TargetGroup struct {
 	IscsiTargetInitialdigest  *string     `json:"iscsi_target_initialdigest,omitempty"`
 }
 
-func (c Client) Create(targetGroup *TargetGroup) (*TargetGroup, error) {
+func (c Client) Create(ctx context.Context, targetGroup *TargetGroup) (*TargetGroup, error) {
 	targetGroupBytes, err := json.Marshal(targetGroup)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := c.client.NewRequest(http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(targetGroupBytes))
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(targetGroupBytes))
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +63,131 @@ func (c Client) Create(targetGroup *TargetGroup) (*TargetGroup, error) {
 	}
 
 	if response.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tg TargetGroup
+	err = json.Unmarshal(body, &tg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tg, nil
+}
+
+func (c Client) Get(ctx context.Context, targetGroup *TargetGroup) (*TargetGroup, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%d/", basePath, *targetGroup.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tg TargetGroup
+	err = json.Unmarshal(body, &tg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tg, nil
+}
+
+func (c Client) List(ctx context.Context, opts rest.ListOptions) ([]*TargetGroup, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/?%s", basePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tg []*TargetGroup
+	err = json.Unmarshal(body, &tg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&tg)
+	if err != nil {
+		return nil, err
+	}
+
+	return tg, nil
+}
+
+func (c Client) Delete(ctx context.Context, targetGroup *TargetGroup) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%d/", basePath, *targetGroup.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusNoContent {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c Client) Update(ctx context.Context, targetGroup *TargetGroup) (*TargetGroup, error) {
+	targetGroupBytes, err := json.Marshal(targetGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%d/", basePath, *targetGroup.ID), bytes.NewReader(targetGroupBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
 	}
 
 	var tg TargetGroup
@@ -0,0 +1,296 @@
+package target_group
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	v2TargetBasePath = "/api/v2.0/iscsi/target"
+
+	// v2.0 has no target group resource, groups are part of their target. A
+	// group is identified by target id * v2GroupsPerTarget + its position in
+	// the target's groups.
+	v2GroupsPerTarget = 1000
+)
+
+// V2Client implements Interface against the v2.0 api by editing the groups of
+// the target.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2Target struct {
+	ID     *int             `json:"id,omitempty"`
+	Groups []*v2TargetGroup `json:"groups"`
+}
+
+type v2TargetGroup struct {
+	Portal     *int    `json:"portal,omitempty"`
+	Initiator  *int    `json:"initiator"`
+	Auth       *int    `json:"auth"`
+	Authmethod *string `json:"authmethod,omitempty"`
+}
+
+func newV2TargetGroup(targetGroup *TargetGroup) *v2TargetGroup {
+	tg := &v2TargetGroup{
+		Portal:    targetGroup.IscsiTargetPortalgroup,
+		Initiator: intValue(targetGroup.IscsiTargetInitiatorgroup),
+		Auth:      intValue(targetGroup.IscsiTargetAuthgroup),
+	}
+	// v1.0 uses None, CHAP and CHAP Mutual, v2.0 NONE, CHAP and CHAP_MUTUAL
+	if targetGroup.IscsiTargetAuthtype != nil {
+		authmethod := strings.Replace(strings.ToUpper(*targetGroup.IscsiTargetAuthtype), " ", "_", -1)
+		tg.Authmethod = &authmethod
+	}
+
+	return tg
+}
+
+func (tg *v2TargetGroup) toTargetGroup(targetID, position int) *TargetGroup {
+	id := targetID*v2GroupsPerTarget + position
+	targetGroup := &TargetGroup{
+		ID:                     &id,
+		IscsiTarget:            &targetID,
+		IscsiTargetPortalgroup: tg.Portal,
+	}
+	if tg.Initiator != nil {
+		targetGroup.IscsiTargetInitiatorgroup = *tg.Initiator
+	}
+	if tg.Auth != nil {
+		targetGroup.IscsiTargetAuthgroup = *tg.Auth
+	}
+	if tg.Authmethod != nil {
+		authtype := *tg.Authmethod
+		switch authtype {
+		case "NONE":
+			authtype = "None"
+		case "CHAP_MUTUAL":
+			authtype = "CHAP Mutual"
+		}
+		targetGroup.IscsiTargetAuthtype = &authtype
+	}
+
+	return targetGroup
+}
+
+// intValue converts the loosely typed group references of TargetGroup, zero
+// means no group.
+func intValue(v interface{}) *int {
+	var i int
+	switch v := v.(type) {
+	case int:
+		i = v
+	case *int:
+		if v == nil {
+			return nil
+		}
+		i = *v
+	case float64:
+		i = int(v)
+	default:
+		return nil
+	}
+
+	if i == 0 {
+		return nil
+	}
+
+	return &i
+}
+
+func (c V2Client) Create(ctx context.Context, targetGroup *TargetGroup) (*TargetGroup, error) {
+	t, err := c.getTarget(ctx, *targetGroup.IscsiTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Groups = append(t.Groups, newV2TargetGroup(targetGroup))
+	t, err = c.updateTarget(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	position := len(t.Groups) - 1
+	return t.Groups[position].toTargetGroup(*t.ID, position), nil
+}
+
+func (c V2Client) Get(ctx context.Context, targetGroup *TargetGroup) (*TargetGroup, error) {
+	targetID, position := *targetGroup.ID/v2GroupsPerTarget, *targetGroup.ID%v2GroupsPerTarget
+
+	t, err := c.getTarget(ctx, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if position >= len(t.Groups) {
+		return nil, rest.NewNotFoundError(fmt.Sprintf("%s/id/%d", v2TargetBasePath, targetID), fmt.Sprintf("target %d has no group %d", targetID, position))
+	}
+
+	return t.Groups[position].toTargetGroup(targetID, position), nil
+}
+
+func (c V2Client) List(ctx context.Context, opts rest.ListOptions) ([]*TargetGroup, error) {
+	// targets hold any number of groups, so groups are paginated here
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?%s", v2TargetBasePath, rest.ListOptions{}.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t []*v2Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	var targetGroups []*TargetGroup
+	for _, target := range t {
+		for position, tg := range target.Groups {
+			targetGroups = append(targetGroups, tg.toTargetGroup(*target.ID, position))
+		}
+	}
+
+	err = opts.Filter(&targetGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Paginate(&targetGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	return targetGroups, nil
+}
+
+func (c V2Client) Delete(ctx context.Context, targetGroup *TargetGroup) error {
+	targetID, position := *targetGroup.ID/v2GroupsPerTarget, *targetGroup.ID%v2GroupsPerTarget
+
+	t, err := c.getTarget(ctx, targetID)
+	if err != nil {
+		return err
+	}
+
+	if position >= len(t.Groups) {
+		return rest.NewNotFoundError(fmt.Sprintf("%s/id/%d", v2TargetBasePath, targetID), fmt.Sprintf("target %d has no group %d", targetID, position))
+	}
+
+	t.Groups = append(t.Groups[:position], t.Groups[position+1:]...)
+	_, err = c.updateTarget(ctx, t)
+	return err
+}
+
+func (c V2Client) Update(ctx context.Context, targetGroup *TargetGroup) (*TargetGroup, error) {
+	targetID, position := *targetGroup.ID/v2GroupsPerTarget, *targetGroup.ID%v2GroupsPerTarget
+
+	t, err := c.getTarget(ctx, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if position >= len(t.Groups) {
+		return nil, rest.NewNotFoundError(fmt.Sprintf("%s/id/%d", v2TargetBasePath, targetID), fmt.Sprintf("target %d has no group %d", targetID, position))
+	}
+
+	t.Groups[position] = newV2TargetGroup(targetGroup)
+	t, err = c.updateTarget(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Groups[position].toTargetGroup(targetID, position), nil
+}
+
+func (c V2Client) getTarget(ctx context.Context, id int) (*v2Target, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/id/%d", v2TargetBasePath, id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t v2Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (c V2Client) updateTarget(ctx context.Context, target *v2Target) (*v2Target, error) {
+	targetBytes, err := json.Marshal(&v2Target{
+		Groups: target.Groups,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/id/%d", v2TargetBasePath, *target.ID), bytes.NewReader(targetBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var t v2Target
+	err = json.Unmarshal(body, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
@@ -2,6 +2,7 @@ package target_to_extent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
@@ -16,7 +17,11 @@ type Client struct {
 }
 
 type Interface interface {
-	Create(targetToExtent *TargetToExtent) (*TargetToExtent, error)
+	Create(ctx context.Context, targetToExtent *TargetToExtent) (*TargetToExtent, error)
+	Get(ctx context.Context, targetToExtent *TargetToExtent) (*TargetToExtent, error)
+	List(ctx context.Context, opts rest.ListOptions) ([]*TargetToExtent, error)
+	Update(ctx context.Context, targetToExtent *TargetToExtent) (*TargetToExtent, error)
+	Delete(ctx context.Context, targetToExtent *TargetToExtent) error
 }
 
 func New(client rest.Interface) Interface {
@@ -32,13 +37,13 @@ type TargetToExtent struct {
 	ID          *int        `json:"id,omitempty"`
 }
 
-func (c Client) Create(targetToExtent *TargetToExtent) (*TargetToExtent, error) {
+func (c Client) Create(ctx context.Context, targetToExtent *TargetToExtent) (*TargetToExtent, error) {
 	targetToExtentBytes, err := json.Marshal(targetToExtent)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := c.client.NewRequest(http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(targetToExtentBytes))
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(targetToExtentBytes))
 	if err != nil {
 		return nil, err
 	}
@@ -55,7 +60,7 @@ func (c Client) Create(targetToExtent *TargetToExtent) (*TargetToExtent, error)
 	}
 
 	if response.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return nil, rest.NewAPIError(response, body)
 	}
 
 	var tte TargetToExtent
@@ -66,3 +71,127 @@ func (c Client) Create(targetToExtent *TargetToExtent) (*TargetToExtent, error)
 
 	return &tte, nil
 }
+
+func (c Client) Get(ctx context.Context, targetToExtent *TargetToExtent) (*TargetToExtent, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%d/", basePath, *targetToExtent.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tte TargetToExtent
+	err = json.Unmarshal(body, &tte)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tte, nil
+}
+
+func (c Client) List(ctx context.Context, opts rest.ListOptions) ([]*TargetToExtent, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/?%s", basePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tte []*TargetToExtent
+	err = json.Unmarshal(body, &tte)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&tte)
+	if err != nil {
+		return nil, err
+	}
+
+	return tte, nil
+}
+
+func (c Client) Update(ctx context.Context, targetToExtent *TargetToExtent) (*TargetToExtent, error) {
+	targetToExtentBytes, err := json.Marshal(targetToExtent)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%d/", basePath, *targetToExtent.ID), bytes.NewReader(targetToExtentBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tte TargetToExtent
+	err = json.Unmarshal(body, &tte)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tte, nil
+}
+
+func (c Client) Delete(ctx context.Context, targetToExtent *TargetToExtent) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%d/", basePath, *targetToExtent.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusNoContent {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package target_to_extent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+)
+
+const v2BasePath = "/api/v2.0/iscsi/targetextent"
+
+// V2Client implements Interface against the v2.0 api.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2TargetToExtent struct {
+	ID     *int        `json:"id,omitempty"`
+	Target *int        `json:"target,omitempty"`
+	Extent *int        `json:"extent,omitempty"`
+	Lunid  interface{} `json:"lunid,omitempty"`
+}
+
+func newV2TargetToExtent(targetToExtent *TargetToExtent) *v2TargetToExtent {
+	return &v2TargetToExtent{
+		Target: targetToExtent.IscsiTarget,
+		Extent: targetToExtent.IscsiExtent,
+		Lunid:  targetToExtent.IscsiLunid,
+	}
+}
+
+func (t *v2TargetToExtent) toTargetToExtent() *TargetToExtent {
+	return &TargetToExtent{
+		ID:          t.ID,
+		IscsiTarget: t.Target,
+		IscsiExtent: t.Extent,
+		IscsiLunid:  t.Lunid,
+	}
+}
+
+func (c V2Client) Create(ctx context.Context, targetToExtent *TargetToExtent) (*TargetToExtent, error) {
+	targetToExtentBytes, err := json.Marshal(newV2TargetToExtent(targetToExtent))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, v2BasePath, bytes.NewReader(targetToExtentBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tte v2TargetToExtent
+	err = json.Unmarshal(body, &tte)
+	if err != nil {
+		return nil, err
+	}
+
+	return tte.toTargetToExtent(), nil
+}
+
+func (c V2Client) Get(ctx context.Context, targetToExtent *TargetToExtent) (*TargetToExtent, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/id/%d", v2BasePath, *targetToExtent.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tte v2TargetToExtent
+	err = json.Unmarshal(body, &tte)
+	if err != nil {
+		return nil, err
+	}
+
+	return tte.toTargetToExtent(), nil
+}
+
+func (c V2Client) List(ctx context.Context, opts rest.ListOptions) ([]*TargetToExtent, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?%s", v2BasePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tte []*v2TargetToExtent
+	err = json.Unmarshal(body, &tte)
+	if err != nil {
+		return nil, err
+	}
+
+	targetToExtents := make([]*TargetToExtent, 0, len(tte))
+	for _, targetToExtent := range tte {
+		targetToExtents = append(targetToExtents, targetToExtent.toTargetToExtent())
+	}
+
+	err = opts.Apply(&targetToExtents)
+	if err != nil {
+		return nil, err
+	}
+
+	return targetToExtents, nil
+}
+
+func (c V2Client) Update(ctx context.Context, targetToExtent *TargetToExtent) (*TargetToExtent, error) {
+	targetToExtentBytes, err := json.Marshal(newV2TargetToExtent(targetToExtent))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/id/%d", v2BasePath, *targetToExtent.ID), bytes.NewReader(targetToExtentBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var tte v2TargetToExtent
+	err = json.Unmarshal(body, &tte)
+	if err != nil {
+		return nil, err
+	}
+
+	return tte.toTargetToExtent(), nil
+}
+
+func (c V2Client) Delete(ctx context.Context, targetToExtent *TargetToExtent) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/id/%d", v2BasePath, *targetToExtent.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,504 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"golang.org/x/net/websocket"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	websocketPath = "/websocket"
+
+	// job states
+	jobSuccess = "SUCCESS"
+	jobFailed  = "FAILED"
+	jobAborted = "ABORTED"
+
+	jobsCollection = "core.get_jobs"
+)
+
+// Client speaks the websocket protocol of the TrueNAS middleware. It logs in
+// on the first call and again after the connection is lost.
+type Client struct {
+	Username string
+	Password string
+	// APIKey takes precedence over Username and Password when set
+	APIKey string
+	Host   string
+	// TLSConfig may be nil to use the defaults
+	TLSConfig *tls.Config
+
+	connectMu sync.Mutex
+	writeMu   sync.Mutex
+
+	// mu guards everything below
+	mu sync.Mutex
+	// conn is the logged in connection, current the one being read from
+	conn       *websocket.Conn
+	current    *websocket.Conn
+	nextID     uint64
+	pending    map[string]chan *message
+	jobs       map[int]chan *jobFields
+	jobMethods map[string]bool
+}
+
+// Error is an error returned by a middleware method.
+type Error struct {
+	Errno   int             `json:"error"`
+	Errname string          `json:"errname,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Reason  string          `json:"reason"`
+	Extra   json.RawMessage `json:"extra,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Errname != "" {
+		return fmt.Sprintf("%s: %s", e.Errname, e.Reason)
+	}
+
+	return e.Reason
+}
+
+// JobProgress is the progress a running job reports.
+type JobProgress struct {
+	Percent     float64 `json:"percent"`
+	Description string  `json:"description"`
+}
+
+type request struct {
+	ID      string        `json:"id,omitempty"`
+	Msg     string        `json:"msg"`
+	Method  string        `json:"method,omitempty"`
+	Params  []interface{} `json:"params,omitempty"`
+	Name    string        `json:"name,omitempty"`
+	Version string        `json:"version,omitempty"`
+	Support []string      `json:"support,omitempty"`
+}
+
+type message struct {
+	ID         json.RawMessage `json:"id,omitempty"`
+	Msg        string          `json:"msg"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      *Error          `json:"error,omitempty"`
+	Collection string          `json:"collection,omitempty"`
+	Fields     *jobFields      `json:"fields,omitempty"`
+}
+
+type jobFields struct {
+	ID       int             `json:"id"`
+	State    string          `json:"state"`
+	Progress *JobProgress    `json:"progress,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    *string         `json:"error,omitempty"`
+}
+
+func New(username, password, host string, tlsConfig *tls.Config) *Client {
+	return &Client{
+		Username:  username,
+		Password:  password,
+		Host:      host,
+		TLSConfig: tlsConfig,
+	}
+}
+
+// NewWithAPIKey returns a client that logs in with a TrueNAS api key instead
+// of a username and password.
+func NewWithAPIKey(apiKey, host string, tlsConfig *tls.Config) *Client {
+	client := New("", "", host, tlsConfig)
+	client.APIKey = apiKey
+
+	return client
+}
+
+// Call calls a middleware method and returns its result. Methods that run as
+// jobs are waited for and return the result of the job.
+func (c *Client) Call(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error) {
+	isJob, err := c.isJob(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+
+	if isJob {
+		return c.CallJob(ctx, method, func(progress JobProgress) {
+			glog.V(2).Infof("%s: %.0f%% %s", method, progress.Percent, progress.Description)
+		}, params...)
+	}
+
+	return c.call(ctx, method, params...)
+}
+
+// CallJob calls a middleware method that runs as a job, reports the job's
+// progress and returns its result once it has finished. The job keeps running
+// on the appliance when ctx is done before it has finished.
+func (c *Client) CallJob(ctx context.Context, method string, progress func(JobProgress), params ...interface{}) (json.RawMessage, error) {
+	result, err := c.call(ctx, method, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobID int
+	err = json.Unmarshal(result, &jobID)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected job id %s returned by %s", string(result), method)
+	}
+
+	events := make(chan *jobFields, 16)
+	c.mu.Lock()
+	if c.jobs == nil {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("connection lost while waiting for job %d (%s)", jobID, method)
+	}
+	c.jobs[jobID] = events
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.jobs, jobID)
+		c.mu.Unlock()
+	}()
+
+	// the job may have progressed before we started listening
+	result, err = c.call(ctx, "core.get_jobs", [][]interface{}{{"id", "=", jobID}})
+	if err != nil {
+		return nil, err
+	}
+	var current []*jobFields
+	err = json.Unmarshal(result, &current)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &jobFields{ID: jobID}
+	if len(current) == 1 {
+		job = current[0]
+	}
+	for {
+		if job.Progress != nil && progress != nil {
+			progress(*job.Progress)
+		}
+
+		switch job.State {
+		case jobSuccess:
+			return job.Result, nil
+		case jobFailed, jobAborted:
+			reason := job.State
+			if job.Error != nil {
+				reason = *job.Error
+			}
+			return nil, &Error{Reason: fmt.Sprintf("job %d (%s) failed: %s", jobID, method, reason)}
+		}
+
+		var ok bool
+		select {
+		case job, ok = <-events:
+			if !ok {
+				return nil, fmt.Errorf("connection lost while waiting for job %d (%s)", jobID, method)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// isJob reports whether a method runs as a job, as advertised by the
+// middleware.
+func (c *Client) isJob(ctx context.Context, method string) (bool, error) {
+	c.mu.Lock()
+	jobMethods := c.jobMethods
+	c.mu.Unlock()
+
+	if jobMethods == nil {
+		result, err := c.call(ctx, "core.get_methods")
+		if err != nil {
+			return false, err
+		}
+
+		var methods map[string]struct {
+			Job bool `json:"job"`
+		}
+		err = json.Unmarshal(result, &methods)
+		if err != nil {
+			return false, err
+		}
+
+		jobMethods = map[string]bool{}
+		for name, m := range methods {
+			if m.Job {
+				jobMethods[name] = true
+			}
+		}
+
+		c.mu.Lock()
+		c.jobMethods = jobMethods
+		c.mu.Unlock()
+	}
+
+	return jobMethods[method], nil
+}
+
+func (c *Client) call(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error) {
+	conn, err := c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.send(ctx, conn, method, params)
+}
+
+func (c *Client) send(ctx context.Context, conn *websocket.Conn, method string, params []interface{}) (json.RawMessage, error) {
+	responses := make(chan *message, 1)
+
+	c.mu.Lock()
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	c.pending[id] = responses
+	c.mu.Unlock()
+
+	if params == nil {
+		params = []interface{}{}
+	}
+	err := c.write(conn, &request{
+		ID:     id,
+		Msg:    "method",
+		Method: method,
+		Params: params,
+	})
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		c.disconnect(conn)
+		return nil, err
+	}
+
+	var response *message
+	var ok bool
+	select {
+	case response, ok = <-responses:
+		if !ok {
+			return nil, fmt.Errorf("connection lost while calling %s", method)
+		}
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	if response.Error != nil {
+		return nil, response.Error
+	}
+
+	return response.Result, nil
+}
+
+func (c *Client) write(conn *websocket.Conn, r *request) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return websocket.JSON.Send(conn, r)
+}
+
+// connection returns the current connection, connecting and logging in first
+// if there is none.
+func (c *Client) connection(ctx context.Context) (*websocket.Conn, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+
+	// another call may have connected in the meantime
+	c.mu.Lock()
+	conn = c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	url := strings.Replace(strings.Replace(c.Host, "https://", "wss://", 1), "http://", "ws://", 1) + websocketPath
+	config, err := websocket.NewConfig(url, c.Host)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = &tls.Config{}
+	if c.TLSConfig != nil {
+		config.TlsConfig = c.TLSConfig.Clone()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		config.Dialer = &net.Dialer{Deadline: deadline}
+	}
+
+	conn, err = websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake is bound by ctx too, later reads are not
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	err = websocket.JSON.Send(conn, &request{Msg: "connect", Version: "1", Support: []string{"1"}})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var connected message
+	err = websocket.JSON.Receive(conn, &connected)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if connected.Msg != "connected" {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected middleware handshake response %s", connected.Msg)
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	c.current = conn
+	c.pending = map[string]chan *message{}
+	c.jobs = map[int]chan *jobFields{}
+	c.mu.Unlock()
+	go c.read(conn)
+
+	err = c.login(ctx, conn)
+	if err != nil {
+		c.disconnect(conn)
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	return conn, nil
+}
+
+func (c *Client) login(ctx context.Context, conn *websocket.Conn) error {
+	method, params := "auth.login", []interface{}{c.Username, c.Password}
+	if c.APIKey != "" {
+		method, params = "auth.login_with_api_key", []interface{}{c.APIKey}
+	}
+
+	result, err := c.send(ctx, conn, method, params)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	err = json.Unmarshal(result, &ok)
+	if err != nil || !ok {
+		return fmt.Errorf("middleware login failed")
+	}
+
+	return c.write(conn, &request{ID: jobsCollection, Msg: "sub", Name: jobsCollection})
+}
+
+// read dispatches responses and job events until the connection fails.
+func (c *Client) read(conn *websocket.Conn) {
+	defer c.disconnect(conn)
+
+	for {
+		var m message
+		err := websocket.JSON.Receive(conn, &m)
+		if err != nil {
+			glog.Warningf("middleware connection lost: %v", err)
+			return
+		}
+
+		switch m.Msg {
+		case "result":
+			var id string
+			err := json.Unmarshal(m.ID, &id)
+			if err != nil {
+				continue
+			}
+
+			c.mu.Lock()
+			if responses, ok := c.pending[id]; ok {
+				delete(c.pending, id)
+				responses <- &m
+			}
+			c.mu.Unlock()
+		case "added", "changed":
+			if m.Collection != jobsCollection || m.Fields == nil {
+				continue
+			}
+
+			c.mu.Lock()
+			if events, ok := c.jobs[m.Fields.ID]; ok {
+				queueJobEvent(events, m.Fields)
+			}
+			c.mu.Unlock()
+		case "ping":
+			err := c.write(conn, &request{Msg: "pong"})
+			if err != nil {
+				glog.Warningf("error answering middleware ping: %v", err)
+			}
+		}
+	}
+}
+
+// queueJobEvent queues a job event without blocking the reader. Progress
+// updates are dropped while the waiting job is behind, a newer one follows.
+// The event ending the job replaces the oldest queued one instead, nothing
+// follows it.
+func queueJobEvent(events chan *jobFields, fields *jobFields) {
+	for {
+		select {
+		case events <- fields:
+			return
+		default:
+		}
+
+		if !fields.finished() {
+			return
+		}
+
+		// only the reader sends, so this makes room
+		select {
+		case <-events:
+		default:
+		}
+	}
+}
+
+func (j *jobFields) finished() bool {
+	return j.State == jobSuccess || j.State == jobFailed || j.State == jobAborted
+}
+
+// disconnect closes conn and fails the calls and jobs waiting on it.
+func (c *Client) disconnect(conn *websocket.Conn) {
+	conn.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.current != conn {
+		return
+	}
+
+	c.conn = nil
+	c.current = nil
+	for id, responses := range c.pending {
+		close(responses)
+		delete(c.pending, id)
+	}
+	for id, events := range c.jobs {
+		close(events)
+		delete(c.jobs, id)
+	}
+}
@@ -0,0 +1,284 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standIn imitates the websocket api of the middleware.
+type standIn struct {
+	server *httptest.Server
+	// results of the plain methods
+	results map[string]interface{}
+	// errors of the plain methods
+	errors map[string]*Error
+	// jobs are the events each job method goes through. They are sent when the
+	// client first asks for the job's state, which is reported as running.
+	jobs map[string][]jobFields
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func newStandIn() *standIn {
+	s := &standIn{
+		results: map[string]interface{}{},
+		errors:  map[string]*Error{},
+		jobs:    map[string][]jobFields{},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(websocketPath, websocket.Handler(s.serve))
+	s.server = httptest.NewServer(mux)
+
+	return s
+}
+
+func (s *standIn) Close() {
+	s.server.Close()
+}
+
+func (s *standIn) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.calls...)
+}
+
+func (s *standIn) serve(conn *websocket.Conn) {
+	jobIDs := map[int]string{}
+	subscribed := false
+
+	for {
+		var r request
+		err := websocket.JSON.Receive(conn, &r)
+		if err != nil {
+			return
+		}
+
+		switch r.Msg {
+		case "connect":
+			websocket.JSON.Send(conn, map[string]interface{}{"msg": "connected", "session": "stand-in"})
+			continue
+		case "sub":
+			subscribed = r.Name == jobsCollection
+			continue
+		case "method":
+		default:
+			continue
+		}
+
+		s.mu.Lock()
+		s.calls = append(s.calls, r.Method)
+		s.mu.Unlock()
+
+		var result interface{}
+		switch {
+		case r.Method == "auth.login":
+			result = r.Params[0] == "root" && r.Params[1] == "secret"
+		case r.Method == "core.get_methods":
+			methods := map[string]interface{}{}
+			for method := range s.results {
+				methods[method] = map[string]bool{"job": false}
+			}
+			for method := range s.jobs {
+				methods[method] = map[string]bool{"job": true}
+			}
+			result = methods
+		case r.Method == "core.get_jobs":
+			id := int(r.Params[0].([]interface{})[0].([]interface{})[2].(float64))
+			if subscribed {
+				for _, fields := range s.jobs[jobIDs[id]] {
+					fields := fields
+					fields.ID = id
+					websocket.JSON.Send(conn, map[string]interface{}{"msg": "changed", "collection": jobsCollection, "id": id, "fields": &fields})
+				}
+			}
+			result = []interface{}{map[string]interface{}{"id": id, "state": "RUNNING"}}
+		case s.jobs[r.Method] != nil:
+			id := len(jobIDs) + 1
+			jobIDs[id] = r.Method
+			result = id
+		case s.errors[r.Method] != nil:
+			websocket.JSON.Send(conn, map[string]interface{}{"msg": "result", "id": r.ID, "error": s.errors[r.Method]})
+			continue
+		default:
+			result = s.results[r.Method]
+		}
+
+		websocket.JSON.Send(conn, map[string]interface{}{"msg": "result", "id": r.ID, "result": result})
+	}
+}
+
+func (s *standIn) Client() *Client {
+	return New("root", "secret", s.server.URL, nil)
+}
+
+func TestClientCall(t *testing.T) {
+	server := newStandIn()
+	defer server.Close()
+	server.results["pool.dataset.query"] = []string{"tank/k8s"}
+	server.errors["pool.dataset.delete"] = &Error{Errno: 2, Errname: "ENOENT", Reason: "dataset not found"}
+
+	client := server.Client()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := client.Call(ctx, "pool.dataset.query")
+	if err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if string(result) != `["tank/k8s"]` {
+		t.Errorf("Call() = %s, want [\"tank/k8s\"]", result)
+	}
+
+	_, err = client.Call(ctx, "pool.dataset.delete", "tank/k8s/pvc-1")
+	if e, ok := err.(*Error); !ok || e.Errname != "ENOENT" {
+		t.Errorf("Call() error = %#v, want ENOENT", err)
+	}
+
+	// the connection, login and methods are reused
+	want := []string{"auth.login", "core.get_methods", "pool.dataset.query", "pool.dataset.delete"}
+	if calls := server.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestClientLoginFailure(t *testing.T) {
+	server := newStandIn()
+	defer server.Close()
+
+	client := New("root", "wrong", server.server.URL, nil)
+	_, err := client.Call(context.Background(), "pool.dataset.query")
+	if err == nil || !strings.Contains(err.Error(), "login failed") {
+		t.Errorf("Call() error = %v, want a failed login", err)
+	}
+}
+
+func progressEvents(n int) []jobFields {
+	events := make([]jobFields, 0, n)
+	for i := 0; i < n; i++ {
+		events = append(events, jobFields{State: "RUNNING", Progress: &JobProgress{Percent: float64(i * 100 / n), Description: fmt.Sprintf("step %d", i)}})
+	}
+
+	return events
+}
+
+func TestClientCallJob(t *testing.T) {
+	jobError := "pool is busy"
+
+	tests := []struct {
+		name         string
+		events       []jobFields
+		want         string
+		wantErr      string
+		wantProgress bool
+	}{
+		{
+			name:         "succeeds",
+			events:       append(progressEvents(3), jobFields{State: jobSuccess, Result: json.RawMessage(`"tank"`)}),
+			want:         `"tank"`,
+			wantProgress: true,
+		},
+		{
+			name:    "fails",
+			events:  []jobFields{{State: jobFailed, Error: &jobError}},
+			wantErr: "failed: pool is busy",
+		},
+		{
+			name:    "is aborted",
+			events:  []jobFields{{State: jobAborted}},
+			wantErr: "failed: ABORTED",
+		},
+		{
+			name:         "succeeds after a flood of progress updates",
+			events:       append(progressEvents(500), jobFields{State: jobSuccess, Result: json.RawMessage(`"tank"`)}),
+			want:         `"tank"`,
+			wantProgress: true,
+		},
+		{
+			name:    "fails after a flood of progress updates",
+			events:  append(progressEvents(500), jobFields{State: jobFailed, Error: &jobError}),
+			wantErr: "failed: pool is busy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newStandIn()
+			defer server.Close()
+			server.jobs["pool.import_pool"] = tt.events
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var progress []JobProgress
+			result, err := server.Client().CallJob(ctx, "pool.import_pool", func(p JobProgress) {
+				progress = append(progress, p)
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("CallJob() error = %v, want %q", err, tt.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("CallJob() error = %v", err)
+				}
+				if string(result) != tt.want {
+					t.Errorf("CallJob() = %s, want %s", result, tt.want)
+				}
+			}
+
+			if tt.wantProgress && len(progress) == 0 {
+				t.Error("CallJob() reported no progress")
+			}
+		})
+	}
+}
+
+func TestClientCallRunsJobs(t *testing.T) {
+	server := newStandIn()
+	defer server.Close()
+	server.jobs["pool.import_pool"] = []jobFields{{State: jobSuccess, Result: json.RawMessage(`true`)}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := server.Client().Call(ctx, "pool.import_pool")
+	if err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if string(result) != "true" {
+		t.Errorf("Call() = %s, want true", result)
+	}
+}
+
+func TestQueueJobEvent(t *testing.T) {
+	events := make(chan *jobFields, 2)
+	queueJobEvent(events, &jobFields{State: "RUNNING"})
+	queueJobEvent(events, &jobFields{State: "RUNNING"})
+	// a full queue drops progress updates
+	queueJobEvent(events, &jobFields{State: "RUNNING"})
+	if len(events) != 2 {
+		t.Fatalf("queued %d events, want 2", len(events))
+	}
+
+	// but keeps the end of the job
+	queueJobEvent(events, &jobFields{State: jobSuccess})
+	var states []string
+	for len(events) > 0 {
+		states = append(states, (<-events).State)
+	}
+	if want := []string{"RUNNING", jobSuccess}; !reflect.DeepEqual(states, want) {
+		t.Errorf("queued states = %v, want %v", states, want)
+	}
+}
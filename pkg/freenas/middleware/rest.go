@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	v2Prefix = "/api/v2.0/"
+
+	// middleware errnos
+	errnoPerm   = 1
+	errnoNoEnt  = 2
+	errnoAccess = 13
+	errnoExist  = 17
+	errnoInval  = 22
+
+	validationErrorType = "VALIDATION"
+)
+
+var (
+	// configServices hold a single object that is read with config
+	configServices = map[string]bool{
+		"iscsi.global": true,
+	}
+	// plainMethods are read with GET but are neither queries nor configs
+	plainMethods = map[string]bool{
+		"system.version": true,
+	}
+	// postMethods are called with POST, mapping the body to the method's
+	// positional parameters. No parameter names means the body is the only
+	// parameter.
+	postMethods = map[string][]string{
+		"pool.dataset.promote":  nil,
+		"zfs.snapshot.clone":    nil,
+		"zfs.snapshot.rollback": {"id", "options"},
+	}
+)
+
+// NewRequest and DoRequest implement rest.Interface on top of the middleware
+// by translating v2.0 api requests to the equivalent method calls, so the
+// v2.0 resource clients work over either transport.
+
+func (c *Client) NewRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, c.Host+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+
+	request.Header.Add("Content-Type", "application/json")
+
+	return request, nil
+}
+
+func (c *Client) DoRequest(request *http.Request) (*http.Response, error) {
+	method, params, err := route(request)
+	if err != nil {
+		return response(request, http.StatusNotFound, []byte(strconv.Quote(err.Error()))), nil
+	}
+
+	result, err := c.Call(request.Context(), method, params...)
+	if e, ok := err.(*Error); ok {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		return response(request, statusCode(e), body), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return response(request, http.StatusOK, result), nil
+}
+
+// route returns the middleware method and parameters equivalent to a v2.0 api
+// request.
+func route(request *http.Request) (string, []interface{}, error) {
+	path := request.URL.EscapedPath()
+	if !strings.HasPrefix(path, v2Prefix) {
+		return "", nil, fmt.Errorf("%s is not a v2.0 api path", path)
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(strings.TrimPrefix(path, v2Prefix), "/"), "/") {
+		segment, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	body, err := requestBody(request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// <namespace>/id/<id>
+	if n := len(segments); n > 2 && segments[n-2] == "id" {
+		namespace := strings.Join(segments[:n-2], ".")
+		var id interface{} = segments[n-1]
+		if i, err := strconv.Atoi(segments[n-1]); err == nil {
+			id = i
+		}
+
+		switch request.Method {
+		case http.MethodGet:
+			return namespace + ".get_instance", []interface{}{id}, nil
+		case http.MethodPut:
+			return namespace + ".update", []interface{}{id, body}, nil
+		case http.MethodDelete:
+			return namespace + ".delete", []interface{}{id}, nil
+		}
+
+		return "", nil, fmt.Errorf("unsupported method %s for %s", request.Method, path)
+	}
+
+	namespace := strings.Join(segments, ".")
+	switch request.Method {
+	case http.MethodGet:
+		if configServices[namespace] {
+			return namespace + ".config", nil, nil
+		}
+		if plainMethods[namespace] {
+			return namespace, nil, nil
+		}
+		filters, options := query(request.URL.Query())
+		return namespace + ".query", []interface{}{filters, options}, nil
+	case http.MethodPut:
+		if configServices[namespace] {
+			return namespace + ".update", []interface{}{body}, nil
+		}
+	case http.MethodPost:
+		names, ok := postMethods[namespace]
+		if !ok {
+			return namespace + ".create", []interface{}{body}, nil
+		}
+		if names == nil {
+			return namespace, []interface{}{body}, nil
+		}
+
+		fields, _ := body.(map[string]interface{})
+		params := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			params = append(params, fields[name])
+		}
+		return namespace, params, nil
+	}
+
+	return "", nil, fmt.Errorf("unsupported method %s for %s", request.Method, path)
+}
+
+func requestBody(request *http.Request) (interface{}, error) {
+	if request.Body == nil {
+		return nil, nil
+	}
+	defer request.Body.Close()
+
+	b, err := ioutil.ReadAll(request.Body)
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+
+	var body interface{}
+	err = json.Unmarshal(b, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// query converts v2.0 api query parameters to query filters and options.
+func query(values url.Values) ([]interface{}, map[string]interface{}) {
+	filters := []interface{}{}
+	options := map[string]interface{}{}
+	for key, vs := range values {
+		for _, v := range vs {
+			switch key {
+			case "limit", "offset":
+				if i, err := strconv.Atoi(v); err == nil {
+					options[key] = i
+				}
+			default:
+				filters = append(filters, []interface{}{key, "=", v})
+			}
+		}
+	}
+
+	return filters, options
+}
+
+func statusCode(e *Error) int {
+	switch {
+	case e.Type == validationErrorType || e.Errno == errnoInval:
+		return http.StatusUnprocessableEntity
+	case e.Errno == errnoNoEnt:
+		return http.StatusNotFound
+	case e.Errno == errnoExist:
+		return http.StatusConflict
+	case e.Errno == errnoPerm || e.Errno == errnoAccess:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func response(request *http.Request, statusCode int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
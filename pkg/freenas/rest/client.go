@@ -1,47 +1,73 @@
 package rest
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
+	"net"
 	"net/http"
+	"time"
 )
 
 type Client struct {
 	Username string
 	Password string
-	Host     string
-	Client   *http.Client
+	// APIKey takes precedence over Username and Password when set
+	APIKey string
+	Host   string
+	Client *http.Client
 }
 
 type Interface interface {
-	NewRequest(method string, url string, body io.Reader) (*http.Request, error)
+	NewRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error)
 	DoRequest(request *http.Request) (*http.Response, error)
 }
 
-func New(username, password, host string, insecureSkipVerify bool) Interface {
-	client := http.DefaultClient
-
-	if insecureSkipVerify {
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+// New returns a client with its own transport, tlsConfig may be nil to use
+// the defaults.
+func New(username, password, host string, tlsConfig *tls.Config) Interface {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
 	}
 
 	return &Client{
 		Username: username,
 		Password: password,
 		Host:     host,
-		Client:   client,
+		Client:   &http.Client{Transport: transport},
 	}
 }
 
-func (c Client) NewRequest(method string, path string, body io.Reader) (*http.Request, error) {
+// NewWithAPIKey returns a client that authenticates with a TrueNAS api key
+// instead of a username and password.
+func NewWithAPIKey(apiKey, host string, tlsConfig *tls.Config) Interface {
+	client := New("", "", host, tlsConfig).(*Client)
+	client.APIKey = apiKey
+
+	return client
+}
+
+func (c Client) NewRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
 	request, err := http.NewRequest(method, c.Host+path, body)
 	if err != nil {
 		return nil, err
 	}
+	request = request.WithContext(ctx)
 
-	request.SetBasicAuth(c.Username, c.Password)
+	if c.APIKey != "" {
+		request.Header.Set("Authorization", "Bearer "+c.APIKey)
+	} else {
+		request.SetBasicAuth(c.Username, c.Password)
+	}
 	request.Header.Add("Content-Type", "application/json")
 
 	return request, nil
@@ -0,0 +1,51 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAuthorization(t *testing.T) {
+	tests := []struct {
+		name   string
+		client Interface
+		want   string
+	}{
+		// base64 of root:secret
+		{name: "basic auth", client: New("root", "secret", "", nil), want: "Basic cm9vdDpzZWNyZXQ="},
+		{name: "api key", client: NewWithAPIKey("1-abcdef", "", nil), want: "Bearer 1-abcdef"},
+		{
+			name:   "api key and password",
+			client: &Client{Username: "root", Password: "secret", APIKey: "1-abcdef", Client: http.DefaultClient},
+			want:   "Bearer 1-abcdef",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header["Authorization"]
+			}))
+			defer server.Close()
+
+			client := tt.client.(*Client)
+			client.Host = server.URL
+			request, err := client.NewRequest(context.Background(), http.MethodGet, "/api/v2.0/system/version", nil)
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			response, err := client.DoRequest(request)
+			if err != nil {
+				t.Fatalf("DoRequest() error = %v", err)
+			}
+			response.Body.Close()
+
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("Authorization = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// APIError is returned for responses with an unexpected status code.
+type APIError struct {
+	StatusCode int
+	Status     string
+	Method     string
+	Path       string
+	// Message is the error message of the appliance, if it returned one
+	Message string
+	// FieldErrors are the validation errors of the appliance by field
+	FieldErrors map[string][]string
+	Body        string
+}
+
+// NewAPIError returns the error for an unexpected response, parsing the error
+// messages of the v1.0 and v2.0 apis and of the middleware from body.
+func NewAPIError(response *http.Response, body []byte) *APIError {
+	e := &APIError{
+		StatusCode:  response.StatusCode,
+		Status:      response.Status,
+		Body:        string(body),
+		FieldErrors: map[string][]string{},
+	}
+	if response.Request != nil {
+		e.Method = response.Request.Method
+		e.Path = response.Request.URL.Path
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return e
+	}
+
+	for field, value := range fields {
+		switch field {
+		case "error_message", "message", "reason":
+			// {"error_message": "..."}, {"reason": "..."}
+			var message string
+			if json.Unmarshal(value, &message) == nil {
+				e.Message = message
+			}
+		case "extra":
+			// middleware validation errors [[field, message, errno], ...]
+			var extra [][]interface{}
+			if json.Unmarshal(value, &extra) != nil {
+				continue
+			}
+			for _, fieldError := range extra {
+				if len(fieldError) < 2 {
+					continue
+				}
+				e.addFieldError(fmt.Sprint(fieldError[0]), fmt.Sprint(fieldError[1]))
+			}
+		case "error", "errname", "type", "trace":
+		default:
+			// v1.0 {"field": ["message", ...]} or {"field": "message"},
+			// v2.0 {"field": [{"message": "...", "errno": 22}, ...]}
+			var messages []json.RawMessage
+			if json.Unmarshal(value, &messages) != nil {
+				messages = []json.RawMessage{value}
+			}
+			for _, m := range messages {
+				var message string
+				var detail struct {
+					Message string `json:"message"`
+				}
+				if json.Unmarshal(m, &message) == nil {
+					e.addFieldError(field, message)
+				} else if json.Unmarshal(m, &detail) == nil && detail.Message != "" {
+					e.addFieldError(field, detail.Message)
+				}
+			}
+		}
+	}
+
+	return e
+}
+
+func (e *APIError) addFieldError(field, message string) {
+	// __all__ holds the v1.0 errors that concern no particular field
+	if field == "__all__" && e.Message == "" {
+		e.Message = message
+		return
+	}
+
+	e.FieldErrors[field] = append(e.FieldErrors[field], message)
+}
+
+func (e *APIError) Error() string {
+	message := fmt.Sprintf("%s %s: unexpected status code: %s", e.Method, e.Path, e.Status)
+
+	var details []string
+	if e.Message != "" {
+		details = append(details, e.Message)
+	}
+	for _, field := range e.fields() {
+		details = append(details, fmt.Sprintf("%s: %s", field, strings.Join(e.FieldErrors[field], ", ")))
+	}
+	if len(details) == 0 {
+		return fmt.Sprintf("%s, body: %s", message, e.Body)
+	}
+
+	return fmt.Sprintf("%s: %s", message, strings.Join(details, "; "))
+}
+
+func (e *APIError) fields() []string {
+	fields := make([]string, 0, len(e.FieldErrors))
+	for field := range e.FieldErrors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+func apiError(err error) (*APIError, bool) {
+	e, ok := errors.Cause(err).(*APIError)
+	return e, ok
+}
+
+// IsNotFound reports whether err is caused by a missing object.
+func IsNotFound(err error) bool {
+	e, ok := apiError(err)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is caused by an object that already exists.
+func IsConflict(err error) bool {
+	e, ok := apiError(err)
+	return ok && e.StatusCode == http.StatusConflict
+}
+
+// IsValidation reports whether err is caused by the appliance rejecting the
+// request's data. The v1.0 api reports duplicate names as validation errors
+// too.
+func IsValidation(err error) bool {
+	e, ok := apiError(err)
+	return ok && (e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity)
+}
+
+// IsRetryable reports whether the request that caused err may succeed when
+// it is sent again.
+func IsRetryable(err error) bool {
+	err = errors.Cause(err)
+	if err == ErrCircuitOpen {
+		return true
+	}
+
+	if e, ok := err.(*APIError); ok {
+		return retryableStatusCode(e.StatusCode)
+	}
+
+	netErr, ok := err.(net.Error)
+	return ok && (netErr.Timeout() || netErr.Temporary())
+}
+
+func retryableStatusCode(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented:
+		return false
+	}
+
+	return statusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,150 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		name            string
+		statusCode      int
+		body            string
+		wantMessage     string
+		wantFieldErrors map[string][]string
+		wantError       string
+	}{
+		{
+			name:            "v1.0 error message",
+			statusCode:      http.StatusNotFound,
+			body:            `{"error_message": "Sorry, this request could not be processed."}`,
+			wantMessage:     "Sorry, this request could not be processed.",
+			wantFieldErrors: map[string][]string{},
+			wantError:       "DELETE /api/v1.0/services/iscsi/target/1/: unexpected status code: 404 Not Found: Sorry, this request could not be processed.",
+		},
+		{
+			name:        "v1.0 field errors",
+			statusCode:  http.StatusBadRequest,
+			body:        `{"iscsi_target_name": ["Target name already exists."], "__all__": ["Invalid request."], "volsize": "Too small."}`,
+			wantMessage: "Invalid request.",
+			wantFieldErrors: map[string][]string{
+				"iscsi_target_name": {"Target name already exists."},
+				"volsize":           {"Too small."},
+			},
+			wantError: "DELETE /api/v1.0/services/iscsi/target/1/: unexpected status code: 400 Bad Request: Invalid request.; iscsi_target_name: Target name already exists.; volsize: Too small.",
+		},
+		{
+			name:        "v2.0 field errors",
+			statusCode:  http.StatusUnprocessableEntity,
+			body:        `{"pool_dataset_create.name": [{"message": "Path already exists", "errno": 17}]}`,
+			wantMessage: "",
+			wantFieldErrors: map[string][]string{
+				"pool_dataset_create.name": {"Path already exists"},
+			},
+		},
+		{
+			name:        "middleware validation errors",
+			statusCode:  http.StatusUnprocessableEntity,
+			body:        `{"error": 11, "errname": "EAGAIN", "type": "VALIDATION", "reason": "[EINVAL] name: exists", "trace": {}, "extra": [["name", "exists", 22], ["short"]]}`,
+			wantMessage: "[EINVAL] name: exists",
+			wantFieldErrors: map[string][]string{
+				"name": {"exists"},
+			},
+		},
+		{
+			name:            "non json body",
+			statusCode:      http.StatusBadGateway,
+			body:            `<html>Bad Gateway</html>`,
+			wantFieldErrors: map[string][]string{},
+			wantError:       "DELETE /api/v1.0/services/iscsi/target/1/: unexpected status code: 502 Bad Gateway, body: <html>Bad Gateway</html>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodDelete, "http://freenas/api/v1.0/services/iscsi/target/1/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := &http.Response{
+				StatusCode: tt.statusCode,
+				Status:     fmt.Sprintf("%d %s", tt.statusCode, http.StatusText(tt.statusCode)),
+				Request:    request,
+			}
+
+			e := NewAPIError(response, []byte(tt.body))
+			if e.StatusCode != tt.statusCode || e.Method != http.MethodDelete || e.Path != "/api/v1.0/services/iscsi/target/1/" || e.Body != tt.body {
+				t.Errorf("NewAPIError() = %+v, want the response's status, method, path and body", e)
+			}
+			if e.Message != tt.wantMessage {
+				t.Errorf("NewAPIError().Message = %q, want %q", e.Message, tt.wantMessage)
+			}
+			if !reflect.DeepEqual(e.FieldErrors, tt.wantFieldErrors) {
+				t.Errorf("NewAPIError().FieldErrors = %v, want %v", e.FieldErrors, tt.wantFieldErrors)
+			}
+			if tt.wantError != "" && e.Error() != tt.wantError {
+				t.Errorf("NewAPIError().Error() = %q, want %q", e.Error(), tt.wantError)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClassification(t *testing.T) {
+	apiError := func(statusCode int) error {
+		return &APIError{StatusCode: statusCode}
+	}
+
+	tests := []struct {
+		name           string
+		err            error
+		wantNotFound   bool
+		wantConflict   bool
+		wantValidation bool
+		wantRetryable  bool
+	}{
+		{name: "nil", err: nil},
+		{name: "not found", err: apiError(http.StatusNotFound), wantNotFound: true},
+		{name: "wrapped not found", err: errors.Wrap(apiError(http.StatusNotFound), "error deleting extent"), wantNotFound: true},
+		{name: "lookup miss", err: NewNotFoundError("/api/v1.0/services/iscsi/target/", "no target named pvc-1"), wantNotFound: true},
+		{name: "conflict", err: apiError(http.StatusConflict), wantConflict: true},
+		{name: "bad request", err: apiError(http.StatusBadRequest), wantValidation: true},
+		{name: "unprocessable entity", err: apiError(http.StatusUnprocessableEntity), wantValidation: true},
+		{name: "internal server error", err: apiError(http.StatusInternalServerError), wantRetryable: true},
+		{name: "service unavailable", err: errors.Wrap(apiError(http.StatusServiceUnavailable), "error listing zvols"), wantRetryable: true},
+		{name: "request timeout", err: apiError(http.StatusRequestTimeout), wantRetryable: true},
+		{name: "too many requests", err: apiError(http.StatusTooManyRequests), wantRetryable: true},
+		{name: "not implemented", err: apiError(http.StatusNotImplemented)},
+		{name: "open circuit breaker", err: errors.Wrap(ErrCircuitOpen, "error getting root dataset"), wantRetryable: true},
+		{name: "network timeout", err: &url.Error{Op: "Get", URL: "http://freenas/", Err: timeoutError{}}, wantRetryable: true},
+		{name: "dial error", err: &net.OpError{Op: "dial", Err: timeoutError{}}, wantRetryable: true},
+		{name: "other error", err: fmt.Errorf("invalid volume id")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsNotFound(tt.err); got != tt.wantNotFound {
+				t.Errorf("IsNotFound() = %t, want %t", got, tt.wantNotFound)
+			}
+			if got := IsConflict(tt.err); got != tt.wantConflict {
+				t.Errorf("IsConflict() = %t, want %t", got, tt.wantConflict)
+			}
+			if got := IsValidation(tt.err); got != tt.wantValidation {
+				t.Errorf("IsValidation() = %t, want %t", got, tt.wantValidation)
+			}
+			if got := IsRetryable(tt.err); got != tt.wantRetryable {
+				t.Errorf("IsRetryable() = %t, want %t", got, tt.wantRetryable)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+)
+
+// ListOptions narrow down the objects returned by a List.
+type ListOptions struct {
+	// Filters select the objects whose fields equal the given values. Fields
+	// are named as in the json of the returned objects, so the same filters
+	// work against every api version.
+	Filters map[string]string
+	// Limit caps the number of returned objects, zero returns all of them
+	Limit  int
+	Offset int
+}
+
+// Query returns the query string of a list request. Pagination is left to the
+// appliance unless objects are filtered, which happens after they have been
+// converted to the v1.0 representation.
+func (o ListOptions) Query() string {
+	values := url.Values{}
+	values.Set("limit", "0")
+	if len(o.Filters) == 0 {
+		if o.Limit > 0 {
+			values.Set("limit", strconv.Itoa(o.Limit))
+		}
+		if o.Offset > 0 {
+			values.Set("offset", strconv.Itoa(o.Offset))
+		}
+	}
+
+	return values.Encode()
+}
+
+// Apply filters the slice list points to and paginates it if the appliance
+// could not.
+func (o ListOptions) Apply(list interface{}) error {
+	if len(o.Filters) == 0 {
+		return nil
+	}
+
+	err := o.Filter(list)
+	if err != nil {
+		return err
+	}
+
+	return o.Paginate(list)
+}
+
+// Filter removes the objects that do not match the filters from the slice
+// list points to.
+func (o ListOptions) Filter(list interface{}) error {
+	if len(o.Filters) == 0 {
+		return nil
+	}
+
+	items := reflect.ValueOf(list).Elem()
+	matching := reflect.MakeSlice(items.Type(), 0, items.Len())
+	for i := 0; i < items.Len(); i++ {
+		item := items.Index(i)
+
+		b, err := json.Marshal(item.Interface())
+		if err != nil {
+			return err
+		}
+		var fields map[string]interface{}
+		err = json.Unmarshal(b, &fields)
+		if err != nil {
+			return err
+		}
+
+		if o.matches(fields) {
+			matching = reflect.Append(matching, item)
+		}
+	}
+	items.Set(matching)
+
+	return nil
+}
+
+func (o ListOptions) matches(fields map[string]interface{}) bool {
+	for field, value := range o.Filters {
+		v, ok := fields[field]
+		if !ok || v == nil || fmt.Sprint(v) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Paginate cuts the page selected by Limit and Offset from the slice list
+// points to.
+func (o ListOptions) Paginate(list interface{}) error {
+	items := reflect.ValueOf(list).Elem()
+
+	start := o.Offset
+	if start > items.Len() {
+		start = items.Len()
+	}
+	end := items.Len()
+	if o.Limit > 0 && start+o.Limit < end {
+		end = start + o.Limit
+	}
+	items.Set(items.Slice(start, end))
+
+	return nil
+}
+
+// NewNotFoundError returns the APIError for an object that a lookup did not
+// find, e.g. by name.
+func NewNotFoundError(path, message string) *APIError {
+	return &APIError{
+		StatusCode:  http.StatusNotFound,
+		Status:      fmt.Sprintf("%d %s", http.StatusNotFound, http.StatusText(http.StatusNotFound)),
+		Method:      http.MethodGet,
+		Path:        path,
+		Message:     message,
+		FieldErrors: map[string][]string{},
+	}
+}
@@ -0,0 +1,151 @@
+package rest
+
+import (
+	"reflect"
+	"testing"
+)
+
+type listItem struct {
+	ID    *int    `json:"id,omitempty"`
+	Name  *string `json:"name,omitempty"`
+	Group int     `json:"group"`
+}
+
+func listItems(names ...string) []*listItem {
+	items := make([]*listItem, 0, len(names))
+	for i, name := range names {
+		id, name := i+1, name
+		items = append(items, &listItem{ID: &id, Name: &name, Group: id % 2})
+	}
+
+	return items
+}
+
+func itemNames(items []*listItem) []string {
+	names := []string{}
+	for _, item := range items {
+		names = append(names, *item.Name)
+	}
+
+	return names
+}
+
+func TestListOptionsQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ListOptions
+		want string
+	}{
+		{name: "everything", opts: ListOptions{}, want: "limit=0"},
+		{name: "page", opts: ListOptions{Limit: 10, Offset: 20}, want: "limit=10&offset=20"},
+		{name: "offset only", opts: ListOptions{Offset: 5}, want: "limit=0&offset=5"},
+		// filtered lists are paginated after filtering
+		{name: "filtered page", opts: ListOptions{Filters: map[string]string{"name": "pvc-1"}, Limit: 10, Offset: 20}, want: "limit=0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.Query(); got != tt.want {
+				t.Errorf("Query() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListOptionsApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  ListOptions
+		items []*listItem
+		want  []string
+	}{
+		{
+			name:  "no filters leave pagination to the appliance",
+			opts:  ListOptions{Limit: 1, Offset: 1},
+			items: listItems("a", "b", "c"),
+			want:  []string{"a", "b", "c"},
+		},
+		{
+			name:  "string field",
+			opts:  ListOptions{Filters: map[string]string{"name": "b"}},
+			items: listItems("a", "b", "c"),
+			want:  []string{"b"},
+		},
+		{
+			name:  "numeric field",
+			opts:  ListOptions{Filters: map[string]string{"id": "3"}},
+			items: listItems("a", "b", "c"),
+			want:  []string{"c"},
+		},
+		{
+			name:  "all filters have to match",
+			opts:  ListOptions{Filters: map[string]string{"group": "1", "name": "c"}},
+			items: listItems("a", "b", "c"),
+			want:  []string{"c"},
+		},
+		{
+			name:  "missing field",
+			opts:  ListOptions{Filters: map[string]string{"comment": "a"}},
+			items: listItems("a", "b", "c"),
+			want:  []string{},
+		},
+		{
+			name:  "omitted field",
+			opts:  ListOptions{Filters: map[string]string{"name": ""}},
+			items: []*listItem{{Group: 1}},
+			want:  []string{},
+		},
+		{
+			name:  "filtered page",
+			opts:  ListOptions{Filters: map[string]string{"group": "1"}, Limit: 2, Offset: 1},
+			items: listItems("a", "b", "c", "d", "e", "f", "g"),
+			want:  []string{"c", "e"},
+		},
+		{
+			name:  "filtered page past the end",
+			opts:  ListOptions{Filters: map[string]string{"group": "1"}, Offset: 10},
+			items: listItems("a", "b", "c"),
+			want:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := tt.items
+			err := tt.opts.Apply(&items)
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if got := itemNames(items); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListOptionsPaginate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ListOptions
+		want []string
+	}{
+		{name: "everything", opts: ListOptions{}, want: []string{"a", "b", "c", "d"}},
+		{name: "first page", opts: ListOptions{Limit: 3}, want: []string{"a", "b", "c"}},
+		{name: "last page", opts: ListOptions{Limit: 3, Offset: 3}, want: []string{"d"}},
+		{name: "offset only", opts: ListOptions{Offset: 1}, want: []string{"b", "c", "d"}},
+		{name: "past the end", opts: ListOptions{Limit: 3, Offset: 6}, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := listItems("a", "b", "c", "d")
+			err := tt.opts.Paginate(&items)
+			if err != nil {
+				t.Fatalf("Paginate() error = %v", err)
+			}
+			if got := itemNames(items); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Paginate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package rest
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	apiRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "freenas_provisioner",
+			Name:      "api_requests_total",
+			Help:      "Total number of FreeNAS API requests. Broken down by resource, method and status code, which is error for requests that got no response.",
+		},
+		[]string{"resource", "method", "code"},
+	)
+	apiRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "freenas_provisioner",
+			Name:      "api_request_duration_seconds",
+			Help:      "Latency of FreeNAS API requests in seconds. Broken down by resource and method.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{"resource", "method"},
+	)
+
+	// resources map api paths of both versions to resource names, the first
+	// match wins
+	resources = []struct {
+		path *regexp.Regexp
+		name string
+	}{
+		{regexp.MustCompile(`/iscsi/(targettoextent|targetextent)(/|$)`), "target_to_extent"},
+		{regexp.MustCompile(`/iscsi/targetgroup(/|$)`), "target_group"},
+		{regexp.MustCompile(`/iscsi/target(/|$)`), "target"},
+		{regexp.MustCompile(`/iscsi/extent(/|$)`), "extent"},
+		{regexp.MustCompile(`/iscsi/(authcredential|auth)(/|$)`), "auth"},
+		{regexp.MustCompile(`/iscsi/(authorizedinitiator|initiator)(/|$)`), "initiator"},
+		{regexp.MustCompile(`/iscsi/(globalconfiguration|global)(/|$)`), "global_configuration"},
+		{regexp.MustCompile(`/storage/volume/[^/]+/zvols(/|$)`), "zvol"},
+		{regexp.MustCompile(`/(storage/volume/[^/]+/datasets|storage/dataset|pool/dataset)(/|$)`), "dataset"},
+		{regexp.MustCompile(`/(storage|zfs)/snapshot(/|$)`), "snapshot"},
+		{regexp.MustCompile(`/sharing/nfs(/|$)`), "nfs_share"},
+		{regexp.MustCompile(`/system/version(/|$)`), "version"},
+	}
+)
+
+func init() {
+	prometheus.MustRegister(apiRequestsTotal, apiRequestDuration)
+}
+
+// InstrumentedClient records the count, status codes and latency of the
+// requests of the wrapped client.
+type InstrumentedClient struct {
+	Interface
+}
+
+func NewInstrumentedClient(client Interface) Interface {
+	return &InstrumentedClient{
+		Interface: client,
+	}
+}
+
+func (c *InstrumentedClient) DoRequest(request *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := c.Interface.DoRequest(request)
+
+	name := resource(request)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(response.StatusCode)
+	}
+	apiRequestsTotal.WithLabelValues(name, request.Method, code).Inc()
+	apiRequestDuration.WithLabelValues(name, request.Method).Observe(time.Since(start).Seconds())
+
+	return response, err
+}
+
+// resource returns the name of the resource request is for. The v2.0 api
+// shares its dataset endpoints with zvols, so only zvol queries are told apart
+// there.
+func resource(request *http.Request) string {
+	path := request.URL.Path
+	for _, r := range resources {
+		if !r.path.MatchString(path) {
+			continue
+		}
+
+		if r.name == "dataset" && request.URL.Query().Get("type") == "VOLUME" {
+			return "zvol"
+		}
+		return r.name
+	}
+
+	return "other"
+}
@@ -0,0 +1,57 @@
+package rest
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResource(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "v1 target to extent", path: "/api/v1.0/services/iscsi/targettoextent/3/", want: "target_to_extent"},
+		{name: "v2 target to extent", path: "/api/v2.0/iscsi/targetextent/id/3", want: "target_to_extent"},
+		// targetgroup and targettoextent start like target and are matched first
+		{name: "v1 target group", path: "/api/v1.0/services/iscsi/targetgroup/", want: "target_group"},
+		{name: "v1 target", path: "/api/v1.0/services/iscsi/target/1/", want: "target"},
+		{name: "v2 target", path: "/api/v2.0/iscsi/target?limit=0", want: "target"},
+		{name: "v1 extent", path: "/api/v1.0/services/iscsi/extent/", want: "extent"},
+		{name: "v2 extent", path: "/api/v2.0/iscsi/extent/id/3", want: "extent"},
+		{name: "v1 auth", path: "/api/v1.0/services/iscsi/authcredential/", want: "auth"},
+		{name: "v2 auth", path: "/api/v2.0/iscsi/auth", want: "auth"},
+		{name: "v1 initiator", path: "/api/v1.0/services/iscsi/authorizedinitiator/2/", want: "initiator"},
+		{name: "v2 initiator", path: "/api/v2.0/iscsi/initiator/id/2", want: "initiator"},
+		{name: "v1 global configuration", path: "/api/v1.0/services/iscsi/globalconfiguration/", want: "global_configuration"},
+		{name: "v2 global configuration", path: "/api/v2.0/iscsi/global", want: "global_configuration"},
+		{name: "v1 zvol", path: "/api/v1.0/storage/volume/tank/zvols/k8s/pvc-1/", want: "zvol"},
+		{name: "v1 dataset", path: "/api/v1.0/storage/volume/tank/datasets/k8s/pvc-1/", want: "dataset"},
+		{name: "v1 dataset promote", path: "/api/v1.0/storage/dataset/tank/k8s/pvc-1/promote/", want: "dataset"},
+		{name: "v2 dataset", path: "/api/v2.0/pool/dataset/id/tank%2Fk8s", want: "dataset"},
+		// v2.0 zvols are datasets of type VOLUME
+		{name: "v2 zvol list", path: "/api/v2.0/pool/dataset?type=VOLUME&pool=tank&limit=0", want: "zvol"},
+		{name: "v2 filesystem list", path: "/api/v2.0/pool/dataset?type=FILESYSTEM", want: "dataset"},
+		{name: "v1 snapshot", path: "/api/v1.0/storage/snapshot/tank/k8s/pvc-1@snap/clone/", want: "snapshot"},
+		{name: "v2 snapshot", path: "/api/v2.0/zfs/snapshot", want: "snapshot"},
+		{name: "v1 nfs share", path: "/api/v1.0/sharing/nfs/", want: "nfs_share"},
+		{name: "v2 nfs share", path: "/api/v2.0/sharing/nfs/id/1", want: "nfs_share"},
+		{name: "v1 version", path: "/api/v1.0/system/version/", want: "version"},
+		{name: "v2 version", path: "/api/v2.0/system/version", want: "version"},
+		{name: "unknown", path: "/api/v2.0/pool", want: "other"},
+		{name: "unknown iscsi resource", path: "/api/v2.0/iscsi/portal", want: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, "https://freenas"+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := resource(request); got != tt.want {
+				t.Errorf("resource(%s) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting the appliance while the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("freenas api circuit breaker is open")
+
+// RetryConfig configures RetryClient.
+type RetryConfig struct {
+	// MaxRetries is how often a failed request is retried, zero disables
+	// retries
+	MaxRetries int
+	// InitialBackoff is the wait before the first retry, it doubles with
+	// every further retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter randomly extends each wait by up to this fraction
+	Jitter float64
+
+	// BreakerThreshold is the number of consecutive failed requests that
+	// opens the circuit breaker, zero disables the breaker
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before a single
+	// request is let through to probe the appliance
+	BreakerCooldown time.Duration
+}
+
+// DefaultRetryConfig rides out a middleware restart of about half a minute.
+var DefaultRetryConfig = RetryConfig{
+	MaxRetries:       5,
+	InitialBackoff:   500 * time.Millisecond,
+	MaxBackoff:       10 * time.Second,
+	Jitter:           0.2,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+// RetryClient retries failed requests of the wrapped client with exponential
+// backoff and fails fast while the appliance is down.
+//
+// Idempotent requests are retried on connection errors and 5xx responses,
+// others only when the connection could not be established, as the appliance
+// may have processed them otherwise.
+type RetryClient struct {
+	Interface
+	Config RetryConfig
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func NewRetryClient(client Interface, config RetryConfig) Interface {
+	return &RetryClient{
+		Interface: client,
+		Config:    config,
+	}
+}
+
+func (c *RetryClient) DoRequest(request *http.Request) (*http.Response, error) {
+	backoff := c.Config.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			err := rewind(request)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := c.allow()
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := c.Interface.DoRequest(request)
+		failed := err != nil || retryableStatusCode(response.StatusCode)
+		c.record(failed)
+
+		if !failed || attempt >= c.Config.MaxRetries || request.Context().Err() != nil || !retryable(request, err) {
+			return response, err
+		}
+
+		if err != nil {
+			glog.Warningf("%s %s failed, retrying in %s: %v", request.Method, request.URL.Path, backoff, err)
+		} else {
+			glog.Warningf("%s %s failed, retrying in %s: %s", request.Method, request.URL.Path, backoff, response.Status)
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		select {
+		case <-time.After(jitter(backoff, c.Config.Jitter)):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+		backoff *= 2
+		if c.Config.MaxBackoff > 0 && backoff > c.Config.MaxBackoff {
+			backoff = c.Config.MaxBackoff
+		}
+	}
+}
+
+// allow returns ErrCircuitOpen while the breaker is open. Once the cooldown
+// has passed a single request at a time is let through until one succeeds.
+func (c *RetryClient) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Config.BreakerThreshold <= 0 || c.failures < c.Config.BreakerThreshold {
+		return nil
+	}
+
+	if c.probing || time.Now().Before(c.openUntil) {
+		return ErrCircuitOpen
+	}
+
+	c.probing = true
+	return nil
+}
+
+func (c *RetryClient) record(failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.probing = false
+	if !failed {
+		if c.failures >= c.Config.BreakerThreshold && c.Config.BreakerThreshold > 0 {
+			glog.Infof("freenas api is available again, closing circuit breaker")
+		}
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.Config.BreakerThreshold > 0 && c.failures >= c.Config.BreakerThreshold {
+		if c.failures == c.Config.BreakerThreshold {
+			glog.Warningf("%d consecutive freenas api requests failed, opening circuit breaker for %s", c.failures, c.Config.BreakerCooldown)
+		}
+		c.openUntil = time.Now().Add(c.Config.BreakerCooldown)
+	}
+}
+
+func retryable(request *http.Request, err error) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+
+	// the request never reached the appliance
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// rewind resets the body of request so it can be sent again.
+func rewind(request *http.Request) error {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil
+	}
+
+	if request.GetBody == nil {
+		return fmt.Errorf("cannot retry %s %s, its body cannot be rewound", request.Method, request.URL.Path)
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return err
+	}
+	request.Body = body
+
+	return nil
+}
+
+func jitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+
+	return d + time.Duration(rand.Float64()*factor*float64(d))
+}
@@ -0,0 +1,261 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubClient answers requests with scripted results, the last one repeats.
+type stubClient struct {
+	results []stubResult
+	calls   int
+	bodies  []string
+}
+
+type stubResult struct {
+	statusCode int
+	err        error
+}
+
+func (c *stubClient) NewRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, "http://freenas"+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return request.WithContext(ctx), nil
+}
+
+func (c *stubClient) DoRequest(request *http.Request) (*http.Response, error) {
+	if request.Body != nil {
+		body, _ := ioutil.ReadAll(request.Body)
+		c.bodies = append(c.bodies, string(body))
+	}
+
+	result := c.results[len(c.results)-1]
+	if c.calls < len(c.results) {
+		result = c.results[c.calls]
+	}
+	c.calls++
+
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return &http.Response{
+		StatusCode: result.statusCode,
+		Status:     http.StatusText(result.statusCode),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    request,
+	}, nil
+}
+
+func dialError() error {
+	return &url.Error{Op: "Post", URL: "http://freenas/", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+}
+
+func readError() error {
+	return &url.Error{Op: "Post", URL: "http://freenas/", Err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}}
+}
+
+func TestRetryClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		results    []stubResult
+		wantCalls  int
+		wantStatus int
+		wantErr    bool
+	}{
+		{
+			name:       "success is not retried",
+			method:     http.MethodGet,
+			results:    []stubResult{{statusCode: http.StatusOK}},
+			wantCalls:  1,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "get is retried on server errors",
+			method:     http.MethodGet,
+			results:    []stubResult{{statusCode: http.StatusServiceUnavailable}, {statusCode: http.StatusBadGateway}, {statusCode: http.StatusOK}},
+			wantCalls:  3,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "retries are limited",
+			method:     http.MethodGet,
+			results:    []stubResult{{statusCode: http.StatusServiceUnavailable}},
+			wantCalls:  4,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "too many requests are retried",
+			method:     http.MethodDelete,
+			results:    []stubResult{{statusCode: http.StatusTooManyRequests}, {statusCode: http.StatusNoContent}},
+			wantCalls:  2,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "client errors are not retried",
+			method:     http.MethodGet,
+			results:    []stubResult{{statusCode: http.StatusNotFound}},
+			wantCalls:  1,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "not implemented is not retried",
+			method:     http.MethodGet,
+			results:    []stubResult{{statusCode: http.StatusNotImplemented}},
+			wantCalls:  1,
+			wantStatus: http.StatusNotImplemented,
+		},
+		{
+			name:       "put is retried on connection errors",
+			method:     http.MethodPut,
+			results:    []stubResult{{err: readError()}, {statusCode: http.StatusOK}},
+			wantCalls:  2,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "post is not retried on server errors",
+			method:     http.MethodPost,
+			results:    []stubResult{{statusCode: http.StatusServiceUnavailable}, {statusCode: http.StatusCreated}},
+			wantCalls:  1,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:      "post is not retried once the connection was established",
+			method:    http.MethodPost,
+			results:   []stubResult{{err: readError()}, {statusCode: http.StatusCreated}},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:       "post is retried when the connection could not be established",
+			method:     http.MethodPost,
+			results:    []stubResult{{err: dialError()}, {statusCode: http.StatusCreated}},
+			wantCalls:  2,
+			wantStatus: http.StatusCreated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubClient{results: tt.results}
+			client := NewRetryClient(stub, RetryConfig{MaxRetries: 3, InitialBackoff: time.Millisecond})
+
+			request, err := client.NewRequest(context.Background(), tt.method, "/api/v1.0/storage/dataset/", bytes.NewReader([]byte(`{"name":"pvc-1"}`)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := client.DoRequest(request)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("DoRequest() status = %d, want an error", response.StatusCode)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("DoRequest() error = %v", err)
+				}
+				if response.StatusCode != tt.wantStatus {
+					t.Errorf("DoRequest() status = %d, want %d", response.StatusCode, tt.wantStatus)
+				}
+			}
+
+			if stub.calls != tt.wantCalls {
+				t.Errorf("DoRequest() sent %d requests, want %d", stub.calls, tt.wantCalls)
+			}
+			// every attempt sends the whole body
+			for i, body := range stub.bodies {
+				if body != `{"name":"pvc-1"}` {
+					t.Errorf("attempt %d sent body %q", i+1, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryClientBreaker(t *testing.T) {
+	stub := &stubClient{results: []stubResult{{statusCode: http.StatusServiceUnavailable}}}
+	cooldown := 50 * time.Millisecond
+	client := NewRetryClient(stub, RetryConfig{BreakerThreshold: 2, BreakerCooldown: cooldown})
+
+	do := func() (*http.Response, error) {
+		request, err := client.NewRequest(context.Background(), http.MethodGet, "/api/v1.0/system/version/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.DoRequest(request)
+	}
+
+	steps := []struct {
+		name string
+		// wait before the request
+		wait       time.Duration
+		statusCode int
+		wantErr    error
+	}{
+		{name: "first failure", statusCode: http.StatusServiceUnavailable},
+		{name: "failure reaching the threshold", statusCode: http.StatusServiceUnavailable},
+		{name: "open breaker fails fast", wantErr: ErrCircuitOpen},
+		{name: "failed probe after the cooldown", wait: cooldown, statusCode: http.StatusServiceUnavailable},
+		{name: "failed probe reopens the breaker", wantErr: ErrCircuitOpen},
+		{name: "successful probe after the cooldown", wait: cooldown, statusCode: http.StatusOK},
+		{name: "closed breaker lets requests through", statusCode: http.StatusServiceUnavailable},
+		{name: "failures are counted from zero again", statusCode: http.StatusServiceUnavailable},
+		{name: "breaker opens again", wantErr: ErrCircuitOpen},
+	}
+
+	for _, step := range steps {
+		time.Sleep(step.wait)
+		stub.results = []stubResult{{statusCode: step.statusCode}}
+		calls := stub.calls
+
+		response, err := do()
+		if step.wantErr != nil {
+			if err != step.wantErr {
+				t.Fatalf("%s: DoRequest() error = %v, want %v", step.name, err, step.wantErr)
+			}
+			if stub.calls != calls {
+				t.Fatalf("%s: DoRequest() reached the appliance", step.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: DoRequest() error = %v", step.name, err)
+		}
+		if response.StatusCode != step.statusCode {
+			t.Fatalf("%s: DoRequest() status = %d, want %d", step.name, response.StatusCode, step.statusCode)
+		}
+	}
+}
+
+func TestRetryClientBreakerDisabled(t *testing.T) {
+	stub := &stubClient{results: []stubResult{{statusCode: http.StatusServiceUnavailable}}}
+	client := NewRetryClient(stub, RetryConfig{})
+
+	for i := 0; i < 10; i++ {
+		request, err := client.NewRequest(context.Background(), http.MethodGet, "/api/v1.0/system/version/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.DoRequest(request)
+		if err != nil {
+			t.Fatalf("DoRequest() error = %v, want the breaker disabled", err)
+		}
+	}
+	if stub.calls != 10 {
+		t.Errorf("DoRequest() sent %d requests, want 10", stub.calls)
+	}
+}
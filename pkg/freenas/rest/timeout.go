@@ -0,0 +1,151 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// operations of the api by http method
+var operations = map[string]string{
+	http.MethodGet:    "get",
+	http.MethodPost:   "create",
+	http.MethodPut:    "update",
+	http.MethodDelete: "delete",
+}
+
+// Timeouts bound how long a single request may take. Requests whose context
+// already carries an earlier deadline keep it.
+type Timeouts struct {
+	// Default applies to every request without a more specific timeout
+	Default time.Duration
+	// Operations overrides Default for get, create, update and delete
+	// requests, e.g. for slow creates of large zvols
+	Operations map[string]time.Duration
+}
+
+// DefaultTimeouts gives up on a request after a minute.
+var DefaultTimeouts = Timeouts{
+	Default: time.Minute,
+}
+
+// ParseOperationTimeouts parses comma separated operation=duration pairs,
+// e.g. create=5m,delete=2m.
+func ParseOperationTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid operation timeout %q, expected operation=duration", pair)
+		}
+
+		operation := strings.TrimSpace(parts[0])
+		if !knownOperation(operation) {
+			return nil, fmt.Errorf("unknown operation %q, expected get, create, update or delete", operation)
+		}
+
+		timeout, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		timeouts[operation] = timeout
+	}
+
+	return timeouts, nil
+}
+
+func knownOperation(operation string) bool {
+	for _, o := range operations {
+		if o == operation {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t Timeouts) timeout(method string) time.Duration {
+	if timeout, ok := t.Operations[operations[method]]; ok {
+		return timeout
+	}
+
+	return t.Default
+}
+
+// TimeoutError is returned when a request is abandoned because it took longer
+// than its timeout.
+type TimeoutError struct {
+	Method string
+	Path   string
+	Limit  time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s %s timed out after %s", e.Method, e.Path, e.Limit)
+}
+
+// Timeout lets TimeoutError satisfy net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// TimeoutClient cancels requests of the wrapped client that exceed their
+// timeout.
+type TimeoutClient struct {
+	Interface
+	Timeouts Timeouts
+}
+
+func NewTimeoutClient(client Interface, timeouts Timeouts) Interface {
+	return &TimeoutClient{
+		Interface: client,
+		Timeouts:  timeouts,
+	}
+}
+
+func (c *TimeoutClient) DoRequest(request *http.Request) (*http.Response, error) {
+	timeout := c.Timeouts.timeout(request.Method)
+	if timeout <= 0 {
+		return c.Interface.DoRequest(request)
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	response, err := c.Interface.DoRequest(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		// only report timeouts of our own making, the caller knows about
+		// its own deadline
+		if ctx.Err() == context.DeadlineExceeded && request.Context().Err() == nil {
+			return nil, &TimeoutError{Method: request.Method, Path: request.URL.Path, Limit: timeout}
+		}
+		return nil, err
+	}
+
+	// the body is read after DoRequest returns
+	response.Body = &cancelBody{ReadCloser: response.Body, cancel: cancel}
+
+	return response, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,146 @@
+package rest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOperationTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]time.Duration
+		wantErr string
+	}{
+		{name: "empty", want: map[string]time.Duration{}},
+		{name: "pairs", s: "create=5m, delete=2m", want: map[string]time.Duration{"create": 5 * time.Minute, "delete": 2 * time.Minute}},
+		{name: "missing duration", s: "create", wantErr: "expected operation=duration"},
+		{name: "unknown operation", s: "list=1m", wantErr: "unknown operation"},
+		{name: "invalid duration", s: "get=soon", wantErr: "invalid duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOperationTimeouts(tt.s)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseOperationTimeouts() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseOperationTimeouts() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseOperationTimeouts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeoutClient(t *testing.T) {
+	const slow = 200 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		method   string
+		timeouts Timeouts
+		// deadline is the caller's own timeout, none if zero
+		deadline time.Duration
+		// wantLimit is the timeout the request is cancelled at, none if zero
+		wantLimit time.Duration
+		wantErr   bool
+	}{
+		{name: "fast enough", method: http.MethodGet, timeouts: Timeouts{Default: time.Minute}},
+		{name: "default timeout", method: http.MethodGet, timeouts: Timeouts{Default: 20 * time.Millisecond}, wantLimit: 20 * time.Millisecond},
+		{
+			name:      "operation timeout",
+			method:    http.MethodPost,
+			timeouts:  Timeouts{Default: time.Minute, Operations: map[string]time.Duration{"create": 20 * time.Millisecond}},
+			wantLimit: 20 * time.Millisecond,
+		},
+		{
+			name:     "timeout of another operation",
+			method:   http.MethodGet,
+			timeouts: Timeouts{Default: time.Minute, Operations: map[string]time.Duration{"create": 20 * time.Millisecond}},
+		},
+		{name: "no timeout", method: http.MethodGet},
+		{
+			name:     "earlier deadline of the caller",
+			method:   http.MethodGet,
+			timeouts: Timeouts{Default: time.Minute},
+			deadline: 20 * time.Millisecond,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the appliance takes its time unless the request is given up on
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(slow):
+					w.Write([]byte(`{}`))
+				case <-r.Context().Done():
+				}
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			if tt.deadline != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+
+			client := NewTimeoutClient(New("root", "secret", server.URL, nil), tt.timeouts)
+			request, err := client.NewRequest(ctx, tt.method, "/api/v1.0/storage/volume/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			response, err := client.DoRequest(request)
+			elapsed := time.Since(start)
+
+			if tt.wantLimit != 0 {
+				timeoutErr, ok := err.(*TimeoutError)
+				if !ok {
+					t.Fatalf("DoRequest() error = %v, want a timeout", err)
+				}
+				if timeoutErr.Limit != tt.wantLimit || timeoutErr.Method != tt.method {
+					t.Errorf("DoRequest() error = %v, want a %s timeout after %s", err, tt.method, tt.wantLimit)
+				}
+				if elapsed >= slow {
+					t.Errorf("DoRequest() gave up after %s, want about %s", elapsed, tt.wantLimit)
+				}
+				return
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("DoRequest() error = nil, want an error")
+				}
+				if _, ok := err.(*TimeoutError); ok {
+					t.Errorf("DoRequest() error = %v, want the caller's deadline instead of a timeout", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DoRequest() error = %v", err)
+			}
+
+			// the body stays readable after DoRequest returns
+			body, err := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil || string(body) != `{}` {
+				t.Errorf("body = %q, %v, want {}", body, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSOptions configure how a client verifies the appliance and how it
+// identifies itself.
+type TLSOptions struct {
+	InsecureSkipVerify bool
+	// CAFile is a PEM bundle of the CAs that sign the appliance's
+	// certificate, trusted in addition to the system's
+	CAFile string
+	// Fingerprint pins the SHA-256 fingerprint of the appliance's
+	// certificate, in hex with or without colons. A pinned certificate is
+	// trusted without verifying its chain, so self signed certificates work,
+	// unless a CAFile is given too, which the chain then has to verify against.
+	Fingerprint string
+	// CertFile and KeyFile hold the PEM client certificate and key for
+	// mutual TLS
+	CertFile string
+	KeyFile  string
+	// MinVersion is the lowest accepted TLS version, 1.0 to 1.3
+	MinVersion string
+}
+
+// Config returns the tls.Config for the options.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.MinVersion != "" {
+		version, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum tls version %s, expected 1.0, 1.1, 1.2 or 1.3", o.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if o.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca bundle: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca bundle %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key have to be given together")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if o.Fingerprint != "" {
+		fingerprint, err := hex.DecodeString(strings.Replace(o.Fingerprint, ":", "", -1))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha-256 fingerprint %s", o.Fingerprint)
+		}
+
+		// the pin replaces the default verification, which would reject self
+		// signed certificates, so a ca bundle is checked here as well
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("appliance presented no certificate")
+			}
+
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], fingerprint) {
+				return fmt.Errorf("appliance certificate fingerprint %s does not match the pinned fingerprint", hex.EncodeToString(sum[:]))
+			}
+
+			if roots == nil {
+				return nil
+			}
+			return verifyChain(rawCerts, roots)
+		}
+	}
+
+	return config, nil
+}
+
+// verifyChain verifies the certificate chain the appliance presented against
+// roots. The host name is not checked, the pinned fingerprint identifies the
+// appliance.
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for i, rawCert := range rawCerts {
+		certificate, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return fmt.Errorf("error parsing appliance certificate: %v", err)
+		}
+		if i == 0 {
+			leaf = certificate
+			continue
+		}
+		intermediates.AddCert(certificate)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	if err != nil {
+		return fmt.Errorf("appliance certificate does not verify against the ca bundle: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate along with its key.
+type testCert struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	der         []byte
+}
+
+var testSerial int64
+
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+
+	// certificates without a parent are self signed
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{certificate: certificate, key: key, der: der}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func (c *testCert) fingerprint() string {
+	sum := sha256.Sum256(c.der)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFiles writes the certificate and its key as PEM to dir and returns
+// their paths.
+func (c *testCert) writeFiles(t *testing.T, dir string) (string, string) {
+	name := c.certificate.Subject.CommonName
+
+	certFile := filepath.Join(dir, name+".crt")
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestTLSOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", true, nil)
+	otherCA := newTestCert(t, "other-ca", true, nil)
+	appliance := newTestCert(t, "appliance", false, ca)
+	selfSigned := newTestCert(t, "self-signed", false, nil)
+	client := newTestCert(t, "client", false, ca)
+
+	caFile, _ := ca.writeFiles(t, dir)
+	otherCAFile, _ := otherCA.writeFiles(t, dir)
+	clientCertFile, clientKeyFile := client.writeFiles(t, dir)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.certificate)
+
+	tests := []struct {
+		name string
+		// server is the certificate the appliance presents
+		server *testCert
+		// requireClientCert makes the appliance ask for a client certificate
+		requireClientCert bool
+		serverMaxVersion  uint16
+		options           TLSOptions
+		wantConfigErr     string
+		wantErr           string
+	}{
+		{name: "unknown ca", server: appliance, wantErr: "certificate"},
+		{name: "insecure", server: selfSigned, options: TLSOptions{InsecureSkipVerify: true}},
+		{name: "ca", server: appliance, options: TLSOptions{CAFile: caFile}},
+		{name: "another ca", server: appliance, options: TLSOptions{CAFile: otherCAFile}, wantErr: "certificate"},
+		{name: "missing ca file", server: appliance, options: TLSOptions{CAFile: filepath.Join(dir, "missing.crt")}, wantConfigErr: "error reading ca bundle"},
+		{name: "fingerprint match", server: selfSigned, options: TLSOptions{Fingerprint: selfSigned.fingerprint()}},
+		{name: "fingerprint match with colons", server: selfSigned, options: TLSOptions{Fingerprint: colons(selfSigned.fingerprint())}},
+		{name: "fingerprint mismatch", server: selfSigned, options: TLSOptions{Fingerprint: appliance.fingerprint()}, wantErr: "does not match the pinned fingerprint"},
+		{name: "invalid fingerprint", server: selfSigned, options: TLSOptions{Fingerprint: "00:11"}, wantConfigErr: "invalid sha-256 fingerprint"},
+		{name: "fingerprint and ca", server: appliance, options: TLSOptions{CAFile: caFile, Fingerprint: appliance.fingerprint()}},
+		{
+			name:    "fingerprint and another ca",
+			server:  appliance,
+			options: TLSOptions{CAFile: otherCAFile, Fingerprint: appliance.fingerprint()},
+			wantErr: "does not verify against the ca bundle",
+		},
+		{
+			name:              "client certificate",
+			server:            appliance,
+			requireClientCert: true,
+			options:           TLSOptions{CAFile: caFile, CertFile: clientCertFile, KeyFile: clientKeyFile},
+		},
+		{name: "missing client certificate", server: appliance, requireClientCert: true, options: TLSOptions{CAFile: caFile}, wantErr: "certificate"},
+		{name: "client certificate without key", server: appliance, options: TLSOptions{CertFile: clientCertFile}, wantConfigErr: "have to be given together"},
+		{name: "min version", server: appliance, serverMaxVersion: tls.VersionTLS12, options: TLSOptions{CAFile: caFile, MinVersion: "1.2"}},
+		{name: "min version above the server's", server: appliance, serverMaxVersion: tls.VersionTLS12, options: TLSOptions{CAFile: caFile, MinVersion: "1.3"}, wantErr: "version"},
+		{name: "unsupported min version", server: appliance, options: TLSOptions{MinVersion: "1.4"}, wantConfigErr: "unsupported minimum tls version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.options.Config()
+			if tt.wantConfigErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantConfigErr) {
+					t.Fatalf("Config() error = %v, want %q", err, tt.wantConfigErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Config() error = %v", err)
+			}
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			server.TLS = &tls.Config{
+				Certificates: []tls.Certificate{tt.server.tlsCertificate()},
+				MaxVersion:   tt.serverMaxVersion,
+			}
+			if tt.requireClientCert {
+				server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+				server.TLS.ClientCAs = clientCAs
+			}
+			// failed handshakes are expected
+			server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+			server.StartTLS()
+			defer server.Close()
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			response, err := client.Get(server.URL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Get() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			response.Body.Close()
+		})
+	}
+}
+
+// colons formats a hex fingerprint as pairs separated by colons.
+func colons(fingerprint string) string {
+	var pairs []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		pairs = append(pairs, fingerprint[i:i+2])
+	}
+
+	return strings.Join(pairs, ":")
+}
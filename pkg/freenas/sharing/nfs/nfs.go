@@ -0,0 +1,139 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+)
+
+const basePath = "/api/v1.0/sharing/nfs"
+
+type Client struct {
+	client rest.Interface
+}
+
+type Interface interface {
+	Create(ctx context.Context, share *Share) (*Share, error)
+	Delete(ctx context.Context, share *Share) error
+	List(ctx context.Context, opts rest.ListOptions) ([]*Share, error)
+}
+
+func New(client rest.Interface) Interface {
+	return &Client{
+		client: client,
+	}
+}
+
+type Share struct {
+	ID              *int     `json:"id,omitempty"`
+	NfsAlldirs      *bool    `json:"nfs_alldirs,omitempty"`
+	NfsComment      *string  `json:"nfs_comment,omitempty"`
+	NfsHosts        *string  `json:"nfs_hosts,omitempty"`
+	NfsMapallGroup  *string  `json:"nfs_mapall_group,omitempty"`
+	NfsMapallUser   *string  `json:"nfs_mapall_user,omitempty"`
+	NfsMaprootGroup *string  `json:"nfs_maproot_group,omitempty"`
+	NfsMaprootUser  *string  `json:"nfs_maproot_user,omitempty"`
+	NfsNetwork      *string  `json:"nfs_network,omitempty"`
+	NfsPaths        []string `json:"nfs_paths,omitempty"`
+	NfsQuiet        *bool    `json:"nfs_quiet,omitempty"`
+	NfsRo           *bool    `json:"nfs_ro,omitempty"`
+	NfsSecurity     []string `json:"nfs_security,omitempty"`
+}
+
+func (c Client) Delete(ctx context.Context, share *Share) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%d/", basePath, *share.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusNoContent {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c Client) Create(ctx context.Context, share *Share) (*Share, error) {
+	shareBytes, err := json.Marshal(share)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(shareBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusCreated {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s Share
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (c Client) List(ctx context.Context, opts rest.ListOptions) ([]*Share, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/?%s", basePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s []*Share
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
@@ -0,0 +1,186 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const v2BasePath = "/api/v2.0/sharing/nfs"
+
+// V2Client implements Interface against the v2.0 api.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2Share struct {
+	ID           *int     `json:"id,omitempty"`
+	Paths        []string `json:"paths,omitempty"`
+	Comment      *string  `json:"comment,omitempty"`
+	Hosts        []string `json:"hosts,omitempty"`
+	Networks     []string `json:"networks,omitempty"`
+	Alldirs      *bool    `json:"alldirs,omitempty"`
+	Ro           *bool    `json:"ro,omitempty"`
+	Quiet        *bool    `json:"quiet,omitempty"`
+	MaprootUser  *string  `json:"maproot_user,omitempty"`
+	MaprootGroup *string  `json:"maproot_group,omitempty"`
+	MapallUser   *string  `json:"mapall_user,omitempty"`
+	MapallGroup  *string  `json:"mapall_group,omitempty"`
+	Security     []string `json:"security,omitempty"`
+}
+
+func newV2Share(share *Share) *v2Share {
+	return &v2Share{
+		Paths:        share.NfsPaths,
+		Comment:      share.NfsComment,
+		Hosts:        fields(share.NfsHosts),
+		Networks:     fields(share.NfsNetwork),
+		Alldirs:      share.NfsAlldirs,
+		Ro:           share.NfsRo,
+		Quiet:        share.NfsQuiet,
+		MaprootUser:  share.NfsMaprootUser,
+		MaprootGroup: share.NfsMaprootGroup,
+		MapallUser:   share.NfsMapallUser,
+		MapallGroup:  share.NfsMapallGroup,
+		Security:     share.NfsSecurity,
+	}
+}
+
+func (s *v2Share) toShare() *Share {
+	hosts := strings.Join(s.Hosts, " ")
+	networks := strings.Join(s.Networks, " ")
+	return &Share{
+		ID:              s.ID,
+		NfsPaths:        s.Paths,
+		NfsComment:      s.Comment,
+		NfsHosts:        &hosts,
+		NfsNetwork:      &networks,
+		NfsAlldirs:      s.Alldirs,
+		NfsRo:           s.Ro,
+		NfsQuiet:        s.Quiet,
+		NfsMaprootUser:  s.MaprootUser,
+		NfsMaprootGroup: s.MaprootGroup,
+		NfsMapallUser:   s.MapallUser,
+		NfsMapallGroup:  s.MapallGroup,
+		NfsSecurity:     s.Security,
+	}
+}
+
+// fields splits a v1.0 whitespace separated list.
+func fields(s *string) []string {
+	if s == nil {
+		return nil
+	}
+
+	return strings.Fields(*s)
+}
+
+func (c V2Client) Delete(ctx context.Context, share *Share) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/id/%d", v2BasePath, *share.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c V2Client) Create(ctx context.Context, share *Share) (*Share, error) {
+	shareBytes, err := json.Marshal(newV2Share(share))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, v2BasePath, bytes.NewReader(shareBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s v2Share
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toShare(), nil
+}
+
+func (c V2Client) List(ctx context.Context, opts rest.ListOptions) ([]*Share, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?%s", v2BasePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s []*v2Share
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([]*Share, 0, len(s))
+	for _, share := range s {
+		shares = append(shares, share.toShare())
+	}
+
+	err = opts.Apply(&shares)
+	if err != nil {
+		return nil, err
+	}
+
+	return shares, nil
+}
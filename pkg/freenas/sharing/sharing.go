@@ -0,0 +1,34 @@
+package sharing
+
+import (
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/sharing/nfs"
+)
+
+type Client struct {
+	client rest.Interface
+	nfs    nfs.Interface
+}
+
+type Interface interface {
+	NFS() nfs.Interface
+}
+
+func New(client rest.Interface) Interface {
+	return &Client{
+		client: client,
+		nfs:    nfs.New(client),
+	}
+}
+
+// NewV2 returns a Client for the v2.0 api.
+func NewV2(client rest.Interface) Interface {
+	return &Client{
+		client: client,
+		nfs:    nfs.NewV2(client),
+	}
+}
+
+func (s Client) NFS() nfs.Interface {
+	return s.nfs
+}
@@ -1,6 +1,8 @@
 package dataset
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
@@ -8,14 +10,22 @@ import (
 	"net/http"
 )
 
-const basePath = "/api/v1.0/storage/dataset"
+const (
+	basePath       = "/api/v1.0/storage/dataset"
+	volumeBasePath = "/api/v1.0/storage/volume"
+)
 
 type Client struct {
 	client rest.Interface
 }
 
 type Interface interface {
-	Get(dataset *Dataset) (*Dataset, error)
+	Get(ctx context.Context, dataset *Dataset) (*Dataset, error)
+	List(ctx context.Context, opts rest.ListOptions) ([]*Dataset, error)
+	Create(ctx context.Context, pool *Dataset, dataset *Dataset) (*Dataset, error)
+	Update(ctx context.Context, pool *Dataset, dataset *Dataset) (*Dataset, error)
+	Delete(ctx context.Context, pool *Dataset, dataset *Dataset) error
+	Promote(ctx context.Context, dataset *Dataset) error
 }
 
 func New(client rest.Interface) Interface {
@@ -44,8 +54,161 @@ type Dataset struct {
 	Used           *int64        `json:"used,omitempty"`
 }
 
-func (c Client) Get(dataset *Dataset) (*Dataset, error) {
-	request, err := c.client.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s/", basePath, *dataset.Name), nil)
+func (c Client) Get(ctx context.Context, dataset *Dataset) (*Dataset, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%s/", basePath, *dataset.Name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var ds Dataset
+	err = json.Unmarshal(body, &ds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ds, nil
+}
+
+func (c Client) Create(ctx context.Context, pool *Dataset, dataset *Dataset) (*Dataset, error) {
+	datasetBytes, err := json.Marshal(dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/datasets/", volumeBasePath, *pool.Pool), bytes.NewReader(datasetBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusCreated {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var ds Dataset
+	err = json.Unmarshal(body, &ds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ds, nil
+}
+
+func (c Client) Delete(ctx context.Context, pool *Dataset, dataset *Dataset) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%s/datasets/%s/", volumeBasePath, *pool.Pool, *dataset.Name), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusNoContent {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c Client) Promote(ctx context.Context, dataset *Dataset) error {
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/promote/", basePath, *dataset.Name), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusAccepted {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c Client) List(ctx context.Context, opts rest.ListOptions) ([]*Dataset, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/?%s", basePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var ds []*Dataset
+	err = json.Unmarshal(body, &ds)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&ds)
+	if err != nil {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+func (c Client) Update(ctx context.Context, pool *Dataset, dataset *Dataset) (*Dataset, error) {
+	datasetBytes, err := json.Marshal(dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%s/datasets/%s/", volumeBasePath, *pool.Pool, *dataset.Name), bytes.NewReader(datasetBytes))
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +225,7 @@ func (c Client) Get(dataset *Dataset) (*Dataset, error) {
 	}
 
 	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return nil, rest.NewAPIError(response, body)
 	}
 
 	var ds Dataset
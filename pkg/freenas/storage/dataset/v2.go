@@ -0,0 +1,372 @@
+package dataset
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	v2BasePath = "/api/v2.0/pool/dataset"
+
+	v2FilesystemType = "FILESYSTEM"
+)
+
+// V2Client implements Interface against the v2.0 api.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+// Property is a zfs property as returned by the v2.0 api.
+type Property struct {
+	Value    *string `json:"value,omitempty"`
+	Rawvalue *string `json:"rawvalue,omitempty"`
+}
+
+// String returns the display value of the property.
+func (p *Property) String() *string {
+	if p == nil {
+		return nil
+	}
+
+	return p.Value
+}
+
+// Int64 returns the raw value of a numeric property.
+func (p *Property) Int64() *int64 {
+	if p == nil || p.Rawvalue == nil {
+		return nil
+	}
+
+	i, err := strconv.ParseInt(*p.Rawvalue, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	return &i
+}
+
+// Int returns the raw value of a numeric property.
+func (p *Property) Int() *int {
+	i64 := p.Int64()
+	if i64 == nil {
+		return nil
+	}
+
+	i := int(*i64)
+	return &i
+}
+
+// V2ID returns the v2.0 api path element of a full dataset or zvol name.
+func V2ID(name string) string {
+	return url.PathEscape(name)
+}
+
+type v2Dataset struct {
+	ID             *string   `json:"id,omitempty"`
+	Name           *string   `json:"name,omitempty"`
+	Pool           *string   `json:"pool,omitempty"`
+	Type           *string   `json:"type,omitempty"`
+	Mountpoint     *string   `json:"mountpoint,omitempty"`
+	Comments       *Property `json:"comments,omitempty"`
+	Compression    *Property `json:"compression,omitempty"`
+	Deduplication  *Property `json:"deduplication,omitempty"`
+	Atime          *Property `json:"atime,omitempty"`
+	Readonly       *Property `json:"readonly,omitempty"`
+	Recordsize     *Property `json:"recordsize,omitempty"`
+	Quota          *Property `json:"quota,omitempty"`
+	Refquota       *Property `json:"refquota,omitempty"`
+	Reservation    *Property `json:"reservation,omitempty"`
+	Refreservation *Property `json:"refreservation,omitempty"`
+	Used           *Property `json:"used,omitempty"`
+	Available      *Property `json:"available,omitempty"`
+	Referenced     *Property `json:"referenced,omitempty"`
+}
+
+func (ds *v2Dataset) toDataset() *Dataset {
+	return &Dataset{
+		Name:           ds.Name,
+		Pool:           ds.Pool,
+		Mountpoint:     ds.Mountpoint,
+		Comments:       ds.Comments.String(),
+		Compression:    ds.Compression.String(),
+		Dedup:          ds.Deduplication.String(),
+		Atime:          ds.Atime.String(),
+		Readonly:       ds.Readonly.String(),
+		Recordsize:     ds.Recordsize.Int(),
+		Quota:          ds.Quota.Int(),
+		Refquota:       ds.Refquota.Int(),
+		Reservation:    ds.Reservation.Int(),
+		Refreservation: ds.Refreservation.Int(),
+		Used:           ds.Used.Int64(),
+		Avail:          ds.Available.Int64(),
+		Refer:          ds.Referenced.Int(),
+	}
+}
+
+type v2DatasetCreate struct {
+	Name           string  `json:"name"`
+	Type           string  `json:"type"`
+	Comments       *string `json:"comments,omitempty"`
+	Compression    *string `json:"compression,omitempty"`
+	Deduplication  *string `json:"deduplication,omitempty"`
+	Atime          *string `json:"atime,omitempty"`
+	Readonly       *string `json:"readonly,omitempty"`
+	Quota          *int    `json:"quota,omitempty"`
+	Refquota       *int    `json:"refquota,omitempty"`
+	Reservation    *int    `json:"reservation,omitempty"`
+	Refreservation *int    `json:"refreservation,omitempty"`
+}
+
+// v2DatasetUpdate holds the properties of a dataset that can be changed.
+type v2DatasetUpdate struct {
+	Comments       *string `json:"comments,omitempty"`
+	Compression    *string `json:"compression,omitempty"`
+	Deduplication  *string `json:"deduplication,omitempty"`
+	Atime          *string `json:"atime,omitempty"`
+	Readonly       *string `json:"readonly,omitempty"`
+	Quota          *int    `json:"quota,omitempty"`
+	Refquota       *int    `json:"refquota,omitempty"`
+	Reservation    *int    `json:"reservation,omitempty"`
+	Refreservation *int    `json:"refreservation,omitempty"`
+}
+
+// upper converts v1.0 option values such as lz4 or on to their v2.0 form.
+func upper(s *string) *string {
+	if s == nil {
+		return nil
+	}
+
+	u := strings.ToUpper(*s)
+	return &u
+}
+
+func (c V2Client) Get(ctx context.Context, dataset *Dataset) (*Dataset, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/id/%s", v2BasePath, V2ID(*dataset.Name)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var ds v2Dataset
+	err = json.Unmarshal(body, &ds)
+	if err != nil {
+		return nil, err
+	}
+
+	return ds.toDataset(), nil
+}
+
+func (c V2Client) Create(ctx context.Context, pool *Dataset, dataset *Dataset) (*Dataset, error) {
+	datasetBytes, err := json.Marshal(&v2DatasetCreate{
+		Name:           fmt.Sprintf("%s/%s", *pool.Pool, *dataset.Name),
+		Type:           v2FilesystemType,
+		Comments:       dataset.Comments,
+		Compression:    upper(dataset.Compression),
+		Deduplication:  upper(dataset.Dedup),
+		Atime:          upper(dataset.Atime),
+		Readonly:       upper(dataset.Readonly),
+		Quota:          dataset.Quota,
+		Refquota:       dataset.Refquota,
+		Reservation:    dataset.Reservation,
+		Refreservation: dataset.Refreservation,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, v2BasePath, bytes.NewReader(datasetBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var ds v2Dataset
+	err = json.Unmarshal(body, &ds)
+	if err != nil {
+		return nil, err
+	}
+
+	return ds.toDataset(), nil
+}
+
+func (c V2Client) Update(ctx context.Context, pool *Dataset, dataset *Dataset) (*Dataset, error) {
+	datasetBytes, err := json.Marshal(&v2DatasetUpdate{
+		Comments:       dataset.Comments,
+		Compression:    upper(dataset.Compression),
+		Deduplication:  upper(dataset.Dedup),
+		Atime:          upper(dataset.Atime),
+		Readonly:       upper(dataset.Readonly),
+		Quota:          dataset.Quota,
+		Refquota:       dataset.Refquota,
+		Reservation:    dataset.Reservation,
+		Refreservation: dataset.Refreservation,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s/%s", *pool.Pool, *dataset.Name)
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/id/%s", v2BasePath, V2ID(name)), bytes.NewReader(datasetBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var ds v2Dataset
+	err = json.Unmarshal(body, &ds)
+	if err != nil {
+		return nil, err
+	}
+
+	return ds.toDataset(), nil
+}
+
+func (c V2Client) Delete(ctx context.Context, pool *Dataset, dataset *Dataset) error {
+	name := fmt.Sprintf("%s/%s", *pool.Pool, *dataset.Name)
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/id/%s", v2BasePath, V2ID(name)), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c V2Client) Promote(ctx context.Context, dataset *Dataset) error {
+	idBytes, err := json.Marshal(*dataset.Name)
+	if err != nil {
+		return err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/promote", v2BasePath), bytes.NewReader(idBytes))
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c V2Client) List(ctx context.Context, opts rest.ListOptions) ([]*Dataset, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?type=%s&%s", v2BasePath, v2FilesystemType, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var ds []*v2Dataset
+	err = json.Unmarshal(body, &ds)
+	if err != nil {
+		return nil, err
+	}
+
+	datasets := make([]*Dataset, 0, len(ds))
+	for _, dataset := range ds {
+		datasets = append(datasets, dataset.toDataset())
+	}
+
+	err = opts.Apply(&datasets)
+	if err != nil {
+		return nil, err
+	}
+
+	return datasets, nil
+}
@@ -0,0 +1,252 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+)
+
+const basePath = "/api/v1.0/storage/snapshot"
+
+type Client struct {
+	client rest.Interface
+}
+
+type Interface interface {
+	Create(ctx context.Context, snapshot *Snapshot) (*Snapshot, error)
+	List(ctx context.Context, opts rest.ListOptions) ([]*Snapshot, error)
+	Get(ctx context.Context, snapshot *Snapshot) (*Snapshot, error)
+	Update(ctx context.Context, snapshot *Snapshot) (*Snapshot, error)
+	Delete(ctx context.Context, snapshot *Snapshot) error
+	Rollback(ctx context.Context, snapshot *Snapshot, force bool) error
+	Clone(ctx context.Context, snapshot *Snapshot, name string) error
+}
+
+func New(client rest.Interface) Interface {
+	return &Client{
+		client: client,
+	}
+}
+
+// Snapshot is a zfs snapshot, identified by its Fullname in pool/dataset@name
+// form. Dataset and Name are only used on creation.
+type Snapshot struct {
+	Dataset    *string     `json:"dataset,omitempty"`
+	Name       *string     `json:"name,omitempty"`
+	Recursive  *bool       `json:"recursive,omitempty"`
+	Filesystem *string     `json:"filesystem,omitempty"`
+	Fullname   *string     `json:"fullname,omitempty"`
+	ID         *string     `json:"id,omitempty"`
+	Mostrecent *bool       `json:"mostrecent,omitempty"`
+	ParentType *string     `json:"parent_type,omitempty"`
+	Refer      interface{} `json:"refer,omitempty"`
+	Used       interface{} `json:"used,omitempty"`
+	// UserProperties are the zfs user properties of the snapshot, whose
+	// names contain a colon. Update sets them, an empty value removes the
+	// property. Only the v2.0 api knows about them.
+	UserProperties map[string]string `json:"-"`
+}
+
+type rollback struct {
+	Force bool `json:"force"`
+}
+
+type clone struct {
+	Name string `json:"name"`
+}
+
+func (c Client) Create(ctx context.Context, snapshot *Snapshot) (*Snapshot, error) {
+	snapshotBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/", basePath), bytes.NewReader(snapshotBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusCreated {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s Snapshot
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (c Client) List(ctx context.Context, opts rest.ListOptions) ([]*Snapshot, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/?%s", basePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s []*Snapshot
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (c Client) Get(ctx context.Context, snapshot *Snapshot) (*Snapshot, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%s/", basePath, *snapshot.Fullname), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s Snapshot
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// Update sets the user properties of snapshot. The v1.0 api cannot change
+// snapshots, so there must be none to set.
+func (c Client) Update(ctx context.Context, snapshot *Snapshot) (*Snapshot, error) {
+	if len(snapshot.UserProperties) != 0 {
+		return nil, fmt.Errorf("the user properties of snapshot %s cannot be updated through the v1.0 api", *snapshot.Fullname)
+	}
+
+	return c.Get(ctx, snapshot)
+}
+
+func (c Client) Delete(ctx context.Context, snapshot *Snapshot) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%s/", basePath, *snapshot.Fullname), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusNoContent {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c Client) Rollback(ctx context.Context, snapshot *Snapshot, force bool) error {
+	rollbackBytes, err := json.Marshal(&rollback{Force: force})
+	if err != nil {
+		return err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/rollback/", basePath, *snapshot.Fullname), bytes.NewReader(rollbackBytes))
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusAccepted {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c Client) Clone(ctx context.Context, snapshot *Snapshot, name string) error {
+	cloneBytes, err := json.Marshal(&clone{Name: name})
+	if err != nil {
+		return err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/clone/", basePath, *snapshot.Fullname), bytes.NewReader(cloneBytes))
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusAccepted {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package snapshot
+
+import (
+	"context"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// request is a request as seen by the appliance.
+type request struct {
+	method string
+	uri    string
+	body   string
+}
+
+// newTestServer answers every request with status and body and records the
+// requests it got.
+func newTestServer(status int, body string, requests *[]request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		*requests = append(*requests, request{method: r.Method, uri: r.RequestURI, body: string(b)})
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestUpdate(t *testing.T) {
+	fullname := "tank/k8s/pvc-1@snapshot-1"
+
+	tests := []struct {
+		name           string
+		v2             bool
+		userProperties map[string]string
+		// status and response are the appliance's answer
+		status       int
+		response     string
+		wantRequests []request
+		want         map[string]string
+		wantErr      string
+	}{
+		{
+			name:           "v2 set and remove",
+			v2:             true,
+			userProperties: map[string]string{"freenas-provisioner:pv": "pvc-1", "freenas-provisioner:class": ""},
+			status:         http.StatusOK,
+			response:       `{"id": "tank/k8s/pvc-1@snapshot-1", "properties": {"used": {"rawvalue": "0"}, "freenas-provisioner:pv": {"value": "pvc-1"}}}`,
+			wantRequests: []request{{
+				method: http.MethodPut,
+				uri:    "/api/v2.0/zfs/snapshot/id/tank%2Fk8s%2Fpvc-1@snapshot-1",
+				body:   `{"user_properties_update":[{"key":"freenas-provisioner:class","remove":true},{"key":"freenas-provisioner:pv","value":"pvc-1"}]}`,
+			}},
+			want: map[string]string{"freenas-provisioner:pv": "pvc-1"},
+		},
+		{
+			name:     "v2 nothing to set",
+			v2:       true,
+			status:   http.StatusOK,
+			response: `{"id": "tank/k8s/pvc-1@snapshot-1", "properties": {"used": {"rawvalue": "0"}}}`,
+			wantRequests: []request{{
+				method: http.MethodPut,
+				uri:    "/api/v2.0/zfs/snapshot/id/tank%2Fk8s%2Fpvc-1@snapshot-1",
+				body:   `{"user_properties_update":[]}`,
+			}},
+		},
+		{
+			name:           "v2 missing snapshot",
+			v2:             true,
+			userProperties: map[string]string{"freenas-provisioner:pv": "pvc-1"},
+			status:         http.StatusNotFound,
+			response:       `{"message": "not found"}`,
+			wantRequests: []request{{
+				method: http.MethodPut,
+				uri:    "/api/v2.0/zfs/snapshot/id/tank%2Fk8s%2Fpvc-1@snapshot-1",
+				body:   `{"user_properties_update":[{"key":"freenas-provisioner:pv","value":"pvc-1"}]}`,
+			}},
+			wantErr: "404",
+		},
+		{
+			name:         "v1 nothing to set",
+			status:       http.StatusOK,
+			response:     `{"fullname": "tank/k8s/pvc-1@snapshot-1", "name": "snapshot-1"}`,
+			wantRequests: []request{{method: http.MethodGet, uri: "/api/v1.0/storage/snapshot/tank/k8s/pvc-1@snapshot-1/"}},
+		},
+		{
+			name:           "v1 user properties",
+			userProperties: map[string]string{"freenas-provisioner:pv": "pvc-1"},
+			wantErr:        "cannot be updated through the v1.0 api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []request
+			server := newTestServer(tt.status, tt.response, &requests)
+			defer server.Close()
+
+			client := New(rest.New("root", "secret", server.URL, nil))
+			if tt.v2 {
+				client = NewV2(rest.New("root", "secret", server.URL, nil))
+			}
+			got, err := client.Update(context.Background(), &Snapshot{Fullname: &fullname, UserProperties: tt.userProperties})
+
+			if !reflect.DeepEqual(requests, tt.wantRequests) {
+				t.Errorf("requests = %+v, want %+v", requests, tt.wantRequests)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Update() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			if *got.Fullname != fullname {
+				t.Errorf("Update() = %s, want %s", *got.Fullname, fullname)
+			}
+			if !reflect.DeepEqual(got.UserProperties, tt.want) {
+				t.Errorf("Update() user properties = %v, want %v", got.UserProperties, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const v2BasePath = "/api/v2.0/zfs/snapshot"
+
+// V2Client implements Interface against the v2.0 api.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2Snapshot struct {
+	ID           *string                      `json:"id,omitempty"`
+	Dataset      *string                      `json:"dataset,omitempty"`
+	SnapshotName *string                      `json:"snapshot_name,omitempty"`
+	Properties   map[string]*dataset.Property `json:"properties,omitempty"`
+}
+
+func (s *v2Snapshot) toSnapshot() *Snapshot {
+	snapshot := &Snapshot{
+		ID:         s.ID,
+		Fullname:   s.ID,
+		Dataset:    s.Dataset,
+		Filesystem: s.Dataset,
+		Name:       s.SnapshotName,
+	}
+	if used := s.Properties["used"].Int64(); used != nil {
+		snapshot.Used = *used
+	}
+	if refer := s.Properties["referenced"].Int64(); refer != nil {
+		snapshot.Refer = *refer
+	}
+	for name, property := range s.Properties {
+		// zfs user property names contain a colon, native ones never do
+		if !strings.Contains(name, ":") || property.String() == nil {
+			continue
+		}
+		if snapshot.UserProperties == nil {
+			snapshot.UserProperties = map[string]string{}
+		}
+		snapshot.UserProperties[name] = *property.String()
+	}
+
+	return snapshot
+}
+
+type v2SnapshotCreate struct {
+	Dataset   *string `json:"dataset"`
+	Name      *string `json:"name"`
+	Recursive *bool   `json:"recursive,omitempty"`
+}
+
+type v2SnapshotUpdate struct {
+	UserPropertiesUpdate []v2UserPropertyUpdate `json:"user_properties_update"`
+}
+
+type v2UserPropertyUpdate struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Remove bool   `json:"remove,omitempty"`
+}
+
+func newV2SnapshotUpdate(snapshot *Snapshot) *v2SnapshotUpdate {
+	names := make([]string, 0, len(snapshot.UserProperties))
+	for name := range snapshot.UserProperties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	update := &v2SnapshotUpdate{UserPropertiesUpdate: []v2UserPropertyUpdate{}}
+	for _, name := range names {
+		value := snapshot.UserProperties[name]
+		update.UserPropertiesUpdate = append(update.UserPropertiesUpdate, v2UserPropertyUpdate{
+			Key:    name,
+			Value:  value,
+			Remove: value == "",
+		})
+	}
+
+	return update
+}
+
+type v2Rollback struct {
+	ID      string            `json:"id"`
+	Options v2RollbackOptions `json:"options"`
+}
+
+type v2RollbackOptions struct {
+	Force bool `json:"force"`
+}
+
+type v2Clone struct {
+	Snapshot   string `json:"snapshot"`
+	DatasetDst string `json:"dataset_dst"`
+}
+
+func (c V2Client) Create(ctx context.Context, snapshot *Snapshot) (*Snapshot, error) {
+	snapshotBytes, err := json.Marshal(&v2SnapshotCreate{
+		Dataset:   snapshot.Dataset,
+		Name:      snapshot.Name,
+		Recursive: snapshot.Recursive,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, v2BasePath, bytes.NewReader(snapshotBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s v2Snapshot
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toSnapshot(), nil
+}
+
+func (c V2Client) List(ctx context.Context, opts rest.ListOptions) ([]*Snapshot, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?%s", v2BasePath, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s []*v2Snapshot
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*Snapshot, 0, len(s))
+	for _, snapshot := range s {
+		snapshots = append(snapshots, snapshot.toSnapshot())
+	}
+
+	err = opts.Apply(&snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+func (c V2Client) Get(ctx context.Context, snapshot *Snapshot) (*Snapshot, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/id/%s", v2BasePath, dataset.V2ID(*snapshot.Fullname)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s v2Snapshot
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toSnapshot(), nil
+}
+
+func (c V2Client) Update(ctx context.Context, snapshot *Snapshot) (*Snapshot, error) {
+	snapshotBytes, err := json.Marshal(newV2SnapshotUpdate(snapshot))
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/id/%s", v2BasePath, dataset.V2ID(*snapshot.Fullname)), bytes.NewReader(snapshotBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var s v2Snapshot
+	err = json.Unmarshal(body, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toSnapshot(), nil
+}
+
+func (c V2Client) Delete(ctx context.Context, snapshot *Snapshot) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/id/%s", v2BasePath, dataset.V2ID(*snapshot.Fullname)), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c V2Client) Rollback(ctx context.Context, snapshot *Snapshot, force bool) error {
+	rollbackBytes, err := json.Marshal(&v2Rollback{
+		ID:      *snapshot.Fullname,
+		Options: v2RollbackOptions{Force: force},
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/rollback", v2BasePath), bytes.NewReader(rollbackBytes))
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c V2Client) Clone(ctx context.Context, snapshot *Snapshot, name string) error {
+	cloneBytes, err := json.Marshal(&v2Clone{
+		Snapshot:   *snapshot.Fullname,
+		DatasetDst: name,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/clone", v2BasePath), bytes.NewReader(cloneBytes))
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
@@ -3,25 +3,39 @@ package storage
 import (
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/snapshot"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/z_vol"
 )
 
 type Client struct {
-	client  rest.Interface
-	dataset dataset.Interface
-	zvol    z_vol.Interface
+	client   rest.Interface
+	dataset  dataset.Interface
+	zvol     z_vol.Interface
+	snapshot snapshot.Interface
 }
 
 type Interface interface {
 	Dataset() dataset.Interface
 	ZVol() z_vol.Interface
+	Snapshot() snapshot.Interface
 }
 
 func New(client rest.Interface) Interface {
 	return &Client{
-		client:  client,
-		dataset: dataset.New(client),
-		zvol:    z_vol.New(client),
+		client:   client,
+		dataset:  dataset.New(client),
+		zvol:     z_vol.New(client),
+		snapshot: snapshot.New(client),
+	}
+}
+
+// NewV2 returns a Client for the v2.0 api.
+func NewV2(client rest.Interface) Interface {
+	return &Client{
+		client:   client,
+		dataset:  dataset.NewV2(client),
+		zvol:     z_vol.NewV2(client),
+		snapshot: snapshot.NewV2(client),
 	}
 }
 
@@ -32,3 +46,7 @@ func (s Client) Dataset() dataset.Interface {
 func (s Client) ZVol() z_vol.Interface {
 	return s.zvol
 }
+
+func (s Client) Snapshot() snapshot.Interface {
+	return s.snapshot
+}
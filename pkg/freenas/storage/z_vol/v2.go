@@ -0,0 +1,351 @@
+package z_vol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
+	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/storage/dataset"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	v2BasePath = "/api/v2.0/pool/dataset"
+
+	v2VolumeType = "VOLUME"
+)
+
+// V2Client implements Interface against the v2.0 api. Like v1.0, zvol names
+// are relative to their pool.
+type V2Client struct {
+	client rest.Interface
+}
+
+func NewV2(client rest.Interface) Interface {
+	return &V2Client{
+		client: client,
+	}
+}
+
+type v2ZVol struct {
+	Name          *string           `json:"name,omitempty"`
+	Pool          *string           `json:"pool,omitempty"`
+	Comments      *dataset.Property `json:"comments,omitempty"`
+	Compression   *dataset.Property `json:"compression,omitempty"`
+	Deduplication *dataset.Property `json:"deduplication,omitempty"`
+	Volsize       *dataset.Property `json:"volsize,omitempty"`
+	Volblocksize  *dataset.Property `json:"volblocksize,omitempty"`
+	Used          *dataset.Property `json:"used,omitempty"`
+	Available     *dataset.Property `json:"available,omitempty"`
+	Referenced    *dataset.Property `json:"referenced,omitempty"`
+	Origin        *dataset.Property `json:"origin,omitempty"`
+}
+
+func (zv *v2ZVol) toZVol() *ZVol {
+	zVol := &ZVol{
+		Name:        zv.Name,
+		Comments:    zv.Comments.String(),
+		Compression: zv.Compression.String(),
+		Dedup:       zv.Deduplication.String(),
+		Blocksize:   zv.Volblocksize.String(),
+		Avail:       zv.Available.Int64(),
+		Refer:       zv.Referenced.Int(),
+		Used:        zv.Used.Int(),
+		Origin:      zv.Origin.String(),
+	}
+	if zv.Name != nil && zv.Pool != nil {
+		name := strings.TrimPrefix(*zv.Name, *zv.Pool+"/")
+		zVol.Name = &name
+	}
+	if volsize := zv.Volsize.Int64(); volsize != nil {
+		zVol.Volsize = *volsize
+	}
+
+	return zVol
+}
+
+type v2ZVolUpdate struct {
+	Name          *string `json:"name,omitempty"`
+	Type          *string `json:"type,omitempty"`
+	Volsize       *int64  `json:"volsize,omitempty"`
+	Volblocksize  *string `json:"volblocksize,omitempty"`
+	Sparse        *bool   `json:"sparse,omitempty"`
+	ForceSize     *bool   `json:"force_size,omitempty"`
+	Comments      *string `json:"comments,omitempty"`
+	Compression   *string `json:"compression,omitempty"`
+	Deduplication *string `json:"deduplication,omitempty"`
+}
+
+func newV2ZVolUpdate(zVol *ZVol) (*v2ZVolUpdate, error) {
+	volsize, err := parseSize(zVol.Volsize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v2ZVolUpdate{
+		Volsize:       volsize,
+		ForceSize:     zVol.Force,
+		Comments:      zVol.Comments,
+		Compression:   upper(zVol.Compression),
+		Deduplication: upper(zVol.Dedup),
+	}, nil
+}
+
+// parseSize converts a v1.0 volume size such as "10 GiB" or a number of bytes
+// to bytes.
+func parseSize(size interface{}) (*int64, error) {
+	var s string
+	switch size := size.(type) {
+	case nil:
+		return nil, nil
+	case int:
+		n := int64(size)
+		return &n, nil
+	case int64:
+		return &size, nil
+	case float64:
+		n := int64(size)
+		return &n, nil
+	case json.Number:
+		s = string(size)
+	case string:
+		s = size
+	case *string:
+		if size == nil {
+			return nil, nil
+		}
+		s = *size
+	default:
+		return nil, fmt.Errorf("unsupported volume size %v", size)
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid volume size %q", s)
+	}
+
+	n, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid volume size %q", s)
+	}
+
+	if len(fields) == 2 {
+		unit := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(fields[1]), "B"), "I")
+		multiplier := int64(1)
+		switch unit {
+		case "":
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		case "T":
+			multiplier = 1 << 40
+		case "P":
+			multiplier = 1 << 50
+		default:
+			return nil, fmt.Errorf("invalid volume size unit %q", fields[1])
+		}
+		n *= multiplier
+	}
+
+	return &n, nil
+}
+
+func upper(s *string) *string {
+	if s == nil {
+		return nil
+	}
+
+	u := strings.ToUpper(*s)
+	return &u
+}
+
+func v2ID(pool *dataset.Dataset, zVol *ZVol) string {
+	return dataset.V2ID(fmt.Sprintf("%s/%s", *pool.Pool, *zVol.Name))
+}
+
+func (c V2Client) Delete(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/id/%s", v2BasePath, v2ID(dataset, zVol)), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return rest.NewAPIError(response, body)
+	}
+
+	return nil
+}
+
+func (c V2Client) Create(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error) {
+	create, err := newV2ZVolUpdate(zVol)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s/%s", *dataset.Pool, *zVol.Name)
+	volumeType := v2VolumeType
+	create.Name = &name
+	create.Type = &volumeType
+	create.Sparse = zVol.Sparse
+	create.Volblocksize = zVol.Blocksize
+
+	zVolBytes, err := json.Marshal(create)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPost, v2BasePath, bytes.NewReader(zVolBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var zv v2ZVol
+	err = json.Unmarshal(body, &zv)
+	if err != nil {
+		return nil, err
+	}
+
+	return zv.toZVol(), nil
+}
+
+func (c V2Client) Update(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error) {
+	update, err := newV2ZVolUpdate(zVol)
+	if err != nil {
+		return nil, err
+	}
+
+	zVolBytes, err := json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/id/%s", v2BasePath, v2ID(dataset, zVol)), bytes.NewReader(zVolBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var zv v2ZVol
+	err = json.Unmarshal(body, &zv)
+	if err != nil {
+		return nil, err
+	}
+
+	return zv.toZVol(), nil
+}
+
+func (c V2Client) Get(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/id/%s", v2BasePath, v2ID(dataset, zVol)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var zv v2ZVol
+	err = json.Unmarshal(body, &zv)
+	if err != nil {
+		return nil, err
+	}
+
+	return zv.toZVol(), nil
+}
+
+func (c V2Client) List(ctx context.Context, dataset *dataset.Dataset, opts rest.ListOptions) ([]*ZVol, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s?type=%s&pool=%s&%s", v2BasePath, v2VolumeType, *dataset.Pool, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var zv []*v2ZVol
+	err = json.Unmarshal(body, &zv)
+	if err != nil {
+		return nil, err
+	}
+
+	zVols := make([]*ZVol, 0, len(zv))
+	for _, zVol := range zv {
+		zVols = append(zVols, zVol.toZVol())
+	}
+
+	err = opts.Apply(&zVols)
+	if err != nil {
+		return nil, err
+	}
+
+	return zVols, nil
+}
@@ -2,6 +2,7 @@ package z_vol
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jakekeeys/freenas-provisioner/pkg/freenas/rest"
@@ -17,8 +18,11 @@ type Client struct {
 }
 
 type Interface interface {
-	Create(dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error)
-	Delete(dataset *dataset.Dataset, zVol *ZVol) error
+	Create(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error)
+	Delete(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) error
+	Update(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error)
+	Get(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error)
+	List(ctx context.Context, dataset *dataset.Dataset, opts rest.ListOptions) ([]*ZVol, error)
 }
 
 func New(client rest.Interface) Interface {
@@ -39,10 +43,27 @@ type ZVol struct {
 	Dedup       *string     `json:"dedup,omitempty"`
 	Refer       *int        `json:"refer,omitempty"`
 	Used        *int        `json:"used,omitempty"`
+	// Origin is the snapshot a cloned zvol was created from, it is empty
+	// for other zvols
+	Origin *string `json:"origin,omitempty"`
 }
 
-func (c Client) Delete(dataset *dataset.Dataset, zVol *ZVol) error {
-	request, err := c.client.NewRequest(http.MethodDelete, fmt.Sprintf("%s/%s/zvols/%s/", basePath, *dataset.Pool, *zVol.Name), nil)
+// Size returns the volume size in bytes. The api reports it as a number of
+// bytes or, like it is sent on create, as a string with a unit.
+func (z *ZVol) Size() (int64, error) {
+	size, err := parseSize(z.Volsize)
+	if err != nil {
+		return 0, err
+	}
+	if size == nil {
+		return 0, fmt.Errorf("zvol has no volume size")
+	}
+
+	return *size, nil
+}
+
+func (c Client) Delete(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) error {
+	request, err := c.client.NewRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%s/zvols/%s/", basePath, *dataset.Pool, *zVol.Name), nil)
 	if err != nil {
 		return err
 	}
@@ -59,19 +80,19 @@ func (c Client) Delete(dataset *dataset.Dataset, zVol *ZVol) error {
 	}
 
 	if response.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return rest.NewAPIError(response, body)
 	}
 
 	return nil
 }
 
-func (c Client) Create(dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error) {
+func (c Client) Create(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error) {
 	zVolBytes, err := json.Marshal(zVol)
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := c.client.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s/zvols/", basePath, *dataset.Pool), bytes.NewReader(zVolBytes))
+	request, err := c.client.NewRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/zvols/", basePath, *dataset.Pool), bytes.NewReader(zVolBytes))
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +109,78 @@ func (c Client) Create(dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error) {
 	}
 
 	if response.StatusCode != http.StatusAccepted {
-		return nil, fmt.Errorf("unexpected status code: %s, body: %s", response.Status, string(body))
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var zv ZVol
+	err = json.Unmarshal(body, &zv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zv, nil
+}
+
+func (c Client) Update(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error) {
+	zVolBytes, err := json.Marshal(&ZVol{
+		Volsize:     zVol.Volsize,
+		Comments:    zVol.Comments,
+		Compression: zVol.Compression,
+		Dedup:       zVol.Dedup,
+		Force:       zVol.Force,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.client.NewRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%s/zvols/%s/", basePath, *dataset.Pool, *zVol.Name), bytes.NewReader(zVolBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var zv ZVol
+	err = json.Unmarshal(body, &zv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zv, nil
+}
+
+func (c Client) Get(ctx context.Context, dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%s/zvols/%s/", basePath, *dataset.Pool, *zVol.Name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
 	}
 
 	var zv ZVol
@@ -99,3 +191,38 @@ func (c Client) Create(dataset *dataset.Dataset, zVol *ZVol) (*ZVol, error) {
 
 	return &zv, nil
 }
+
+func (c Client) List(ctx context.Context, dataset *dataset.Dataset, opts rest.ListOptions) ([]*ZVol, error) {
+	request, err := c.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%s/zvols/?%s", basePath, *dataset.Pool, opts.Query()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.DoRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, rest.NewAPIError(response, body)
+	}
+
+	var zv []*ZVol
+	err = json.Unmarshal(body, &zv)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.Apply(&zv)
+	if err != nil {
+		return nil, err
+	}
+
+	return zv, nil
+}
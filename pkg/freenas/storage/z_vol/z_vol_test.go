@@ -0,0 +1,46 @@
+package z_vol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestZVolSize(t *testing.T) {
+	text := "2 GiB"
+
+	tests := []struct {
+		name    string
+		volsize interface{}
+		want    int64
+		wantErr bool
+	}{
+		{name: "float64", volsize: float64(1 << 30), want: 1 << 30},
+		{name: "int64", volsize: int64(1 << 30), want: 1 << 30},
+		{name: "int", volsize: 1 << 30, want: 1 << 30},
+		{name: "json number", volsize: json.Number("1073741824"), want: 1 << 30},
+		{name: "string of bytes", volsize: "1073741824", want: 1 << 30},
+		{name: "string with a unit", volsize: "1 G", want: 1 << 30},
+		{name: "string pointer", volsize: &text, want: 2 << 30},
+		{name: "fractional json number", volsize: json.Number("1.5"), wantErr: true},
+		{name: "missing", wantErr: true},
+		{name: "unsupported type", volsize: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&ZVol{Volsize: tt.volsize}).Size()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Size() = %d, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Size() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Size() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}